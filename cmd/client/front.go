@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// frontRules maps a target ("host:port" or "host") to the TLS server name the
+// server should present when it connects there (see proxy.TargetFlagSNI)
+type frontRules map[string]string
+
+// fronts holds the --front rules (nil = no overrides)
+var fronts frontRules
+
+// parseFrontRules parses repeated --front TARGET=SNI values
+func parseFrontRules(entries []string) (frontRules, error) {
+	rules := make(frontRules, len(entries))
+	for _, e := range entries {
+		target, sni, ok := strings.Cut(e, "=")
+		target = strings.ToLower(strings.TrimSpace(target))
+		sni = strings.TrimSpace(sni)
+		if !ok || target == "" || sni == "" || len(sni) > 255 {
+			return nil, fmt.Errorf("invalid --front %q (want HOST[:PORT]=SNI)", e)
+		}
+		rules[target] = sni
+	}
+	return rules, nil
+}
+
+// sniFor returns the server name override for addr, preferring an exact
+// host:port rule over a host-only one
+func (r frontRules) sniFor(addr string) string {
+	if len(r) == 0 {
+		return ""
+	}
+	if sni, ok := r[strings.ToLower(addr)]; ok {
+		return sni
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return r[strings.ToLower(host)]
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/tunnel"
+)
+
+// negotiate runs the capability exchange on a fresh connection and logs what
+// the operator should do about any feature the client relies on
+// (tm.requiredCaps) that the server doesn't offer (see tunnel.Negotiate)
+func (tm *TunnelManager) negotiate(conn *quic.Conn, dnsConn *protocol.DnsPacketConn) {
+	server, err := tm.exchangeHello(conn, dnsConn)
+	if errors.Is(err, tunnel.ErrHelloNotSent) {
+		return
+	}
+	tunnel.ReportCapabilities(tm.requiredCaps, server, err, log.Logger)
+}
+
+// exchangeHello runs tunnel.ExchangeHello and remembers what the server advertised
+func (tm *TunnelManager) exchangeHello(conn *quic.Conn, dnsConn *protocol.DnsPacketConn) (protocol.Hello, error) {
+	server, err := tunnel.ExchangeHello(conn, dnsConn, tm.requiredCaps, log.Logger)
+	if err == nil {
+		tm.serverCaps.Store(uint32(server.Caps))
+	}
+	return server, err
+}
+
+// ServerCaps returns the capabilities the server advertised on the current
+// connection; none until the exchange has completed
+func (tm *TunnelManager) ServerCaps() protocol.Capabilities {
+	return protocol.Capabilities(tm.serverCaps.Load())
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
-	cryptorand "crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"runtime/debug"
 	"strings"
@@ -15,18 +16,33 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"slipstream-go/internal/config"
 	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/profile"
 	"slipstream-go/internal/protocol"
 	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/telemetry"
+	"slipstream-go/internal/tunnel"
 )
 
+// tracer exports stream lifecycle spans when --otel-endpoint is set (nil = disabled)
+var tracer *telemetry.Tracer
+
+// errTunnelClosed is returned by Connect after Close
+var errTunnelClosed = errors.New("tunnel closed")
+
+// streamIdleTimeout tears down SOCKS5 connections that moved no data for this long (0 = never)
+var streamIdleTimeout time.Duration
+
 // TunnelManager manages the QUIC connection with auto-reconnection
 type TunnelManager struct {
 	resolvers   []string // Multiple resolvers for load balancing
+	strategy    protocol.ResolverStrategy
 	domain      string
 	tlsConfig   *tls.Config
 	quicConfig  *quic.Config
@@ -38,36 +54,50 @@ type TunnelManager struct {
 
 	connected   atomic.Bool
 	reconnecting atomic.Bool
-}
-
-// randomPacketSize returns a random packet size between min and max bytes
-func randomPacketSize(minSize, maxSize uint16) uint16 {
-	if minSize >= maxSize {
-		return minSize
-	}
-	b := make([]byte, 2)
-	cryptorand.Read(b)
-	rangeSize := maxSize - minSize + 1
-	return minSize + (binary.BigEndian.Uint16(b) % rangeSize)
+	// closed stops health checks and reconnects for good
+	closed atomic.Bool
+
+	// Resolver rotation for reconnects: the last resolver known to answer goes
+	// first, and every failed attempt moves the start one resolver further
+	lastGoodResolver string
+	failedAttempts   int
+	// dnsResolvers is the resolver order dnsConn was created with
+	dnsResolvers []string
+
+	// Number of SOCKS5 streams currently using this tunnel (for pool balancing)
+	activeStreams atomic.Int64
+	// Number of interactive (priority-port) streams
+	interactiveStreams atomic.Int64
+	// pacer holds bulk streams back while interactive ones write (see priority.go)
+	pacer *bulkPacer
+
+	// Transport tuning passed to every new DnsPacketConn
+	dnsOptions protocol.DnsConnOptions
+
+	// streamWindow caps upstream bytes queued in the transport before bulk streams pause (0 = unbounded)
+	streamWindow int
+
+	// requiredCaps are the server capabilities the configured features rely on (see negotiate)
+	requiredCaps protocol.Capabilities
+	// serverCaps holds what the server of the current connection advertised
+	serverCaps atomic.Uint32
+
+	// migrateSessions: Reconnect first tries to move the live connection to a
+	// new session (see migrate); migrations counts the moves that succeeded
+	migrateSessions bool
+	migrations      atomic.Int64
 }
 
 // NewTunnelManager creates a new tunnel manager
 func NewTunnelManager(resolvers []string, domain string, tlsConfig *tls.Config, minPacket, maxPacket uint16) *TunnelManager {
-	packetSize := randomPacketSize(minPacket, maxPacket)
+	packetSize := tunnel.RandomPacketSize(minPacket, maxPacket)
 	log.Info().Uint16("packet_size", packetSize).Uint16("min", minPacket).Uint16("max", maxPacket).Msg("Using random packet size")
 	return &TunnelManager{
 		resolvers: resolvers,
 		domain:    domain,
 		tlsConfig: tlsConfig,
-		quicConfig: &quic.Config{
-			KeepAlivePeriod:            30 * time.Second,
-			MaxIdleTimeout:             60 * time.Second,
-			MaxStreamReceiveWindow:     6 * 1024 * 1024,
-			MaxConnectionReceiveWindow: 15 * 1024 * 1024,
-			// Random packet size in optimal range for Iran: 512-768 bytes
-			InitialPacketSize:       packetSize,
-			DisablePathMTUDiscovery: true,
-		},
+		pacer:     newBulkPacer(0),
+		quicConfig: tunnel.QUICConfig(packetSize),
 	}
 }
 
@@ -76,24 +106,31 @@ func (tm *TunnelManager) Connect() error {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	// Close existing connection if any
+	if tm.closed.Load() {
+		return errTunnelClosed
+	}
+
+	// Close existing connection if any, remembering which resolver still worked
 	if tm.dnsConn != nil {
+		tm.rememberGoodResolver(tm.dnsConn)
 		tm.dnsConn.Close()
+		tm.dnsConn = nil
 	}
 
 	// Generate new session ID for each connection
-	tm.sessionID = generateSessionID()
+	tm.sessionID = tunnel.SessionID()
 	log.Info().Str("session", tm.sessionID).Msg("Generated session ID")
 
 	// Setup DNS transport with multiple resolvers for load balancing
-	dnsConn, err := protocol.NewDnsPacketConn(tm.resolvers, tm.domain, tm.sessionID)
+	resolvers := tm.resolverOrder()
+	dnsConn, err := protocol.NewDnsPacketConnWithOptions(resolvers, tm.domain, tm.sessionID, tm.dnsOptions)
 	if err != nil {
+		tm.failedAttempts++
 		return err
 	}
+	dnsConn.SetResolverStrategy(tm.strategy)
 	tm.dnsConn = dnsConn
-
-	// Dummy address for QUIC
-	dummyAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	tm.dnsResolvers = resolvers
 
 	// Establish QUIC connection
 	log.Info().Int("resolvers", len(tm.resolvers)).Str("domain", tm.domain).Msg("Establishing QUIC connection over DNS")
@@ -101,19 +138,62 @@ func (tm *TunnelManager) Connect() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	quicConn, err := quic.Dial(ctx, dnsConn, dummyAddr, tm.tlsConfig, tm.quicConfig)
+	quicConn, err := tunnel.Dial(ctx, dnsConn, tm.tlsConfig, tm.quicConfig)
 	if err != nil {
 		dnsConn.Close()
+		tm.dnsConn = nil
+		tm.failedAttempts++
 		return err
 	}
 
+	tm.failedAttempts = 0
+	tm.rememberGoodResolver(dnsConn)
 	tm.conn = quicConn
+	tm.serverCaps.Store(0)
 	tm.connected.Store(true)
 	log.Info().Msg("QUIC tunnel established")
+	go tm.negotiate(quicConn, dnsConn)
+	go tm.logResponseSummary(dnsConn)
 
 	return nil
 }
 
+// resolverOrder returns the configured resolvers rotated so that the next
+// candidate comes first: the last resolver that answered, then one further
+// along the list for every failed attempt since. With --resolver-strategy
+// failover the first entry carries all traffic; with roundrobin it gets the
+// handshake's first query. Caller must hold tm.mu.
+func (tm *TunnelManager) resolverOrder() []string {
+	n := len(tm.resolvers)
+	if n <= 1 {
+		return tm.resolvers
+	}
+	base := 0
+	for i, r := range tm.resolvers {
+		if r == tm.lastGoodResolver {
+			base = i
+			break
+		}
+	}
+	start := (base + tm.failedAttempts) % n
+	order := make([]string, 0, n)
+	order = append(order, tm.resolvers[start:]...)
+	order = append(order, tm.resolvers[:start]...)
+	if start != 0 || tm.failedAttempts > 0 {
+		log.Info().Str("first", order[0]).Int("attempt", tm.failedAttempts+1).Msg("Rotating resolver order for reconnect")
+	}
+	return order
+}
+
+// rememberGoodResolver records the resolver that most recently answered on dnsConn.
+// Caller must hold tm.mu.
+func (tm *TunnelManager) rememberGoodResolver(dnsConn *protocol.DnsPacketConn) {
+	idx := dnsConn.LastAnsweredResolver()
+	if idx >= 0 && idx < len(tm.dnsResolvers) {
+		tm.lastGoodResolver = tm.dnsResolvers[idx]
+	}
+}
+
 // GetConnection returns the current QUIC connection
 func (tm *TunnelManager) GetConnection() *quic.Conn {
 	tm.mu.RLock()
@@ -121,6 +201,13 @@ func (tm *TunnelManager) GetConnection() *quic.Conn {
 	return tm.conn
 }
 
+// SessionID returns the DNS session ID of the current connection
+func (tm *TunnelManager) SessionID() string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.sessionID
+}
+
 // IsConnected returns whether the tunnel is connected
 func (tm *TunnelManager) IsConnected() bool {
 	return tm.connected.Load()
@@ -142,10 +229,17 @@ func (tm *TunnelManager) Reconnect() {
 
 	tm.MarkDisconnected()
 
+	// A connection that is still alive keeps its streams on a new session
+	if tm.migrate() {
+		log.Info().Str("session", tm.SessionID()).Msg("Connection migrated, streams kept")
+		tm.connected.Store(true)
+		return
+	}
+
 	backoff := 1 * time.Second
 	maxBackoff := 30 * time.Second
 
-	for {
+	for !tm.closed.Load() {
 		log.Warn().Dur("backoff", backoff).Msg("Attempting to reconnect...")
 
 		err := tm.Connect()
@@ -164,10 +258,86 @@ func (tm *TunnelManager) Reconnect() {
 	}
 }
 
+// Close shuts the tunnel down for good: the QUIC connection and DNS transport
+// are closed and no reconnection is attempted afterwards
+func (tm *TunnelManager) Close() error {
+	tm.closed.Store(true)
+	tm.MarkDisconnected()
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.conn != nil {
+		tm.conn.CloseWithError(0, "client shutting down")
+		tm.conn = nil
+	}
+	if tm.dnsConn != nil {
+		tm.dnsConn.Close()
+		tm.dnsConn = nil
+	}
+	return nil
+}
+
+// queuedBytes estimates the upstream bytes accepted but not yet sent as DNS queries
+func (tm *TunnelManager) queuedBytes() int {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	if tm.dnsConn == nil {
+		return 0
+	}
+	return tm.dnsConn.TxBacklog() * tm.dnsConn.ChunkSize()
+}
+
+// FragmentStats returns downstream fragment counters of the current DNS session
+func (tm *TunnelManager) FragmentStats() protocol.FragmentStats {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	if tm.dnsConn == nil {
+		return protocol.FragmentStats{}
+	}
+	return tm.dnsConn.FragmentStats()
+}
+
+// responseSummaryDelay is how long after connecting the resolver response summary is logged
+const responseSummaryDelay = 20 * time.Second
+
+// logResponseSummary logs, once per connection, the largest response and the
+// most fragments per response each resolver delivered, so operators can tell
+// whether EDNS0 survives the path and tune the server's --max-frags, and
+// what upstream compression saved, how often reordering was undone and how
+// many truncated answers were fetched over TCP if any
+func (tm *TunnelManager) logResponseSummary(dnsConn *protocol.DnsPacketConn) {
+	time.Sleep(responseSummaryDelay)
+	tm.mu.RLock()
+	current := tm.dnsConn == dnsConn
+	tm.mu.RUnlock()
+	if !current || tm.closed.Load() {
+		return
+	}
+	for _, stats := range dnsConn.ResponseStats() {
+		if stats.Responses == 0 {
+			log.Info().Str("resolver", stats.Resolver).Msg("Resolver response summary: no responses yet")
+			continue
+		}
+		log.Info().Str("resolver", stats.Resolver).Uint64("responses", stats.Responses).Int("max_size", stats.MaxSize).
+			Int("max_frags", stats.MaxFragments).Bool("edns0", stats.EDNS0()).Msg("Resolver response summary")
+	}
+	if stats := dnsConn.CompressionStats(); stats.Packets > 0 {
+		log.Info().Uint64("packets", stats.Packets).Uint64("compressed", stats.Compressed).
+			Float64("ratio", stats.Ratio()).Msg("Upstream compression summary")
+	}
+	if stats := dnsConn.ReorderStats(); stats.Held > 0 {
+		log.Info().Uint64("held", stats.Held).Uint64("corrected", stats.Corrected).Uint64("skipped", stats.Skipped).
+			Uint64("late", stats.Late).Uint64("resyncs", stats.Resyncs).Msg("Downstream reorder summary")
+	}
+	if stats := dnsConn.TCPFallbackStats(); stats.Retries > 0 {
+		log.Info().Uint64("retries", stats.Retries).Uint64("fetched", stats.Fetched).Msg("TCP fallback summary")
+	}
+}
+
 // StartHealthCheck monitors connection health and triggers reconnection
 func (tm *TunnelManager) StartHealthCheck() {
 	go func() {
-		for {
+		for !tm.closed.Load() {
 			time.Sleep(5 * time.Second)
 
 			conn := tm.GetConnection()
@@ -178,31 +348,146 @@ func (tm *TunnelManager) StartHealthCheck() {
 			// Check if connection is still alive by checking context
 			select {
 			case <-conn.Context().Done():
-				log.Warn().Msg("Connection lost, initiating reconnection")
+				var appErr *quic.ApplicationError
+				isAppErr := errors.As(context.Cause(conn.Context()), &appErr)
+				if isAppErr && appErr.ErrorCode == protocol.CloseCodeSessionInUse {
+					log.Warn().Str("session", tm.SessionID()).Msg("Session ID collided with another client, reconnecting under a new ID")
+				} else if isAppErr && appErr.ErrorCode == protocol.CloseCodeShutdown {
+					log.Warn().Msg("Server is shutting down, reconnecting")
+				} else if isAppErr && appErr.ErrorCode == protocol.CloseCodeSessionExpired {
+					log.Warn().Str("session", tm.SessionID()).Msg("Server expired the session after no queries arrived for it, reconnecting")
+				} else {
+					log.Warn().Msg("Connection lost, initiating reconnection")
+				}
 				go tm.Reconnect()
 			default:
 				// Connection is still alive
+				if stats := tm.FragmentStats(); stats.Expected > 0 {
+					log.Debug().Str("session", tm.SessionID()).Uint64("packets", stats.Packets).Uint64("lost", stats.PacketsLost).
+						Uint64("duplicates", stats.Duplicates).Uint64("dupCompleted", stats.DuplicatesCompleted).Uint64("late", stats.Late).
+						Uint64("outOfOrder", stats.OutOfOrder).Float64("fragLoss", stats.LossRate()).Msg("Downstream fragment stats")
+				}
 			}
 		}
 	}()
 }
 
+// stringSlice is a custom flag type for multiple string values
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
 	// CLI Flags
 	domain := flag.String("domain", "", "Tunnel domain (required)")
 	listen := flag.String("listen", "127.0.0.1:1080", "Local SOCKS5 listen address")
-	resolversFlag := flag.String("resolvers", "", "Comma-separated DNS resolver addresses for load balancing (required)")
+	flag.StringVar(&socksUser, "socks-user", "", "Require this username from SOCKS5 apps (with --socks-pass)")
+	flag.StringVar(&socksPass, "socks-pass", "", "Require this password from SOCKS5 apps (with --socks-user)")
+	resolversFlag := flag.String("resolvers", "", "Comma-separated DNS resolver addresses for load balancing (host:port, https:// URLs for DNS over HTTPS or tls://host[:port] for DNS over TLS)")
+	var resolverList stringSlice
+	flag.Var(&resolverList, "resolver", "DNS resolver address, DoH URL or tls:// DoT resolver (can be specified multiple times)")
+	resolverStrategy := flag.String("resolver-strategy", "roundrobin", "Resolver selection: roundrobin or failover")
 	pubkeyFile := flag.String("pubkey-file", "", "Server public key for pinning (required)")
+	manifestFile := flag.String("manifest", "", "Signed fingerprint manifest to pin instead of --pubkey-file")
+	manifestSigner := flag.String("manifest-signer", "", "Fingerprint of the manifest signing key (empty = trust on first use)")
+	pinReload := flag.Duration("pin-reload", 30*time.Second, "How often to check --pubkey-file/--manifest for a rotated server key (0 = never)")
+	psk := flag.String("psk", "", "Pre-shared key to authenticate to the server (must match server --psk)")
 	logLevel := flag.String("log-level", "info", "Log level: debug/info/warn/error")
 	memoryLimit := flag.Int("memory-limit", 200, "Memory limit in MB")
 	minPacketSize := flag.Int("min-packet-size", 512, "Minimum QUIC packet size in bytes (512-1200)")
 	maxPacketSize := flag.Int("max-packet-size", 768, "Maximum QUIC packet size in bytes (512-1200)")
+	profileName := flag.String("profile", profile.DefaultName, "Tuning preset: "+strings.Join(profile.Names(), ", ")+" (individual flags override it)")
+	configFile := flag.String("config", "", "Read flag values from this JSON file (command-line flags override it, it overrides --profile)")
+	alpn := flag.String("alpn", "slipstream", "QUIC ALPN protocol (must match the server)")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "QUIC keepalive period")
+	idleTimeout := flag.Duration("idle-timeout", 60*time.Second, "QUIC idle timeout before the tunnel reconnects")
+	pollInterval := flag.Duration("poll-interval", protocol.PollInterval, "Idle polling heartbeat")
+	idlePollInterval := flag.Duration("idle-poll-interval", protocol.DefaultIdlePollInterval, "Let the heartbeat back off up to this while polls come back empty (at most --poll-interval = never back off)")
+	parallelPolls := flag.Int("parallel-polls", protocol.ParallelPolls, "Polls sent per heartbeat or burst (1-256)")
+	adaptivePolls := flag.Bool("adaptive-polls", false, "Halve the polls per burst when polls are lost or refused and grow them back up to --parallel-polls as polls return data")
+	idleThreshold := flag.Duration("idle-threshold", protocol.IdleThreshold, "Start idle polling this long after the last upstream packet")
+	redundancyThreshold := flag.Int("redundancy-threshold", protocol.DefaultRedundancyThreshold, "Send QUIC packets at least this large twice (0 = never)")
+	udpReadBuffer := flag.Int("udp-read-buffer", protocol.DefaultReadBuffer/1024, "UDP socket read buffer in KB (0 = OS default)")
+	udpWriteBuffer := flag.Int("udp-write-buffer", 0, "UDP socket write buffer in KB (0 = OS default)")
+	txWorkers := flag.Int("tx-workers", protocol.NumTxWorkers, "Number of goroutines sending DNS queries (1-256)")
+	rxBuffer := flag.Int("rx-buffer", protocol.RxBufferSize, "Read buffer for a single DNS response in bytes (512-65535)")
+	connections := flag.Int("connections", 1, "Number of parallel DNS sessions/QUIC connections (1-16)")
+	captureFile := flag.String("capture-file", "", "Write every tunnel fragment (direction, time, session, packet ID, seq) to this file as JSON lines")
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/HTTP collector URL for stream traces (e.g. http://localhost:4318)")
+	priorityPortsFlag := flag.String("priority-ports", "22", "Comma-separated target ports treated as interactive (prioritized over bulk)")
+	bulkRate := flag.Int("bulk-rate", 16, "KB/s bulk streams may send upstream while an interactive stream is active (0 = no cap)")
+	flag.BoolVar(&fastConnect, "fast-connect", false, "Answer SOCKS5 CONNECT at once and send the app's first data with the target header, saving a DNS round trip per connection (failed targets show up as closed connections)")
+	flag.DurationVar(&reconnectWindow, "reconnect-window", 10*time.Second, "How long SOCKS5 connections wait for a dropped tunnel to reconnect before failing (0 = fail at once)")
+	flag.DurationVar(&streamIdleTimeout, "stream-idle-timeout", 0, "Tear down SOCKS5 connections that moved no data either way for this long (0 = never)")
+	flag.BoolVar(&reconnectReplay, "reconnect-replay", false, "Reopen streams whose tunnel dropped before the target answered and resend their data (only safe for idempotent requests)")
+	streamWindow := flag.Int("stream-window", proxy.DefaultStreamWindow/1024, "KB of upstream data a tunnel may have queued before streams pause reading from apps (0 = unbounded)")
+	maxInflight := flag.Int("max-inflight", 0, "Cap upstream DNS queries awaiting an answer; the window starts small and adapts to loss (0 = no cap)")
+	longPolls := flag.Int("long-polls", 0, "Keep this many polls held at the server until downstream data is ready, instead of idle short polling (0 = off)")
+	longPollHold := flag.Duration("long-poll-hold", protocol.DefaultLongPollHold, "How long the server may hold each long poll (keep below the resolver's retry timeout)")
+	ednsSize := flag.Int("edns-size", protocol.DefaultEDNSSize, "Response size advertised to resolvers in bytes (512-4096); above 1232 only where the path passes large UDP answers")
+	tcpFallback := flag.Int("tcp-fallback", protocol.DefaultTCPFallback, "Fetch truncated UDP answers again over TCP, at most this many at once (0 = never)")
+	encryptFragments := flag.Bool("encrypt-fragments", false, "Seal every DNS fragment with ChaCha20-Poly1305 under a key agreed with the pinned server, so the bytes in the queries and answers don't look like QUIC (needs a server that supports it)")
+	reorderWindow := flag.Duration("reorder-window", 0, "Hold downstream packets that overtook a missing one up to this long so QUIC gets them in order (needs server support; 0 = off)")
+	reassemblyTimeout := flag.Duration("reassembly-timeout", protocol.ReassemblyTimeout, "Give up on a downstream packet still missing fragments after this long and poll at once")
+	nack := flag.Bool("nack", true, "Name missing downstream fragments in polls so the server resends them before QUIC would")
+	maxGoodput := flag.Int("max-goodput", 0, "Cap each tunnel's upstream QUIC traffic at this many KB/s (0 = unlimited)")
+	compress := flag.Bool("compress", false, "Compress upstream packets that shrink, and ask the server to compress downstream (encrypted QUIC rarely shrinks; check the compression summary)")
+	migrateSessions := flag.Bool("migrate", true, "On reconnect, first try to move the live QUIC connection to a new session so its streams survive")
+	fecRatio := flag.Float64("fec-ratio", 0, "Add this many Reed-Solomon parity fragments per data fragment (rounded up) so packets survive lost fragments, and ask the server for FEC downstream (0 = off, at most 1)")
+	var frontList stringSlice
+	flag.Var(&frontList, "front", "HOST[:PORT]=SNI: server connects to HOST over TLS presenting SNI; the app speaks plaintext (repeatable)")
+	recordTypeName := flag.String("record-type", "txt", "Query type downstream data comes back in: txt; a for resolvers that strip or truncate TXT answers (slower, needs EDNS0); cname for networks that only pass CNAME chains (one fragment per response); null for raw binary answers that don't look like base64 (often filtered, the server must enable it)")
+	case0x20 := flag.Bool("0x20", false, "Randomize query name case and drop responses that don't echo it (anti-spoofing)")
+	cookies := flag.Bool("cookies", false, "Send EDNS0 client cookies and drop responses with a wrong one, or with none once the resolver has echoed one (anti-spoofing)")
+	serviceMode := flag.String("service", "", "Windows service control: install, uninstall or run")
+	logFile := flag.String("log-file", "", "Append logs to this file instead of stderr")
+	selftest := flag.Bool("selftest", false, "Connect one tunnel, report latency, loss, downstream capacity and the server fingerprint, then exit (non-zero on failure)")
 
 	flag.Parse()
 
+	// Fill in flags from the config file, then every flag the profile covers
+	// that neither set
+	if *configFile != "" {
+		file, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load --config")
+		}
+		if err := file.Apply(flag.CommandLine, config.Explicit(flag.CommandLine)); err != nil {
+			log.Fatal().Err(err).Msg("Invalid --config")
+		}
+	}
+	prof, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --profile")
+	}
+	if err := prof.Apply(flag.CommandLine); err != nil {
+		log.Fatal().Err(err).Msg("Failed to apply profile")
+	}
+
 	// Setup logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", *logFile).Msg("Failed to open log file")
+		}
+		log.Logger = zerolog.New(f).With().Timestamp().Logger()
+	} else if *serviceMode == "run" {
+		// A service has no console; log to the platform's service log instead
+		w, err := serviceLogWriter()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open service log")
+		}
+		log.Logger = zerolog.New(w).With().Timestamp().Logger()
+	}
 
 	switch *logLevel {
 	case "debug":
@@ -219,38 +504,55 @@ func main() {
 
 	// Set memory limit
 	debug.SetMemoryLimit(int64(*memoryLimit) * 1024 * 1024)
+	log.Info().Str("profile", prof.Name).Msg("Using tuning profile")
 
 	// Validate required flags
 	if *domain == "" {
 		log.Fatal().Msg("--domain is required")
 	}
-	if *resolversFlag == "" {
-		log.Fatal().Msg("--resolvers is required (comma-separated list of DNS resolvers)")
+	if *resolversFlag == "" && len(resolverList) == 0 {
+		log.Fatal().Msg("--resolvers or --resolver is required")
 	}
-	if *pubkeyFile == "" {
-		log.Fatal().Msg("--pubkey-file is required")
+	if *pubkeyFile == "" && *manifestFile == "" {
+		log.Fatal().Msg("--pubkey-file or --manifest is required")
 	}
 
-	// Parse resolvers list
-	resolvers := strings.Split(*resolversFlag, ",")
-	for i, r := range resolvers {
-		resolvers[i] = strings.TrimSpace(r)
+	// Parse resolvers list (--resolvers and repeated --resolver are merged)
+	var resolvers []string
+	for _, r := range append(strings.Split(*resolversFlag, ","), resolverList...) {
+		if r = strings.TrimSpace(r); r != "" {
+			resolvers = append(resolvers, r)
+		}
 	}
-	if len(resolvers) == 0 || resolvers[0] == "" {
+	if len(resolvers) == 0 {
 		log.Fatal().Msg("At least one resolver is required")
 	}
-	log.Info().Int("count", len(resolvers)).Strs("resolvers", resolvers).Msg("Configured DNS resolvers")
+	strategy, err := protocol.ParseResolverStrategy(*resolverStrategy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --resolver-strategy")
+	}
+	log.Info().Int("count", len(resolvers)).Strs("resolvers", resolvers).Str("strategy", strategy.String()).Msg("Configured DNS resolvers")
 
-	// Load public key and calculate fingerprint
-	pubKey, err := crypto.LoadPublicKey(*pubkeyFile)
+	// Collect the fingerprints to pin: the public key file and/or a signed manifest
+	pinSrc := pinSource{pubkeyFile: *pubkeyFile, manifestFile: *manifestFile, manifestSigner: *manifestSigner, domain: *domain}
+	fingerprints, err := pinSrc.load()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load public key")
+		log.Fatal().Err(err).Msg("Failed to load server pins")
+	}
+	if reconnectWindow < 0 {
+		log.Fatal().Msg("--reconnect-window cannot be negative")
+	}
+	if *pinReload < 0 {
+		log.Fatal().Msg("--pin-reload cannot be negative")
 	}
-	fingerprint := crypto.PublicKeyFingerprint(pubKey)
-	log.Info().Str("fingerprint", fingerprint).Msg("Using server public key")
 
-	// Create TLS config with certificate pinning
-	tlsConfig := crypto.GetClientTLSConfig(fingerprint)
+	// Create TLS config with certificate pinning; the pins are swapped in place on reload
+	pins := crypto.NewPinSet(fingerprints)
+	tlsConfig := crypto.GetClientTLSConfigPinSet(pins)
+	if *alpn == "" {
+		log.Fatal().Msg("--alpn cannot be empty")
+	}
+	tlsConfig.NextProtos = []string{*alpn}
 
 	// Validate packet size range
 	if *minPacketSize < 512 || *minPacketSize > 1200 {
@@ -262,53 +564,271 @@ func main() {
 	if *minPacketSize > *maxPacketSize {
 		log.Fatal().Int("min", *minPacketSize).Int("max", *maxPacketSize).Msg("--min-packet-size cannot be greater than --max-packet-size")
 	}
+	if *keepAlive <= 0 || *idleTimeout <= *keepAlive {
+		log.Fatal().Dur("keepalive", *keepAlive).Dur("idle_timeout", *idleTimeout).Msg("--keepalive must be positive and below --idle-timeout")
+	}
+	if *pollInterval <= 0 {
+		log.Fatal().Msg("--poll-interval must be positive")
+	}
+	if *parallelPolls < 1 || *parallelPolls > 256 {
+		log.Fatal().Int("parallel_polls", *parallelPolls).Msg("--parallel-polls must be between 1 and 256")
+	}
+	if *idleThreshold <= 0 {
+		log.Fatal().Msg("--idle-threshold must be positive")
+	}
+	if *redundancyThreshold < 0 {
+		log.Fatal().Msg("--redundancy-threshold cannot be negative")
+	}
+	if *reassemblyTimeout <= 0 {
+		log.Fatal().Msg("--reassembly-timeout must be positive")
+	}
+	if *ednsSize < protocol.MinResponseSize || *ednsSize > protocol.MaxEDNSSize {
+		log.Fatal().Int("edns_size", *ednsSize).Msg("--edns-size must be between 512 and 4096")
+	}
+	if *reorderWindow < 0 {
+		log.Fatal().Msg("--reorder-window cannot be negative")
+	}
+	if *tcpFallback < 0 {
+		log.Fatal().Msg("--tcp-fallback cannot be negative")
+	}
+	if *fecRatio < 0 || *fecRatio > protocol.MaxFECRatio {
+		log.Fatal().Float64("fec_ratio", *fecRatio).Msg("--fec-ratio must be between 0 and 1")
+	}
+	// The flag's "never" is 0, the transport's is negative
+	redundancy := *redundancyThreshold
+	if redundancy == 0 {
+		redundancy = -1
+	}
+	tcpRetries := *tcpFallback
+	if tcpRetries == 0 {
+		tcpRetries = -1
+	}
+	if *udpReadBuffer < 0 || *udpWriteBuffer < 0 {
+		log.Fatal().Msg("--udp-read-buffer and --udp-write-buffer cannot be negative")
+	}
+	readBuffer := *udpReadBuffer * 1024
+	if readBuffer == 0 {
+		readBuffer = -1
+	}
+	if *bulkRate < 0 {
+		log.Fatal().Msg("--bulk-rate cannot be negative")
+	}
+	if *streamWindow < 0 {
+		log.Fatal().Msg("--stream-window cannot be negative")
+	}
+	if streamIdleTimeout < 0 {
+		log.Fatal().Msg("--stream-idle-timeout cannot be negative")
+	}
+	if (socksUser == "") != (socksPass == "") {
+		log.Fatal().Msg("--socks-user and --socks-pass must be set together")
+	}
+	if len(socksUser) > 255 || len(socksPass) > 255 {
+		log.Fatal().Msg("--socks-user and --socks-pass must be at most 255 bytes")
+	}
+	if *maxGoodput < 0 {
+		log.Fatal().Msg("--max-goodput cannot be negative")
+	}
+	if *maxInflight < 0 {
+		log.Fatal().Msg("--max-inflight cannot be negative")
+	}
+	if *longPolls < 0 || *longPolls > protocol.MaxTxWorkers {
+		log.Fatal().Msg("--long-polls must be between 0 and 256")
+	}
+	if *longPollHold <= 0 {
+		log.Fatal().Msg("--long-poll-hold must be positive")
+	}
+
+	priorityPorts, err := parsePriorityPorts(*priorityPortsFlag)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --priority-ports")
+	}
+
+	if *txWorkers < 1 || *txWorkers > protocol.MaxTxWorkers {
+		log.Fatal().Int("tx_workers", *txWorkers).Msg("--tx-workers must be between 1 and 256")
+	}
+	if *rxBuffer < protocol.MinRxBufferSize || *rxBuffer > protocol.RxBufferSize {
+		log.Fatal().Int("rx_buffer", *rxBuffer).Msg("--rx-buffer must be between 512 and 65535")
+	}
+
+	recordType, err := protocol.ParseRecordType(*recordTypeName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --record-type")
+	}
+	if recordType == dns.TypeCNAME && len(strings.TrimSuffix(*domain, ".")) > protocol.MaxCNAMEDomainLen {
+		log.Fatal().Int("max", protocol.MaxCNAMEDomainLen).Msg("--record-type cname needs a --domain of at most that many characters")
+	}
+
+	fronts, err = parseFrontRules(frontList)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --front")
+	}
+
+	if *connections < 1 || *connections > 16 {
+		log.Fatal().Int("connections", *connections).Msg("--connections must be between 1 and 16")
+	}
+
+	// Service control happens once the configuration is known to be valid,
+	// so an installed service does not fail on every start
+	switch *serviceMode {
+	case "", "run":
+	case "install":
+		if err := installService(serviceArgs(os.Args[1:])); err != nil {
+			log.Fatal().Err(err).Msg("Failed to install service")
+		}
+		log.Info().Str("name", serviceName).Msg("Service installed")
+		return
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to uninstall service")
+		}
+		log.Info().Str("name", serviceName).Msg("Service uninstalled")
+		return
+	default:
+		log.Fatal().Str("service", *serviceMode).Msg("--service must be install, uninstall or run")
+	}
 
-	// Create tunnel manager with multiple resolvers
-	tunnel := NewTunnelManager(resolvers, *domain, tlsConfig, uint16(*minPacketSize), uint16(*maxPacketSize))
+	var capture *protocol.Capture
+	if *captureFile != "" {
+		capture, err = protocol.NewCapture(*captureFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", *captureFile).Msg("Failed to open capture file")
+		}
+		defer capture.Close()
+		log.Warn().Str("path", *captureFile).Msg("Capturing tunnel fragments")
+	}
 
+	// Server features the configuration relies on beyond the transport's
+	// (see tunnel.RequiredCaps), checked after every connect
+	var extraCaps protocol.Capabilities
+	if len(fronts) > 0 {
+		extraCaps |= protocol.CapTargetSNI
+	}
+	if fastConnect {
+		extraCaps |= protocol.CapDeferStatus
+	}
+
+	// Create tunnel pool, each tunnel with its own session over all resolvers
+	newTunnel := func() *TunnelManager {
+		tm := NewTunnelManager(resolvers, *domain, tlsConfig, uint16(*minPacketSize), uint16(*maxPacketSize))
+		tm.strategy = strategy
+		tm.quicConfig.KeepAlivePeriod = *keepAlive
+		tm.quicConfig.MaxIdleTimeout = *idleTimeout
+		tm.dnsOptions = protocol.DnsConnOptions{
+			TxWorkers:           *txWorkers,
+			RxBufferSize:        *rxBuffer,
+			Randomize0x20:       *case0x20,
+			Cookies:             *cookies,
+			MaxGoodput:          *maxGoodput * 1024,
+			Nacks:               *nack,
+			MaxInflight:         *maxInflight,
+			LongPolls:           *longPolls,
+			LongPollHold:        *longPollHold,
+			Capture:             capture,
+			PollInterval:        *pollInterval,
+			IdlePollInterval:    *idlePollInterval,
+			ParallelPolls:       *parallelPolls,
+			AdaptivePolls:       *adaptivePolls,
+			IdleThreshold:       *idleThreshold,
+			RedundancyThreshold: redundancy,
+			RecordType:          recordType,
+			FECRatio:            *fecRatio,
+			Compress:            *compress,
+			ReassemblyTimeout:   *reassemblyTimeout,
+			ReorderWindow:       *reorderWindow,
+			EDNSSize:            *ednsSize,
+			TCPFallback:         tcpRetries,
+			EncryptFragments:    *encryptFragments,
+			ServerPins:          pins,
+			ReadBuffer:          readBuffer,
+			WriteBuffer:         *udpWriteBuffer * 1024,
+		}
+		if *psk != "" {
+			tm.dnsOptions.PSK = []byte(*psk)
+		}
+		tm.streamWindow = *streamWindow * 1024
+		tm.pacer = newBulkPacer(*bulkRate * 1024)
+		tm.migrateSessions = *migrateSessions
+		tm.requiredCaps = tunnel.RequiredCaps(tm.dnsOptions) | extraCaps
+		return tm
+	}
+	if *selftest {
+		runSelftest(newTunnel())
+	}
+	tunnels := NewTunnelPool(*connections, newTunnel)
+
+	run := func(stop <-chan struct{}) {
+		if *pinReload > 0 {
+			go watchPins(pins, pinSrc, *pinReload, stop)
+		}
+		runClient(tunnels, *listen, priorityPorts, *otelEndpoint, stop)
+	}
+	if *serviceMode == "run" {
+		if err := runService(run); err != nil {
+			log.Fatal().Err(err).Msg("Service failed")
+		}
+		return
+	}
+	run(nil)
+}
+
+// runClient connects the tunnels and serves SOCKS5 until stop is closed
+// (a nil stop serves forever)
+func runClient(tunnels *TunnelPool, listen string, priorityPorts map[uint16]bool, otelEndpoint string, stop <-chan struct{}) {
 	// Initial connection
-	if err := tunnel.Connect(); err != nil {
+	if err := tunnels.Connect(); err != nil {
 		log.Fatal().Err(err).Msg("Initial connection failed")
 	}
 
 	// Start health check for auto-reconnection
-	tunnel.StartHealthCheck()
+	tunnels.StartHealthCheck()
+
+	// Optional tracing of stream lifecycles
+	tracer = telemetry.NewTracer(otelEndpoint, "slipstream-client", log.Logger)
+	if tracer != nil {
+		log.Info().Str("endpoint", otelEndpoint).Msg("Exporting stream traces via OTLP")
+	}
 
 	// Start local SOCKS5 server
-	listener, err := net.Listen("tcp", *listen)
+	listener, err := net.Listen("tcp", listen)
 	if err != nil {
-		log.Fatal().Err(err).Str("addr", *listen).Msg("Failed to start SOCKS5 listener")
+		log.Fatal().Err(err).Str("addr", listen).Msg("Failed to start SOCKS5 listener")
+	}
+	log.Info().Str("addr", listen).Msg("SOCKS5 server listening")
+
+	stopping := make(chan struct{})
+	if stop != nil {
+		go func() {
+			<-stop
+			log.Info().Msg("Stopping client")
+			close(stopping)
+			listener.Close()
+			tunnels.Close()
+			tracer.Shutdown()
+		}()
 	}
-	log.Info().Str("addr", *listen).Msg("SOCKS5 server listening")
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
 			log.Error().Err(err).Msg("Failed to accept connection")
 			continue
 		}
 
-		go handleSOCKS5Connection(conn, tunnel)
+		go handleSOCKS5Connection(conn, tunnels, priorityPorts)
 	}
 }
 
-// generateSessionID creates a random session ID using crypto/rand
-func generateSessionID() string {
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, 8)
-	cryptorand.Read(b)
-	for i := range b {
-		b[i] = charset[int(b[i])%len(charset)]
-	}
-	return string(b)
-}
-
 // handleSOCKS5Connection handles an incoming SOCKS5 connection from a local app
-func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
+func handleSOCKS5Connection(conn net.Conn, tunnels *TunnelPool, priorityPorts map[uint16]bool) {
 	defer conn.Close()
 
-	// Check if tunnel is connected
-	if !tunnel.IsConnected() {
+	// Reject early if no tunnel is up and we may not wait for one
+	if reconnectWindow == 0 && tunnels.Pick(false) == nil {
 		log.Warn().Msg("Tunnel not connected, rejecting SOCKS5 request")
 		sendSOCKS5Error(conn, 0x01)
 		return
@@ -334,20 +854,22 @@ func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
 		return
 	}
 
-	// Reply: no authentication required
-	conn.Write([]byte{0x05, 0x00})
+	if !negotiateSOCKS5Auth(conn, buf[:nmethods]) {
+		return
+	}
 
-	// Read CONNECT request: version, cmd, reserved, atype, addr, port
+	// Read CONNECT or UDP ASSOCIATE request: version, cmd, reserved, atype, addr, port
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
 		log.Debug().Err(err).Msg("Failed to read SOCKS5 request")
 		return
 	}
 
-	if buf[0] != 0x05 || buf[1] != 0x01 {
-		log.Debug().Msg("Not a CONNECT request")
+	if buf[0] != 0x05 || (buf[1] != 0x01 && buf[1] != 0x03) {
+		log.Debug().Msg("Not a CONNECT or UDP ASSOCIATE request")
 		sendSOCKS5Error(conn, 0x07) // Command not supported
 		return
 	}
+	udpAssociate := buf[1] == 0x03
 
 	// Parse address
 	addrType := buf[3]
@@ -375,7 +897,8 @@ func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
 		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
 			return
 		}
-		targetAddr = net.IP(buf[:16]).String()
+		// netip keeps an IPv4-mapped address in IPv6 form, as the client asked
+		targetAddr = netip.AddrFrom16([16]byte(buf[:16])).String()
 
 	default:
 		sendSOCKS5Error(conn, 0x08) // Address type not supported
@@ -390,10 +913,40 @@ func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
 
 	fullAddr := net.JoinHostPort(targetAddr, portToString(port))
 
-	log.Debug().Str("target", fullAddr).Msg("SOCKS5 CONNECT request")
+	if udpAssociate {
+		handleUDPAssociate(conn, tunnels, fullAddr)
+		return
+	}
+
+	span := tracer.Start("socks5.connect", nil)
+	defer span.End()
+	span.SetString("target", fullAddr)
+
+	interactive := priorityPorts[port]
+	log.Debug().Str("target", fullAddr).Bool("interactive", interactive).Msg("SOCKS5 CONNECT request")
 
-	// Get current QUIC connection
-	quicConn := tunnel.GetConnection()
+	// Pick a tunnel for this stream's priority class
+	tunnel := tunnels.Pick(interactive)
+	if tunnel == nil && reconnectWindow > 0 {
+		// Hold the application's connection while the tunnel reconnects
+		tunnel = tunnels.WaitPick(interactive, reconnectWindow)
+	}
+	if tunnel == nil {
+		log.Warn().Msg("Tunnel not connected, rejecting SOCKS5 request")
+		sendSOCKS5Error(conn, 0x01)
+		return
+	}
+	tunnel.activeStreams.Add(1)
+	defer tunnel.activeStreams.Add(-1)
+	if interactive {
+		tunnel.interactiveStreams.Add(1)
+		defer tunnel.interactiveStreams.Add(-1)
+	}
+
+	span.SetString("session", tunnel.SessionID())
+
+	// Get current QUIC connection, waiting out a reconnect in progress
+	quicConn := tunnel.WaitConnection(nil, reconnectWindow)
 	if quicConn == nil {
 		log.Error().Msg("No QUIC connection available")
 		sendSOCKS5Error(conn, 0x01)
@@ -401,11 +954,25 @@ func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
 	}
 
 	// Open QUIC stream with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), streamOpenTimeout)
 	defer cancel()
 
+	openSpan := tracer.Start("stream.open", span)
 	stream, err := quicConn.OpenStreamSync(ctx)
+	if err != nil && reconnectWindow > 0 {
+		// The tunnel may have just dropped: try once more on the reconnected one
+		log.Warn().Err(err).Msg("Failed to open QUIC stream, waiting for reconnect")
+		go tunnel.Reconnect()
+		if quicConn = tunnel.WaitConnection(quicConn, reconnectWindow); quicConn != nil {
+			retryCtx, retryCancel := context.WithTimeout(context.Background(), streamOpenTimeout)
+			stream, err = quicConn.OpenStreamSync(retryCtx)
+			retryCancel()
+		}
+	}
+	openSpan.SetError(err)
+	openSpan.End()
 	if err != nil {
+		span.SetError(err)
 		log.Error().Err(err).Msg("Failed to open QUIC stream")
 		sendSOCKS5Error(conn, 0x01)
 
@@ -413,28 +980,56 @@ func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
 		go tunnel.Reconnect()
 		return
 	}
-	defer stream.Close()
-
-	// Send target address to server via stream header
-	if err := proxy.WriteTargetAddress(stream, fullAddr); err != nil {
+	span.SetInt("stream", int64(stream.StreamID()))
+
+	// Send target address (and any --front TLS name) to server via stream header.
+	// With --fast-connect the status byte isn't awaited here: it is read in
+	// front of the first downstream data, and servers that support it send it
+	// there instead of on its own
+	connectSpan := tracer.Start("target.connect", span)
+	target := proxy.Target{Addr: fullAddr, SNI: fronts.sniFor(fullAddr)}
+	if target.SNI != "" {
+		span.SetString("sni", target.SNI)
+	}
+	target.DeferStatus = fastConnect && tunnel.ServerCaps().Has(protocol.CapDeferStatus)
+	if err := proxy.WriteTarget(stream, target); err != nil {
+		connectSpan.SetError(err)
+		connectSpan.End()
 		log.Error().Err(err).Msg("Failed to write target address")
-		sendSOCKS5Error(conn, 0x01)
+		sendSOCKS5Error(conn, proxy.ReplyCodeForError(err))
 		return
 	}
 
-	// Read server response (1 byte: 0x00 = success, 0x01 = error)
-	respBuf := make([]byte, 1)
-	if _, err := io.ReadFull(stream, respBuf); err != nil {
-		log.Error().Err(err).Msg("Failed to read server response")
-		sendSOCKS5Error(conn, 0x01)
-		return
-	}
+	if !fastConnect {
+		// Read server response (1 byte: 0x00 = success, 0x01 = error)
+		respBuf := make([]byte, 1)
+		if _, err := io.ReadFull(stream, respBuf); err != nil {
+			connectSpan.SetError(err)
+			connectSpan.End()
+			var streamErr *quic.StreamError
+			if errors.As(err, &streamErr) && streamErr.ErrorCode == protocol.StreamCodeTooManyStreams {
+				log.Warn().Msg("Server refused the stream: too many open streams on this session (server --max-streams-per-session)")
+			} else {
+				log.Error().Err(err).Msg("Failed to read server response")
+			}
+			sendSOCKS5Error(conn, 0x01)
+			return
+		}
 
-	if respBuf[0] != 0x00 {
-		log.Debug().Msg("Server reported connection failure")
-		sendSOCKS5Error(conn, 0x05) // Connection refused
-		return
+		if respBuf[0] != 0x00 {
+			connectSpan.End()
+			span.SetString("result", "refused")
+			// Older servers send a bare failure byte: report those as refused
+			code := byte(proxy.ReplyConnectionRefused)
+			if tunnel.ServerCaps().Has(protocol.CapReplyCodes) {
+				code = respBuf[0]
+			}
+			log.Debug().Uint8("reply", code).Msg("Server reported connection failure")
+			sendSOCKS5Error(conn, code)
+			return
+		}
 	}
+	connectSpan.End()
 
 	// Send SOCKS5 success response
 	response := []byte{
@@ -447,19 +1042,59 @@ func handleSOCKS5Connection(conn net.Conn, tunnel *TunnelManager) {
 	log.Debug().Str("target", fullAddr).Msg("SOCKS5 tunnel established")
 
 	// Bidirectional pipe
-	done := make(chan struct{}, 2)
-
-	go func() {
-		io.Copy(stream, conn)
-		done <- struct{}{}
-	}()
-
-	go func() {
-		io.Copy(conn, stream)
-		done <- struct{}{}
-	}()
+	pipeSpan := tracer.Start("pipe", span)
+	defer pipeSpan.End()
+	tunneled := newResumableStream(tunnel, quicConn, stream, target, fastConnect)
+	defer tunneled.Close()
+	abort := func(code quic.StreamErrorCode) {
+		tunneled.Abort(code)
+		conn.Close()
+	}
+	idle := proxy.NewIdleWatch(streamIdleTimeout, func() { abort(protocol.StreamCodeIdle) })
+	defer idle.Stop()
+	upstream := &telemetry.CountingWriter{W: idle.Writer(&pacedWriter{w: tunneled, pacer: tunnel.pacer, interactive: interactive})}
+	downstream := &telemetry.CountingWriter{W: idle.Writer(conn)}
+
+	// Each direction half-closes its destination at EOF so the other can finish
+	upErr, downErr := proxy.Pipe(func() error {
+		// Bulk streams stop reading from the app while the tunnel has a window's worth queued;
+		// interactive ones are never held back by it
+		window := tunnel.streamWindow
+		if interactive {
+			window = 0
+		}
+		if _, err := proxy.WindowedCopy(upstream, conn, window, tunnel.queuedBytes); err != nil {
+			return err
+		}
+		return tunneled.Close()
+	}, func() error {
+		if _, err := io.Copy(downstream, tunneled); err != nil {
+			return err
+		}
+		if !proxy.CloseWrite(conn) {
+			return proxy.ErrHalfCloseUnsupported
+		}
+		return nil
+	}, func() {
+		abort(protocol.StreamCodePipeFailed)
+	})
+	if idle.Expired() {
+		upErr, downErr = proxy.ErrIdle, proxy.ErrIdle
+	}
 
-	<-done
+	pipeSpan.SetInt("bytes_up", upstream.Count())
+	pipeSpan.SetInt("bytes_down", downstream.Count())
+	pipeSpan.SetString("up", proxy.Ending(upErr))
+	pipeSpan.SetString("down", proxy.Ending(downErr))
+	err = upErr
+	if proxy.Ending(err) == proxy.EndingEOF {
+		err = downErr
+	}
+	if proxy.Ending(err) != proxy.EndingEOF {
+		pipeSpan.SetError(err)
+		log.Debug().Err(err).Str("target", fullAddr).Str("up", proxy.Ending(upErr)).Str("down", proxy.Ending(downErr)).
+			Int64("bytes_up", upstream.Count()).Int64("bytes_down", downstream.Count()).Msg("Tunneled connection failed")
+	}
 }
 
 func sendSOCKS5Error(conn net.Conn, code byte) {
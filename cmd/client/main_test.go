@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/tunnel"
+)
+
+// captureLog sends the global logger's output to the returned buffer for the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := log.Logger
+	log.Logger = zerolog.New(&buf).Level(zerolog.InfoLevel)
+	t.Cleanup(func() { log.Logger = saved })
+	return &buf
+}
+
+// fakeResolver keeps the queries it receives and, if answering, replies to
+// each with a junk datagram (enough for the client to count it as answering)
+type fakeResolver struct {
+	addr    string
+	mu      sync.Mutex
+	queries [][]byte
+}
+
+// queriesFor counts the queries sent under session
+func (r *fakeResolver) queriesFor(session string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, q := range r.queries {
+		if bytes.Contains(bytes.ToLower(q), []byte(session)) {
+			n++
+		}
+	}
+	return n
+}
+
+func newFakeResolver(t *testing.T, answering bool) *fakeResolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	r := &fakeResolver{addr: pc.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.queries = append(r.queries, bytes.Clone(buf[:n]))
+			r.mu.Unlock()
+			if answering {
+				pc.WriteTo([]byte("junk"), from)
+			}
+		}
+	}()
+	return r
+}
+
+// newFailoverTunnel returns a tunnel over resolvers whose handshakes give up quickly
+func newFailoverTunnel(resolvers ...*fakeResolver) *TunnelManager {
+	var addrs []string
+	for _, r := range resolvers {
+		addrs = append(addrs, r.addr)
+	}
+	tm := NewTunnelManager(addrs, "t.example.com", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"slipstream"}}, 512, 512)
+	tm.strategy = protocol.StrategyFailover
+	tm.quicConfig.HandshakeIdleTimeout = 250 * time.Millisecond
+	return tm
+}
+
+func TestConnectRotatesResolversAfterFailure(t *testing.T) {
+	captureLog(t)
+	a, b := newFakeResolver(t, false), newFakeResolver(t, false)
+	tm := newFailoverTunnel(a, b)
+	defer tm.Close()
+
+	if err := tm.Connect(); err == nil {
+		t.Fatal("connected through silent resolvers")
+	}
+	if first, second := a.queriesFor(tm.sessionID), b.queriesFor(tm.sessionID); first == 0 || second != 0 {
+		t.Fatalf("first attempt: %d queries to the first resolver, %d to the second", first, second)
+	}
+
+	// The retry starts one resolver further along the list
+	if err := tm.Connect(); err == nil {
+		t.Fatal("connected through silent resolvers")
+	}
+	if first, second := a.queriesFor(tm.sessionID), b.queriesFor(tm.sessionID); first != 0 || second == 0 {
+		t.Errorf("retry: %d queries to the first resolver, %d to the second", first, second)
+	}
+}
+
+func TestReconnectStartsWithLastGoodResolver(t *testing.T) {
+	captureLog(t)
+	a, b := newFakeResolver(t, false), newFakeResolver(t, true)
+	tm := newFailoverTunnel(a, b)
+	defer tm.Close()
+
+	// A connection whose traffic went through the second resolver, which answered
+	order := []string{b.addr, a.addr}
+	dnsConn, err := protocol.NewDnsPacketConnWithOptions(order, tm.domain, tunnel.SessionID(), tm.dnsOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConn.SetResolverStrategy(protocol.StrategyFailover)
+	if _, err := dnsConn.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dnsConn.LastAnsweredResolver() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the answering resolver never got through")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tm.mu.Lock()
+	tm.dnsConn, tm.dnsResolvers = dnsConn, order
+	tm.mu.Unlock()
+
+	// Without a failed attempt the reconnect goes straight back to it
+	tm.Connect()
+	if first, good := a.queriesFor(tm.sessionID), b.queriesFor(tm.sessionID); first != 0 || good == 0 {
+		t.Errorf("reconnect: %d queries to the first resolver, %d to the last good one", first, good)
+	}
+	if tm.lastGoodResolver != b.addr {
+		t.Errorf("last good resolver is %q, want %q", tm.lastGoodResolver, b.addr)
+	}
+}
+
+func TestWaitPickHoldsForReconnect(t *testing.T) {
+	tm := &TunnelManager{}
+	tunnels := NewTunnelPool(1, func() *TunnelManager { return tm })
+
+	start := time.Now()
+	if got := tunnels.WaitPick(false, 200*time.Millisecond); got != nil {
+		t.Fatal("picked a tunnel that never connected")
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Fatalf("gave up after %v, want the 200ms window", waited)
+	}
+
+	// A tunnel coming back within the window takes the held connection
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		tm.connected.Store(true)
+	}()
+	if got := tunnels.WaitPick(false, 5*time.Second); got != tm {
+		t.Fatal("reconnected tunnel not picked")
+	}
+
+	// A closed tunnel never comes back: don't wait it out
+	tm.closed.Store(true)
+	start = time.Now()
+	if conn := tm.WaitConnection(nil, 5*time.Second); conn != nil || time.Since(start) > time.Second {
+		t.Errorf("WaitConnection on a closed tunnel returned %v after %v", conn, time.Since(start))
+	}
+}
+
+// replayServer accepts plain QUIC connections and answers each stream's
+// target header with success. The first stream never gets a response; later
+// ones are answered with what the app sent, but only once its EOF arrived.
+func replayServer(t *testing.T) string {
+	t.Helper()
+	_, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := crypto.GetTLSConfig(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var streams atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					first := streams.Add(1) == 1
+					go func() {
+						if _, err := proxy.ParseTarget(stream); err != nil {
+							stream.CancelRead(0)
+							return
+						}
+						stream.Write([]byte{0x00})
+						request, err := io.ReadAll(stream)
+						if err != nil || first {
+							return
+						}
+						stream.Write(append([]byte("answer to "), request...))
+						stream.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dialReplayServer(t *testing.T, addr string) *quic.Conn {
+	t.Helper()
+	conn, err := quic.DialAddr(context.Background(), addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"slipstream"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return conn
+}
+
+func TestReplayedStreamKeepsHalfClose(t *testing.T) {
+	captureLog(t)
+	savedReplay, savedWindow := reconnectReplay, reconnectWindow
+	reconnectReplay, reconnectWindow = true, 2*time.Second
+	t.Cleanup(func() { reconnectReplay, reconnectWindow = savedReplay, savedWindow })
+
+	addr := replayServer(t)
+	dropped, reconnected := dialReplayServer(t, addr), dialReplayServer(t, addr)
+	tm := &TunnelManager{conn: reconnected}
+	tm.connected.Store(true)
+
+	target := proxy.Target{Addr: "example.com:80"}
+	stream, err := openTargetStream(dropped, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newResumableStream(tm, dropped, stream, target, false)
+	if _, err := s.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	// The app is done sending, then the tunnel drops before the target answers
+	s.Close()
+	dropped.CloseWithError(0, "")
+
+	// The server only answers the replay once it sees the app's EOF again
+	result := make(chan []byte, 1)
+	go func() {
+		got, _ := io.ReadAll(s)
+		result <- got
+	}()
+	select {
+	case got := <-result:
+		if string(got) != "answer to request" {
+			t.Errorf("got %q, want the answer to the replayed request", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer: the reopened stream never saw the app's EOF")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/tunnel"
+)
+
+// migrate moves the live QUIC connection to a fresh session ID instead of
+// replacing it, so the streams on it survive (--migrate). The DNS transport
+// is rebound to the new ID; the server sees its peer move and validates the
+// new path like any QUIC connection migration. A capability exchange then
+// proves the connection works on the new session, and carries FEC and
+// compression over. Reports false if the connection is gone or didn't answer,
+// in which case the caller reconnects the usual way.
+func (tm *TunnelManager) migrate() bool {
+	tm.mu.Lock()
+	conn, dnsConn := tm.conn, tm.dnsConn
+	if !tm.migrateSessions || conn == nil || dnsConn == nil || conn.Context().Err() != nil {
+		tm.mu.Unlock()
+		return false
+	}
+	from, sessionID := tm.sessionID, tunnel.SessionID()
+	if err := dnsConn.Rebind(sessionID); err != nil {
+		tm.mu.Unlock()
+		log.Warn().Err(err).Msg("Cannot migrate the connection")
+		return false
+	}
+	tm.sessionID = sessionID
+	tm.mu.Unlock()
+
+	log.Info().Str("from", from).Str("session", sessionID).Msg("Migrating connection to a new session")
+	if _, err := tm.exchangeHello(conn, dnsConn); err != nil && !errors.Is(err, protocol.ErrHelloUnsupported) {
+		log.Warn().Err(err).Msg("Connection did not answer on the new session")
+		return false
+	}
+	tm.migrations.Add(1)
+	return true
+}
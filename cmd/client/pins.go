@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
+)
+
+// pinSource describes where the accepted server fingerprints come from
+type pinSource struct {
+	pubkeyFile     string
+	manifestFile   string
+	manifestSigner string
+	domain         string
+}
+
+// load reads the public key file and/or verifies the manifest and returns
+// every fingerprint they pin
+func (s pinSource) load() ([]string, error) {
+	var fingerprints []string
+	if s.pubkeyFile != "" {
+		pubKey, err := crypto.LoadPublicKey(s.pubkeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load public key: %w", err)
+		}
+		fingerprint := crypto.PublicKeyFingerprint(pubKey)
+		fingerprints = append(fingerprints, fingerprint)
+		log.Info().Str("fingerprint", fingerprint).Msg("Using server public key")
+	}
+	if s.manifestFile != "" {
+		manifest, err := crypto.LoadManifest(s.manifestFile, s.domain, s.manifestSigner, s.manifestFile+".signer", time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("verify manifest: %w", err)
+		}
+		fingerprints = append(fingerprints, manifest.Fingerprints...)
+		log.Info().Strs("fingerprints", manifest.Fingerprints).Time("expires", manifest.NotAfter).Msg("Using server fingerprints from manifest")
+	}
+	return fingerprints, nil
+}
+
+// stamp identifies the current version of the source files
+func (s pinSource) stamp() string {
+	var stamp string
+	for _, path := range []string{s.pubkeyFile, s.manifestFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp
+}
+
+// watchPins polls the pin source every interval and swaps the new fingerprints
+// into pins when a file changes, so reconnects after a server key rotation
+// pin the new key while established connections carry on. A file that fails
+// to load (e.g. mid-write or a bad signature) keeps the previous pins.
+func watchPins(pins *crypto.PinSet, source pinSource, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := source.stamp()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		stamp := source.stamp()
+		if stamp == last {
+			continue
+		}
+		fingerprints, err := source.load()
+		if err != nil {
+			// Retry on the next tick: the file may still be being written
+			log.Warn().Err(err).Msg("Server key changed but could not be loaded; keeping the current pins")
+			continue
+		}
+		last = stamp
+		if slices.Equal(fingerprints, pins.Fingerprints()) {
+			continue
+		}
+		pins.Set(fingerprints)
+		log.Info().Strs("fingerprints", fingerprints).Msg("Server pins updated; new connections use the new key")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"slipstream-go/internal/crypto"
+)
+
+// writePubKey saves a fresh server public key to path and returns its fingerprint
+func writePubKey(t *testing.T, path string) string {
+	t.Helper()
+	pub, _, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crypto.SavePublicKey(pub, path); err != nil {
+		t.Fatal(err)
+	}
+	return crypto.PublicKeyFingerprint(pub)
+}
+
+// waitForPins fails unless pins come to hold exactly want
+func waitForPins(t *testing.T, pins *crypto.PinSet, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Equal(pins.Fingerprints(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pins are %v, want %v", pins.Fingerprints(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchPinsFollowsKeyFile(t *testing.T) {
+	captureLog(t)
+	path := filepath.Join(t.TempDir(), "server.pub")
+	writePubKey(t, path)
+	source := pinSource{pubkeyFile: path}
+	loaded, err := source.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := crypto.NewPinSet(loaded)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		watchPins(pins, source, 10*time.Millisecond, stop)
+	}()
+	// The watcher must be gone before captureLog restores the logger
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// Rotated key: later handshakes pin the new one
+	time.Sleep(20 * time.Millisecond) // a distinct modification time
+	second := writePubKey(t, path)
+	waitForPins(t, pins, []string{second})
+
+	// A file that doesn't load keeps the pins
+	if err := os.WriteFile(path, []byte("half-written"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := pins.Fingerprints(); !slices.Equal(got, []string{second}) {
+		t.Fatalf("pins changed to %v by a bad key file", got)
+	}
+}
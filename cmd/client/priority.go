@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"slipstream-go/internal/protocol"
+)
+
+const (
+	// interactiveWindow: a tunnel counts as having interactive traffic for this long after its last interactive write
+	interactiveWindow = 200 * time.Millisecond
+	// bulkChunkSize splits bulk writes so the bucket is consulted often
+	bulkChunkSize = 4096
+)
+
+// parsePriorityPorts parses a comma-separated list of target ports treated as interactive
+func parsePriorityPorts(s string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports[uint16(n)] = true
+	}
+	return ports, nil
+}
+
+// bulkPacer biases a tunnel's upstream toward interactive streams. quic-go
+// has no stream priorities, and every stream's packets share one fragment
+// queue, so an interactive packet waits behind whatever bulk data is queued
+// ahead of it. While interactive streams are writing, bulk streams draw
+// from a token bucket, which keeps the queue from outgrowing what the
+// transport sends in about a tenth of a second.
+type bulkPacer struct {
+	bucket          *protocol.TokenBucket // nil: bulk is never held back
+	lastInteractive atomic.Int64
+}
+
+// newBulkPacer caps bulk streams at bytesPerSec while interactive ones are active (0 = no cap)
+func newBulkPacer(bytesPerSec int) *bulkPacer {
+	return &bulkPacer{bucket: protocol.NewTokenBucket(bytesPerSec)}
+}
+
+// noteInteractive records that an interactive stream just sent data
+func (p *bulkPacer) noteInteractive() {
+	p.lastInteractive.Store(time.Now().UnixNano())
+}
+
+// interactiveRecently reports whether an interactive stream sent data within interactiveWindow
+func (p *bulkPacer) interactiveRecently() bool {
+	return time.Since(time.Unix(0, p.lastInteractive.Load())) < interactiveWindow
+}
+
+// waitBulk holds a bulk write of n bytes until the bucket has credit for it,
+// if interactive traffic is active
+func (p *bulkPacer) waitBulk(n int) {
+	if p.bucket == nil || !p.interactiveRecently() {
+		return
+	}
+	if wait := p.bucket.Reserve(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// pacedWriter writes upstream data into a QUIC stream: interactive writes
+// mark the tunnel as busy, bulk writes are paced while it is (see bulkPacer)
+type pacedWriter struct {
+	w           io.Writer
+	pacer       *bulkPacer
+	interactive bool
+}
+
+func (pw *pacedWriter) Write(p []byte) (int, error) {
+	if pw.interactive {
+		pw.pacer.noteInteractive()
+		return pw.w.Write(p)
+	}
+
+	written := 0
+	for written < len(p) {
+		end := min(written+bulkChunkSize, len(p))
+		pw.pacer.waitBulk(end - written)
+		n, err := pw.w.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
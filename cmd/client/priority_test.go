@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// link stands in for the tunnel's upstream fragment queue: writes queue up
+// and drain at a fixed rate
+type link struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	queued float64
+	last   time.Time
+}
+
+func newLink(bytesPerSec float64) *link {
+	return &link{rate: bytesPerSec, last: time.Now()}
+}
+
+func (l *link) drainLocked() {
+	now := time.Now()
+	l.queued = max(l.queued-now.Sub(l.last).Seconds()*l.rate, 0)
+	l.last = now
+}
+
+func (l *link) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drainLocked()
+	l.queued += float64(len(p))
+	return len(p), nil
+}
+
+// delay is how long bytes written now wait before they are sent
+func (l *link) delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drainLocked()
+	return time.Duration(l.queued / l.rate * float64(time.Second))
+}
+
+// interactiveDelay runs a bulk transfer next to an interactive stream over
+// one link and returns the longest an interactive write waited
+func interactiveDelay(t *testing.T, pacer *bulkPacer) time.Duration {
+	t.Helper()
+	const linkRate = 64 * 1024
+	l := newLink(linkRate)
+	interactive := &pacedWriter{w: l, pacer: pacer, interactive: true}
+	bulk := &pacedWriter{w: l, pacer: pacer}
+
+	interactive.Write([]byte("ls\n"))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chunk := make([]byte, 32*1024)
+		// Two seconds of link time at most, so an uncapped run ends too
+		for sent := 0; sent < 2*linkRate; sent += len(chunk) {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			bulk.Write(chunk)
+		}
+	}()
+
+	var worst time.Duration
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		worst = max(worst, l.delay())
+		interactive.Write([]byte("x"))
+	}
+	close(stop)
+	<-done
+	t.Logf("longest interactive delay: %v", worst)
+	return worst
+}
+
+func TestBulkPacerBoundsInteractiveDelay(t *testing.T) {
+	// Bulk may use half the link while the interactive stream types
+	if worst := interactiveDelay(t, newBulkPacer(32*1024)); worst > 250*time.Millisecond {
+		t.Errorf("interactive writes waited up to %v behind bulk data", worst)
+	}
+	// Without a cap bulk data queues up ahead of every keystroke
+	if worst := interactiveDelay(t, newBulkPacer(0)); worst < time.Second {
+		t.Errorf("uncapped bulk only delayed interactive writes by %v; the test link is too fast", worst)
+	}
+}
+
+func TestBulkPacerIdleWithoutInteractive(t *testing.T) {
+	pacer := newBulkPacer(1024)
+	l := newLink(1 << 30)
+	bulk := &pacedWriter{w: l, pacer: pacer}
+	start := time.Now()
+	bulk.Write(make([]byte, 64*1024))
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("bulk write took %v with no interactive stream active", took)
+	}
+}
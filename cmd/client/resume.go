@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/proxy"
+)
+
+// reconnectWindow is how long SOCKS5 connections wait for a dropped tunnel to
+// come back before giving up (--reconnect-window; 0 = fail at once)
+var reconnectWindow time.Duration
+
+// reconnectReplay lets a stream whose tunnel dropped before the target sent
+// anything be reopened on the new tunnel and its request sent again (--reconnect-replay)
+var reconnectReplay bool
+
+// fastConnect answers SOCKS5 CONNECT before the server's status byte arrives
+// (--fast-connect); the status is then read in front of the first downstream data
+var fastConnect bool
+
+// maxReplay caps the upstream bytes kept per stream for a replay; a stream
+// that sends more before the target answers can no longer be reopened
+const maxReplay = 64 * 1024
+
+// streamOpenTimeout bounds opening a QUIC stream on the tunnel
+const streamOpenTimeout = 10 * time.Second
+
+var errTargetRefused = errors.New("server reported connection failure")
+
+// WaitConnection returns a live QUIC connection other than stale, or stale
+// itself once it migrated to a new session, waiting up to timeout for a
+// reconnect and starting one if the current connection is dead. Returns nil
+// if none came up in time.
+func (tm *TunnelManager) WaitConnection(stale *quic.Conn, timeout time.Duration) *quic.Conn {
+	deadline := time.Now().Add(timeout)
+	migrations := tm.migrations.Load()
+	for {
+		conn := tm.GetConnection()
+		if conn != nil && (conn != stale || tm.migrations.Load() > migrations) && conn.Context().Err() == nil {
+			return conn
+		}
+		if conn != nil && conn.Context().Err() != nil && tm.IsConnected() {
+			// Don't wait for the health check to notice
+			go tm.Reconnect()
+		}
+		if tm.closed.Load() || !time.Now().Before(deadline) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// WaitPick is Pick, waiting up to timeout for a tunnel to connect
+func (p *TunnelPool) WaitPick(interactive bool, timeout time.Duration) *TunnelManager {
+	deadline := time.Now().Add(timeout)
+	for {
+		if t := p.Pick(interactive); t != nil {
+			return t
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// openTargetStream opens a stream on conn and asks the server to connect it to target
+func openTargetStream(conn *quic.Conn, target proxy.Target) (*quic.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamOpenTimeout)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := proxy.WriteTarget(stream, target); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if resp[0] != 0x00 {
+		stream.Close()
+		return nil, errTargetRefused
+	}
+	return stream, nil
+}
+
+// resumableStream carries one SOCKS5 connection over the tunnel. With
+// --reconnect-replay it keeps a copy of the upstream data until the target
+// sends its first byte; if the tunnel drops before that, the stream is
+// reopened to the same target on the reconnected tunnel and the copy is sent
+// again, so a request caught by a short outage is simply retried. Once the
+// target has answered, or the copy outgrew maxReplay, a broken tunnel ends
+// the connection as before.
+type resumableStream struct {
+	tunnel *TunnelManager
+	target proxy.Target
+
+	// mu serializes writes and reopening; reads only take it to reopen. stream
+	// is only replaced under mu but may be loaded without it.
+	mu     sync.Mutex
+	conn   *quic.Conn
+	stream atomic.Pointer[quic.Stream]
+	sent   []byte
+	replay bool
+	// closed: the app finished sending and the stream's send side was closed
+	closed bool
+
+	received atomic.Bool
+	// awaitStatus: the server's status byte hasn't been read yet (fast connect)
+	awaitStatus atomic.Bool
+}
+
+func newResumableStream(tunnel *TunnelManager, conn *quic.Conn, stream *quic.Stream, target proxy.Target, awaitStatus bool) *resumableStream {
+	s := &resumableStream{tunnel: tunnel, target: target, conn: conn, replay: reconnectReplay}
+	s.stream.Store(stream)
+	s.awaitStatus.Store(awaitStatus)
+	return s
+}
+
+func (s *resumableStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		n, err := s.stream.Load().Write(p)
+		if err == nil {
+			s.recordLocked(p)
+			return n, nil
+		}
+		if !s.reopenLocked(err) {
+			return n, err
+		}
+		// Everything before p was replayed: write p again on the new stream
+	}
+}
+
+func (s *resumableStream) Read(p []byte) (int, error) {
+	for {
+		stream := s.stream.Load()
+		var n int
+		var err error
+		if s.awaitStatus.Load() {
+			status := make([]byte, 1)
+			if _, err = io.ReadFull(stream, status); err == nil {
+				s.awaitStatus.Store(false)
+				if status[0] != 0x00 {
+					return 0, errTargetRefused
+				}
+				continue
+			}
+		} else {
+			n, err = stream.Read(p)
+			if n > 0 {
+				s.received.Store(true)
+				return n, err
+			}
+			if err == nil {
+				continue
+			}
+		}
+
+		s.mu.Lock()
+		reopened := s.stream.Load() != stream || s.reopenLocked(err)
+		s.mu.Unlock()
+		if !reopened {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the sending side of the current stream; the server sees EOF
+// while downstream data keeps arriving. A reopened stream is closed again
+// after its replay.
+func (s *resumableStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.stream.Load().Close()
+}
+
+// Abort resets both directions of the current stream. It doesn't wait for a
+// write in progress, which it unblocks.
+func (s *resumableStream) Abort(code quic.StreamErrorCode) {
+	stream := s.stream.Load()
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
+
+func (s *resumableStream) recordLocked(p []byte) {
+	if !s.replay {
+		return
+	}
+	if s.received.Load() || len(s.sent)+len(p) > maxReplay {
+		s.replay, s.sent = false, nil
+		return
+	}
+	s.sent = append(s.sent, p...)
+}
+
+// reopenLocked replaces a stream broken by err with a new one on the
+// reconnected tunnel and replays the upstream data. It reports whether the
+// stream may be used again.
+func (s *resumableStream) reopenLocked(err error) bool {
+	// Only a dead tunnel is worth a retry: a closed or reset stream is the server's answer
+	if !s.replay || s.received.Load() || errors.Is(err, io.EOF) || s.conn.Context().Err() == nil {
+		return false
+	}
+	log.Info().Str("target", s.target.Addr).Int("replay", len(s.sent)).Msg("Tunnel dropped before the target answered, reopening stream")
+
+	// A failed attempt is final, the other direction must not wait again
+	s.replay = false
+	conn := s.tunnel.WaitConnection(s.conn, reconnectWindow)
+	if conn == nil {
+		log.Debug().Str("target", s.target.Addr).Msg("Tunnel did not come back within the reconnect window")
+		return false
+	}
+	// Reopen the plain way: the status must be in before the replay is sent
+	target := s.target
+	target.DeferStatus = false
+	stream, err := openTargetStream(conn, target)
+	if err != nil {
+		log.Debug().Err(err).Str("target", s.target.Addr).Msg("Failed to reopen stream")
+		return false
+	}
+	if len(s.sent) > 0 {
+		if _, err := stream.Write(s.sent); err != nil {
+			stream.Close()
+			return false
+		}
+	}
+	if s.closed {
+		// The target must see the app's EOF again
+		stream.Close()
+	}
+	s.conn, s.replay = conn, true
+	s.stream.Store(stream)
+	s.awaitStatus.Store(false)
+	return true
+}
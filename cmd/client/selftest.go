@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+)
+
+// selftestPollTime is how long --selftest lets the tunnel poll after the
+// handshake before it reads the counters
+const selftestPollTime = 5 * time.Second
+
+// selftestMaxLoss is the query loss above which --selftest fails
+const selftestMaxLoss = 0.5
+
+// runSelftest connects one tunnel with the configured resolvers and options,
+// lets its polls run for a few seconds, prints what the path delivers and
+// exits: 0 if the server's certificate matched a pin and the resolvers
+// answered, 1 otherwise. No SOCKS5 listener is opened.
+func runSelftest(tm *TunnelManager) {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	fmt.Println("Slipstream client self-test")
+	fmt.Printf("  domain:        %s\n", tm.domain)
+	fmt.Printf("  resolvers:     %s\n", strings.Join(tm.resolvers, ", "))
+
+	// Remember what the server presented, so a pin mismatch names both sides
+	var presented atomic.Value
+	tlsConfig := tm.tlsConfig.Clone()
+	verify := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if len(rawCerts) > 0 {
+			if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil {
+				if pub, ok := cert.PublicKey.(ed25519.PublicKey); ok {
+					presented.Store(crypto.PublicKeyFingerprint(pub))
+				}
+			}
+		}
+		return verify(rawCerts, chains)
+	}
+	tm.tlsConfig = tlsConfig
+
+	start := time.Now()
+	err := tm.Connect()
+	handshake := time.Since(start)
+	fingerprint, _ := presented.Load().(string)
+	switch {
+	case err != nil && fingerprint != "" && strings.Contains(err.Error(), "fingerprint mismatch"):
+		fmt.Printf("  fingerprint:   %s (NOT PINNED)\n", fingerprint)
+		fail("the server's certificate matches no pin: check --pubkey-file/--manifest")
+	case err != nil:
+		fail("tunnel handshake failed after %s: %v", handshake.Round(time.Millisecond), err)
+	default:
+		fmt.Printf("  fingerprint:   %s (pinned)\n", fingerprint)
+		fmt.Printf("  handshake:     %s\n", handshake.Round(time.Millisecond))
+	}
+
+	if err == nil {
+		time.Sleep(selftestPollTime)
+		tm.mu.RLock()
+		conn, dnsConn := tm.conn, tm.dnsConn
+		tm.mu.RUnlock()
+
+		if caps := tm.ServerCaps(); caps != 0 {
+			fmt.Printf("  server caps:   %s\n", caps)
+		} else {
+			fmt.Println("  server caps:   none reported (old server or hello lost)")
+		}
+		quicStats := conn.ConnectionStats()
+		fmt.Printf("  tunnel rtt:    min %s, smoothed %s\n", quicStats.MinRTT.Round(time.Millisecond), quicStats.SmoothedRTT.Round(time.Millisecond))
+
+		maxFrags, answered := 0, false
+		for _, stats := range dnsConn.ResponseStats() {
+			fmt.Printf("  resolver:      %s: %d queries, %d responses (%.1f%% lost), largest %d bytes, %d fragments, edns0 %t\n",
+				stats.Resolver, stats.Queries, stats.Responses, 100*stats.LossRate(), stats.MaxSize, stats.MaxFragments, stats.EDNS0())
+			if stats.Responses == 0 {
+				fail("resolver %s never answered", stats.Resolver)
+				continue
+			}
+			answered = true
+			if stats.LossRate() > selftestMaxLoss {
+				fail("resolver %s lost %.0f%% of queries", stats.Resolver, 100*stats.LossRate())
+			}
+			maxFrags = max(maxFrags, stats.MaxFragments)
+		}
+		frags := dnsConn.FragmentStats()
+		fmt.Printf("  fragments:     %d received, %d packets, %.1f%% lost\n", frags.Fragments, frags.Packets, 100*frags.LossRate())
+		if reorder := dnsConn.ReorderStats(); reorder.Held > 0 {
+			fmt.Printf("  reordering:    %d packets held, %d gaps filled in time, %d skipped\n", reorder.Held, reorder.Corrected, reorder.Skipped)
+		}
+		if answered {
+			perPoll := maxFrags * protocol.MaxChunkSize
+			fmt.Printf("  downstream:    %d bytes per response, %d per round trip with %d polls per burst\n",
+				perPoll, perPoll*dnsConn.PollsPerBurst(), dnsConn.PollsPerBurst())
+			if maxFrags <= 1 {
+				fmt.Println("  hint:          one fragment per response; the resolver may strip EDNS0, try a lower server --max-frags or --record-type a")
+			}
+		}
+	}
+	tm.Close()
+
+	if len(problems) > 0 {
+		fmt.Printf("\n%d problem(s) found:\n", len(problems))
+		for _, p := range problems {
+			fmt.Printf("  - %s\n", p)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("\nTunnel OK")
+	os.Exit(0)
+}
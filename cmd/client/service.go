@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+const (
+	// serviceName is the Windows service name managed by --service
+	serviceName = "slipstream-client"
+	// serviceDisplayName is shown in the Services console
+	serviceDisplayName = "Slipstream DNS Tunnel Client"
+)
+
+// serviceArgs returns the arguments the installed service is started with:
+// the current ones with --service replaced by --service run
+func serviceArgs(args []string) []string {
+	out := make([]string, 0, len(args)+2)
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "service" {
+			i++ // skip the value
+			continue
+		}
+		if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return append(out, "--service", "run")
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var errServiceUnsupported = errors.New("--service is only supported on Windows")
+
+func installService(args []string) error { return errServiceUnsupported }
+
+func uninstallService() error { return errServiceUnsupported }
+
+func runService(run func(stop <-chan struct{})) error { return errServiceUnsupported }
+
+func serviceLogWriter() (io.Writer, error) { return nil, errServiceUnsupported }
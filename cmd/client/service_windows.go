@@ -0,0 +1,166 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// installService registers the client as an automatically started service
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "SOCKS5 proxy tunnelled over DNS",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %w", err)
+	}
+	return nil
+}
+
+// uninstallService stops and removes the service
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	// Best effort: a stopped service just refuses the control
+	s.Control(svc.Stop)
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(serviceName)
+	return nil
+}
+
+// runService runs the client under the service control manager. Started
+// from a console instead, it runs in the foreground until interrupted.
+func runService(run func(stop <-chan struct{})) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		run(nil)
+		return nil
+	}
+	return svc.Run(serviceName, &clientService{run: run})
+}
+
+// clientService adapts runClient to the svc.Handler interface
+type clientService struct {
+	run func(stop <-chan struct{})
+}
+
+func (s *clientService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		s.run(stop)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				select {
+				case <-finished:
+				case <-time.After(10 * time.Second):
+					log.Warn().Msg("Client did not stop in time")
+				}
+				return false, 0
+			}
+		case <-finished:
+			return false, 1
+		}
+	}
+}
+
+// serviceLogWriter sends log lines to the Windows event log
+func serviceLogWriter() (io.Writer, error) {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{elog: elog}, nil
+}
+
+// eventLogWriter maps zerolog levels onto event log entry types
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.InfoLevel, p)
+}
+
+func (w *eventLogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	msg := string(p)
+	var err error
+	switch {
+	case level >= zerolog.ErrorLevel:
+		err = w.elog.Error(1, msg)
+	case level == zerolog.WarnLevel:
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
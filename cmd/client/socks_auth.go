@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"net"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/proxy"
+)
+
+// socksUser and socksPass, when set, are the credentials local apps must
+// present (RFC 1929) before the SOCKS5 listener takes their requests
+var socksUser, socksPass string
+
+// negotiateSOCKS5Auth answers the greeting's methods: no authentication
+// when no credentials are configured, username/password otherwise. It
+// reports whether the app may go on to send its request.
+func negotiateSOCKS5Auth(conn net.Conn, methods []byte) bool {
+	if socksUser == "" {
+		conn.Write([]byte{proxy.SOCKS5Version, proxy.AuthNone})
+		return true
+	}
+	if !slices.Contains(methods, proxy.AuthUserPassword) {
+		log.Warn().Str("from", conn.RemoteAddr().String()).Msg("SOCKS5 app offered no username/password authentication, rejecting")
+		conn.Write([]byte{proxy.SOCKS5Version, proxy.AuthNoAcceptable})
+		return false
+	}
+	conn.Write([]byte{proxy.SOCKS5Version, proxy.AuthUserPassword})
+
+	// Subnegotiation: version, ulen, username, plen, password
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 0x01 {
+		log.Debug().Err(err).Msg("Failed to read SOCKS5 auth request")
+		return false
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return false
+	}
+	pass := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return false
+	}
+
+	// Check both in full, so the time taken doesn't tell which one was wrong
+	userOK := subtle.ConstantTimeCompare(user, []byte(socksUser))
+	passOK := subtle.ConstantTimeCompare(pass, []byte(socksPass))
+	if userOK&passOK != 1 {
+		log.Warn().Str("from", conn.RemoteAddr().String()).Msg("SOCKS5 authentication failed")
+		conn.Write([]byte{0x01, 0x01})
+		return false
+	}
+	conn.Write([]byte{0x01, 0x00})
+	return true
+}
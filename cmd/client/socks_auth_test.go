@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"slipstream-go/internal/proxy"
+)
+
+func TestNegotiateSOCKS5Auth(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string // configured credentials
+		methods    []byte // offered in the greeting
+		sendUser   string // presented if username/password was chosen
+		sendPass   string
+		method     byte   // chosen
+		status     []byte // subnegotiation reply, nil if none
+		ok         bool
+		warning    string
+	}{
+		{"no credentials configured", "", "", []byte{proxy.AuthNone}, "", "", proxy.AuthNone, nil, true, ""},
+		{"no credentials configured, password offered", "", "", []byte{proxy.AuthUserPassword}, "", "", proxy.AuthNone, nil, true, ""},
+		{"password not offered", "alice", "secret", []byte{proxy.AuthNone}, "", "", proxy.AuthNoAcceptable, nil, false, "offered no username/password"},
+		{"correct credentials", "alice", "secret", []byte{proxy.AuthNone, proxy.AuthUserPassword}, "alice", "secret", proxy.AuthUserPassword, []byte{0x01, 0x00}, true, ""},
+		{"wrong password", "alice", "secret", []byte{proxy.AuthUserPassword}, "alice", "guess", proxy.AuthUserPassword, []byte{0x01, 0x01}, false, "authentication failed"},
+		{"wrong username", "alice", "secret", []byte{proxy.AuthUserPassword}, "bob", "secret", proxy.AuthUserPassword, []byte{0x01, 0x01}, false, "authentication failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			savedUser, savedPass := socksUser, socksPass
+			socksUser, socksPass = tt.user, tt.pass
+			t.Cleanup(func() { socksUser, socksPass = savedUser, savedPass })
+
+			app, listener := net.Pipe()
+			defer app.Close()
+			app.SetDeadline(time.Now().Add(5 * time.Second))
+			result := make(chan bool, 1)
+			go func() {
+				defer listener.Close()
+				result <- negotiateSOCKS5Auth(listener, tt.methods)
+			}()
+
+			reply := make([]byte, 2)
+			if _, err := io.ReadFull(app, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[0] != proxy.SOCKS5Version || reply[1] != tt.method {
+				t.Fatalf("method reply %x, want method 0x%02x", reply, tt.method)
+			}
+			if tt.method == proxy.AuthUserPassword {
+				request := []byte{0x01, byte(len(tt.sendUser))}
+				request = append(request, tt.sendUser...)
+				request = append(request, byte(len(tt.sendPass)))
+				request = append(request, tt.sendPass...)
+				if _, err := app.Write(request); err != nil {
+					t.Fatal(err)
+				}
+				status := make([]byte, 2)
+				if _, err := io.ReadFull(app, status); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(status, tt.status) {
+					t.Errorf("status %x, want %x", status, tt.status)
+				}
+			}
+			if ok := <-result; ok != tt.ok {
+				t.Errorf("negotiation ok %v, want %v", ok, tt.ok)
+			}
+			if tt.warning != "" && !strings.Contains(logs.String(), tt.warning) {
+				t.Errorf("log %q, want a warning about %q", logs.String(), tt.warning)
+			}
+		})
+	}
+}
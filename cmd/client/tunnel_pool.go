@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/protocol"
+)
+
+// TunnelPool runs several independent DNS sessions/QUIC connections in parallel
+// and spreads SOCKS5 streams across them to multiply aggregate throughput
+type TunnelPool struct {
+	tunnels []*TunnelManager
+}
+
+// NewTunnelPool creates a pool of n tunnels built by newTunnel
+func NewTunnelPool(n int, newTunnel func() *TunnelManager) *TunnelPool {
+	if n < 1 {
+		n = 1
+	}
+	pool := &TunnelPool{tunnels: make([]*TunnelManager, n)}
+	for i := range pool.tunnels {
+		pool.tunnels[i] = newTunnel()
+	}
+	return pool
+}
+
+// Connect establishes all tunnels. Tunnels that fail keep retrying in the
+// background; an error is returned only if none could connect.
+func (p *TunnelPool) Connect() error {
+	var firstErr error
+	connected := 0
+	for i, t := range p.tunnels {
+		if err := t.Connect(); err != nil {
+			log.Warn().Err(err).Int("tunnel", i).Msg("Tunnel connection failed, retrying in background")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		return firstErr
+	}
+	for _, t := range p.tunnels {
+		if !t.IsConnected() {
+			go t.Reconnect()
+		}
+	}
+	log.Info().Int("connected", connected).Int("total", len(p.tunnels)).Msg("Tunnel pool ready")
+	return nil
+}
+
+// StartHealthCheck starts reconnection monitoring for every tunnel
+func (p *TunnelPool) StartHealthCheck() {
+	for _, t := range p.tunnels {
+		t.StartHealthCheck()
+	}
+}
+
+// Close shuts every tunnel down without reconnecting
+func (p *TunnelPool) Close() {
+	for _, t := range p.tunnels {
+		t.Close()
+	}
+}
+
+// FragmentStats sums downstream fragment counters over all tunnels
+func (p *TunnelPool) FragmentStats() protocol.FragmentStats {
+	var total protocol.FragmentStats
+	for _, t := range p.tunnels {
+		total = total.Add(t.FragmentStats())
+	}
+	return total
+}
+
+// Pick returns the connected tunnel carrying the fewest active streams, or nil.
+// Bulk streams additionally prefer tunnels without interactive streams so that
+// interactive traffic gets a DNS session of its own when the pool allows it.
+func (p *TunnelPool) Pick(interactive bool) *TunnelManager {
+	var best *TunnelManager
+	var bestShared bool
+	var bestLoad int64
+	for _, t := range p.tunnels {
+		if !t.IsConnected() {
+			continue
+		}
+		shared := !interactive && t.interactiveStreams.Load() > 0
+		load := t.activeStreams.Load()
+		if best == nil || (bestShared && !shared) || (shared == bestShared && load < bestLoad) {
+			best, bestShared, bestLoad = t, shared, load
+		}
+	}
+	return best
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/proxy"
+)
+
+// handleUDPAssociate serves a SOCKS5 UDP ASSOCIATE request (RFC 1928
+// section 7). The application sends its datagrams to a relay socket opened
+// for it; they travel as frames on one tunnel stream opened with
+// proxy.TargetFlagUDP, and the server's replies come back through the same
+// socket. The association lasts as long as the control connection.
+// clientAddr is the address the application said it will send from.
+func handleUDPAssociate(conn net.Conn, tunnels *TunnelPool, clientAddr string) {
+	span := tracer.Start("socks5.udp_associate", nil)
+	defer span.End()
+
+	tunnel := tunnels.Pick(true)
+	if tunnel == nil && reconnectWindow > 0 {
+		tunnel = tunnels.WaitPick(true, reconnectWindow)
+	}
+	if tunnel == nil {
+		log.Warn().Msg("Tunnel not connected, rejecting SOCKS5 request")
+		sendSOCKS5Error(conn, proxy.ReplyGeneralFailure)
+		return
+	}
+	tunnel.activeStreams.Add(1)
+	defer tunnel.activeStreams.Add(-1)
+	span.SetString("session", tunnel.SessionID())
+
+	quicConn := tunnel.WaitConnection(nil, reconnectWindow)
+	if quicConn == nil {
+		log.Error().Msg("No QUIC connection available")
+		sendSOCKS5Error(conn, proxy.ReplyGeneralFailure)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), streamOpenTimeout)
+	stream, err := quicConn.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		span.SetError(err)
+		log.Error().Err(err).Msg("Failed to open QUIC stream")
+		sendSOCKS5Error(conn, proxy.ReplyGeneralFailure)
+		go tunnel.Reconnect()
+		return
+	}
+	defer stream.Close()
+	defer stream.CancelRead(protocol.StreamCodeClosed)
+	span.SetInt("stream", int64(stream.StreamID()))
+
+	if err := proxy.WriteTarget(stream, proxy.Target{Addr: clientAddr, UDP: true}); err != nil {
+		log.Error().Err(err).Msg("Failed to write target address")
+		sendSOCKS5Error(conn, proxy.ReplyCodeForError(err))
+		return
+	}
+	respBuf := make([]byte, 1)
+	if _, err := io.ReadFull(stream, respBuf); err != nil {
+		span.SetError(err)
+		log.Error().Err(err).Msg("Failed to read server response")
+		sendSOCKS5Error(conn, proxy.ReplyGeneralFailure)
+		return
+	}
+	if respBuf[0] != proxy.ReplySuccess {
+		span.SetString("result", "refused")
+		log.Warn().Stringer("server_caps", tunnel.ServerCaps()).
+			Msg("Server refused the UDP association; it needs UDP support and --target-type direct")
+		sendSOCKS5Error(conn, proxy.ReplyCommandNotSupported)
+		return
+	}
+
+	// The relay socket listens where the application reached us
+	localIP := net.IPv4zero
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open UDP relay socket")
+		sendSOCKS5Error(conn, proxy.ReplyGeneralFailure)
+		return
+	}
+	defer relay.Close()
+
+	var response bytes.Buffer
+	response.Write([]byte{0x05, 0x00, 0x00})
+	proxy.WriteTargetAddress(&response, relay.LocalAddr().String())
+	conn.Write(response.Bytes())
+	log.Debug().Str("relay", relay.LocalAddr().String()).Msg("SOCKS5 UDP association established")
+
+	// Only the application may use the relay: datagrams are accepted from the
+	// address it announced, or from the first sender if it announced none
+	var expected *net.UDPAddr
+	if host, port, err := net.SplitHostPort(clientAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			expected = &net.UDPAddr{IP: ip}
+			if port != "0" {
+				expected, _ = net.ResolveUDPAddr("udp", clientAddr)
+			}
+		}
+	}
+	var app atomic.Pointer[net.UDPAddr]
+
+	var up, down atomic.Int64
+	upstream := &pacedWriter{w: stream, pacer: tunnel.pacer, interactive: true}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if expected != nil && (!expected.IP.Equal(from.IP) || (expected.Port != 0 && expected.Port != from.Port)) {
+				continue
+			}
+			if known := app.Load(); known == nil {
+				app.Store(from)
+			} else if !known.IP.Equal(from.IP) || known.Port != from.Port {
+				continue
+			}
+			target, payload, err := proxy.ParseUDPRequest(buf[:n])
+			if err != nil {
+				log.Debug().Err(err).Msg("Dropping SOCKS5 UDP datagram")
+				continue
+			}
+			if err := proxy.WriteDatagram(upstream, target, payload); err != nil {
+				if errors.Is(err, proxy.ErrDatagramTooLarge) {
+					continue
+				}
+				conn.Close()
+				return
+			}
+			up.Add(int64(len(payload)))
+		}
+	}()
+	go func() {
+		for {
+			source, payload, err := proxy.ReadDatagram(stream)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			to := app.Load()
+			if to == nil {
+				continue
+			}
+			packet, err := proxy.BuildUDPRequest(source, payload)
+			if err != nil {
+				continue
+			}
+			if _, err := relay.WriteToUDP(packet, to); err == nil {
+				down.Add(int64(len(payload)))
+			}
+		}
+	}()
+
+	// The application ends the association by closing the control connection
+	io.Copy(io.Discard, conn)
+	span.SetInt("bytes_up", up.Load())
+	span.SetInt("bytes_down", down.Load())
+	log.Debug().Int64("bytes_up", up.Load()).Int64("bytes_down", down.Load()).Msg("SOCKS5 UDP association closed")
+}
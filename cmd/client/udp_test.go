@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/proxy"
+)
+
+// udpEchoServer accepts plain QUIC connections and serves each UDP
+// association stream like the server would, except that every datagram is
+// answered by the tunnel itself: "echo " and the payload, sourced from the
+// destination it was sent to
+func udpEchoServer(t *testing.T) string {
+	t.Helper()
+	_, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := crypto.GetTLSConfig(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				if target, err := proxy.ParseTarget(stream); err != nil || !target.UDP {
+					stream.Write([]byte{proxy.ReplyGeneralFailure})
+					return
+				}
+				stream.Write([]byte{proxy.ReplySuccess})
+				for {
+					addr, payload, err := proxy.ReadDatagram(stream)
+					if err != nil {
+						return
+					}
+					proxy.WriteDatagram(stream, addr, append([]byte("echo "), payload...))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readReply reads one datagram from the relay and unwraps it
+func readReply(t *testing.T, app *net.UDPConn) (source, payload string) {
+	t.Helper()
+	buf := make([]byte, 65535)
+	app.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := app.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, data, err := proxy.ParseUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr, string(data)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	captureLog(t)
+	tm := &TunnelManager{conn: dialReplayServer(t, udpEchoServer(t)), pacer: &bulkPacer{}}
+	tm.connected.Store(true)
+	tunnels := NewTunnelPool(1, func() *TunnelManager { return tm })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	control, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleUDPAssociate(accepted, tunnels, "0.0.0.0:0")
+	}()
+
+	// The reply names the relay socket
+	control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(control, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[1] != proxy.ReplySuccess {
+		t.Fatalf("association refused with 0x%02x", header[1])
+	}
+	relayAddr, err := proxy.ParseTargetAddress(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	send := func(conn *net.UDPConn, payload string, frag byte) {
+		t.Helper()
+		packet, err := proxy.BuildUDPRequest("192.0.2.7:53", []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet[2] = frag
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(app, "hello", 0)
+	if source, payload := readReply(t, app); source != "192.0.2.7:53" || payload != "echo hello" {
+		t.Errorf("got %q from %s, want the echo from 192.0.2.7:53", payload, source)
+	}
+
+	// Fragments are dropped rather than sent on in pieces
+	send(app, "fragment", 1)
+	send(app, "whole", 0)
+	if _, payload := readReply(t, app); payload != "echo whole" {
+		t.Errorf("got %q, want the fragment dropped and the whole datagram echoed", payload)
+	}
+
+	// The first sender holds the relay: another socket's datagrams are dropped
+	// and nothing is sent back to it
+	intruder, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	send(intruder, "intruder", 0)
+	send(app, "again", 0)
+	if _, payload := readReply(t, app); payload != "echo again" {
+		t.Errorf("got %q, want the intruder dropped", payload)
+	}
+	intruder.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := intruder.Read(make([]byte, 1500)); err == nil {
+		t.Errorf("intruder got a %d byte datagram", n)
+	}
+
+	// Closing the control connection ends the association
+	control.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("association still open after the control connection closed")
+	}
+}
@@ -0,0 +1,40 @@
+// Command mockresolver runs the testutil recursive-resolver stub so the client
+// and server can be exercised locally: client --resolver 127.0.0.1:5300 ->
+// mockresolver -> server --dns-port 5353.
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/testutil"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:5300", "UDP address to answer queries on")
+	upstream := flag.String("upstream", "127.0.0.1:5353", "Tunnel server DNS address")
+	cacheTTL := flag.Duration("cache-ttl", 0, "Serve repeated questions from cache for this long (0 = off)")
+	maxSize := flag.Int("max-response-size", 0, "Truncate responses larger than this many bytes (0 = off)")
+	lowercase := flag.Bool("lowercase", false, "Lowercase question names (resolvers that break 0x20)")
+	dropRate := flag.Float64("drop", 0, "Drop this fraction (0-1) of queries")
+	rateLimit := flag.Int("rate-limit", 0, "Drop queries beyond this many per second (0 = unlimited)")
+	flag.Parse()
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	r := testutil.NewResolver(testutil.ResolverOptions{
+		Upstream:           *upstream,
+		CacheTTL:           *cacheTTL,
+		MaxResponseSize:    *maxSize,
+		LowercaseQuestions: *lowercase,
+		DropRate:           *dropRate,
+		RateLimit:          *rateLimit,
+	})
+	log.Info().Str("listen", *listen).Str("upstream", *upstream).Msg("Mock resolver running")
+	if err := r.ListenAndServe(*listen); err != nil {
+		log.Fatal().Err(err).Msg("Mock resolver failed")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/proxy"
+)
+
+// accessLog emits one summary line per stream when --access-log is set
+var accessLog bool
+
+// Stream outcomes reported in the access log
+const (
+	outcomeSuccess     = "success"
+	outcomeBadRequest  = "bad-request"
+	outcomeDialFailure = "dial-failure"
+	outcomeTimeout     = "timeout"
+	outcomeTLSFailure  = "tls-failure"
+	outcomeDenied      = "denied"
+)
+
+// accessRecord collects what the access log reports about one stream
+type accessRecord struct {
+	session string
+	target  string
+	start   time.Time
+	outcome string
+	up      int64
+	down    int64
+	// ending is how a successful stream broke off (proxy.Ending), empty for a clean close
+	ending string
+}
+
+func newAccessRecord(sessionID string) *accessRecord {
+	// A stream that ends before its target header parses was a bad request
+	return &accessRecord{session: sessionID, start: time.Now(), outcome: outcomeBadRequest}
+}
+
+// dialFailed records why the target could not be reached
+func (r *accessRecord) dialFailed(err error) {
+	var netErr net.Error
+	if errors.Is(err, proxy.ErrTargetNotAllowed) {
+		r.outcome = outcomeDenied
+		return
+	}
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		r.outcome = outcomeTimeout
+		return
+	}
+	r.outcome = outcomeDialFailure
+}
+
+// emit writes the access log line (no-op unless --access-log). It carries no
+// level so --log-level doesn't filter it out.
+func (r *accessRecord) emit() {
+	if !accessLog {
+		return
+	}
+	ev := log.Log().
+		Str("log", "access").
+		Str("sess", r.session).
+		Str("target", r.target).
+		Int64("bytes_up", r.up).
+		Int64("bytes_down", r.down).
+		Dur("duration", time.Since(r.start)).
+		Str("outcome", r.outcome)
+	if r.ending != "" {
+		ev = ev.Str("ending", r.ending)
+	}
+	ev.Msg("Stream closed")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/server"
+)
+
+// serveAdmin exposes GET /sessions: the state of every live session as JSON,
+// sorted by ID, for debugging stuck tunnels. Session IDs let anyone who can
+// reach the endpoint inject into a session, so bind it to localhost.
+func serveAdmin(addr string, sessions *server.SessionManager) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		snapshot := sessions.Snapshot()
+		slices.SortFunc(snapshot, func(a, b server.SessionStat) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(snapshot); err != nil {
+			log.Debug().Err(err).Msg("Failed to write session snapshot")
+		}
+	})
+
+	go func() {
+		log.Info().Str("addr", addr).Msg("Admin endpoint listening")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error().Err(err).Str("addr", addr).Msg("Admin endpoint failed")
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/server"
+)
+
+// healthState is what the --health-addr endpoints report on
+type healthState struct {
+	dnsUp      atomic.Bool // DNS listener is serving
+	quicUp     atomic.Bool // QUIC listener is accepting
+	keysLoaded bool
+	domains    int
+	sessions   *server.SessionManager
+}
+
+// serveHealth exposes /healthz (liveness: the DNS listener is up) and /readyz
+// (readiness: keys loaded, domains registered, listeners up, not draining)
+func serveHealth(addr string, st *healthState) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !st.dnsUp.Load() {
+			http.Error(w, "dns listener down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !st.keysLoaded:
+			http.Error(w, "keys not loaded", http.StatusServiceUnavailable)
+		case st.domains == 0:
+			http.Error(w, "no domains registered", http.StatusServiceUnavailable)
+		case !st.dnsUp.Load():
+			http.Error(w, "dns listener down", http.StatusServiceUnavailable)
+		case !st.quicUp.Load():
+			http.Error(w, "quic listener down", http.StatusServiceUnavailable)
+		case st.sessions.Draining():
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintf(w, "ok sessions=%d streams=%d\n", st.sessions.Count(), st.sessions.StreamCount())
+		}
+	})
+
+	go func() {
+		log.Info().Str("addr", addr).Msg("Health endpoints listening")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error().Err(err).Str("addr", addr).Msg("Health endpoint failed")
+		}
+	}()
+}
+
+// serveMetrics exposes the tunnel counters at /metrics for Prometheus
+func serveMetrics(addr string, m *server.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	go func() {
+		log.Info().Str("addr", addr).Msg("Metrics endpoint listening")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error().Err(err).Str("addr", addr).Msg("Metrics endpoint failed")
+		}
+	}()
+}
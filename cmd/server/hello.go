@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/server"
+)
+
+// serverCaps is what the server advertises in the capability hello; main
+// clears the bits its flags turn off
+var serverCaps = protocol.CapNack | protocol.CapSizeHint | protocol.CapLongPoll | protocol.CapTargetSNI | protocol.CapDeferStatus | protocol.CapARecords | protocol.CapCNAME | protocol.CapUDP | protocol.CapFEC | protocol.CapCompress | protocol.CapReplyCodes | protocol.CapSequence | protocol.CapNULL | protocol.CapRawBase64 | protocol.CapTXTMulti | protocol.CapCredit
+
+// helloTimeout bounds how long a hello stream may take to deliver its body
+const helloTimeout = 30 * time.Second
+
+// answerHello completes the capability exchange on a stream that opened with
+// protocol.HelloMarker. A client asking for CapFEC, CapCompress, CapSequence,
+// CapRawBase64 or CapTXTMulti gets FEC, compression, numbered packets,
+// base64url or multi-string TXT answers downstream on sess (nil when the
+// session is already gone), and one asking for CapCredit has its downstream
+// held to the credit it acknowledges unless --downstream-credit is 0.
+func answerHello(stream *quic.Stream, sess *server.Session, sessionID string) {
+	stream.SetReadDeadline(time.Now().Add(helloTimeout))
+	client, err := protocol.ReadHello(stream)
+	if err != nil {
+		log.Debug().Err(err).Str("sess", sessionID).Msg("Failed to read capability hello")
+		return
+	}
+	if sess != nil && client.Caps.Has(protocol.CapFEC) {
+		sess.EnableFEC()
+	}
+	if sess != nil && client.Caps.Has(protocol.CapCompress) {
+		sess.EnableCompression()
+	}
+	if sess != nil && client.Caps.Has(protocol.CapSequence) {
+		sess.EnableSequence()
+	}
+	if sess != nil && client.Caps.Has(protocol.CapRawBase64) {
+		sess.EnableRawBase64()
+	}
+	if sess != nil && client.Caps.Has(protocol.CapTXTMulti) {
+		sess.EnableTXTMulti()
+	}
+	if sess != nil && client.Caps.Has(protocol.CapCredit) && serverCaps.Has(protocol.CapCredit) {
+		sess.EnableCredit()
+	}
+	if err := protocol.WriteHelloReply(stream, protocol.Hello{Version: protocol.ProtocolVersion, Caps: serverCaps}); err != nil {
+		log.Debug().Err(err).Str("sess", sessionID).Msg("Failed to answer capability hello")
+		return
+	}
+
+	ev := log.Debug()
+	if client.Version != protocol.ProtocolVersion {
+		ev = log.Info()
+	}
+	ev.Str("sess", sessionID).Uint8("client_version", client.Version).Uint8("server_version", protocol.ProtocolVersion).
+		Stringer("client_caps", client.Caps).Stringer("missing", serverCaps.Missing(client.Caps)).Msg("Client capabilities")
+}
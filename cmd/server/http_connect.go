@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"slipstream-go/internal/proxy"
+)
+
+// httpConnectTimeout bounds the CONNECT exchange with the upstream proxy
+const httpConnectTimeout = 15 * time.Second
+
+// httpConnectDialer reaches targets through an HTTP proxy's CONNECT method
+// (--target-type http-connect)
+type httpConnectDialer struct {
+	proxyAddr string
+	// auth is the Proxy-Authorization value, empty without credentials
+	auth string
+}
+
+// newHTTPConnectDialer takes the proxy as http://[user:pass@]host:port
+func newHTTPConnectDialer(proxyURL string) (*httpConnectDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("HTTP proxy must be given as http://host:port, got %q", proxyURL)
+	}
+	d := &httpConnectDialer{proxyAddr: u.Host}
+	if u.Port() == "" {
+		d.proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, proxy.ErrUnsupportedNetwork
+	}
+	conn, err := net.Dial("tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("http connect: connect to proxy: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(httpConnectTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http connect: send request: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http connect: read response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http connect: proxy answered %s: %w", resp.Status, &proxy.ReplyError{Code: connectReplyCode(resp.StatusCode)})
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// connectReplyCode maps a failed CONNECT's status to the SOCKS5 reply code
+// the client gets (see proxy.ReplyCodeForError)
+func connectReplyCode(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return proxy.ReplyConnectionNotAllowed
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return proxy.ReplyHostUnreachable
+	default:
+		return proxy.ReplyGeneralFailure
+	}
+}
+
+// bufferedConn reads through the reader that parsed the CONNECT response,
+// which may already hold the target's first bytes
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the proxy connection, see proxy.CloseWrite
+func (c *bufferedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"slipstream-go/internal/proxy"
+)
+
+// connectProxy is a fake HTTP proxy on loopback. It answers every CONNECT
+// with status, sending the requests it got on requests; on 200 it writes
+// early in the same segment as the response head, as if the target had
+// spoken first, and echoes whatever follows.
+func connectProxy(t *testing.T, status int, early string) (string, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan *http.Request, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				requests <- req
+				head := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n\r\n"
+				if status != http.StatusOK {
+					conn.Write([]byte(head))
+					return
+				}
+				conn.Write([]byte(head + early))
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+	return ln.Addr().String(), requests
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	addr, requests := connectProxy(t, http.StatusOK, "banner")
+	d, err := newHTTPConnectDialer("http://user:p%40ss@" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.RequestURI != "example.com:443" || req.Host != "example.com:443" {
+		t.Errorf("request %s %s (Host %s), want CONNECT example.com:443", req.Method, req.RequestURI, req.Host)
+	}
+	if got, want := req.Header.Get("Proxy-Authorization"), "Basic "+base64.StdEncoding.EncodeToString([]byte("user:p@ss")); got != want {
+		t.Errorf("Proxy-Authorization %q, want %q", got, want)
+	}
+
+	// Bytes that came in with the response head are read first, then the tunnel
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	banner := make([]byte, len("banner"))
+	if _, err := io.ReadFull(conn, banner); err != nil || string(banner) != "banner" {
+		t.Fatalf("read %q, %v, want the buffered banner", banner, err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	if echoed, err := io.ReadAll(conn); err != nil || string(echoed) != "ping" {
+		t.Errorf("echoed %q, %v", echoed, err)
+	}
+
+	// Without credentials no Proxy-Authorization is sent
+	d, err = newHTTPConnectDialer("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if req := <-requests; req.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("Proxy-Authorization %q sent without credentials", req.Header.Get("Proxy-Authorization"))
+	}
+
+	if _, err := d.Dial("udp", "example.com:53"); !errors.Is(err, proxy.ErrUnsupportedNetwork) {
+		t.Errorf("UDP: got %v, want ErrUnsupportedNetwork", err)
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		code   byte
+	}{
+		{http.StatusForbidden, proxy.ReplyConnectionNotAllowed},
+		{http.StatusProxyAuthRequired, proxy.ReplyConnectionNotAllowed},
+		{http.StatusBadGateway, proxy.ReplyHostUnreachable},
+		{http.StatusGatewayTimeout, proxy.ReplyHostUnreachable},
+		{http.StatusServiceUnavailable, proxy.ReplyGeneralFailure},
+	} {
+		addr, _ := connectProxy(t, tt.status, "")
+		d, err := newHTTPConnectDialer("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.Dial("tcp", "example.com:443")
+		var replyErr *proxy.ReplyError
+		if !errors.As(err, &replyErr) || replyErr.Code != tt.code {
+			t.Errorf("status %d: got %v, want reply code 0x%02x", tt.status, err, tt.code)
+		}
+		if code := proxy.ReplyCodeForError(err); code != tt.code {
+			t.Errorf("status %d: client gets 0x%02x, want 0x%02x", tt.status, code, tt.code)
+		}
+	}
+}
+
+func TestNewHTTPConnectDialer(t *testing.T) {
+	d, err := newHTTPConnectDialer("http://proxy.example")
+	if err != nil || d.proxyAddr != "proxy.example:80" || d.auth != "" {
+		t.Errorf("got %+v, %v, want proxy.example:80 without credentials", d, err)
+	}
+	for _, bad := range []string{"https://proxy.example:443", "socks5://proxy.example:1080", "http://"} {
+		if _, err := newHTTPConnectDialer(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
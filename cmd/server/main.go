@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
@@ -18,11 +25,28 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"slipstream-go/internal/config"
 	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/profile"
+	"slipstream-go/internal/protocol"
 	"slipstream-go/internal/proxy"
 	"slipstream-go/internal/server"
+	"slipstream-go/internal/telemetry"
 )
 
+// tracer exports stream lifecycle spans when --otel-endpoint is set (nil = disabled)
+var tracer *telemetry.Tracer
+
+// maxStreamsPerSession caps the streams one session may have open (0 = unlimited)
+var maxStreamsPerSession int
+
+// streamIdleTimeout tears down streams that moved no data for this long (0 = never)
+var streamIdleTimeout time.Duration
+
+// targetPolicy restricts the destinations streams may reach (nil = any); a
+// SIGHUP reload swaps it
+var targetPolicy atomic.Pointer[server.TargetPolicy]
+
 // randomPacketSize returns a random packet size between min and max bytes
 func randomPacketSize(minSize, maxSize uint16) uint16 {
 	if minSize >= maxSize {
@@ -46,24 +70,109 @@ func (s *stringSlice) Set(value string) error {
 	return nil
 }
 
+// parseRecordTypes parses --downstream-record into the set of query types
+// answered in kind; TXT is always included
+func parseRecordTypes(list string) (map[uint16]bool, error) {
+	types := map[uint16]bool{dns.TypeTXT: true}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		qtype, err := protocol.ParseRecordType(name)
+		if err != nil {
+			return nil, err
+		}
+		types[qtype] = true
+	}
+	return types, nil
+}
+
 func main() {
 	// CLI Flags
 	var domains stringSlice
 	flag.Var(&domains, "domain", "Allowed tunnel domain (can be specified multiple times)")
-	dnsPort := flag.Int("dns-port", 5353, "DNS server port")
-	targetType := flag.String("target-type", "direct", "Target type: direct or socks5")
-	target := flag.String("target", "", "Upstream SOCKS5 address (required if target-type=socks5)")
+	dnsPort := flag.Int("dns-port", 5353, "DNS server port (UDP, and TCP for truncated answers)")
+	var allowSources, denySources stringSlice
+	flag.Var(&allowSources, "allow-source", "Only serve queries from this IP/CIDR (repeatable; the recursive resolver's IPs when behind one)")
+	flag.Var(&denySources, "deny-source", "Never serve queries from this IP/CIDR (repeatable)")
+	targetType := flag.String("target-type", "direct", "Target type: direct, socks5 or http-connect")
+	target := flag.String("target", "", "Upstream SOCKS5 address, or HTTP proxy as http://[user:pass@]host:port (required unless target-type=direct)")
+	targetPolicyFile := flag.String("target-policy", "", "File of allowed/denied target CIDRs, domains and ports (see README)")
+	allowPrivateTargets := flag.Bool("allow-private-targets", false, "Let direct targets be loopback, private, link-local or multicast addresses (the server's own network)")
+	targetFamily := flag.String("target-family", familyAuto, "Address family for direct targets: auto, ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
 	privkeyFile := flag.String("privkey-file", "", "Ed25519 private key file")
+	var domainKeyList stringSlice
+	flag.Var(&domainKeyList, "domain-key", "Per-domain key as DOMAIN=PRIVKEY-FILE (repeatable; registers the domain, overrides --privkey-file for it)")
+	psk := flag.String("psk", "", "Pre-shared key clients must prove to open a session (empty = open)")
+	clientKeysFile := flag.String("client-keys", "", "File of per-client pre-shared keys, one NAME KEY per line; clients prove theirs with --psk (empty = open)")
 	pubkeyFile := flag.String("pubkey-file", "", "Public key output file (with --gen-key)")
 	genKey := flag.Bool("gen-key", false, "Generate keys and exit")
+	writeManifest := flag.String("write-manifest", "", "Write a fingerprint manifest signed with --privkey-file for the first --domain to this file and exit")
+	manifestValidity := flag.Duration("manifest-validity", 30*24*time.Hour, "Validity period of a manifest written with --write-manifest")
+	var manifestExtra stringSlice
+	flag.Var(&manifestExtra, "manifest-fingerprint", "Additional fingerprint to publish in the manifest, e.g. the next key during a rotation (repeatable)")
+	healthAddr := flag.String("health-addr", "", "Serve /healthz and /readyz on this address (e.g. 127.0.0.1:8080; empty = off)")
+	adminAddr := flag.String("admin-addr", "", "Serve live session state as JSON at /sessions on this address (e.g. 127.0.0.1:8081; empty = off)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at /metrics on this address (e.g. 127.0.0.1:9100; empty = off)")
+	flag.BoolVar(&accessLog, "access-log", false, "Log one line per stream: session, target, bytes up/down, duration and outcome")
+	captureFile := flag.String("capture-file", "", "Write every tunnel fragment (direction, time, session, packet ID, seq) to this file as JSON lines")
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/HTTP collector URL for stream traces (e.g. http://localhost:4318)")
+	flag.IntVar(&maxStreamsPerSession, "max-streams-per-session", 256, "Refuse new streams while a session has this many open (0 = unlimited)")
+	sessionTTL := flag.Duration("session-ttl", server.SessionTTL, "Forget a session, and close its connection, after no query arrived for it this long")
+	reassemblyTimeout := flag.Duration("reassembly-timeout", protocol.ReassemblyTimeout, "Give up on an upstream packet still missing fragments after this long")
+	maxSessions := flag.Int("max-sessions", 0, "Refuse queries for new sessions while this many are live (0 = unlimited)")
+	flag.DurationVar(&streamIdleTimeout, "stream-idle-timeout", 0, "Tear down tunneled connections that moved no data either way for this long (0 = never)")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "Max time to wait for sessions to finish after SIGUSR1")
+	shutdownGrace := flag.Duration("shutdown-grace", 10*time.Second, "On SIGTERM or SIGINT, close every connection and exit once clients have polled their last data or this expires")
+	validate := flag.Bool("validate", false, "Check configuration and keys without listening, then exit")
 	logLevel := flag.String("log-level", "info", "Log level: debug/info/warn/error")
 	memoryLimit := flag.Int("memory-limit", 400, "Memory limit in MB")
-	maxFrags := flag.Int("max-frags", 6, "Max fragments per DNS response (1-20, default 6 with EDNS0)")
+	maxFrags := flag.Int("max-frags", 6, "Max fragments per DNS response (1-23, default 6 with EDNS0; responses larger than the resolver allows carry fewer)")
+	maxQPSPerSession := flag.Int("max-qps-per-session", 1000, "Refuse a session's queries beyond this many per second, with a second's worth of burst (0 = unlimited)")
+	maxQPSPerIP := flag.Int("max-qps-per-ip", 0, "Refuse a source IP's queries beyond this many per second; a recursive resolver's IP carries all of its clients, so size it for them (0 = unlimited)")
+	dropRejected := flag.Bool("drop-rejected", false, "Silently drop rejected queries (unregistered domains, disallowed sources, rate limits, bad tokens) instead of answering REFUSED")
+	framedUpstream := flag.Bool("framed-upstream", false, "Split every reassembled upstream payload into its [len:2]-framed packets (only for clients that coalesce packets)")
+	padResponses := flag.Bool("pad-responses", false, "Pad EDNS0 responses to 468-byte blocks to hide payload size")
+	maxPollHold := flag.Duration("max-poll-hold", protocol.MaxLongPollHold, "Longest a client long poll is held waiting for downstream data (0 = answer polls at once)")
+	responseHold := flag.Duration("response-hold", 0, "Hold queries that find no downstream data for up to this long before answering empty (max 900ms, 0 = answer at once)")
+	streamWindow := flag.Int("stream-window", proxy.DefaultStreamWindow/1024, "KB of downstream data a session may have queued before streams pause reading from targets (0 = unbounded)")
 	minPacketSize := flag.Int("min-packet-size", 512, "Minimum QUIC packet size in bytes (512-1200)")
 	maxPacketSize := flag.Int("max-packet-size", 768, "Maximum QUIC packet size in bytes (512-1200)")
+	profileName := flag.String("profile", profile.DefaultName, "Tuning preset: "+strings.Join(profile.Names(), ", ")+" (individual flags override it)")
+	configFile := flag.String("config", "", "Read flag values from this JSON file (command-line flags override it, it overrides --profile); SIGHUP reloads the domains, --max-frags, rate limits and target policy")
+	alpn := flag.String("alpn", "slipstream", "QUIC ALPN protocol (must match clients)")
+	downstreamRecords := flag.String("downstream-record", "txt,a,cname", "Comma-separated record types downstream data may be sent in, as clients ask with --record-type: txt, a, cname, null (txt is always on)")
+	redundancyThreshold := flag.Int("redundancy-threshold", protocol.DefaultRedundancyThreshold, "Queue QUIC packets at least this large twice (0 = never)")
+	compress := flag.Bool("compress", true, "Compress downstream packets that shrink for clients that ask for compression")
+	fecRatio := flag.Float64("fec-ratio", 0.25, "Reed-Solomon parity fragments per data fragment (rounded up) on downstream packets of clients that ask for FEC (0 = never, at most 1)")
+	downstreamQueue := flag.Int("downstream-queue", 256, "Hold QUIC back while a session has this many downstream fragments waiting for a poll, so streams share the channel in turns instead of queueing behind a bulk transfer (0 = off)")
+	downstreamCredit := flag.Int("downstream-credit", protocol.DefaultCreditWindow, "Queued and unacknowledged downstream fragments per session of clients that report what they received; QUIC waits for room instead of overflowing the queue (0 = off)")
+	udpReadBuffer := flag.Int("udp-read-buffer", protocol.DefaultReadBuffer/1024, "DNS server UDP socket read buffer in KB (0 = OS default)")
+	udpWriteBuffer := flag.Int("udp-write-buffer", 0, "DNS server UDP socket write buffer in KB (0 = OS default)")
 
 	flag.Parse()
 
+	// Fill in flags from the config file, then every flag the profile covers
+	// that neither set
+	explicit := config.Explicit(flag.CommandLine)
+	cmdDomains := slices.Clone(domains)
+	if *configFile != "" {
+		file, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load --config")
+		}
+		if err := file.Apply(flag.CommandLine, explicit); err != nil {
+			log.Fatal().Err(err).Msg("Invalid --config")
+		}
+	}
+	prof, err := profile.Lookup(*profileName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --profile")
+	}
+	if err := prof.Apply(flag.CommandLine); err != nil {
+		log.Fatal().Err(err).Msg("Failed to apply profile")
+	}
+
 	// Setup logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -83,6 +192,7 @@ func main() {
 
 	// Set memory limit
 	debug.SetMemoryLimit(int64(*memoryLimit) * 1024 * 1024)
+	log.Info().Str("profile", prof.Name).Msg("Using tuning profile")
 
 	// Handle key generation
 	if *genKey {
@@ -114,43 +224,235 @@ func main() {
 		os.Exit(0)
 	}
 
+	domainKeys, err := parseDomainKeys(domainKeyList)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --domain-key")
+	}
+	// Domains with their own key are registered even if not listed with --domain
+	for domain := range domainKeys {
+		listed := false
+		for _, d := range domains {
+			if normalizeDomain(d) == domain {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			domains = append(domains, domain)
+		}
+	}
+	// --privkey-file is only needed for domains without their own key
+	needDefaultKey := false
+	for _, d := range domains {
+		if _, ok := domainKeys[normalizeDomain(d)]; !ok {
+			needDefaultKey = true
+		}
+	}
+
+	// Handle manifest signing
+	if *writeManifest != "" {
+		if *privkeyFile == "" || len(domains) == 0 {
+			log.Fatal().Msg("--privkey-file and --domain are required with --write-manifest")
+		}
+		privKey, err := crypto.LoadPrivateKey(*privkeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load private key")
+		}
+		now := time.Now()
+		manifest := crypto.Manifest{
+			Domain:       normalizeDomain(domains[0]),
+			Fingerprints: append([]string{crypto.PublicKeyFingerprint(crypto.PublicKeyOf(privKey))}, manifestExtra...),
+			NotBefore:    now.Add(-5 * time.Minute), // tolerate client clock skew
+			NotAfter:     now.Add(*manifestValidity),
+		}
+		data, err := crypto.SignManifest(manifest, crypto.SignerFromPrivateKey(privKey))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to sign manifest")
+		}
+		if err := os.WriteFile(*writeManifest, data, 0o644); err != nil {
+			log.Fatal().Err(err).Msg("Failed to write manifest")
+		}
+		log.Info().Str("path", *writeManifest).Str("domain", manifest.Domain).Strs("fingerprints", manifest.Fingerprints).
+			Time("expires", manifest.NotAfter).Msg("Signed manifest written")
+		os.Exit(0)
+	}
+
+	// Handle dry-run validation
+	if *validate {
+		runValidate(validateOptions{
+			Domains:       domains,
+			DomainKeys:    domainKeys,
+			AllowSources:  allowSources,
+			DenySources:   denySources,
+			DNSPort:       *dnsPort,
+			TargetType:    *targetType,
+			Target:        *target,
+			TargetPolicy:  *targetPolicyFile,
+			PrivkeyFile:   *privkeyFile,
+			ClientKeys:    *clientKeysFile,
+			MaxFrags:      *maxFrags,
+			MinPacketSize: *minPacketSize,
+			MaxPacketSize: *maxPacketSize,
+
+			SessionTTL:           *sessionTTL,
+			ReassemblyTimeout:    *reassemblyTimeout,
+			MaxSessions:          *maxSessions,
+			MaxStreamsPerSession: maxStreamsPerSession,
+			StreamIdleTimeout:    streamIdleTimeout,
+			StreamWindow:         *streamWindow,
+			MaxQPSPerSession:     *maxQPSPerSession,
+			MaxQPSPerIP:          *maxQPSPerIP,
+
+			ALPN:                *alpn,
+			TargetFamily:        *targetFamily,
+			DownstreamRecords:   *downstreamRecords,
+			ResponseHold:        *responseHold,
+			MaxPollHold:         *maxPollHold,
+			RedundancyThreshold: *redundancyThreshold,
+			FECRatio:            *fecRatio,
+			DownstreamCredit:    *downstreamCredit,
+			DownstreamQueue:     *downstreamQueue,
+			UDPReadBuffer:       *udpReadBuffer,
+			UDPWriteBuffer:      *udpWriteBuffer,
+		})
+	}
+
 	// Validate required flags
 	if len(domains) == 0 {
 		log.Fatal().Msg("At least one --domain is required")
 	}
-	if *privkeyFile == "" {
-		log.Fatal().Msg("--privkey-file is required")
+	if *privkeyFile == "" && needDefaultKey {
+		log.Fatal().Msg("--privkey-file is required (or a --domain-key for every domain)")
 	}
-	if *targetType == "socks5" && *target == "" {
-		log.Fatal().Msg("--target is required when --target-type=socks5")
+	if *targetType != "direct" && *targetType != "socks5" && *targetType != "http-connect" {
+		log.Fatal().Str("target_type", *targetType).Msg("--target-type must be direct, socks5 or http-connect")
+	}
+	if *targetType != "direct" && *target == "" {
+		log.Fatal().Str("target_type", *targetType).Msg("--target is required unless --target-type=direct")
+	}
+	if *udpReadBuffer < 0 || *udpWriteBuffer < 0 {
+		log.Fatal().Msg("--udp-read-buffer and --udp-write-buffer cannot be negative")
+	}
+	if *streamWindow < 0 {
+		log.Fatal().Msg("--stream-window cannot be negative")
+	}
+	if streamIdleTimeout < 0 {
+		log.Fatal().Msg("--stream-idle-timeout cannot be negative")
+	}
+	if *responseHold < 0 || *responseHold > server.MaxResponseHold {
+		log.Fatal().Dur("hold", *responseHold).Msg("--response-hold must be between 0 and 900ms, resolvers retry unanswered queries after about a second")
+	}
+	if maxStreamsPerSession < 0 {
+		log.Fatal().Msg("--max-streams-per-session cannot be negative")
+	}
+	if *sessionTTL <= 0 {
+		log.Fatal().Msg("--session-ttl must be positive")
+	}
+	if *reassemblyTimeout <= 0 {
+		log.Fatal().Msg("--reassembly-timeout must be positive")
+	}
+	if *maxSessions < 0 {
+		log.Fatal().Msg("--max-sessions cannot be negative")
+	}
+	if *maxPollHold < 0 {
+		log.Fatal().Msg("--max-poll-hold cannot be negative")
+	}
+	recordTypes, err := parseRecordTypes(*downstreamRecords)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid --downstream-record")
+	}
+	switch *targetFamily {
+	case familyAuto, familyIPv4, familyIPv6, familyPreferIPv4, familyPreferIPv6:
+	default:
+		log.Fatal().Str("family", *targetFamily).Msg("--target-family must be auto, ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
 	}
 
 	// Build allowed domains set (normalize to lowercase)
 	allowedDomains := make(map[string]bool)
 	for _, d := range domains {
-		normalized := strings.ToLower(strings.TrimSuffix(d, "."))
+		normalized := normalizeDomain(d)
 		allowedDomains[normalized] = true
 		log.Info().Str("domain", normalized).Msg("Registered allowed domain")
+		if recordTypes[dns.TypeCNAME] && len(normalized) > protocol.MaxCNAMEDomainLen {
+			log.Warn().Str("domain", normalized).Int("max", protocol.MaxCNAMEDomainLen).Msg("Domain too long for CNAME downstream, its CNAME queries get TXT answers")
+		}
 	}
 
-	// Load private key
-	privKey, err := crypto.LoadPrivateKey(*privkeyFile)
+	// Load the target policy
+	if *targetPolicyFile != "" {
+		policy, err := server.LoadTargetPolicy(*targetPolicyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --target-policy")
+		}
+		targetPolicy.Store(policy)
+		log.Info().Str("file", *targetPolicyFile).Msg("Target policy enabled")
+		if *targetType != "direct" && policy.HasAddressRules() {
+			log.Warn().Str("type", *targetType).Msg("The upstream proxy resolves target names, CIDR rules only see targets given as IPs")
+		}
+	}
+
+	// Build source IP filter
+	sourceFilter, err := server.NewSourceFilter(allowSources, denySources)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load private key")
+		log.Fatal().Err(err).Msg("Invalid --allow-source/--deny-source")
+	}
+	if !sourceFilter.Empty() {
+		log.Info().Strs("allow", allowSources).Strs("deny", denySources).Msg("Source IP filter enabled")
 	}
-	log.Info().Msg("Private key loaded")
 
-	// Create TLS config
-	tlsConfig, err := crypto.GetTLSConfig(privKey)
+	// Create session manager; a session that expires under a live connection
+	// takes the connection down with it, ending handleQUICConnection
+	sessionMgr := server.NewSessionManagerWithOptions(server.SessionOptions{TTL: *sessionTTL, MaxSessions: *maxSessions, ReassemblyTimeout: *reassemblyTimeout})
+	sessionMgr.OnExpire = closeExpired
+
+	// Load keys: the default key plus any per-domain (tenant) keys. The
+	// certificate is picked per handshake from the domain the session uses;
+	// SIGHUP re-reads the key files and rotates changed keys in place.
+	keys, err := loadServerKeys(*privkeyFile, domainKeys)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create TLS config")
+		log.Fatal().Err(err).Msg("Failed to load private key")
+	}
+	certSelector, err := newCertSelector(sessionMgr, keys)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create TLS certificate")
+	}
+	if certSelector.Default != nil {
+		log.Info().Str("fingerprint", certSelector.Default.Fingerprint()).Msg("Private key loaded")
+	}
+	for domain, certs := range certSelector.ByDomain {
+		log.Info().Str("domain", domain).Str("fingerprint", certs.Fingerprint()).Msg("Loaded per-domain key")
 	}
 
-	// Create session manager
-	sessionMgr := server.NewSessionManager()
+	// Create TLS config
+	tlsConfig := crypto.GetSelectingTLSConfig(certSelector.GetCertificate)
+	if *alpn == "" {
+		log.Fatal().Msg("--alpn cannot be empty")
+	}
+	tlsConfig.NextProtos = []string{*alpn}
 
 	// Create virtual connection (bridges DNS <-> QUIC)
 	virtualConn := server.NewVirtualConn(sessionMgr)
+	if *redundancyThreshold < 0 {
+		log.Fatal().Msg("--redundancy-threshold cannot be negative")
+	}
+	// The flag's "never" is 0, the conn's is negative
+	virtualConn.RedundancyThreshold = *redundancyThreshold
+	if virtualConn.RedundancyThreshold == 0 {
+		virtualConn.RedundancyThreshold = -1
+	}
+	if *fecRatio < 0 || *fecRatio > protocol.MaxFECRatio {
+		log.Fatal().Float64("fec_ratio", *fecRatio).Msg("--fec-ratio must be between 0 and 1")
+	}
+	virtualConn.FECRatio = *fecRatio
+	virtualConn.Compress = *compress
+	if *downstreamCredit < 0 {
+		log.Fatal().Msg("--downstream-credit cannot be negative")
+	}
+	virtualConn.CreditWindow = *downstreamCredit
+	if *downstreamQueue < 0 {
+		log.Fatal().Msg("--downstream-queue cannot be negative")
+	}
+	virtualConn.MaxBacklog = *downstreamQueue
 
 	// Create DNS handler with allowed domains
 	dnsHandler := &server.DNSHandler{
@@ -158,23 +460,137 @@ func main() {
 		Injector:            virtualConn,
 		AllowedDomains:      allowedDomains,
 		MaxFragsPerResponse: *maxFrags,
+		DropRejected:        *dropRejected,
+		Framed:              *framedUpstream,
+		Sources:             sourceFilter,
+		MaxPollHold:         *maxPollHold,
+		ResponseHold:        *responseHold,
+		RecordTypes:         recordTypes,
+		IdentityKey:         certSelector.IdentityKey,
+	}
+	if !recordTypes[dns.TypeA] {
+		serverCaps &^= protocol.CapARecords
+	}
+	if !recordTypes[dns.TypeCNAME] {
+		serverCaps &^= protocol.CapCNAME
+	}
+	if !recordTypes[dns.TypeNULL] {
+		serverCaps &^= protocol.CapNULL
+	}
+	if *downstreamCredit == 0 {
+		serverCaps &^= protocol.CapCredit
+	}
+	if *maxPollHold == 0 {
+		// Polls are answered at once: tell long-polling clients so in the hello
+		serverCaps &^= protocol.CapLongPoll
+	}
+	if *metricsAddr != "" {
+		metrics := &server.Metrics{Sessions: sessionMgr}
+		sessionMgr.Metrics = metrics
+		virtualConn.Metrics = metrics
+		dnsHandler.Metrics = metrics
+		serveMetrics(*metricsAddr, metrics)
+	}
+	if *adminAddr != "" {
+		serveAdmin(*adminAddr, sessionMgr)
+	}
+	if *psk != "" {
+		dnsHandler.PSK = []byte(*psk)
+		log.Info().Msg("Client authentication enabled (PSK)")
+	}
+	if *maxQPSPerSession < 0 || *maxQPSPerIP < 0 {
+		log.Fatal().Msg("--max-qps-per-session and --max-qps-per-ip cannot be negative")
+	}
+	dnsHandler.SessionLimiter = server.NewRateLimiter(*maxQPSPerSession)
+	dnsHandler.SourceLimiter = server.NewRateLimiter(*maxQPSPerIP)
+	if *clientKeysFile != "" {
+		clientKeys, err := server.LoadClientKeys(*clientKeysFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load client keys")
+		}
+		dnsHandler.ClientKeys = clientKeys
+		log.Info().Int("clients", clientKeys.Len()).Msg("Client authentication enabled (client keys)")
+	}
+	(&reloader{
+		configFile:     *configFile,
+		flags:          flag.CommandLine,
+		explicit:       explicit,
+		cmdDomains:     cmdDomains,
+		domainKeys:     domainKeys,
+		privkeyFile:    *privkeyFile,
+		certs:          certSelector,
+		clientKeysFile: *clientKeysFile,
+		clientKeys:     dnsHandler.ClientKeys,
+		profile:        prof,
+		handler:        dnsHandler,
+		targetType:     *targetType,
+	}).watch()
+	if *padResponses {
+		dnsHandler.PadBlockSize = server.ResponsePadBlockSize
+	}
+	if *captureFile != "" {
+		capture, err := protocol.NewCapture(*captureFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", *captureFile).Msg("Failed to open capture file")
+		}
+		defer capture.Close()
+		dnsHandler.Capture = capture
+		log.Warn().Str("path", *captureFile).Msg("Capturing tunnel fragments")
 	}
 
-	// Start DNS server
+	// Start DNS server on a socket we own so its buffers can be tuned
 	dnsAddr := fmt.Sprintf(":%d", *dnsPort)
+	udpAddr, err := net.ResolveUDPAddr("udp", dnsAddr)
+	if err != nil {
+		log.Fatal().Err(err).Str("addr", dnsAddr).Msg("Invalid DNS listen address")
+	}
+	dnsSocket, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		log.Fatal().Err(err).Str("addr", dnsAddr).Msg("Failed to open DNS socket")
+	}
+	protocol.SetUDPBuffers(dnsSocket, *udpReadBuffer*1024, *udpWriteBuffer*1024, log.Logger)
+
+	health := &healthState{
+		keysLoaded: certSelector.Default != nil || len(certSelector.ByDomain) > 0,
+		domains:    len(allowedDomains),
+		sessions:   sessionMgr,
+	}
+	if *healthAddr != "" {
+		serveHealth(*healthAddr, health)
+	}
+
 	dnsServer := &dns.Server{
-		Addr:    dnsAddr,
-		Net:     "udp",
-		Handler: dns.HandlerFunc(dnsHandler.HandleDNS),
+		PacketConn:        dnsSocket,
+		Handler:           dns.HandlerFunc(dnsHandler.HandleDNS),
+		NotifyStartedFunc: func() { health.dnsUp.Store(true) },
 	}
 
 	go func() {
 		log.Info().Str("addr", dnsAddr).Int("domains", len(allowedDomains)).Msg("Starting DNS server")
-		if err := dnsServer.ListenAndServe(); err != nil {
+		err := dnsServer.ActivateAndServe()
+		health.dnsUp.Store(false)
+		if err != nil {
 			log.Fatal().Err(err).Msg("DNS server failed")
 		}
 	}()
 
+	// DNS over TCP on the same port, for clients and resolvers fetching
+	// truncated answers again (RFC 7766); UDP keeps working without it
+	var dnsTCPServer *dns.Server
+	if dnsListener, err := net.Listen("tcp", dnsAddr); err != nil {
+		log.Warn().Err(err).Str("addr", dnsAddr).Msg("Failed to open DNS TCP listener, truncated answers can't be fetched over TCP")
+	} else {
+		dnsTCPServer = &dns.Server{
+			Listener: dnsListener,
+			Handler:  dns.HandlerFunc(dnsHandler.HandleDNS),
+		}
+		go func() {
+			if err := dnsTCPServer.ActivateAndServe(); err != nil {
+				log.Error().Err(err).Msg("DNS TCP server failed")
+			}
+		}()
+	}
+
 	// Create Transport with address validation to force Retry packets
 	// This bypasses the 3x amplification limit that causes handshake deadlock
 	// when certificate chain exceeds 3600 bytes and ACKs get lost in DNS tunnel
@@ -214,39 +630,272 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to create QUIC listener")
 	}
 	log.Info().Msg("QUIC listener started on virtual connection")
+	health.quicUp.Store(true)
 
 	// Setup dialer based on target type
 	var dialer Dialer
-	if *targetType == "socks5" {
+	switch *targetType {
+	case "socks5":
 		dialer = &socks5Dialer{proxy: proxy.NewSOCKS5Dialer(*target)}
 		log.Info().Str("proxy", *target).Msg("Using SOCKS5 upstream")
-	} else {
-		dialer = &directDialer{}
-		log.Info().Msg("Using direct connections")
+		// UDP associations are only relayed directly
+		serverCaps &^= protocol.CapUDP
+	case "http-connect":
+		httpDialer, err := newHTTPConnectDialer(*target)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --target")
+		}
+		dialer = httpDialer
+		log.Info().Str("proxy", httpDialer.proxyAddr).Bool("auth", httpDialer.auth != "").Msg("Using HTTP CONNECT upstream")
+		serverCaps &^= protocol.CapUDP
+	default:
+		dialer = &directDialer{family: *targetFamily, allowPrivate: *allowPrivateTargets}
+		log.Info().Str("family", *targetFamily).Bool("private_targets", *allowPrivateTargets).Msg("Using direct connections")
 	}
 
+	// Optional tracing of stream lifecycles
+	tracer = telemetry.NewTracer(*otelEndpoint, "slipstream-server", log.Logger)
+	if tracer != nil {
+		log.Info().Str("endpoint", *otelEndpoint).Msg("Exporting stream traces via OTLP")
+	}
+
+	// Drain on signal: refuse new sessions, stop accepting, exit once existing ones finish
+	if len(drainSignals) > 0 {
+		drainCh := make(chan os.Signal, 1)
+		signal.Notify(drainCh, drainSignals...)
+		go func() {
+			<-drainCh
+			log.Warn().Int("sessions", sessionMgr.Count()).Dur("timeout", *drainTimeout).Msg("Draining: refusing new sessions")
+			sessionMgr.StartDraining()
+			health.quicUp.Store(false)
+			quicListener.Close()
+		}()
+	}
+
+	// Shut down on SIGTERM/SIGINT: refuse new sessions, close every connection
+	// with CloseCodeShutdown so clients reconnect at once, and keep answering
+	// polls until the CONNECTION_CLOSE and other queued fragments are picked up
+	var conns sync.Map // *quic.Conn of every open connection
+	shutdownDone := make(chan struct{})
+	var shuttingDown atomic.Bool
+	shutdownCh := make(chan os.Signal, 1)
+	signal.Notify(shutdownCh, shutdownSignals...)
+	go func() {
+		<-shutdownCh
+		shuttingDown.Store(true)
+		log.Warn().Int("sessions", sessionMgr.Count()).Dur("grace", *shutdownGrace).Msg("Shutting down: closing connections")
+		deadline := time.Now().Add(*shutdownGrace)
+		sessionMgr.StartDraining()
+		health.quicUp.Store(false)
+		quicListener.Close()
+		conns.Range(func(conn, _ any) bool {
+			conn.(*quic.Conn).CloseWithError(protocol.CloseCodeShutdown, "server shutting down")
+			return true
+		})
+		if undelivered := sessionMgr.CloseAll(deadline); undelivered > 0 {
+			log.Warn().Int("sessions", undelivered).Msg("Grace period expired with undelivered fragments")
+		}
+		dnsServer.Shutdown()
+		if dnsTCPServer != nil {
+			dnsTCPServer.Shutdown()
+		}
+		close(shutdownDone)
+	}()
+
 	// Accept QUIC connections
+	var activeConns atomic.Int64
 	for {
 		conn, err := quicListener.Accept(context.Background())
 		if err != nil {
+			if sessionMgr.Draining() {
+				break
+			}
 			log.Error().Err(err).Msg("Failed to accept QUIC connection")
 			continue
 		}
 
 		log.Info().Str("remote", conn.RemoteAddr().String()).Msg("New QUIC connection")
-		go handleQUICConnection(conn, dialer)
+		activeConns.Add(1)
+		conns.Store(conn, struct{}{})
+		go func() {
+			defer activeConns.Add(-1)
+			defer conns.Delete(conn)
+			handleQUICConnection(conn, dialer, sessionMgr, *streamWindow*1024)
+		}()
+	}
+
+	if shuttingDown.Load() {
+		<-shutdownDone
+		log.Info().Msg("Shutdown complete")
+	} else {
+		waitForDrain(&activeConns, sessionMgr, *drainTimeout, shutdownDone)
+	}
+	if stats := virtualConn.CompressionStats(); stats.Packets > 0 {
+		log.Info().Uint64("packets", stats.Packets).Uint64("compressed", stats.Compressed).
+			Float64("ratio", stats.Ratio()).Msg("Downstream compression summary")
 	}
 }
 
+// waitForDrain blocks until all QUIC connections have closed or the timeout expires,
+// then gives polls a last chance to collect queued downstream fragments. A
+// shutdown signal during the drain (shutdownDone closed) ends it at once.
+func waitForDrain(activeConns *atomic.Int64, sessions *server.SessionManager, timeout time.Duration, shutdownDone <-chan struct{}) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		select {
+		case <-shutdownDone:
+			log.Info().Msg("Shutdown complete")
+			return
+		default:
+		}
+		remaining := activeConns.Load()
+		if remaining == 0 {
+			log.Info().Msg("All connections drained, exiting")
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Warn().Int64("connections", remaining).Msg("Drain timeout reached, exiting")
+			break
+		}
+	}
+
+	sessions.DrainAll(time.Now().Add(server.SessionDrainTimeout))
+}
+
 // Dialer interface for connection abstraction
 type Dialer interface {
 	Dial(network, addr string) (net.Conn, error)
 }
 
-type directDialer struct{}
+// Target address families for --target-family
+const (
+	familyAuto       = "auto"
+	familyIPv4       = "ipv4"
+	familyIPv6       = "ipv6"
+	familyPreferIPv4 = "prefer-ipv4"
+	familyPreferIPv6 = "prefer-ipv6"
+)
+
+// hostResolver looks up target hostnames (net.DefaultResolver in production)
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type directDialer struct {
+	// family restricts (ipv4/ipv6) or orders (prefer-*) the addresses dialed; "" or auto leaves it to Go
+	family   string
+	resolver hostResolver
+	// allowPrivate lets targets reach the server's own network (--allow-private-targets)
+	allowPrivate bool
+}
+
+// netDialer returns a dialer whose Control hook vets the address actually
+// connected, so a name resolving to an internal address is caught too
+func (d *directDialer) netDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			return d.checkAddress(address)
+		},
+	}
+}
+
+// checkAddress applies the internal address guard and the target policy to
+// an address about to be dialed (ip:port), including those a name resolved to
+func (d *directDialer) checkAddress(address string) error {
+	if !d.allowPrivate {
+		if err := server.CheckPublicAddress(address); err != nil {
+			return err
+		}
+	}
+	return targetPolicy.Load().CheckAddress(address)
+}
 
 func (d *directDialer) Dial(network, addr string) (net.Conn, error) {
-	return net.Dial(network, addr)
+	switch d.family {
+	case familyIPv4, familyIPv6, familyPreferIPv4, familyPreferIPv6:
+		return d.dialFamily(network, addr)
+	default:
+		return d.netDialer(0).Dial(network, addr)
+	}
+}
+
+// restrictNetwork turns "tcp" into "tcp4"/"tcp6"
+func restrictNetwork(network, suffix string) string {
+	return strings.TrimRight(network, "46") + suffix
+}
+
+// dialFamily resolves the host and dials its addresses of the allowed family
+// (ipv4/ipv6), or all of them with the preferred family first (prefer-*)
+func (d *directDialer) dialFamily(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch d.family {
+	case familyIPv4:
+		network = restrictNetwork(network, "4")
+	case familyIPv6:
+		network = restrictNetwork(network, "6")
+	}
+	if net.ParseIP(host) != nil {
+		return d.netDialer(0).Dial(network, addr)
+	}
+
+	resolver := d.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ordered := orderByFamily(ips, d.family == familyIPv4 || d.family == familyPreferIPv4)
+	if d.family == familyIPv4 || d.family == familyIPv6 {
+		ordered = filterFamily(ordered, d.family == familyIPv4)
+	}
+
+	var lastErr error
+	for _, ip := range ordered {
+		conn, err := d.netDialer(10*time.Second).Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no %s addresses for %s", strings.TrimPrefix(d.family, "prefer-"), host)
+	}
+	return nil, lastErr
+}
+
+// orderByFamily returns ips with the preferred family first, keeping resolver order otherwise
+func orderByFamily(ips []net.IPAddr, preferIPv4 bool) []net.IP {
+	var preferred, other []net.IP
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == preferIPv4 {
+			preferred = append(preferred, ip.IP)
+		} else {
+			other = append(other, ip.IP)
+		}
+	}
+	return append(preferred, other...)
+}
+
+// filterFamily returns the IPv4 (or IPv6) addresses among ips
+func filterFamily(ips []net.IP, ipv4 bool) []net.IP {
+	var kept []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == ipv4 {
+			kept = append(kept, ip)
+		}
+	}
+	return kept
 }
 
 type socks5Dialer struct {
@@ -257,65 +906,245 @@ func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
 	return d.proxy.Dial(network, addr)
 }
 
-func handleQUICConnection(conn *quic.Conn, dialer Dialer) {
-	defer conn.CloseWithError(0, "")
+// closeExpired closes the connection owning a session that expired (see
+// server.SessionManager.OnExpire)
+func closeExpired(id string, owner any) {
+	if conn, ok := owner.(*quic.Conn); ok {
+		conn.CloseWithError(protocol.CloseCodeSessionExpired, "session expired")
+	}
+}
+
+func handleQUICConnection(conn *quic.Conn, dialer Dialer, sessions *server.SessionManager, streamWindow int) {
+	sessionID := conn.RemoteAddr().String()
+	if !sessions.Claim(sessionID, conn) {
+		// Session ID collision: another client's connection already uses it
+		log.Warn().Str("sess", sessionID).Msg("Session ID already owned by another connection, refusing")
+		conn.CloseWithError(protocol.CloseCodeSessionInUse, "session id in use")
+		return
+	}
+	// The client may move the connection to a new session ID (see the client's
+	// --migrate): quic-go validates the new path and switches the remote
+	// address, and current follows it so the live session is the one used
+	var sessionMu sync.Mutex
+	current := func() string {
+		id := conn.RemoteAddr().String()
+		sessionMu.Lock()
+		defer sessionMu.Unlock()
+		if id != sessionID {
+			if !sessions.Claim(id, conn) {
+				log.Warn().Str("sess", id).Msg("Connection migrated to a session ID owned by another connection")
+			}
+			sessions.Release(sessionID, conn)
+			sessions.Migrate(sessionID, id)
+			log.Info().Str("from", sessionID).Str("sess", id).Msg("Connection migrated to a new session")
+			sessionID = id
+		}
+		return sessionID
+	}
+	// Downstream bytes queued for this session and not yet picked up by polls
+	backlog := func() int {
+		if sess := sessions.Get(current()); sess != nil {
+			return sess.Backlog() * protocol.MaxChunkSize
+		}
+		return 0
+	}
+	defer func() {
+		sessionID := current()
+		sessions.Release(sessionID, conn)
+		conn.CloseWithError(0, "")
+		// Let polls pick up the tail of the downstream (incl. CONNECTION_CLOSE) before forgetting the session
+		if sess := sessions.Get(sessionID); sess != nil {
+			if !sess.Drain(time.Now().Add(server.SessionDrainTimeout)) {
+				log.Debug().Str("sess", sessionID).Int("pending", sess.Backlog()).Msg("Session closed with undelivered fragments")
+			}
+			sessions.Remove(sessionID)
+		}
+	}()
 
+	warned := false
 	for {
 		stream, err := conn.AcceptStream(context.Background())
 		if err != nil {
-			if !strings.Contains(err.Error(), "timeout") && !strings.Contains(err.Error(), "closed") {
+			var appErr *quic.ApplicationError
+			if !strings.Contains(err.Error(), "timeout") && !strings.Contains(err.Error(), "closed") && !errors.As(err, &appErr) {
 				log.Error().Err(err).Msg("Failed to accept stream")
 			}
 			return
 		}
 
-		go handleStream(stream, dialer)
+		// Per-session stream cap: refuse the stream before anything is dialed for it
+		sessionID := current()
+		sess, admitted := admitStream(sessions, sessionID)
+		if sess == nil {
+			log.Debug().Str("sess", sessionID).Msg("Stream for a session that is gone, closing the connection")
+			conn.CloseWithError(protocol.CloseCodeSessionExpired, "session expired")
+			return
+		}
+		if !admitted {
+			if !warned {
+				log.Warn().Str("sess", sessionID).Int("max", maxStreamsPerSession).Msg("Session reached its stream cap, refusing new streams")
+				warned = true
+			}
+			stream.CancelRead(protocol.StreamCodeTooManyStreams)
+			stream.CancelWrite(protocol.StreamCodeTooManyStreams)
+			continue
+		}
+
+		go func() {
+			defer sess.CloseStream()
+			handleStream(stream, dialer, sess, sessionID, streamWindow, backlog)
+		}()
+	}
+}
+
+// admitStream counts a new stream against the cap of the session sessionID
+// and reports whether it is under it. It returns a nil session when the
+// session expired or was removed under the connection: nothing reaches the
+// client any more, and a stream can't run uncounted.
+func admitStream(sessions *server.SessionManager, sessionID string) (*server.Session, bool) {
+	sess := sessions.Get(sessionID)
+	if sess == nil {
+		return nil, false
 	}
+	return sess, sess.OpenStream(maxStreamsPerSession)
 }
 
-func handleStream(stream *quic.Stream, dialer Dialer) {
+func handleStream(stream *quic.Stream, dialer Dialer, sess *server.Session, sessionID string, streamWindow int, backlog func() int) {
 	defer stream.Close()
 
-	// Read target address from stream header
-	targetAddr, err := proxy.ParseTargetAddress(stream)
+	// The client's capability hello arrives on a stream of its own in place of a target header
+	first := make([]byte, 1)
+	n, _ := io.ReadFull(stream, first)
+	if n == 1 && first[0] == protocol.HelloMarker {
+		answerHello(stream, sess, sessionID)
+		return
+	}
+
+	span := tracer.Start("stream.handle", nil)
+	defer span.End()
+	access := newAccessRecord(sessionID)
+	defer access.emit()
+	span.SetString("session", sessionID)
+	span.SetInt("stream", int64(stream.StreamID()))
+
+	// Read target address (and optional TLS name override) from stream header
+	target, err := proxy.ParseTarget(io.MultiReader(bytes.NewReader(first[:n]), stream))
 	if err != nil {
+		span.SetError(err)
 		log.Error().Err(err).Msg("Failed to parse target address")
-		stream.Write([]byte{0x01}) // Error response
+		stream.Write([]byte{proxy.ReplyCodeForError(err)}) // Error response
+		return
+	}
+	targetAddr := target.Addr
+	span.SetString("target", targetAddr)
+	access.target = targetAddr
+
+	if target.UDP {
+		relayUDP(stream, dialer, span, access)
+		return
+	}
+
+	if err := targetPolicy.Load().Check(targetAddr); err != nil {
+		span.SetError(err)
+		access.outcome = outcomeDenied
+		log.Info().Err(err).Str("sess", sessionID).Msg("Refusing target")
+		stream.Write([]byte{proxy.ReplyConnectionNotAllowed}) // Error response
 		return
 	}
 
 	log.Debug().Str("target", targetAddr).Msg("Connecting to target")
 
 	// Connect to target
+	dialSpan := tracer.Start("target.dial", span)
 	targetConn, err := dialer.Dial("tcp", targetAddr)
+	dialSpan.SetError(err)
+	dialSpan.End()
 	if err != nil {
+		span.SetError(err)
+		access.dialFailed(err)
 		log.Error().Err(err).Str("target", targetAddr).Msg("Failed to connect to target")
-		stream.Write([]byte{0x01}) // Error response
+		stream.Write([]byte{proxy.ReplyCodeForError(err)}) // Error response, the reason as a SOCKS5 reply code
 		return
 	}
 	defer targetConn.Close()
 
-	// Send success response
-	if _, err := stream.Write([]byte{0x00}); err != nil {
+	// SNI override: speak TLS to the target ourselves, the stream carries plaintext
+	if target.SNI != "" {
+		span.SetString("sni", target.SNI)
+		tlsConn, err := originateTLS(targetConn, target.SNI)
+		if err != nil {
+			span.SetError(err)
+			access.outcome = outcomeTLSFailure
+			log.Error().Err(err).Str("target", targetAddr).Str("sni", target.SNI).Msg("TLS handshake with target failed")
+			stream.Write([]byte{proxy.ReplyCodeForError(err)}) // Error response, the reason as a SOCKS5 reply code
+			return
+		}
+		targetConn = tlsConn
+		defer targetConn.Close()
+	}
+
+	// Send success response, or let it ride with the target's first bytes
+	// when the client didn't wait for it
+	var streamOut io.Writer = stream
+	if target.DeferStatus {
+		streamOut = &proxy.DeferredStatusWriter{W: stream}
+	} else if _, err := stream.Write([]byte{0x00}); err != nil {
+		span.SetError(err)
 		log.Error().Err(err).Msg("Failed to send success response")
 		return
 	}
 
 	log.Debug().Str("target", targetAddr).Msg("Connected to target, piping data")
+	access.outcome = outcomeSuccess
 
 	// Bidirectional pipe
-	done := make(chan struct{}, 2)
-
-	go func() {
-		io.Copy(targetConn, stream)
-		done <- struct{}{}
-	}()
+	pipeSpan := tracer.Start("pipe", span)
+	defer pipeSpan.End()
+	abort := func(code quic.StreamErrorCode) {
+		stream.CancelRead(code)
+		stream.CancelWrite(code)
+		targetConn.Close()
+	}
+	idle := proxy.NewIdleWatch(streamIdleTimeout, func() { abort(protocol.StreamCodeIdle) })
+	defer idle.Stop()
+	upstream := &telemetry.CountingWriter{W: idle.Writer(targetConn)}
+	downstream := &telemetry.CountingWriter{W: idle.Writer(streamOut)}
 
-	go func() {
-		io.Copy(stream, targetConn)
-		done <- struct{}{}
-	}()
+	// Each direction half-closes its destination at EOF so the other can finish
+	upErr, downErr := proxy.Pipe(func() error {
+		if _, err := io.Copy(upstream, stream); err != nil {
+			return err
+		}
+		if !proxy.CloseWrite(targetConn) {
+			return proxy.ErrHalfCloseUnsupported
+		}
+		return nil
+	}, func() error {
+		// Keep a fast target from running far ahead of what polls drain
+		if _, err := proxy.WindowedCopy(downstream, targetConn, streamWindow, backlog); err != nil {
+			return err
+		}
+		return stream.Close()
+	}, func() {
+		abort(protocol.StreamCodePipeFailed)
+	})
+	if idle.Expired() {
+		upErr, downErr = proxy.ErrIdle, proxy.ErrIdle
+	}
 
-	// Wait for one direction to finish
-	<-done
+	pipeSpan.SetInt("bytes_up", upstream.Count())
+	pipeSpan.SetInt("bytes_down", downstream.Count())
+	pipeSpan.SetString("up", proxy.Ending(upErr))
+	pipeSpan.SetString("down", proxy.Ending(downErr))
+	err = upErr
+	if proxy.Ending(err) == proxy.EndingEOF {
+		err = downErr
+	}
+	if proxy.Ending(err) != proxy.EndingEOF {
+		pipeSpan.SetError(err)
+		access.ending = proxy.Ending(err)
+		log.Debug().Err(err).Str("target", targetAddr).Str("up", proxy.Ending(upErr)).Str("down", proxy.Ending(downErr)).
+			Int64("bytes_up", upstream.Count()).Int64("bytes_down", downstream.Count()).Msg("Tunneled connection failed")
+	}
+	access.up, access.down = upstream.Count(), downstream.Count()
 }
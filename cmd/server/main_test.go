@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/server"
+)
+
+// stubResolver answers every lookup with the same addresses
+type stubResolver []net.IPAddr
+
+func (r stubResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return r, nil
+}
+
+// dualStackListener listens on both loopbacks at one port, or skips the test without IPv6
+func dualStackListener(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("no dual-stack listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if probe, err := net.Dial("tcp6", ln.Addr().(*net.TCPAddr).AddrPort().String()); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		probe.Close()
+		conn, _ := ln.Accept()
+		conn.Close()
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return ln, port
+}
+
+// dialedFamily dials dual.test through d and returns "4" or "6", the family the listener saw
+func dialedFamily(t *testing.T, d *directDialer, ln net.Listener, port string) (string, error) {
+	t.Helper()
+	conn, err := d.Dial("tcp", net.JoinHostPort("dual.test", port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if peer.RemoteAddr().(*net.TCPAddr).IP.To4() != nil {
+		return "4", nil
+	}
+	return "6", nil
+}
+
+func TestDirectDialerFamily(t *testing.T) {
+	ln, port := dualStackListener(t)
+	v4 := net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	v6 := net.IPAddr{IP: net.IPv6loopback}
+
+	for _, tt := range []struct {
+		family string
+		ips    stubResolver
+		want   string
+	}{
+		{familyIPv4, stubResolver{v6, v4}, "4"},
+		{familyIPv6, stubResolver{v4, v6}, "6"},
+		{familyPreferIPv4, stubResolver{v6, v4}, "4"},
+		{familyPreferIPv6, stubResolver{v4, v6}, "6"},
+		// Preferring a family still falls back to the other
+		{familyPreferIPv6, stubResolver{v4}, "4"},
+	} {
+		d := &directDialer{family: tt.family, resolver: tt.ips, allowPrivate: true}
+		got, err := dialedFamily(t, d, ln, port)
+		if err != nil {
+			t.Errorf("%s with %v: %v", tt.family, tt.ips, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s with %v dialed IPv%s, want IPv%s", tt.family, tt.ips, got, tt.want)
+		}
+	}
+}
+
+func TestDirectDialerRestrictedFamilyMissing(t *testing.T) {
+	for _, tt := range []struct {
+		family string
+		ips    stubResolver
+	}{
+		{familyIPv4, stubResolver{{IP: net.IPv6loopback}}},
+		{familyIPv6, stubResolver{{IP: net.IPv4(127, 0, 0, 1)}}},
+	} {
+		d := &directDialer{family: tt.family, resolver: tt.ips, allowPrivate: true}
+		if conn, err := d.Dial("tcp", "dual.test:1"); err == nil {
+			conn.Close()
+			t.Errorf("%s dialed %v, which only has the other family", tt.family, tt.ips)
+		}
+	}
+}
+
+func TestDirectDialerRefusesInternalHostnames(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for _, tt := range []struct {
+		name string
+		d    *directDialer
+		addr string
+	}{
+		// Go's own resolver, through /etc/hosts
+		{"localhost", &directDialer{}, "localhost"},
+		// A public-looking name pointing inside
+		{"internal.test", &directDialer{family: familyPreferIPv4, resolver: stubResolver{{IP: net.IPv4(127, 0, 0, 1)}}}, "internal.test"},
+		{"metadata.test", &directDialer{family: familyIPv4, resolver: stubResolver{{IP: net.IPv4(169, 254, 169, 254)}}}, "metadata.test"},
+	} {
+		conn, err := tt.d.Dial("tcp", net.JoinHostPort(tt.addr, port))
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: dialed an internal address", tt.name)
+			continue
+		}
+		if !errors.Is(err, proxy.ErrTargetNotAllowed) {
+			t.Errorf("%s: got %v, want a refusal", tt.name, err)
+		}
+		if code := proxy.ReplyCodeForError(err); code != proxy.ReplyConnectionNotAllowed {
+			t.Errorf("%s: client would get reply 0x%02x, want connection not allowed", tt.name, code)
+		}
+	}
+
+	// --allow-private-targets lets the same names through
+	d := &directDialer{allowPrivate: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("with private targets allowed: %v", err)
+	}
+	conn.Close()
+}
+
+const testDomain = "t.example.com"
+
+var testQUICConfig = &quic.Config{
+	MaxIdleTimeout:          30 * time.Second,
+	InitialPacketSize:       600,
+	DisablePathMTUDiscovery: true,
+}
+
+// serveQUIC runs a QUIC server on h's transport presenting the certificates
+// of getCert, passing each connection to handle
+func serveQUIC(t *testing.T, h *server.DNSHandler, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error), handle func(*quic.Conn)) {
+	t.Helper()
+	transport := &quic.Transport{Conn: h.Injector, VerifySourceAddress: func(net.Addr) bool { return true }}
+	listener, err := transport.Listen(crypto.GetSelectingTLSConfig(getCert), testQUICConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+// echoStreams echoes every stream of conn back
+func echoStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+	}
+}
+
+// newTunnelTransport returns a client transport for session that h answers in-process
+func newTunnelTransport(t *testing.T, h *server.DNSHandler, session string) *protocol.DnsPacketConn {
+	t.Helper()
+	logger := zerolog.Nop()
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	dnsConn, err := protocol.NewDnsPacketConnWithOptions([]string{protocol.LoopbackResolverAddr.String()}, testDomain, session, protocol.DnsConnOptions{
+		Logger:    &logger,
+		Transport: protocol.NewLoopbackConn(h.LoopbackResponder(source)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dnsConn.Close() })
+	return dnsConn
+}
+
+// dialOver runs the QUIC handshake over transport, pinning fingerprint
+func dialOver(t *testing.T, transport *protocol.DnsPacketConn, fingerprint string) (*quic.Conn, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pins := crypto.NewPinSet([]string{fingerprint})
+	conn, err := quic.Dial(ctx, transport, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, crypto.GetClientTLSConfigPinSet(pins), testQUICConfig)
+	if err == nil {
+		t.Cleanup(func() { conn.CloseWithError(0, "") })
+	}
+	return conn, err
+}
+
+// dialTunnel connects to h's server in-process as session, pinning fingerprint
+func dialTunnel(t *testing.T, h *server.DNSHandler, session, fingerprint string) (*quic.Conn, error) {
+	t.Helper()
+	return dialOver(t, newTunnelTransport(t, h, session), fingerprint)
+}
+
+// echoOver sends data through a new stream of conn and fails unless it all comes back
+func echoOver(t *testing.T, conn *quic.Conn, data []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	go func() {
+		stream.Write(data)
+		stream.Close()
+	}()
+	got, err := io.ReadAll(stream)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d of %d bytes: %v", len(got), len(data), err)
+	}
+}
+
+func TestExpiredSessionClosesConnection(t *testing.T) {
+	logger := zerolog.Nop()
+	sessions := server.NewSessionManagerWithOptions(server.SessionOptions{TTL: 300 * time.Millisecond})
+	sessions.Logger = &logger
+	expired := make(chan string, 1)
+	sessions.OnExpire = func(id string, owner any) {
+		closeExpired(id, owner)
+		expired <- id
+	}
+	injector := server.NewVirtualConn(sessions)
+	injector.Logger = &logger
+	h := &server.DNSHandler{
+		Sessions:            sessions,
+		Injector:            injector,
+		AllowedDomains:      map[string]bool{testDomain: true},
+		MaxFragsPerResponse: 6,
+		Logger:              &logger,
+	}
+	_, privKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := crypto.NewCertSet(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, handled := make(chan struct{}), make(chan struct{})
+	serveQUIC(t, h, certs.GetCertificate, func(conn *quic.Conn) {
+		defer close(handled)
+		close(accepted)
+		handleQUICConnection(conn, nil, sessions, 0)
+	})
+	baseline := runtime.NumGoroutine()
+
+	transport := newTunnelTransport(t, h, "sessaaaa")
+	conn, err := dialOver(t, transport, certs.Fingerprint())
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server never accepted the connection")
+	}
+	// The client vanishes: no more queries keep its session alive
+	transport.Close()
+	conn.CloseWithError(0, "")
+
+	select {
+	case id := <-expired:
+		if id != "sessaaaa" {
+			t.Errorf("OnExpire called for %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session never expired")
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleQUICConnection still running after its session expired")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines after the session expired, %d before the client came:\n%s",
+				runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdmitStream(t *testing.T) {
+	defer func(max int) { maxStreamsPerSession = max }(maxStreamsPerSession)
+	maxStreamsPerSession = 2
+	sessions := server.NewSessionManagerWithOptions(server.SessionOptions{})
+	sess := sessions.GetOrCreate("sessaaaa")
+
+	for i := range 2 {
+		if got, ok := admitStream(sessions, "sessaaaa"); got != sess || !ok {
+			t.Fatalf("stream %d refused under the cap", i+1)
+		}
+	}
+	if got, ok := admitStream(sessions, "sessaaaa"); got != sess || ok {
+		t.Fatal("stream admitted past the cap")
+	}
+	sess.CloseStream()
+	if _, ok := admitStream(sessions, "sessaaaa"); !ok {
+		t.Fatal("stream refused after one closed")
+	}
+
+	// A session gone from under its connection admits nothing, however few
+	// streams it had
+	sessions.Remove("sessaaaa")
+	if got, ok := admitStream(sessions, "sessaaaa"); got != nil || ok {
+		t.Errorf("admitted a stream for a removed session (%p, %v)", got, ok)
+	}
+}
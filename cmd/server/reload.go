@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/config"
+	"slipstream-go/internal/profile"
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/server"
+)
+
+// reloader re-reads --config on SIGHUP and applies the flags that can change
+// while sessions are up: --domain, --max-frags, --max-qps-per-session,
+// --max-qps-per-ip and --target-policy. It also re-reads the --privkey-file
+// and --domain-key files, so a key replaced on disk is rotated in without
+// dropping established connections, and the --client-keys file, so clients
+// can be added and revoked. Other flags need a restart.
+type reloader struct {
+	configFile string
+	// flags are the server's flags (flag.CommandLine): their defaults and
+	// command-line values, and the names a config file may set
+	flags *flag.FlagSet
+	// explicit flags were set on the command line and keep their value
+	explicit map[string]bool
+	// cmdDomains are the --domain values given on the command line
+	cmdDomains []string
+	// domainKeys domains stay registered whatever the file says
+	domainKeys map[string]string
+	// privkeyFile and the domainKeys files are loaded again into certs
+	privkeyFile string
+	certs       *server.CertSelector
+	// clientKeysFile is loaded again into clientKeys (nil without --client-keys)
+	clientKeysFile string
+	clientKeys     *server.ClientKeys
+	profile        profile.Profile
+	handler        *server.DNSHandler
+	targetType     string
+}
+
+// watch reloads on every reload signal until the process exits
+func (r *reloader) watch() {
+	if len(reloadSignals) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, reloadSignals...)
+	go func() {
+		for range ch {
+			if err := r.reload(); err != nil {
+				log.Error().Err(err).Msg("Reload failed, keeping the current configuration")
+			}
+		}
+	}()
+}
+
+// reload resolves the reloadable flags again with the startup precedence
+// (command line, then config file, then profile, then default) and swaps the
+// result in. Nothing changes unless every value is valid.
+func (r *reloader) reload() error {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	var domains stringSlice
+	fs.Var(&domains, "domain", "")
+	maxFrags := fs.Int("max-frags", r.defaultInt("max-frags"), "")
+	maxQPSPerSession := fs.Int("max-qps-per-session", r.defaultInt("max-qps-per-session"), "")
+	maxQPSPerIP := fs.Int("max-qps-per-ip", r.defaultInt("max-qps-per-ip"), "")
+	targetPolicyFile := fs.String("target-policy", r.flags.Lookup("target-policy").DefValue, "")
+
+	// Command-line values first, so the file and profile leave them alone
+	fs.VisitAll(func(f *flag.Flag) {
+		if !r.explicit[f.Name] {
+			return
+		}
+		if f.Name == "domain" {
+			for _, d := range r.cmdDomains {
+				fs.Set(f.Name, d)
+			}
+			return
+		}
+		fs.Set(f.Name, r.flags.Lookup(f.Name).Value.String())
+	})
+	if r.configFile != "" {
+		file, err := config.Load(r.configFile)
+		if err != nil {
+			return err
+		}
+		if err := file.Check(r.flags); err != nil {
+			return err
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			if r.explicit[f.Name] {
+				return
+			}
+			for _, v := range file.Values(f.Name) {
+				if err == nil {
+					if err = fs.Set(f.Name, v); err != nil {
+						err = fmt.Errorf("config %s: set --%s: %w", r.configFile, f.Name, err)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := r.profile.Apply(fs); err != nil {
+		return err
+	}
+
+	// Validate everything before touching the running configuration
+	allowedDomains := make(map[string]bool)
+	for _, d := range domains {
+		allowedDomains[normalizeDomain(d)] = true
+	}
+	for d := range r.domainKeys {
+		allowedDomains[d] = true
+	}
+	if len(allowedDomains) == 0 {
+		return fmt.Errorf("at least one --domain is required")
+	}
+	if *maxFrags < 1 || *maxFrags > protocol.MaxFragsPerResponse {
+		return fmt.Errorf("--max-frags must be between 1 and %d", protocol.MaxFragsPerResponse)
+	}
+	if *maxQPSPerSession < 0 || *maxQPSPerIP < 0 {
+		return fmt.Errorf("--max-qps-per-session and --max-qps-per-ip cannot be negative")
+	}
+	var policy *server.TargetPolicy
+	if *targetPolicyFile != "" {
+		var err error
+		if policy, err = server.LoadTargetPolicy(*targetPolicyFile); err != nil {
+			return fmt.Errorf("--target-policy: %w", err)
+		}
+		if r.targetType != "direct" && policy.HasAddressRules() {
+			log.Warn().Str("type", r.targetType).Msg("The upstream proxy resolves target names, CIDR rules only see targets given as IPs")
+		}
+	}
+
+	keys, err := loadServerKeys(r.privkeyFile, r.domainKeys)
+	if err != nil {
+		return err
+	}
+	certs, err := newCertificates(r.certs, keys)
+	if err != nil {
+		return err
+	}
+	var clientKeys *server.ClientKeys
+	if r.clientKeysFile != "" {
+		if clientKeys, err = server.LoadClientKeys(r.clientKeysFile); err != nil {
+			return fmt.Errorf("--client-keys: %w", err)
+		}
+	}
+
+	// Keep limiters whose rate is unchanged, so their buckets carry over
+	conf := r.handler.Config()
+	if conf.SessionLimiter.QPS() != *maxQPSPerSession {
+		conf.SessionLimiter = server.NewRateLimiter(*maxQPSPerSession)
+	}
+	if conf.SourceLimiter.QPS() != *maxQPSPerIP {
+		conf.SourceLimiter = server.NewRateLimiter(*maxQPSPerIP)
+	}
+	conf.AllowedDomains = allowedDomains
+	conf.MaxFragsPerResponse = *maxFrags
+
+	// Everything checked out: swap it all in together
+	r.handler.Reconfigure(conf)
+	targetPolicy.Store(policy)
+	rotateCertificates(r.certs, certs)
+	if clientKeys != nil {
+		r.clientKeys.Replace(clientKeys)
+		log.Info().Int("clients", clientKeys.Len()).Msg("Client keys reloaded")
+	}
+
+	names := slices.Sorted(maps.Keys(allowedDomains))
+	log.Info().Strs("domains", names).Int("max_frags", *maxFrags).Int("max_qps_per_session", *maxQPSPerSession).
+		Int("max_qps_per_ip", *maxQPSPerIP).Str("target_policy", *targetPolicyFile).Msg("Configuration reloaded")
+	return nil
+}
+
+// defaultInt returns the default of the server's integer flag name
+func (r *reloader) defaultInt(name string) int {
+	n, _ := strconv.Atoi(r.flags.Lookup(name).DefValue)
+	return n
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/profile"
+	"slipstream-go/internal/server"
+)
+
+// writeFile writes content to name in dir and returns the path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeServerKey saves a new server key at path and returns its fingerprint
+func writeServerKey(t *testing.T, path string) string {
+	t.Helper()
+	pub, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crypto.SavePrivateKey(priv, path); err != nil {
+		t.Fatal(err)
+	}
+	return crypto.PublicKeyFingerprint(pub)
+}
+
+// newReloadFlags declares the reloadable flags as main does, with defaults
+// of their own so tests can tell them from main's
+func newReloadFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.Var(new(stringSlice), "domain", "")
+	flags.Int("max-frags", 6, "")
+	flags.Int("max-qps-per-session", 250, "")
+	flags.Int("max-qps-per-ip", 0, "")
+	flags.String("target-policy", "", "")
+	return flags
+}
+
+// newTestReloader returns a reloader over a server running testDomain with
+// a key in dir and the client keys in clients (none if empty), as main sets it up
+func newTestReloader(t *testing.T, dir, clients string) *reloader {
+	t.Helper()
+	logger := zerolog.Nop()
+	sessions := server.NewSessionManager()
+	sessions.Logger = &logger
+	privkeyFile := filepath.Join(dir, "server.key")
+	writeServerKey(t, privkeyFile)
+	keys, err := loadServerKeys(privkeyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := newCertSelector(sessions, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injector := server.NewVirtualConn(sessions)
+	injector.Logger = &logger
+	handler := &server.DNSHandler{
+		Sessions:            sessions,
+		Injector:            injector,
+		AllowedDomains:      map[string]bool{testDomain: true},
+		MaxFragsPerResponse: 6,
+		Logger:              &logger,
+	}
+	prof, err := profile.Lookup(profile.DefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reloader{
+		flags:       newReloadFlags(),
+		explicit:    map[string]bool{"domain": true},
+		cmdDomains:  []string{testDomain},
+		privkeyFile: privkeyFile,
+		certs:       certs,
+		profile:     prof,
+		handler:     handler,
+		targetType:  "direct",
+	}
+	if clients != "" {
+		r.clientKeysFile = writeFile(t, dir, "clients.keys", clients)
+		if r.clientKeys, err = server.LoadClientKeys(r.clientKeysFile); err != nil {
+			t.Fatal(err)
+		}
+		handler.ClientKeys = r.clientKeys
+	}
+	return r
+}
+
+func TestReloadClientKeys(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestReloader(t, dir, "alice key-a\nbob key-b\n")
+	accepted := func(key string) bool {
+		now := time.Now()
+		_, _, ok := r.clientKeys.Verify("abcdefgh", crypto.SessionToken([]byte(key), "abcdefgh", 1, now), now)
+		return ok
+	}
+	if !accepted("key-b") {
+		t.Fatal("bob refused before the reload")
+	}
+
+	writeFile(t, dir, "clients.keys", "alice key-a\ncarol key-c\n")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !accepted("key-a") || !accepted("key-c") {
+		t.Error("a listed client is refused after the reload")
+	}
+	if accepted("key-b") {
+		t.Error("bob was removed from the file but is still accepted")
+	}
+
+	// A broken file leaves the keys in force alone
+	writeFile(t, dir, "clients.keys", "alice\n")
+	if err := r.reload(); err == nil {
+		t.Fatal("reloaded a malformed client keys file")
+	}
+	if !accepted("key-c") {
+		t.Error("a failed reload dropped the keys in force")
+	}
+}
+
+func TestReloadRestoresDefaults(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestReloader(t, dir, "")
+	r.configFile = writeFile(t, dir, "config.json", `{"max-qps-per-session": 50}`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if qps := r.handler.Config().SessionLimiter.QPS(); qps != 50 {
+		t.Fatalf("--max-qps-per-session %d after the reload, want the file's 50", qps)
+	}
+
+	// Dropped from the file, the flag goes back to its declared default
+	writeFile(t, dir, "config.json", `{}`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if qps := r.handler.Config().SessionLimiter.QPS(); qps != 250 {
+		t.Errorf("--max-qps-per-session %d once the file leaves it out, want the default 250", qps)
+	}
+
+	// Names that aren't server flags are refused as at startup
+	writeFile(t, dir, "config.json", `{"no-such-flag": 1}`)
+	if err := r.reload(); err == nil {
+		t.Error("reloaded a config file naming an unknown flag")
+	}
+}
+
+func TestReloadRotatesKeyKeepingConnections(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestReloader(t, dir, "")
+	serveQUIC(t, r.handler, r.certs.GetCertificate, echoStreams)
+	oldFingerprint := r.certs.Default.Fingerprint()
+	live, err := dialTunnel(t, r.handler, "sessaaaa", oldFingerprint)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	echoOver(t, live, []byte("before the rotation"))
+
+	newFingerprint := writeServerKey(t, r.privkeyFile)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.certs.Default.Fingerprint(); got != newFingerprint {
+		t.Fatalf("serving %s after the reload, want the new key's %s", got, newFingerprint)
+	}
+
+	// The connection made under the old key carries on
+	echoOver(t, live, bytes.Repeat([]byte("after the rotation "), 200))
+	// New handshakes get the new key
+	if _, err := dialTunnel(t, r.handler, "sessbbbb", oldFingerprint); err == nil {
+		t.Error("a client pinning the old key connected after the rotation")
+	}
+	next, err := dialTunnel(t, r.handler, "sesscccc", newFingerprint)
+	if err != nil {
+		t.Fatalf("handshake with the new key: %v", err)
+	}
+	echoOver(t, next, []byte("new connection"))
+}
+
+func TestFailedReloadChangesNothing(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		breakIt func(t *testing.T, r *reloader, dir string)
+	}{
+		{"broken server key", func(t *testing.T, r *reloader, dir string) {
+			writeFile(t, dir, "clients.keys", "alice key-a\nbob key-b\n")
+			writeFile(t, dir, "server.key", "not a key")
+		}},
+		{"broken client keys", func(t *testing.T, r *reloader, dir string) {
+			writeServerKey(t, r.privkeyFile)
+			writeFile(t, dir, "clients.keys", "alice\n")
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := newTestReloader(t, dir, "alice key-a\n")
+			fingerprint := r.certs.Default.Fingerprint()
+			r.configFile = writeFile(t, dir, "config.json", `{"max-qps-per-session": 50}`)
+			tt.breakIt(t, r, dir)
+
+			if err := r.reload(); err == nil {
+				t.Fatal("reload succeeded")
+			}
+			if got := r.certs.Default.Fingerprint(); got != fingerprint {
+				t.Errorf("serving %s after a failed reload, want the old %s", got, fingerprint)
+			}
+			if qps := r.handler.Config().SessionLimiter.QPS(); qps == 50 {
+				t.Error("a failed reload applied the config file's rate limit")
+			}
+			if r.clientKeys.Len() != 1 {
+				t.Errorf("%d client keys after a failed reload, want the 1 in force", r.clientKeys.Len())
+			}
+		})
+	}
+}
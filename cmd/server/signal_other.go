@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// drainSignals is empty where SIGUSR1 does not exist
+var drainSignals []os.Signal
+
+// shutdownSignals close every connection and exit within --shutdown-grace
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// reloadSignals is empty where SIGHUP does not exist
+var reloadSignals []os.Signal
@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals start connection draining (e.g. before key rotation or redeploy)
+var drainSignals = []os.Signal{syscall.SIGUSR1}
+
+// shutdownSignals close every connection and exit within --shutdown-grace
+var shutdownSignals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+
+// reloadSignals re-read --config and apply the flags that can change live
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/server"
+)
+
+// normalizeDomain lowercases a tunnel domain and strips the trailing dot
+func normalizeDomain(d string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+}
+
+// parseDomainKeys parses repeated --domain-key DOMAIN=PRIVKEY-FILE values
+func parseDomainKeys(entries []string) (map[string]string, error) {
+	keys := make(map[string]string, len(entries))
+	for _, e := range entries {
+		domain, path, ok := strings.Cut(e, "=")
+		domain = normalizeDomain(domain)
+		path = strings.TrimSpace(path)
+		if !ok || domain == "" || path == "" {
+			return nil, fmt.Errorf("invalid --domain-key %q (want DOMAIN=PRIVKEY-FILE)", e)
+		}
+		if _, dup := keys[domain]; dup {
+			return nil, fmt.Errorf("domain %s has more than one --domain-key", domain)
+		}
+		keys[domain] = path
+	}
+	return keys, nil
+}
+
+// loadServerKeys loads the --privkey-file key (if any) and every per-domain
+// key; the default key is stored under the empty domain
+func loadServerKeys(privkeyFile string, domainKeys map[string]string) (map[string]ed25519.PrivateKey, error) {
+	keys := make(map[string]ed25519.PrivateKey, len(domainKeys)+1)
+	if privkeyFile != "" {
+		privKey, err := crypto.LoadPrivateKey(privkeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("default key: %w", err)
+		}
+		keys[""] = privKey
+	}
+	for domain, path := range domainKeys {
+		privKey, err := crypto.LoadPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("key for %s: %w", domain, err)
+		}
+		keys[domain] = privKey
+	}
+	return keys, nil
+}
+
+// newCertSelector builds the certificates of keys (see loadServerKeys)
+func newCertSelector(sessions *server.SessionManager, keys map[string]ed25519.PrivateKey) (*server.CertSelector, error) {
+	cs := &server.CertSelector{Sessions: sessions, ByDomain: make(map[string]*crypto.CertSet, len(keys))}
+	for domain, privKey := range keys {
+		certs, err := crypto.NewCertSet(privKey)
+		if err != nil {
+			return nil, fmt.Errorf("certificate for %s: %w", domainOrDefault(domain), err)
+		}
+		if domain == "" {
+			cs.Default = certs
+		} else {
+			cs.ByDomain[domain] = certs
+		}
+	}
+	return cs, nil
+}
+
+// newCertificates derives a certificate for every key of keys whose
+// fingerprint differs from the one cs serves, without serving it yet
+func newCertificates(cs *server.CertSelector, keys map[string]ed25519.PrivateKey) (map[string]*crypto.CertSet, error) {
+	next := make(map[string]*crypto.CertSet)
+	for domain, privKey := range keys {
+		if servedCerts(cs, domain).Fingerprint() == crypto.PublicKeyFingerprint(crypto.PublicKeyOf(privKey)) {
+			continue
+		}
+		certs, err := crypto.NewCertSet(privKey)
+		if err != nil {
+			return nil, fmt.Errorf("certificate for %s: %w", domainOrDefault(domain), err)
+		}
+		next[domain] = certs
+	}
+	return next, nil
+}
+
+// rotateCertificates starts serving the certificates of newCertificates,
+// logging each change
+func rotateCertificates(cs *server.CertSelector, next map[string]*crypto.CertSet) {
+	for domain, certs := range next {
+		served := servedCerts(cs, domain)
+		old := served.Fingerprint()
+		served.Replace(certs)
+		log.Info().Str("domain", domainOrDefault(domain)).Str("old_fingerprint", old).
+			Str("fingerprint", served.Fingerprint()).Msg("Server key rotated")
+	}
+}
+
+// servedCerts returns the certificate set cs serves domain's key from, the
+// default one for ""
+func servedCerts(cs *server.CertSelector, domain string) *crypto.CertSet {
+	if domain == "" {
+		return cs.Default
+	}
+	return cs.ByDomain[domain]
+}
+
+// domainOrDefault names the key of domain in messages
+func domainOrDefault(domain string) string {
+	if domain == "" {
+		return "default"
+	}
+	return domain
+}
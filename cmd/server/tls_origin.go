@@ -0,0 +1,23 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsOriginTimeout bounds the TLS handshake with a target when the client asked for an SNI override
+const tlsOriginTimeout = 15 * time.Second
+
+// originateTLS starts TLS over an established target connection presenting
+// sni as the server name (domain fronting: connect to one host, name another).
+// The certificate is verified against sni using the system roots.
+func originateTLS(conn net.Conn, sni string) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: sni})
+	tlsConn.SetDeadline(time.Now().Add(tlsOriginTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
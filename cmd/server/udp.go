@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/telemetry"
+)
+
+const (
+	// udpBufferSize fits the largest UDP payload
+	udpBufferSize = 65535
+	// udpResolveCacheSize bounds the destinations an association remembers
+	// the resolved address of; the cache starts over when it fills up
+	udpResolveCacheSize = 256
+)
+
+// udpNetwork is the UDP network matching --target-family; the prefer-*
+// families leave the choice to Go's resolver
+func (d *directDialer) udpNetwork() string {
+	switch d.family {
+	case familyIPv4:
+		return "udp4"
+	case familyIPv6:
+		return "udp6"
+	default:
+		return "udp"
+	}
+}
+
+// relayUDP serves a stream opened with proxy.TargetFlagUDP. Datagram frames
+// from the client leave through one unconnected UDP socket towards the
+// destination each names, and every datagram arriving on that socket goes
+// back framed with its source. The association ends with the stream.
+func relayUDP(stream *quic.Stream, dialer Dialer, span *telemetry.Span, access *accessRecord) {
+	access.target = "udp-associate"
+	direct, ok := dialer.(*directDialer)
+	if !ok {
+		log.Warn().Msg("Refusing UDP association: UDP is only relayed with --target-type direct")
+		stream.Write([]byte{proxy.ReplyGeneralFailure})
+		return
+	}
+	network := direct.udpNetwork()
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		span.SetError(err)
+		access.dialFailed(err)
+		log.Error().Err(err).Msg("Failed to open UDP socket")
+		stream.Write([]byte{proxy.ReplyGeneralFailure})
+		return
+	}
+	defer conn.Close()
+
+	if _, err := stream.Write([]byte{proxy.ReplySuccess}); err != nil {
+		span.SetError(err)
+		log.Error().Err(err).Msg("Failed to send success response")
+		return
+	}
+	access.outcome = outcomeSuccess
+	log.Debug().Str("local", conn.LocalAddr().String()).Msg("UDP association open")
+
+	var up, down atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if err := proxy.WriteDatagram(stream, from.String(), buf[:n]); err != nil {
+				// The stream is gone: stop the upstream loop too
+				stream.CancelRead(protocol.StreamCodePipeFailed)
+				return
+			}
+			down.Add(int64(n))
+		}
+	}()
+
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		addr, payload, err := proxy.ReadDatagram(stream)
+		if err != nil {
+			if err != io.EOF {
+				// Don't leave the downstream loop blocked on a broken stream
+				stream.CancelWrite(protocol.StreamCodePipeFailed)
+			}
+			break
+		}
+		dst, ok := resolved[addr]
+		if !ok {
+			if err := targetPolicy.Load().Check(addr); err != nil {
+				log.Debug().Err(err).Msg("Dropping UDP datagram: destination not allowed")
+				continue
+			}
+			if dst, err = net.ResolveUDPAddr(network, addr); err != nil {
+				log.Debug().Err(err).Str("target", addr).Msg("Dropping UDP datagram: cannot resolve destination")
+				continue
+			}
+			if err := direct.checkAddress(dst.String()); err != nil {
+				log.Debug().Err(err).Str("target", addr).Msg("Dropping UDP datagram: destination not allowed")
+				continue
+			}
+			if len(resolved) >= udpResolveCacheSize {
+				clear(resolved)
+			}
+			resolved[addr] = dst
+		}
+		if _, err := conn.WriteToUDP(payload, dst); err != nil {
+			log.Debug().Err(err).Str("target", addr).Msg("Failed to send UDP datagram")
+			continue
+		}
+		up.Add(int64(len(payload)))
+	}
+	conn.Close()
+	<-done
+
+	span.SetInt("bytes_up", up.Load())
+	span.SetInt("bytes_down", down.Load())
+	access.up, access.down = up.Load(), down.Load()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/server"
+)
+
+// udpEcho runs a UDP echo server on loopback; every datagram it receives is
+// also sent on the returned channel
+func udpEcho(t *testing.T) (*net.UDPConn, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	received := make(chan string, 16)
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn, received
+}
+
+// openUDPAssociation opens a UDP association through a QUIC server whose
+// streams relayUDP serves with dialer, and returns the stream and the
+// server's one byte answer
+func openUDPAssociation(t *testing.T, dialer Dialer) (*quic.Stream, byte) {
+	t.Helper()
+	_, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := crypto.GetTLSConfig(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		if _, err := proxy.ParseTarget(stream); err != nil {
+			stream.CancelRead(0)
+			return
+		}
+		relayUDP(stream, dialer, nil, newAccessRecord("sessaaaa"))
+		stream.Close()
+	}()
+
+	conn, err := quic.DialAddr(context.Background(), ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"slipstream"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.WriteTarget(stream, proxy.Target{Addr: "0.0.0.0:0", UDP: true}); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(stream, status); err != nil {
+		t.Fatal(err)
+	}
+	return stream, status[0]
+}
+
+// expectNothing fails t if received gets a datagram within a short wait
+func expectNothing(t *testing.T, received <-chan string, why string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		t.Errorf("%s: echo got %q", why, got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestRelayUDP(t *testing.T) {
+	allowed, allowedReceived := udpEcho(t)
+	denied, deniedReceived := udpEcho(t)
+	policyFile := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(policyFile, []byte("deny-port "+strconv.Itoa(denied.LocalAddr().(*net.UDPAddr).Port)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := server.LoadTargetPolicy(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := targetPolicy.Load()
+	targetPolicy.Store(policy)
+	t.Cleanup(func() { targetPolicy.Store(saved) })
+
+	stream, status := openUDPAssociation(t, &directDialer{allowPrivate: true})
+	if status != proxy.ReplySuccess {
+		t.Fatalf("association refused with 0x%02x", status)
+	}
+	// The policy drops the first datagram; the second is echoed back framed
+	// with the echo server's address as its source
+	proxy.WriteDatagram(stream, denied.LocalAddr().String(), []byte("to denied"))
+	proxy.WriteDatagram(stream, allowed.LocalAddr().String(), []byte("to allowed"))
+	source, payload, err := proxy.ReadDatagram(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != allowed.LocalAddr().String() || string(payload) != "to allowed" {
+		t.Errorf("got %q from %s, want the echo from %s", payload, source, allowed.LocalAddr())
+	}
+	<-allowedReceived
+	expectNothing(t, deniedReceived, "target policy")
+
+	// Without --allow-private-targets loopback is off limits
+	stream, status = openUDPAssociation(t, &directDialer{})
+	if status != proxy.ReplySuccess {
+		t.Fatalf("association refused with 0x%02x", status)
+	}
+	proxy.WriteDatagram(stream, allowed.LocalAddr().String(), []byte("internal"))
+	expectNothing(t, allowedReceived, "internal address")
+
+	// UDP is only relayed straight to the destination
+	if _, status = openUDPAssociation(t, &socks5Dialer{}); status != proxy.ReplyGeneralFailure {
+		t.Errorf("through an upstream proxy: got 0x%02x, want general failure", status)
+	}
+}
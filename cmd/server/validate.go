@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/server"
+)
+
+// validateOptions holds the flag values checked by --validate
+type validateOptions struct {
+	Domains       []string
+	DomainKeys    map[string]string
+	AllowSources  []string
+	DenySources   []string
+	DNSPort       int
+	TargetType    string
+	Target        string
+	TargetPolicy  string
+	PrivkeyFile   string
+	ClientKeys    string
+	MaxFrags      int
+	MinPacketSize int
+	MaxPacketSize int
+
+	// Session and stream limits
+	SessionTTL           time.Duration
+	ReassemblyTimeout    time.Duration
+	MaxSessions          int
+	MaxStreamsPerSession int
+	StreamIdleTimeout    time.Duration
+	StreamWindow         int
+	MaxQPSPerSession     int
+	MaxQPSPerIP          int
+
+	// Transport tuning
+	ALPN                string
+	TargetFamily        string
+	DownstreamRecords   string
+	ResponseHold        time.Duration
+	MaxPollHold         time.Duration
+	RedundancyThreshold int
+	FECRatio            float64
+	DownstreamCredit    int
+	DownstreamQueue     int
+	UDPReadBuffer       int
+	UDPWriteBuffer      int
+}
+
+// runValidate checks the configuration without binding any sockets,
+// prints a summary and exits non-zero if anything is wrong. Because nothing
+// is bound or created, it can't tell whether --dns-port, --metrics-addr or
+// --admin-addr are free, or whether --capture-file can be written.
+func runValidate(opts validateOptions) {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	fmt.Println("Slipstream server configuration check")
+
+	// Domains
+	if len(opts.Domains) == 0 {
+		fail("at least one --domain is required")
+	}
+	seen := make(map[string]bool)
+	for _, d := range opts.Domains {
+		normalized := strings.ToLower(strings.TrimSuffix(d, "."))
+		if _, ok := dns.IsDomainName(normalized); !ok || normalized == "" || !strings.Contains(normalized, ".") {
+			fail("domain %q is not a valid tunnel domain", d)
+			continue
+		}
+		if seen[normalized] {
+			fail("domain %q is registered more than once", normalized)
+			continue
+		}
+		seen[normalized] = true
+		fmt.Printf("  domain:        %s\n", normalized)
+	}
+
+	// Source filter
+	if _, err := server.NewSourceFilter(opts.AllowSources, opts.DenySources); err != nil {
+		fail("source filter: %v", err)
+	} else if len(opts.AllowSources)+len(opts.DenySources) > 0 {
+		fmt.Printf("  sources:       allow %v deny %v\n", opts.AllowSources, opts.DenySources)
+	}
+
+	// DNS port
+	if opts.DNSPort < 1 || opts.DNSPort > 65535 {
+		fail("--dns-port %d is out of range", opts.DNSPort)
+	} else {
+		fmt.Printf("  dns port:      %d\n", opts.DNSPort)
+	}
+
+	// Per-domain keys
+	for domain, path := range opts.DomainKeys {
+		if privKey, err := crypto.LoadPrivateKey(path); err != nil {
+			fail("key for %s (%s): %v", domain, path, err)
+		} else {
+			fmt.Printf("  domain key:    %s %s (%s)\n", domain, path, crypto.PublicKeyFingerprint(crypto.PublicKeyOf(privKey)))
+		}
+	}
+
+	// Private key (needed unless every domain has its own)
+	needDefault := false
+	for d := range seen {
+		if _, ok := opts.DomainKeys[d]; !ok {
+			needDefault = true
+		}
+	}
+	if opts.PrivkeyFile == "" {
+		if needDefault {
+			fail("--privkey-file is required (or a --domain-key for every domain)")
+		}
+	} else if privKey, err := crypto.LoadPrivateKey(opts.PrivkeyFile); err != nil {
+		fail("private key %s: %v", opts.PrivkeyFile, err)
+	} else if _, err := crypto.GetTLSConfig(privKey); err != nil {
+		fail("TLS config from %s: %v", opts.PrivkeyFile, err)
+	} else {
+		pubKey := privKey.Public().(ed25519.PublicKey)
+		fmt.Printf("  private key:   %s\n", opts.PrivkeyFile)
+		fmt.Printf("  fingerprint:   %s\n", crypto.PublicKeyFingerprint(pubKey))
+	}
+
+	// Client keys
+	if opts.ClientKeys != "" {
+		if keys, err := server.LoadClientKeys(opts.ClientKeys); err != nil {
+			fail("client keys: %v", err)
+		} else {
+			fmt.Printf("  client keys:   %s (%d clients)\n", opts.ClientKeys, keys.Len())
+		}
+	}
+
+	// Upstream target
+	switch opts.TargetType {
+	case "direct":
+		fmt.Println("  target:        direct")
+	case "socks5":
+		if opts.Target == "" {
+			fail("--target is required when --target-type=socks5")
+			break
+		}
+		conn, err := net.DialTimeout("tcp", opts.Target, 5*time.Second)
+		if err != nil {
+			fail("upstream SOCKS5 %s unreachable: %v", opts.Target, err)
+			break
+		}
+		conn.Close()
+		fmt.Printf("  target:        socks5 %s (reachable)\n", opts.Target)
+	case "http-connect":
+		d, err := newHTTPConnectDialer(opts.Target)
+		if err != nil {
+			fail("--target: %v", err)
+			break
+		}
+		conn, err := net.DialTimeout("tcp", d.proxyAddr, 5*time.Second)
+		if err != nil {
+			fail("upstream HTTP proxy %s unreachable: %v", d.proxyAddr, err)
+			break
+		}
+		conn.Close()
+		fmt.Printf("  target:        http-connect %s (reachable)\n", d.proxyAddr)
+	default:
+		fail("--target-type must be direct, socks5 or http-connect, got %q", opts.TargetType)
+	}
+
+	// Target policy
+	if opts.TargetPolicy != "" {
+		if _, err := server.LoadTargetPolicy(opts.TargetPolicy); err != nil {
+			fail("target policy: %v", err)
+		} else {
+			fmt.Printf("  target policy: %s\n", opts.TargetPolicy)
+		}
+	}
+
+	// Sizes
+	if opts.MaxFrags < 1 || opts.MaxFrags > protocol.MaxFragsPerResponse {
+		fail("--max-frags must be between 1 and %d", protocol.MaxFragsPerResponse)
+	}
+	if opts.MinPacketSize < 512 || opts.MinPacketSize > 1200 {
+		fail("--min-packet-size must be between 512 and 1200")
+	}
+	if opts.MaxPacketSize < 512 || opts.MaxPacketSize > 1200 {
+		fail("--max-packet-size must be between 512 and 1200")
+	}
+	if opts.MinPacketSize > opts.MaxPacketSize {
+		fail("--min-packet-size cannot be greater than --max-packet-size")
+	}
+	fmt.Printf("  max frags:     %d\n", opts.MaxFrags)
+	fmt.Printf("  packet size:   %d-%d\n", opts.MinPacketSize, opts.MaxPacketSize)
+
+	// Sessions and streams
+	if opts.SessionTTL <= 0 {
+		fail("--session-ttl must be positive")
+	}
+	if opts.ReassemblyTimeout <= 0 {
+		fail("--reassembly-timeout must be positive")
+	}
+	if opts.MaxSessions < 0 {
+		fail("--max-sessions cannot be negative")
+	}
+	if opts.MaxStreamsPerSession < 0 {
+		fail("--max-streams-per-session cannot be negative")
+	}
+	if opts.StreamIdleTimeout < 0 {
+		fail("--stream-idle-timeout cannot be negative")
+	}
+	if opts.StreamWindow < 0 {
+		fail("--stream-window cannot be negative")
+	}
+	if opts.MaxQPSPerSession < 0 || opts.MaxQPSPerIP < 0 {
+		fail("--max-qps-per-session and --max-qps-per-ip cannot be negative")
+	}
+	fmt.Printf("  sessions:      ttl %v, max %s\n", opts.SessionTTL, limitString(opts.MaxSessions))
+	fmt.Printf("  reassembly:    %v timeout\n", opts.ReassemblyTimeout)
+	fmt.Printf("  streams:       max %s per session\n", limitString(opts.MaxStreamsPerSession))
+	fmt.Printf("  query rate:    %s per session, %s per IP\n", limitString(opts.MaxQPSPerSession), limitString(opts.MaxQPSPerIP))
+
+	// Transport
+	if opts.ALPN == "" {
+		fail("--alpn cannot be empty")
+	}
+	switch opts.TargetFamily {
+	case familyAuto, familyIPv4, familyIPv6, familyPreferIPv4, familyPreferIPv6:
+	default:
+		fail("--target-family must be auto, ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+	}
+	if _, err := parseRecordTypes(opts.DownstreamRecords); err != nil {
+		fail("--downstream-record: %v", err)
+	}
+	if opts.ResponseHold < 0 || opts.ResponseHold > server.MaxResponseHold {
+		fail("--response-hold must be between 0 and %v", server.MaxResponseHold)
+	}
+	if opts.MaxPollHold < 0 {
+		fail("--max-poll-hold cannot be negative")
+	}
+	if opts.RedundancyThreshold < 0 {
+		fail("--redundancy-threshold cannot be negative")
+	}
+	if opts.FECRatio < 0 || opts.FECRatio > protocol.MaxFECRatio {
+		fail("--fec-ratio must be between 0 and %v", protocol.MaxFECRatio)
+	}
+	if opts.DownstreamCredit < 0 {
+		fail("--downstream-credit cannot be negative")
+	}
+	if opts.DownstreamQueue < 0 {
+		fail("--downstream-queue cannot be negative")
+	}
+	if opts.UDPReadBuffer < 0 || opts.UDPWriteBuffer < 0 {
+		fail("--udp-read-buffer and --udp-write-buffer cannot be negative")
+	}
+	fmt.Printf("  alpn:          %s\n", opts.ALPN)
+
+	if len(problems) > 0 {
+		fmt.Printf("\n%d problem(s) found:\n", len(problems))
+		for _, p := range problems {
+			fmt.Printf("  - %s\n", p)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("\nConfiguration OK")
+	os.Exit(0)
+}
+
+// limitString prints a limit where 0 means none
+func limitString(n int) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(n)
+}
@@ -0,0 +1,116 @@
+// Package config loads flag values from a JSON file given with --config.
+// The file is an object keyed by flag name; a value set on the command line
+// wins over the file, which wins over the --profile preset:
+//
+//	{
+//	  "domain": ["t1.example.com", "t2.example.com"],
+//	  "privkey-file": "/etc/slipstream/server.key",
+//	  "max-frags": 8,
+//	  "drop-rejected": true
+//	}
+//
+// Arrays set repeatable flags once per element.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// File is a parsed configuration file: flag name to the values to set
+type File struct {
+	Path   string
+	values map[string][]string
+}
+
+// Load reads and parses a configuration file
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	f := &File{Path: path, values: make(map[string][]string, len(raw))}
+	for name, v := range raw {
+		items, isList := v.([]any)
+		if !isList {
+			items = []any{v}
+		}
+		for _, item := range items {
+			s, err := scalar(item)
+			if err != nil {
+				return nil, fmt.Errorf("config %s: %q: %w", path, name, err)
+			}
+			f.values[name] = append(f.values[name], s)
+		}
+	}
+	return f, nil
+}
+
+// scalar renders a JSON string, number or bool the way the flag package parses it
+func scalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	default:
+		return "", fmt.Errorf("want a string, number, bool or an array of them")
+	}
+}
+
+// Apply sets every flag of fs the file names unless it was set on the
+// command line (explicit). A name fs doesn't define is an error, so typos
+// don't go unnoticed. Call it after fs.Parse and before the profile.
+func (f *File) Apply(fs *flag.FlagSet, explicit map[string]bool) error {
+	if err := f.Check(fs); err != nil {
+		return err
+	}
+	for name, values := range f.values {
+		if explicit[name] {
+			continue
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("config %s: set --%s: %w", f.Path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Check returns an error for the first name in the file fs doesn't define
+func (f *File) Check(fs *flag.FlagSet) error {
+	for name := range f.values {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("config %s: unknown flag %q", f.Path, name)
+		}
+	}
+	return nil
+}
+
+// Values returns what the file sets a flag to, nil if it doesn't name it
+func (f *File) Values(name string) []string {
+	return f.values[name]
+}
+
+// Explicit returns the flags of fs set on the command line
+func Explicit(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { explicit[fl.Name] = true })
+	return explicit
+}
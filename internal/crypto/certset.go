@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// CertSet is the server's certificate for a key that can be replaced while
+// in use, the counterpart of the client's PinSet. Handshakes started after
+// Rotate get the new certificate; connections already established keep the
+// one they were made with, since TLS never asks for it again.
+type CertSet struct {
+	current atomic.Pointer[certSetEntry]
+}
+
+type certSetEntry struct {
+	cert        *tls.Certificate
+	key         ed25519.PrivateKey
+	fingerprint string
+}
+
+// NewCertSet creates a certificate set serving privKey
+func NewCertSet(privKey ed25519.PrivateKey) (*CertSet, error) {
+	c := &CertSet{}
+	if err := c.Rotate(privKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Rotate derives a certificate for privKey and atomically starts serving it
+func (c *CertSet) Rotate(privKey ed25519.PrivateKey) error {
+	cert, err := GenerateTLSCertificate(privKey)
+	if err != nil {
+		return err
+	}
+	c.current.Store(&certSetEntry{
+		cert:        &cert,
+		key:         privKey,
+		fingerprint: PublicKeyFingerprint(PublicKeyOf(privKey)),
+	})
+	return nil
+}
+
+// Replace starts serving the certificate next holds, so a certificate can be
+// derived and checked before anything changes
+func (c *CertSet) Replace(next *CertSet) {
+	c.current.Store(next.current.Load())
+}
+
+// LoadKey loads the private key at path (see LoadPrivateKey), starts serving
+// it and returns its fingerprint
+func (c *CertSet) LoadKey(path string) (string, error) {
+	privKey, err := LoadPrivateKey(path)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Rotate(privKey); err != nil {
+		return "", err
+	}
+	return c.Fingerprint(), nil
+}
+
+// Certificate returns the certificate currently served
+func (c *CertSet) Certificate() *tls.Certificate {
+	return c.current.Load().cert
+}
+
+// PrivateKey returns the key currently served
+func (c *CertSet) PrivateKey() ed25519.PrivateKey {
+	return c.current.Load().key
+}
+
+// Fingerprint returns the fingerprint clients must pin for the current key
+func (c *CertSet) Fingerprint() string {
+	return c.current.Load().fingerprint
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *CertSet) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
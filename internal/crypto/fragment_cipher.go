@@ -0,0 +1,254 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Fragment encryption: QUIC already encrypts its payloads, but its packets
+// keep a recognizable shape (long header, version, Initial sizes) inside the
+// DNS labels. A FragmentCipher seals every fragment with ChaCha20-Poly1305,
+// header included, so what a resolver or DPI box decodes is random bytes.
+//
+// The key comes from an X25519 exchange bootstrapped from the server's
+// Ed25519 identity: the server's X25519 key is its Ed25519 key mapped to the
+// Montgomery curve (RFC 7748 section 4.1), which clients already pin. The
+// client sends an ephemeral public key; both sides derive
+//
+//	shared = X25519(client ephemeral, server identity)
+//	keys   = HKDF-SHA256(shared, salt = client public || server Ed25519 public)
+//
+// 64 bytes: the client-to-server key, then the server-to-client key. The
+// server answers with its Ed25519 public key and a tag sealed with the
+// server-to-client key over the client's public key, which proves it holds
+// the identity key before the client sends anything under it.
+//
+// A sealed fragment is [counter:8][ciphertext][tag:16]: the counter is the
+// nonce, so a key never seals two fragments with the same one.
+
+const (
+	// FragmentKeySize is the length of an X25519 public key sent in the exchange
+	FragmentKeySize = 32
+	// FragmentCipherOverhead is what sealing adds to a fragment
+	FragmentCipherOverhead = fragmentCounterLen + chacha20poly1305.Overhead
+	// FragmentKeyReplySize is the length of the server's exchange answer
+	FragmentKeyReplySize = ed25519.PublicKeySize + chacha20poly1305.Overhead
+
+	fragmentCounterLen = 8
+	fragmentKeyInfo    = "slipstream fragment keys"
+)
+
+var (
+	// ErrFragmentAuth means a sealed fragment failed authentication
+	ErrFragmentAuth = errors.New("fragment failed authentication")
+	// ErrFragmentKeyReply means the server's exchange answer doesn't verify
+	ErrFragmentKeyReply = errors.New("fragment key exchange answer invalid")
+)
+
+// confirmNonce seals the exchange tag; counter nonces start with four zero
+// bytes, so it never collides with one
+var confirmNonce = bytes.Repeat([]byte{0xff}, chacha20poly1305.NonceSize)
+
+// FragmentCipher seals outgoing and opens incoming fragments of one session.
+// It is safe for concurrent use.
+type FragmentCipher struct {
+	seal    cipher.AEAD
+	open    cipher.AEAD
+	counter atomic.Uint64
+}
+
+// newFragmentCipher creates a cipher sealing with sealKey and opening with openKey
+func newFragmentCipher(sealKey, openKey []byte) (*FragmentCipher, error) {
+	seal, err := chacha20poly1305.New(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := chacha20poly1305.New(openKey)
+	if err != nil {
+		return nil, err
+	}
+	return &FragmentCipher{seal: seal, open: open}, nil
+}
+
+// Seal returns frag encrypted and authenticated under the next counter
+func (f *FragmentCipher) Seal(frag []byte) []byte {
+	counter := f.counter.Add(1) - 1
+	out := make([]byte, fragmentCounterLen, fragmentCounterLen+len(frag)+chacha20poly1305.Overhead)
+	binary.BigEndian.PutUint64(out, counter)
+	return f.seal.Seal(out, fragmentNonce(counter), frag, nil)
+}
+
+// Open returns the fragment sealed in data, or ErrFragmentAuth if it was
+// sealed under another key or altered
+func (f *FragmentCipher) Open(data []byte) ([]byte, error) {
+	if len(data) < FragmentCipherOverhead {
+		return nil, ErrFragmentAuth
+	}
+	counter := binary.BigEndian.Uint64(data[:fragmentCounterLen])
+	frag, err := f.open.Open(nil, fragmentNonce(counter), data[fragmentCounterLen:], nil)
+	if err != nil {
+		return nil, ErrFragmentAuth
+	}
+	return frag, nil
+}
+
+// fragmentNonce returns the nonce for counter: four zero bytes, then the counter
+func fragmentNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// FragmentKeyExchange is the client's half of the exchange: an ephemeral
+// X25519 key waiting for the server's answer
+type FragmentKeyExchange struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewFragmentKeyExchange starts an exchange with a fresh ephemeral key
+func NewFragmentKeyExchange() (*FragmentKeyExchange, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate X25519 key: %w", err)
+	}
+	return &FragmentKeyExchange{priv: priv}, nil
+}
+
+// PublicKey returns the ephemeral public key to send to the server
+func (x *FragmentKeyExchange) PublicKey() []byte {
+	return x.priv.PublicKey().Bytes()
+}
+
+// Finish checks the server's answer and returns the client's cipher.
+// verify must accept the server's Ed25519 identity key, e.g. by its pinned
+// fingerprint (see PinSet.VerifyKey).
+func (x *FragmentKeyExchange) Finish(reply []byte, verify func(ed25519.PublicKey) error) (*FragmentCipher, error) {
+	if len(reply) != FragmentKeyReplySize {
+		return nil, ErrFragmentKeyReply
+	}
+	identity := ed25519.PublicKey(bytes.Clone(reply[:ed25519.PublicKeySize]))
+	if err := verify(identity); err != nil {
+		return nil, err
+	}
+	serverKey, err := X25519PublicKeyFromEd25519(identity)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := x.priv.ECDH(serverKey)
+	if err != nil {
+		return nil, fmt.Errorf("X25519: %w", err)
+	}
+	up, down, err := deriveFragmentKeys(shared, x.PublicKey(), identity)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFragmentCipher(up, down)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.open.Open(nil, confirmNonce, reply[ed25519.PublicKeySize:], x.PublicKey()); err != nil {
+		return nil, ErrFragmentKeyReply
+	}
+	return f, nil
+}
+
+// AnswerFragmentKeyExchange is the server's half: it derives the session's
+// cipher from the client's ephemeral public key and returns it with the
+// answer for the client. The same inputs always give the same keys.
+func AnswerFragmentKeyExchange(identity ed25519.PrivateKey, clientKey []byte) (*FragmentCipher, []byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(clientKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client key: %w", err)
+	}
+	priv, err := X25519PrivateKeyFromEd25519(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("X25519: %w", err)
+	}
+	pub := PublicKeyOf(identity)
+	up, down, err := deriveFragmentKeys(shared, clientKey, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := newFragmentCipher(down, up)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply := append(bytes.Clone(pub), f.seal.Seal(nil, confirmNonce, nil, clientKey)...)
+	return f, reply, nil
+}
+
+// deriveFragmentKeys returns the client-to-server and server-to-client keys
+func deriveFragmentKeys(shared, clientKey []byte, identity ed25519.PublicKey) (up, down []byte, err error) {
+	salt := append(bytes.Clone(clientKey), identity...)
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(fragmentKeyInfo)), keys); err != nil {
+		return nil, nil, fmt.Errorf("derive fragment keys: %w", err)
+	}
+	return keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:], nil
+}
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// X25519PublicKeyFromEd25519 maps an Ed25519 public key to the X25519 key of
+// the same secret (RFC 7748 section 4.1): u = (1 + y) / (1 - y)
+func X25519PublicKeyFromEd25519(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	// y is little-endian with the sign of x in the top bit
+	le := bytes.Clone(pub)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("Ed25519 public key out of range")
+	}
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("Ed25519 public key has no X25519 form")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+	return ecdh.X25519().NewPublicKey(reverse(u.FillBytes(make([]byte, 32))))
+}
+
+// X25519PrivateKeyFromEd25519 returns the X25519 key of an Ed25519 key's
+// secret scalar, the first half of SHA-512 of its seed (RFC 8032 section
+// 5.1.5); X25519 clamps it the same way
+func X25519PrivateKeyFromEd25519(priv ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	h := sha512.Sum512(priv.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// reverse returns b with its bytes in the opposite order, converting between
+// big.Int's big-endian and the curve's little-endian encoding
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, v := range b {
+		out[len(b)-1-i] = v
+	}
+	return out
+}
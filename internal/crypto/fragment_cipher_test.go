@@ -0,0 +1,231 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// agreeFragmentCiphers runs the key exchange against identity and returns the
+// client's and the server's cipher
+func agreeFragmentCiphers(t *testing.T, identity ed25519.PrivateKey) (client, server *FragmentCipher) {
+	t.Helper()
+	exchange, err := NewFragmentKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, reply, err := AnswerFragmentKeyExchange(identity, exchange.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := NewPinSet([]string{PublicKeyFingerprint(PublicKeyOf(identity))})
+	client, err = exchange.Finish(reply, pins.VerifyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestFragmentCipherRoundTrip(t *testing.T) {
+	_, identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := agreeFragmentCiphers(t, identity)
+
+	for _, frag := range [][]byte{{}, []byte("x"), bytes.Repeat([]byte{0xAB}, 128)} {
+		up := client.Seal(frag)
+		if len(up) != len(frag)+FragmentCipherOverhead {
+			t.Errorf("sealed %d bytes into %d, want %d of overhead", len(frag), len(up), FragmentCipherOverhead)
+		}
+		if got, err := server.Open(up); err != nil || !bytes.Equal(got, frag) {
+			t.Errorf("upstream: got %x, %v; want %x", got, err, frag)
+		}
+		down := server.Seal(frag)
+		if got, err := client.Open(down); err != nil || !bytes.Equal(got, frag) {
+			t.Errorf("downstream: got %x, %v; want %x", got, err, frag)
+		}
+	}
+
+	// Every fragment gets its own counter, so equal fragments don't look alike
+	frag := []byte("same fragment")
+	if bytes.Equal(client.Seal(frag), client.Seal(frag)) {
+		t.Error("the same fragment sealed twice came out the same")
+	}
+}
+
+func TestFragmentCipherRejectsTampering(t *testing.T) {
+	_, identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := agreeFragmentCiphers(t, identity)
+	sealed := client.Seal([]byte("QUIC packet fragment"))
+
+	// Counter, ciphertext and tag are all covered
+	for i := range sealed {
+		tampered := bytes.Clone(sealed)
+		tampered[i] ^= 0x01
+		if _, err := server.Open(tampered); !errors.Is(err, ErrFragmentAuth) {
+			t.Fatalf("byte %d flipped: got %v, want ErrFragmentAuth", i, err)
+		}
+	}
+	for _, short := range [][]byte{nil, sealed[:FragmentCipherOverhead-1], sealed[:len(sealed)-1]} {
+		if _, err := server.Open(short); !errors.Is(err, ErrFragmentAuth) {
+			t.Errorf("%d of %d bytes: got %v, want ErrFragmentAuth", len(short), len(sealed), err)
+		}
+	}
+	// Each direction has its own key
+	if _, err := client.Open(sealed); !errors.Is(err, ErrFragmentAuth) {
+		t.Errorf("opened an upstream fragment as downstream: %v", err)
+	}
+	// And every exchange its own keys
+	_, otherServer := agreeFragmentCiphers(t, identity)
+	if _, err := otherServer.Open(sealed); !errors.Is(err, ErrFragmentAuth) {
+		t.Errorf("another session opened the fragment: %v", err)
+	}
+	if got, err := server.Open(sealed); err != nil || string(got) != "QUIC packet fragment" {
+		t.Errorf("untouched fragment: got %q, %v", got, err)
+	}
+}
+
+func TestFragmentKeyExchangeVerifiesServer(t *testing.T) {
+	_, identity, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, impostor, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := NewPinSet([]string{PublicKeyFingerprint(PublicKeyOf(identity))})
+
+	exchange, err := NewFragmentKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, reply, err := AnswerFragmentKeyExchange(impostor, exchange.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exchange.Finish(reply, pins.VerifyKey); err == nil {
+		t.Error("accepted an answer from an unpinned key")
+	}
+
+	_, reply, err = AnswerFragmentKeyExchange(identity, exchange.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(reply)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := exchange.Finish(tampered, pins.VerifyKey); !errors.Is(err, ErrFragmentKeyReply) {
+		t.Errorf("altered answer: got %v, want ErrFragmentKeyReply", err)
+	}
+	if _, err := exchange.Finish(reply[:len(reply)-1], pins.VerifyKey); !errors.Is(err, ErrFragmentKeyReply) {
+		t.Errorf("short answer: got %v, want ErrFragmentKeyReply", err)
+	}
+	if _, err := exchange.Finish(reply, pins.VerifyKey); err != nil {
+		t.Errorf("genuine answer: %v", err)
+	}
+}
+
+// mustHex decodes a hex test vector
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Known answers for the identity key of RFC 8032 test 1 and the client
+// ephemeral key of RFC 7748 section 6.1 (Alice), computed with an
+// independent implementation of X25519, HKDF-SHA256 and ChaCha20-Poly1305
+func TestFragmentCipherVectors(t *testing.T) {
+	identity := ed25519.NewKeyFromSeed(mustHex(t, "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"))
+	ephemeral, err := ecdh.X25519().NewPrivateKey(mustHex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := &FragmentKeyExchange{priv: ephemeral}
+	const (
+		identityPub  = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+		clientPub    = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+		serverX25519 = "d85e07ec22b0ad881537c2f44d662d1a143cf830c57aca4305d85c7a90f6b62e"
+		shared       = "90f395580ca33f3c54390ac1d7210220b6a336de2c47a61ac90ff56e6be11f18"
+		upKey        = "49f5e6c985e87b04872b0190a8ebf50106705b44d380a3fb9779c767202b076a"
+		downKey      = "56bd8c01714c151ff0cb433b52c66745f620d5a67be3b29f9ef7d80ac3a3b940"
+		reply        = identityPub + "4ac701c9f0066f23c92f231a39486af2"
+		sealedUp     = "0000000000000000" + "2025131c2c594d005a25d0f402c57fe3f41de1b1ce7c8c43d967c74829a7ff83bd884ecb"
+		sealedDown   = "0000000000000000" + "30879bcf366a14917cedbaad8e54ce8f9f12141716ed8bdc3cd0681484916a4cbc87f063"
+	)
+	frag := []byte("QUIC packet fragment")
+
+	if got := hex.EncodeToString(PublicKeyOf(identity)); got != identityPub {
+		t.Fatalf("identity public key %s, want %s", got, identityPub)
+	}
+	if got := hex.EncodeToString(exchange.PublicKey()); got != clientPub {
+		t.Errorf("client public key %s, want %s", got, clientPub)
+	}
+	// Both halves of the Ed25519 to X25519 mapping land on the same key
+	serverPub, err := X25519PublicKeyFromEd25519(PublicKeyOf(identity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(serverPub.Bytes()); got != serverX25519 {
+		t.Errorf("X25519 form of the identity %s, want %s", got, serverX25519)
+	}
+	serverPriv, err := X25519PrivateKeyFromEd25519(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(serverPriv.PublicKey().Bytes()); got != serverX25519 {
+		t.Errorf("X25519 public key of the identity's scalar %s, want %s", got, serverX25519)
+	}
+	secret, err := ephemeral.ECDH(serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(secret); got != shared {
+		t.Errorf("shared secret %s, want %s", got, shared)
+	}
+	up, down, err := deriveFragmentKeys(secret, exchange.PublicKey(), PublicKeyOf(identity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(up); got != upKey {
+		t.Errorf("client-to-server key %s, want %s", got, upKey)
+	}
+	if got := hex.EncodeToString(down); got != downKey {
+		t.Errorf("server-to-client key %s, want %s", got, downKey)
+	}
+
+	server, answer, err := AnswerFragmentKeyExchange(identity, exchange.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(answer); got != reply {
+		t.Errorf("answer %s, want %s", got, reply)
+	}
+	client, err := exchange.Finish(answer, func(ed25519.PublicKey) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first fragment each way is sealed under counter 0
+	if got := hex.EncodeToString(client.Seal(frag)); got != sealedUp {
+		t.Errorf("sealed upstream %s, want %s", got, sealedUp)
+	}
+	if got := hex.EncodeToString(server.Seal(frag)); got != sealedDown {
+		t.Errorf("sealed downstream %s, want %s", got, sealedDown)
+	}
+	if got, err := server.Open(mustHex(t, sealedUp)); err != nil || !bytes.Equal(got, frag) {
+		t.Errorf("opened upstream vector: %q, %v", got, err)
+	}
+	if got, err := client.Open(mustHex(t, sealedDown)); err != nil || !bytes.Equal(got, frag) {
+		t.Errorf("opened downstream vector: %q, %v", got, err)
+	}
+}
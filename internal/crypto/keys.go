@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
@@ -14,6 +15,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -65,19 +67,54 @@ func SavePublicKey(pubKey ed25519.PublicKey, path string) error {
 	return pem.Encode(f, block)
 }
 
-// LoadPrivateKey loads an Ed25519 private key from a PEM file
+// SavePrivateKeyRaw saves an Ed25519 private key as its raw 32-byte seed,
+// the form other tools often use
+func SavePrivateKeyRaw(privKey ed25519.PrivateKey, path string) error {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return errors.New("not an Ed25519 private key")
+	}
+	return os.WriteFile(path, privKey.Seed(), 0600)
+}
+
+// LoadPrivateKey loads an Ed25519 private key from a file holding it as
+// PEM-wrapped PKCS#8, PKCS#8 DER, a raw 32-byte seed or the raw 64-byte
+// seed and public key
 func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read file: %w", err)
 	}
+	return parsePrivateKey(data)
+}
 
-	block, _ := pem.Decode(data)
-	if block == nil {
+// parsePrivateKey decodes an Ed25519 private key in any of the formats
+// LoadPrivateKey accepts
+func parsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return parsePKCS8PrivateKey(block.Bytes)
+	}
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		privKey := ed25519.NewKeyFromSeed(data[:ed25519.SeedSize])
+		if !bytes.Equal(privKey[ed25519.SeedSize:], data[ed25519.SeedSize:]) {
+			return nil, errors.New("raw private key's public half does not match its seed")
+		}
+		return privKey, nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
 		return nil, errors.New("failed to decode PEM block")
 	}
+	privKey, err := parsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%d bytes are neither PEM, PKCS#8 DER nor a raw %d- or %d-byte key: %w", len(data), ed25519.SeedSize, ed25519.PrivateKeySize, err)
+	}
+	return privKey, nil
+}
 
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+func parsePKCS8PrivateKey(der []byte) (ed25519.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
 		return nil, fmt.Errorf("parse private key: %w", err)
 	}
@@ -90,19 +127,37 @@ func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
 	return privKey, nil
 }
 
-// LoadPublicKey loads an Ed25519 public key from a PEM file
+// LoadPublicKey loads an Ed25519 public key from a file holding it as
+// PEM-wrapped PKIX, PKIX DER or the raw 32 bytes
 func LoadPublicKey(path string) (ed25519.PublicKey, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read file: %w", err)
 	}
+	return parsePublicKey(data)
+}
 
-	block, _ := pem.Decode(data)
-	if block == nil {
+// parsePublicKey decodes an Ed25519 public key in any of the formats
+// LoadPublicKey accepts
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return parsePKIXPublicKey(block.Bytes)
+	}
+	if len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(bytes.Clone(data)), nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
 		return nil, errors.New("failed to decode PEM block")
 	}
+	pubKey, err := parsePKIXPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%d bytes are neither PEM, PKIX DER nor a raw %d-byte key: %w", len(data), ed25519.PublicKeySize, err)
+	}
+	return pubKey, nil
+}
 
-	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+func parsePKIXPublicKey(der []byte) (ed25519.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
 	if err != nil {
 		return nil, fmt.Errorf("parse public key: %w", err)
 	}
@@ -155,6 +210,11 @@ func PublicKeyFingerprint(pubKey ed25519.PublicKey) string {
 
 // CreatePinningVerifier creates a TLS verification callback that pins to a specific public key fingerprint
 func CreatePinningVerifier(expectedFingerprint string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return CreateMultiPinningVerifier([]string{expectedFingerprint})
+}
+
+// CreateMultiPinningVerifier pins to any of several fingerprints (e.g. during a key rotation)
+func CreateMultiPinningVerifier(expectedFingerprints []string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 		if len(rawCerts) == 0 {
 			return errors.New("no certificates provided")
@@ -171,36 +231,59 @@ func CreatePinningVerifier(expectedFingerprint string) func(rawCerts [][]byte, v
 		}
 
 		fingerprint := PublicKeyFingerprint(pubKey)
-		if fingerprint != expectedFingerprint {
-			return fmt.Errorf("certificate fingerprint mismatch: got %s, expected %s", fingerprint, expectedFingerprint)
+		for _, expected := range expectedFingerprints {
+			if fingerprint == expected {
+				return nil
+			}
 		}
-
-		return nil
+		return fmt.Errorf("certificate fingerprint mismatch: got %s, expected %s", fingerprint, strings.Join(expectedFingerprints, " or "))
 	}
 }
 
-// GetTLSConfig returns a TLS config for the server using the given private key
+// GetTLSConfig returns a TLS config for the server using the given private
+// key; use GetRotatingTLSConfig to replace the key later
 func GetTLSConfig(privKey ed25519.PrivateKey) (*tls.Config, error) {
-	cert, err := GenerateTLSCertificate(privKey)
+	certs, err := NewCertSet(privKey)
 	if err != nil {
 		return nil, err
 	}
+	return GetRotatingTLSConfig(certs), nil
+}
 
+// GetRotatingTLSConfig returns a server TLS config serving whatever key certs
+// holds at the time of each handshake (see CertSet.Rotate)
+func GetRotatingTLSConfig(certs *CertSet) *tls.Config {
+	return GetSelectingTLSConfig(certs.GetCertificate)
+}
+
+// GetSelectingTLSConfig returns a server TLS config that picks the certificate
+// for every handshake through getCert (e.g. per tunnel domain)
+func GetSelectingTLSConfig(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
 	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"slipstream"},
-	}, nil
+		GetCertificate: getCert,
+		NextProtos:     []string{"slipstream"},
+	}
 }
 
 // GetClientTLSConfig returns a TLS config for the client with certificate pinning
 func GetClientTLSConfig(expectedFingerprint string) *tls.Config {
+	return GetClientTLSConfigMulti([]string{expectedFingerprint})
+}
+
+// GetClientTLSConfigMulti returns a client TLS config accepting any of the pinned fingerprints
+func GetClientTLSConfigMulti(expectedFingerprints []string) *tls.Config {
 	return &tls.Config{
 		InsecureSkipVerify:    true, // Skip default verification
-		VerifyPeerCertificate: CreatePinningVerifier(expectedFingerprint),
+		VerifyPeerCertificate: CreateMultiPinningVerifier(expectedFingerprints),
 		NextProtos:            []string{"slipstream"},
 	}
 }
 
+// PublicKeyOf returns the public half of an Ed25519 private key
+func PublicKeyOf(privKey ed25519.PrivateKey) ed25519.PublicKey {
+	return privKey.Public().(ed25519.PublicKey)
+}
+
 // SignerFromPrivateKey returns a crypto.Signer from an Ed25519 private key
 func SignerFromPrivateKey(privKey ed25519.PrivateKey) crypto.Signer {
 	return privKey
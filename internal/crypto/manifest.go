@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ManifestVersion is the manifest format produced by SignManifest
+const ManifestVersion = 1
+
+// Manifest publishes the server fingerprints clients should pin for a domain.
+// Listing more than one fingerprint lets a key rotation overlap: clients
+// accept the old and the new key until the next manifest drops the old one.
+type Manifest struct {
+	Version      int       `json:"version"`
+	Domain       string    `json:"domain"`
+	Fingerprints []string  `json:"fingerprints"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+}
+
+// SignedManifest is the on-the-wire form: the manifest bytes exactly as
+// signed, the signer's public key and the Ed25519 signature, all base64
+type SignedManifest struct {
+	Manifest  string `json:"manifest"`
+	SignerKey string `json:"signer_key"`
+	Signature string `json:"signature"`
+}
+
+var (
+	// ErrManifestSignature means the signature does not verify
+	ErrManifestSignature = errors.New("manifest signature invalid")
+	// ErrManifestSigner means the manifest was signed by an untrusted key
+	ErrManifestSigner = errors.New("manifest signed by untrusted key")
+	// ErrManifestExpired means the manifest is outside its validity period
+	ErrManifestExpired = errors.New("manifest not valid at this time")
+)
+
+// SignManifest signs m with signer (an Ed25519 key, see SignerFromPrivateKey)
+// and returns the SignedManifest as JSON
+func SignManifest(m Manifest, signer crypto.Signer) ([]byte, error) {
+	pubKey, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("manifest signer is not an Ed25519 key")
+	}
+	if m.Version == 0 {
+		m.Version = ManifestVersion
+	}
+	if m.Domain == "" || len(m.Fingerprints) == 0 {
+		return nil, errors.New("manifest needs a domain and at least one fingerprint")
+	}
+	if !m.NotAfter.After(m.NotBefore) {
+		return nil, errors.New("manifest validity period is empty")
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	// Ed25519 signs the message itself (no pre-hash)
+	sig, err := signer.Sign(nil, body, crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("sign manifest: %w", err)
+	}
+	return json.MarshalIndent(SignedManifest{
+		Manifest:  base64.StdEncoding.EncodeToString(body),
+		SignerKey: base64.StdEncoding.EncodeToString(pubKey),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}, "", "  ")
+}
+
+// VerifyManifest checks a signed manifest and returns its contents. The
+// signer key must have signerFingerprint (see PublicKeyFingerprint) and the
+// manifest must be valid at now. The signer fingerprint is the long-lived
+// trust anchor; the fingerprints inside can rotate freely.
+func VerifyManifest(data []byte, signerFingerprint string, now time.Time) (*Manifest, ed25519.PublicKey, error) {
+	var sm SignedManifest
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return nil, nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	body, err1 := base64.StdEncoding.DecodeString(sm.Manifest)
+	keyBytes, err2 := base64.StdEncoding.DecodeString(sm.SignerKey)
+	sig, err3 := base64.StdEncoding.DecodeString(sm.Signature)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return nil, nil, errors.New("manifest signer key has the wrong size")
+	}
+	signerKey := ed25519.PublicKey(keyBytes)
+
+	if signerFingerprint != "" && PublicKeyFingerprint(signerKey) != signerFingerprint {
+		return nil, nil, ErrManifestSigner
+	}
+	if !ed25519.Verify(signerKey, body, sig) {
+		return nil, nil, ErrManifestSignature
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, nil, fmt.Errorf("parse manifest body: %w", err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if now.Before(m.NotBefore) || now.After(m.NotAfter) {
+		return nil, nil, ErrManifestExpired
+	}
+	return &m, signerKey, nil
+}
+
+// LoadManifest reads and verifies a signed manifest for domain. With an empty
+// signerFingerprint the signer is trusted on first use: its fingerprint is
+// stored in pinFile and required from then on.
+func LoadManifest(path, domain, signerFingerprint, pinFile string, now time.Time) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	firstUse := false
+	if signerFingerprint == "" && pinFile != "" {
+		pinned, err := os.ReadFile(pinFile)
+		switch {
+		case err == nil:
+			signerFingerprint = strings.TrimSpace(string(pinned))
+		case errors.Is(err, os.ErrNotExist):
+			firstUse = true
+		default:
+			return nil, fmt.Errorf("read signer pin: %w", err)
+		}
+	}
+	if signerFingerprint == "" && !firstUse {
+		return nil, errors.New("no trusted manifest signer configured")
+	}
+
+	m, signerKey, err := VerifyManifest(data, signerFingerprint, now)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(strings.TrimSuffix(m.Domain, "."), strings.TrimSuffix(domain, ".")) {
+		return nil, fmt.Errorf("manifest is for domain %s, not %s", m.Domain, domain)
+	}
+	if firstUse {
+		if err := os.WriteFile(pinFile, []byte(PublicKeyFingerprint(signerKey)+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("store signer pin: %w", err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,134 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var manifestNow = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// signTestManifest signs a manifest for t.example.com valid for a day around
+// manifestNow and returns it with the signer's private key
+func signTestManifest(t *testing.T, fingerprints ...string) ([]byte, ed25519.PrivateKey) {
+	t.Helper()
+	_, signer, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := SignManifest(Manifest{
+		Domain:       "t.example.com",
+		Fingerprints: fingerprints,
+		NotBefore:    manifestNow.Add(-12 * time.Hour),
+		NotAfter:     manifestNow.Add(12 * time.Hour),
+	}, SignerFromPrivateKey(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, signer
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	data, signer := signTestManifest(t, "old-fingerprint", "new-fingerprint")
+	m, signerKey, err := VerifyManifest(data, PublicKeyFingerprint(PublicKeyOf(signer)), manifestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != ManifestVersion || m.Domain != "t.example.com" {
+		t.Errorf("got version %d for %s", m.Version, m.Domain)
+	}
+	if !slices.Equal(m.Fingerprints, []string{"old-fingerprint", "new-fingerprint"}) {
+		t.Errorf("got fingerprints %v", m.Fingerprints)
+	}
+	if !signerKey.Equal(PublicKeyOf(signer)) {
+		t.Error("returned another signer key")
+	}
+}
+
+func TestManifestExpired(t *testing.T) {
+	data, signer := signTestManifest(t, "fingerprint")
+	pin := PublicKeyFingerprint(PublicKeyOf(signer))
+	for _, at := range []time.Time{manifestNow.Add(-13 * time.Hour), manifestNow.Add(13 * time.Hour)} {
+		if _, _, err := VerifyManifest(data, pin, at); !errors.Is(err, ErrManifestExpired) {
+			t.Errorf("at %v: got %v, want ErrManifestExpired", at, err)
+		}
+	}
+}
+
+func TestManifestWrongSigner(t *testing.T) {
+	data, _ := signTestManifest(t, "fingerprint")
+	_, trusted, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyManifest(data, PublicKeyFingerprint(PublicKeyOf(trusted)), manifestNow); !errors.Is(err, ErrManifestSigner) {
+		t.Errorf("got %v, want ErrManifestSigner", err)
+	}
+
+	// Claiming the trusted key doesn't help without its signature
+	var sm SignedManifest
+	if err := json.Unmarshal(data, &sm); err != nil {
+		t.Fatal(err)
+	}
+	sm.SignerKey = base64.StdEncoding.EncodeToString(PublicKeyOf(trusted))
+	forged, _ := json.Marshal(sm)
+	if _, _, err := VerifyManifest(forged, PublicKeyFingerprint(PublicKeyOf(trusted)), manifestNow); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("forged signer key: got %v, want ErrManifestSignature", err)
+	}
+}
+
+func TestManifestTamperedFingerprints(t *testing.T) {
+	data, signer := signTestManifest(t, "genuine-fingerprint")
+	var sm SignedManifest
+	if err := json.Unmarshal(data, &sm); err != nil {
+		t.Fatal(err)
+	}
+	body, err := base64.StdEncoding.DecodeString(sm.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Manifest = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(body), "genuine-fingerprint", "attacker-fingerprint", 1)))
+	tampered, _ := json.Marshal(sm)
+	if _, _, err := VerifyManifest(tampered, PublicKeyFingerprint(PublicKeyOf(signer)), manifestNow); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("got %v, want ErrManifestSignature", err)
+	}
+}
+
+func TestLoadManifestTrustsFirstSigner(t *testing.T) {
+	dir := t.TempDir()
+	path, pinFile := filepath.Join(dir, "manifest.json"), filepath.Join(dir, "signer.pin")
+	data, signer := signTestManifest(t, "fingerprint")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(path, "T.example.com.", "", pinFile, manifestNow); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if pinned, _ := os.ReadFile(pinFile); strings.TrimSpace(string(pinned)) != PublicKeyFingerprint(PublicKeyOf(signer)) {
+		t.Errorf("pinned %q, want the signer's fingerprint", pinned)
+	}
+
+	// From then on only that signer is accepted
+	other, _ := signTestManifest(t, "fingerprint")
+	if err := os.WriteFile(path, other, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(path, "t.example.com", "", pinFile, manifestNow); !errors.Is(err, ErrManifestSigner) {
+		t.Errorf("another signer: got %v, want ErrManifestSigner", err)
+	}
+
+	// And only for its own domain
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(path, "other.example.com", "", pinFile, manifestNow); err == nil {
+		t.Error("accepted a manifest for another domain")
+	}
+}
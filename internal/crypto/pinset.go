@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+// PinSet is a set of accepted server fingerprints that can be replaced while
+// in use. Handshakes started after Set see the new pins; connections already
+// established are unaffected. An empty set accepts no server.
+type PinSet struct {
+	fingerprints atomic.Pointer[[]string]
+}
+
+// NewPinSet creates a pin set accepting the given fingerprints
+func NewPinSet(fingerprints []string) *PinSet {
+	p := &PinSet{}
+	p.Set(fingerprints)
+	return p
+}
+
+// Set atomically replaces the accepted fingerprints
+func (p *PinSet) Set(fingerprints []string) {
+	fps := append([]string(nil), fingerprints...)
+	p.fingerprints.Store(&fps)
+}
+
+// Fingerprints returns the currently accepted fingerprints
+func (p *PinSet) Fingerprints() []string {
+	return *p.fingerprints.Load()
+}
+
+// VerifyPeerCertificate checks the peer against the current pins
+func (p *PinSet) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return CreateMultiPinningVerifier(p.Fingerprints())(rawCerts, verifiedChains)
+}
+
+// VerifyKey checks a server public key against the current pins
+func (p *PinSet) VerifyKey(pubKey ed25519.PublicKey) error {
+	if fingerprint := PublicKeyFingerprint(pubKey); !slices.Contains(p.Fingerprints(), fingerprint) {
+		return fmt.Errorf("server key fingerprint %s is not pinned", fingerprint)
+	}
+	return nil
+}
+
+// GetClientTLSConfigPinSet returns a client TLS config pinned to a replaceable pin set
+func GetClientTLSConfigPinSet(pins *PinSet) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify:    true, // Skip default verification
+		VerifyPeerCertificate: pins.VerifyPeerCertificate,
+		NextProtos:            []string{"slipstream"},
+	}
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// newTestIdentity returns a fresh server key and the DER certificate it presents
+func newTestIdentity(t *testing.T) (ed25519.PublicKey, []byte) {
+	t.Helper()
+	pub, priv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := GenerateTLSCertificate(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, cert.Certificate[0]
+}
+
+func TestPinSetMatchesAnyPin(t *testing.T) {
+	oldKey, oldCert := newTestIdentity(t)
+	newKey, newCert := newTestIdentity(t)
+	_, unknownCert := newTestIdentity(t)
+	pins := NewPinSet([]string{PublicKeyFingerprint(oldKey), PublicKeyFingerprint(newKey)})
+
+	for name, cert := range map[string][]byte{"old": oldCert, "new": newCert} {
+		if err := pins.VerifyPeerCertificate([][]byte{cert}, nil); err != nil {
+			t.Errorf("%s key rejected: %v", name, err)
+		}
+	}
+	if err := pins.VerifyKey(newKey); err != nil {
+		t.Errorf("new key rejected: %v", err)
+	}
+	if err := pins.VerifyPeerCertificate([][]byte{unknownCert}, nil); err == nil {
+		t.Error("unpinned certificate accepted")
+	}
+	if err := pins.VerifyPeerCertificate(nil, nil); err == nil {
+		t.Error("handshake without a certificate accepted")
+	}
+}
+
+func TestPinSetRotation(t *testing.T) {
+	oldKey, oldCert := newTestIdentity(t)
+	newKey, newCert := newTestIdentity(t)
+	pins := NewPinSet([]string{PublicKeyFingerprint(oldKey)})
+	if err := pins.VerifyPeerCertificate([][]byte{newCert}, nil); err == nil {
+		t.Fatal("new key accepted before the rotation")
+	}
+
+	pins.Set([]string{PublicKeyFingerprint(newKey)})
+	if err := pins.VerifyPeerCertificate([][]byte{newCert}, nil); err != nil {
+		t.Errorf("new key rejected after the rotation: %v", err)
+	}
+	if err := pins.VerifyPeerCertificate([][]byte{oldCert}, nil); err == nil {
+		t.Error("old key still accepted after the rotation")
+	}
+}
+
+func TestPinSetEmpty(t *testing.T) {
+	key, cert := newTestIdentity(t)
+	pins := NewPinSet(nil)
+	if got := pins.Fingerprints(); len(got) != 0 {
+		t.Errorf("empty set holds %v", got)
+	}
+	if err := pins.VerifyPeerCertificate([][]byte{cert}, nil); err == nil {
+		t.Error("empty set accepted a certificate")
+	}
+	if err := pins.VerifyKey(key); err == nil {
+		t.Error("empty set accepted a key")
+	}
+
+	// Set copies its argument: changing the caller's slice changes nothing
+	fingerprints := []string{PublicKeyFingerprint(key)}
+	pins.Set(fingerprints)
+	fingerprints[0] = "changed"
+	if err := pins.VerifyKey(key); err != nil {
+		t.Errorf("pinned key rejected: %v", err)
+	}
+}
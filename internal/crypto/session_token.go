@@ -0,0 +1,171 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionTokenWindow is the validity period of a session token; the server
+// also accepts the neighbouring windows to tolerate clock skew
+const SessionTokenWindow = 5 * time.Minute
+
+// sessionTokenLen is the number of HMAC bytes carried in the label (64 bits)
+// Kept short because every label byte is taken from the QNAME data budget
+const sessionTokenLen = 8
+
+// sessionKeyIDLen and sessionCounterLen are the key ID and per-query counter
+// the token carries ahead of the HMAC: 14 bytes in all, 23 base32 chars
+const (
+	sessionKeyIDLen   = 2
+	sessionCounterLen = 4
+	sessionHeaderLen  = sessionKeyIDLen + sessionCounterLen
+)
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SessionKeyID is the short ID of a pre-shared key that session tokens
+// carry, so a server with many client keys finds the right one without
+// trying them all. IDs are not unique: two keys may share one.
+func SessionKeyID(psk []byte) uint16 {
+	sum := sha256.Sum256(append([]byte("slipstream-key-id:"), psk...))
+	return binary.BigEndian.Uint16(sum[:])
+}
+
+// SessionToken derives the token that proves knowledge of the pre-shared key
+// for sessionID in the time window containing t. The token carries the key's
+// SessionKeyID and counter, which the client must not reuse within a
+// session, so the server can tell a replayed query from a new one (see
+// ReplayWindow).
+func SessionToken(psk []byte, sessionID string, counter uint32, t time.Time) string {
+	return sessionTokenForWindow(psk, sessionID, counter, t.Unix()/int64(SessionTokenWindow/time.Second))
+}
+
+func sessionTokenForWindow(psk []byte, sessionID string, counter uint32, window int64) string {
+	header := make([]byte, sessionHeaderLen)
+	binary.BigEndian.PutUint16(header, SessionKeyID(psk))
+	binary.BigEndian.PutUint32(header[sessionKeyIDLen:], counter)
+	return strings.ToLower(tokenEncoding.EncodeToString(sessionMAC(psk, sessionID, header, window)))
+}
+
+// sessionMAC returns the header of a token (key ID and counter) followed by
+// its HMAC over sessionID, the header and window
+func sessionMAC(psk []byte, sessionID string, header []byte, window int64) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("slipstream-session:"))
+	mac.Write([]byte(strings.ToLower(sessionID)))
+	var w [8]byte
+	binary.BigEndian.PutUint64(w[:], uint64(window))
+	mac.Write(w[:])
+	mac.Write(header[:sessionHeaderLen])
+	out := make([]byte, sessionHeaderLen, sessionHeaderLen+sha256.Size)
+	copy(out, header)
+	return mac.Sum(out)[:sessionHeaderLen+sessionTokenLen]
+}
+
+// decodeSessionToken returns the raw bytes of a well-formed token
+func decodeSessionToken(token string) ([]byte, bool) {
+	raw, err := tokenEncoding.DecodeString(strings.ToUpper(token))
+	if err != nil || len(raw) != sessionHeaderLen+sessionTokenLen {
+		return nil, false
+	}
+	return raw, true
+}
+
+// SessionTokenKeyID returns the key ID a token claims to be made with; only
+// VerifySessionToken tells whether it really was
+func SessionTokenKeyID(token string) (uint16, bool) {
+	raw, ok := decodeSessionToken(token)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(raw), true
+}
+
+// VerifySessionToken checks a token against the current and adjacent windows
+// and returns the query counter it carries
+func VerifySessionToken(psk []byte, sessionID, token string, now time.Time) (uint32, bool) {
+	raw, ok := decodeSessionToken(token)
+	if !ok {
+		return 0, false
+	}
+	window := now.Unix() / int64(SessionTokenWindow/time.Second)
+	for _, w := range []int64{window, window - 1, window + 1} {
+		if hmac.Equal(raw, sessionMAC(psk, sessionID, raw, w)) {
+			return binary.BigEndian.Uint32(raw[sessionKeyIDLen:]), true
+		}
+	}
+	return 0, false
+}
+
+// ReplayWindowSize is how far behind the highest counter seen a query may
+// arrive: queries race each other through different resolvers
+const ReplayWindowSize = 1024
+
+// ReplayWindow rejects session token counters already seen, like the
+// anti-replay window of IPsec: counters more than ReplayWindowSize behind the
+// highest are rejected too, as there is no telling whether they were seen
+type ReplayWindow struct {
+	mu      sync.Mutex
+	started bool
+	highest uint32
+	seen    [ReplayWindowSize / 64]uint64
+}
+
+// Accept records counter and reports whether it is new
+func (w *ReplayWindow) Accept(counter uint32) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case !w.started:
+		w.started = true
+	case counter > w.highest:
+		// Forget the counters that fall out of the window
+		for i := uint32(1); i <= min(counter-w.highest, ReplayWindowSize); i++ {
+			w.clear(w.highest + i)
+		}
+	case w.highest-counter >= ReplayWindowSize || w.has(counter):
+		return false
+	default:
+		w.set(counter)
+		return true
+	}
+	w.highest = counter
+	w.set(counter)
+	return true
+}
+
+func (w *ReplayWindow) has(counter uint32) bool {
+	bit := counter % ReplayWindowSize
+	return w.seen[bit/64]&(1<<(bit%64)) != 0
+}
+
+func (w *ReplayWindow) set(counter uint32) {
+	bit := counter % ReplayWindowSize
+	w.seen[bit/64] |= 1 << (bit % 64)
+}
+
+func (w *ReplayWindow) clear(counter uint32) {
+	bit := counter % ReplayWindowSize
+	w.seen[bit/64] &^= 1 << (bit % 64)
+}
+
+// SessionLabel builds the DNS label for a session: "<id>-<token>" with a PSK, "<id>" without
+func SessionLabel(psk []byte, sessionID string, counter uint32, t time.Time) string {
+	if len(psk) == 0 {
+		return sessionID
+	}
+	return sessionID + "-" + SessionToken(psk, sessionID, counter, t)
+}
+
+// SplitSessionLabel splits a session label into its ID and token (empty if absent)
+func SplitSessionLabel(label string) (sessionID, token string) {
+	if i := strings.LastIndexByte(label, '-'); i >= 0 {
+		return label[:i], label[i+1:]
+	}
+	return label, ""
+}
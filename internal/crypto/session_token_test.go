@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	psk := []byte("secret")
+	now := time.Unix(1_700_000_000, 0)
+	token := SessionToken(psk, "abcdefgh", 42, now)
+
+	for _, skew := range []time.Duration{0, -SessionTokenWindow, SessionTokenWindow} {
+		counter, ok := VerifySessionToken(psk, "abcdefgh", token, now.Add(skew))
+		if !ok || counter != 42 {
+			t.Errorf("skew %v: got counter %d, ok %v; want 42, true", skew, counter, ok)
+		}
+	}
+	if _, ok := VerifySessionToken(psk, "ABCDEFGH", token, now); !ok {
+		t.Error("session IDs are case-insensitive in DNS")
+	}
+	if _, ok := VerifySessionToken(psk, "abcdefgh", token, now.Add(3*SessionTokenWindow)); ok {
+		t.Error("accepted a token three windows old")
+	}
+	if _, ok := VerifySessionToken([]byte("other"), "abcdefgh", token, now); ok {
+		t.Error("accepted a token made with another key")
+	}
+	if _, ok := VerifySessionToken(psk, "zzzzzzzz", token, now); ok {
+		t.Error("accepted a token for another session")
+	}
+}
+
+func TestSessionTokenBindsCounter(t *testing.T) {
+	psk := []byte("secret")
+	now := time.Unix(1_700_000_000, 0)
+	token := SessionToken(psk, "abcdefgh", 1, now)
+	if token == SessionToken(psk, "abcdefgh", 2, now) {
+		t.Fatal("two queries got the same token")
+	}
+	// Swap in another counter while keeping the HMAC
+	raw, err := tokenEncoding.DecodeString(strings.ToUpper(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[sessionHeaderLen-1] ^= 3
+	if _, ok := VerifySessionToken(psk, "abcdefgh", tokenEncoding.EncodeToString(raw), now); ok {
+		t.Error("accepted a token whose counter was changed")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	for _, step := range []struct {
+		counter uint32
+		want    bool
+	}{
+		{10, true},
+		{10, false},
+		{12, true},
+		// Late but within the window
+		{11, true},
+		{11, false},
+		{12, false},
+		{10 + ReplayWindowSize, true},
+		// Now too far behind to tell
+		{10, false},
+		// The oldest counter still in the window is remembered
+		{11, false},
+		{11 + 5*ReplayWindowSize, true},
+		// A slot reused after the window moved on isn't taken for a replay
+		{11 + 5*ReplayWindowSize - 1, true},
+		{11 + 4*ReplayWindowSize + 1, true},
+	} {
+		if got := w.Accept(step.counter); got != step.want {
+			t.Errorf("Accept(%d) = %v, want %v", step.counter, got, step.want)
+		}
+	}
+}
+
+func TestSessionTokenKeyID(t *testing.T) {
+	psk := []byte("secret")
+	now := time.Unix(1_700_000_000, 0)
+	token := SessionToken(psk, "abcdefgh", 1, now)
+	if id, ok := SessionTokenKeyID(token); !ok || id != SessionKeyID(psk) {
+		t.Fatalf("token claims key ID %d, %v; want %d", id, ok, SessionKeyID(psk))
+	}
+	// The key ID is covered by the HMAC too
+	raw, _ := tokenEncoding.DecodeString(strings.ToUpper(token))
+	raw[0] ^= 1
+	if _, ok := VerifySessionToken(psk, "abcdefgh", tokenEncoding.EncodeToString(raw), now); ok {
+		t.Error("accepted a token whose key ID was changed")
+	}
+	if _, ok := SessionTokenKeyID("short"); ok {
+		t.Error("read a key ID from a malformed token")
+	}
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A-record downstream: some resolvers strip or truncate TXT answers but pass
+// A records untouched, so a client may ask with A queries and get its
+// fragments back packed into synthetic IPv4 addresses. The fragments of one
+// response form a stream of [len:1][fragment] entries, split into 3-byte
+// pieces. Each address is [index:1][piece:3]: resolvers shuffle the records
+// of an RRset and drop duplicate ones, so every record carries its position,
+// which also keeps identical pieces distinct. The index is encoded as a first
+// octet of a public unicast range, as resolvers with DNS rebinding protection
+// strip private and loopback addresses. A response that arrives with a record
+// missing is dropped whole.
+
+const (
+	// ARecordPayload is the fragment bytes carried by one A record
+	ARecordPayload = 3
+	// ARecordRRLen is the wire size of one A answer: compressed name (2) +
+	// type/class/TTL/rdlength (10) + address (4)
+	ARecordRRLen = 16
+	// aRecordsPerFragment is the records a full fragment takes, length byte included
+	aRecordsPerFragment = (1 + FragHeaderLen + MaxChunkSize + ARecordPayload - 1) / ARecordPayload
+)
+
+var errARecordGap = errors.New("A record answer is missing records")
+
+// aRecordOctets maps a record index to its first octet: 1-223, leaving out
+// 10, 100 (CGNAT), 127, 169, 172 and 192, whose private parts rebinding
+// protection filters
+var aRecordOctets = func() []byte {
+	var octets []byte
+	for o := 1; o <= 223; o++ {
+		switch o {
+		case 10, 100, 127, 169, 172, 192:
+			continue
+		}
+		octets = append(octets, byte(o))
+	}
+	return octets
+}()
+
+// aRecordIndex is the inverse of aRecordOctets (-1 for unused octets)
+var aRecordIndex = func() [256]int {
+	var index [256]int
+	for i := range index {
+		index[i] = -1
+	}
+	for i, o := range aRecordOctets {
+		index[o] = i
+	}
+	return index
+}()
+
+// MaxARecords is the most A records a response may carry
+var MaxARecords = len(aRecordOctets)
+
+// ParseRecordType maps a --record-type value to the query type carrying
+// downstream data: "txt" (the default), "a" or "cname" (see cname.go)
+func ParseRecordType(name string) (uint16, error) {
+	switch strings.ToLower(name) {
+	case "", "txt":
+		return dns.TypeTXT, nil
+	case "a":
+		return dns.TypeA, nil
+	case "cname":
+		return dns.TypeCNAME, nil
+	case "null":
+		return dns.TypeNULL, nil
+	}
+	return 0, fmt.Errorf("unknown record type %q (want txt, a, cname or null)", name)
+}
+
+// EncodeARecords packs fragments into addresses for one response. The
+// fragments must fit in MaxARecords records (see ARecordFragmentsForSize).
+func EncodeARecords(frags [][]byte) []net.IP {
+	var stream []byte
+	for _, frag := range frags {
+		stream = append(stream, byte(len(frag)))
+		stream = append(stream, frag...)
+	}
+	addrs := make([]net.IP, 0, (len(stream)+ARecordPayload-1)/ARecordPayload)
+	for i := 0; i < len(stream); i += ARecordPayload {
+		// The zero padding of the last piece reads as an empty entry, which ends the stream
+		ip := net.IPv4(aRecordOctets[len(addrs)], 0, 0, 0).To4()
+		copy(ip[1:], stream[i:min(i+ARecordPayload, len(stream))])
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
+
+// DecodeARecords restores the fragments packed by EncodeARecords, in any record order
+func DecodeARecords(addrs []net.IP) ([][]byte, error) {
+	pieces := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := addr.To4(); ip != nil && aRecordIndex[ip[0]] >= 0 {
+			pieces = append(pieces, ip)
+		}
+	}
+	slices.SortFunc(pieces, func(a, b net.IP) int { return aRecordIndex[a[0]] - aRecordIndex[b[0]] })
+
+	stream := make([]byte, 0, len(pieces)*ARecordPayload)
+	for i, ip := range pieces {
+		if aRecordIndex[ip[0]] != i {
+			return nil, errARecordGap
+		}
+		stream = append(stream, ip[1:]...)
+	}
+
+	var frags [][]byte
+	for len(stream) > 0 && stream[0] > 0 {
+		n := int(stream[0])
+		if 1+n > len(stream) {
+			return frags, errARecordGap
+		}
+		frags = append(frags, stream[1:1+n])
+		stream = stream[1+n:]
+	}
+	return frags, nil
+}
+
+// ARecordFragmentsForSize is FragmentsForSize for A-record responses. At
+// least one fragment is always allowed, so a response sized for 512 bytes
+// still overflows it: A records need EDNS0.
+func ARecordFragmentsForSize(limit, baseLen int) int {
+	records := min((limit-baseLen)/ARecordRRLen, MaxARecords)
+	return max(records/aRecordsPerFragment, 1)
+}
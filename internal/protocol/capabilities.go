@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Capability negotiation: right after the QUIC handshake the client opens a
+// stream whose first byte is HelloMarker, followed by its protocol version and
+// capability bits. The server answers with a status byte and its own version
+// and capabilities. HelloMarker is not a valid target header, so a server that
+// predates negotiation answers with the usual error byte and closes the stream,
+// which the client reports as ErrHelloUnsupported.
+
+// ProtocolVersion is bumped whenever the wire protocol changes incompatibly
+const ProtocolVersion = 1
+
+// HelloMarker opens a capability stream in place of a target address type
+const HelloMarker = 0x7F
+
+// helloLen is the hello body after the marker or status byte: [version:1][caps:4]
+const helloLen = 5
+
+// ErrHelloUnsupported means the peer answered the hello like an old server
+var ErrHelloUnsupported = errors.New("server does not support capability negotiation")
+
+// Capabilities is a set of optional protocol features
+type Capabilities uint32
+
+const (
+	// CapNack: downstream fragments named in poll nack labels are resent
+	CapNack Capabilities = 1 << iota
+	// CapSizeHint: poll size hints cap the response size
+	CapSizeHint
+	// CapLongPoll: polls with a hold hint are held until data is queued
+	CapLongPoll
+	// CapTargetSNI: the server originates TLS for targets carrying an SNI override
+	CapTargetSNI
+	// CapDeferStatus: the server accepts proxy.TargetFlagDeferStatus
+	CapDeferStatus
+	// CapARecords: A queries are answered with A records (see arecord.go)
+	CapARecords
+	// CapCNAME: CNAME queries are answered with CNAME records (see cname.go)
+	CapCNAME
+	// CapUDP: the server relays UDP associations (proxy.TargetFlagUDP)
+	CapUDP
+	// CapFEC: the server rebuilds upstream FEC packets (see fec.go); in the
+	// client's hello it asks for FEC downstream as well
+	CapFEC
+	// CapCompress: the server inflates compressed upstream packets (see
+	// compress.go); in the client's hello it asks for compression downstream as well
+	CapCompress
+	// CapReplyCodes: a failed target stream's status byte is the SOCKS5
+	// reply code for the failure (proxy.ReplyCodeForError) rather than any non-zero byte
+	CapReplyCodes
+	// CapSequence: in the client's hello it asks for the session's downstream
+	// packet IDs to count up so it can restore their order (see reorder.go)
+	CapSequence
+	// CapNULL: NULL queries are answered with NULL records (see null.go)
+	CapNULL
+	// CapRawBase64: in the client's hello it asks for TXT answers in
+	// unpadded base64url (see txt.go)
+	CapRawBase64
+	// CapTXTMulti: in the client's hello it asks for all TXT fragments of a
+	// response in one record, a character-string each (see txt.go)
+	CapTXTMulti
+	// CapCredit: in the client's hello it asks the server to hold downstream
+	// writes within the credit its poll acknowledgements grant (see credit.go)
+	CapCredit
+)
+
+// capabilityInfo names each capability and tells the operator what to do
+// when the server lacks one the client relies on
+var capabilityInfo = []struct {
+	cap  Capabilities
+	name string
+	hint string
+}{
+	{CapNack, "nack", "lost downstream fragments wait for QUIC retransmission; upgrade the server or pass --nack=false"},
+	{CapSizeHint, "size-hint", "responses may stay too large for resolvers that strip EDNS0; upgrade the server"},
+	{CapLongPoll, "long-poll", "polls are answered at once so --long-polls only adds load; raise the server's --max-poll-hold or drop --long-polls"},
+	{CapTargetSNI, "target-sni", "--front streams will fail; upgrade the server or remove --front"},
+	{CapDeferStatus, "defer-status", "--fast-connect sends the status byte in a packet of its own; upgrade the server"},
+	{CapARecords, "a-records", "A queries are answered with TXT records, which resolvers that strip TXT drop; upgrade the server, add a to its --downstream-record or drop --record-type"},
+	{CapCNAME, "cname", "CNAME queries are answered with TXT records, which CNAME-only paths drop; upgrade the server, add cname to its --downstream-record or drop --record-type"},
+	{CapUDP, "udp", "SOCKS5 UDP ASSOCIATE requests are refused; upgrade the server (one with --target-type socks5 or http-connect never relays UDP)"},
+	{CapFEC, "fec", "upstream packets go without parity fragments; upgrade the server or drop --fec-ratio"},
+	{CapCompress, "compress", "upstream packets go uncompressed; upgrade the server or drop --compress"},
+	{CapReplyCodes, "reply-codes", "SOCKS5 apps see every failed connection as refused; upgrade the server"},
+	{CapNULL, "null", "NULL queries are answered with TXT records; upgrade the server, add null to its --downstream-record or drop --record-type"},
+	{CapRawBase64, "raw-base64", "TXT answers stay in padded base64, a character more per fragment; upgrade the server"},
+	{CapTXTMulti, "txt-multi", "every TXT fragment takes a record of its own, 12 bytes more each; upgrade the server"},
+	{CapCredit, "credit", "downstream bursts beyond the server's queue are dropped and left to QUIC retransmission; upgrade the server or drop --downstream-credit 0 from its flags"},
+	{CapSequence, "sequence", "downstream packets reach QUIC in arrival order; upgrade the server or drop --reorder-window"},
+}
+
+// Has reports whether every capability in want is in c
+func (c Capabilities) Has(want Capabilities) bool {
+	return c&want == want
+}
+
+// Missing returns the capabilities in required that c lacks
+func (c Capabilities) Missing(required Capabilities) Capabilities {
+	return required &^ c
+}
+
+// String lists the capability names, e.g. "nack,long-poll"
+func (c Capabilities) String() string {
+	var names []string
+	for _, info := range capabilityInfo {
+		if c.Has(info.cap) {
+			names = append(names, info.name)
+			c &^= info.cap
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// List splits c into its known single capabilities
+func (c Capabilities) List() []Capabilities {
+	var caps []Capabilities
+	for _, info := range capabilityInfo {
+		if c.Has(info.cap) {
+			caps = append(caps, info.cap)
+		}
+	}
+	return caps
+}
+
+// Hint tells the operator what to do when the server lacks the single capability c
+func (c Capabilities) Hint() string {
+	for _, info := range capabilityInfo {
+		if info.cap == c {
+			return info.hint
+		}
+	}
+	return "upgrade the server"
+}
+
+// Hello is one side's half of the negotiation
+type Hello struct {
+	Version uint8
+	Caps    Capabilities
+}
+
+func (h Hello) encode(first byte) []byte {
+	buf := make([]byte, 1+helloLen)
+	buf[0] = first
+	buf[1] = h.Version
+	binary.BigEndian.PutUint32(buf[2:], uint32(h.Caps))
+	return buf
+}
+
+func decodeHello(buf []byte) Hello {
+	return Hello{Version: buf[0], Caps: Capabilities(binary.BigEndian.Uint32(buf[1:]))}
+}
+
+// WriteHello sends the client's hello, marker included
+func WriteHello(w io.Writer, h Hello) error {
+	_, err := w.Write(h.encode(HelloMarker))
+	return err
+}
+
+// ReadHello reads the client's hello after the server consumed HelloMarker
+func ReadHello(r io.Reader) (Hello, error) {
+	buf := make([]byte, helloLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Hello{}, fmt.Errorf("read hello: %w", err)
+	}
+	return decodeHello(buf), nil
+}
+
+// WriteHelloReply sends the server's answer: a success status and its hello
+func WriteHelloReply(w io.Writer, h Hello) error {
+	_, err := w.Write(h.encode(0x00))
+	return err
+}
+
+// ReadHelloReply reads the server's answer. An old server replies with a
+// non-zero status byte (or closes the stream), reported as ErrHelloUnsupported.
+func ReadHelloReply(r io.Reader) (Hello, error) {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Hello{}, ErrHelloUnsupported
+		}
+		return Hello{}, fmt.Errorf("read hello status: %w", err)
+	}
+	if status[0] != 0x00 {
+		return Hello{}, ErrHelloUnsupported
+	}
+	return ReadHello(r)
+}
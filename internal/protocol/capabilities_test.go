@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCapabilitiesMissing(t *testing.T) {
+	client := CapNack | CapFEC | CapCompress
+	server := CapNack | CapLongPoll
+	missing := server.Missing(client)
+	if missing != CapFEC|CapCompress {
+		t.Fatalf("missing %s, want fec,compress", missing)
+	}
+	if got := missing.String(); got != "fec,compress" {
+		t.Errorf("String() = %q", got)
+	}
+	if list := missing.List(); len(list) != 2 || list[0] != CapFEC || list[1] != CapCompress {
+		t.Errorf("List() = %v, want [fec compress]", list)
+	}
+	if hint := CapFEC.Hint(); hint == "upgrade the server" {
+		t.Error("fec has no hint of its own")
+	}
+	if got := client.Missing(server | client); got != CapLongPoll {
+		t.Errorf("client lacks %s, want long-poll", got)
+	}
+	if got := server.Missing(server); got != 0 || got.String() != "none" {
+		t.Errorf("a server has nothing missing from its own set, got %s", got)
+	}
+	if got := Capabilities(1 << 31).String(); got != "0x80000000" {
+		t.Errorf("unknown capability named %q", got)
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	client := Hello{Version: ProtocolVersion, Caps: CapNack | CapFEC}
+	if err := WriteHello(&buf, client); err != nil {
+		t.Fatal(err)
+	}
+	if marker, _ := buf.ReadByte(); marker != HelloMarker {
+		t.Fatalf("hello starts with 0x%02x, want the marker", marker)
+	}
+	got, err := ReadHello(&buf)
+	if err != nil || got != client {
+		t.Fatalf("server read %+v, %v; want %+v", got, err, client)
+	}
+
+	server := Hello{Version: ProtocolVersion + 1, Caps: CapNack}
+	if err := WriteHelloReply(&buf, server); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadHelloReply(&buf); err != nil || got != server {
+		t.Fatalf("client read %+v, %v; want %+v", got, err, server)
+	}
+}
+
+func TestHelloReplyFromOldServer(t *testing.T) {
+	// An old server takes the marker for a bad target: error byte, then close
+	if _, err := ReadHelloReply(bytes.NewReader([]byte{0x01})); !errors.Is(err, ErrHelloUnsupported) {
+		t.Errorf("error byte: got %v, want ErrHelloUnsupported", err)
+	}
+	if _, err := ReadHelloReply(bytes.NewReader(nil)); !errors.Is(err, ErrHelloUnsupported) {
+		t.Errorf("closed stream: got %v, want ErrHelloUnsupported", err)
+	}
+}
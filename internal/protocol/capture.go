@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture directions
+const (
+	CaptureUp   = "up"   // Client to server (query data)
+	CaptureDown = "down" // Server to client (response data)
+)
+
+const (
+	// captureQueueSize bounds records waiting for the writer; beyond it records are dropped
+	captureQueueSize = 8192
+	// captureFlushInterval: buffered records reach the file at least this often
+	captureFlushInterval = time.Second
+)
+
+// Capture writes one JSON line per tunnel fragment for offline analysis of
+// loss, duplication and timing:
+//
+//	{"ts":1700000000123456789,"dir":"down","sess":"abcd123456","id":4660,"total":3,"seq":1,"len":124}
+//
+// ts is Unix nanoseconds, id/total/seq come from the fragment header and len
+// is the payload length without the header. FEC fragments add "parity":N. Recording only formats a line and
+// hands it to a writer goroutine; when the writer falls behind, records are
+// dropped and counted rather than slowing the tunnel. A nil *Capture records nothing.
+type Capture struct {
+	file    *os.File
+	lines   chan []byte
+	done    chan struct{}
+	dropped atomic.Uint64
+	// mu lets Close shut lines while recorders may still be sending
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewCapture creates (or truncates) path and starts writing records to it
+func NewCapture(path string) (*Capture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{
+		file:  f,
+		lines: make(chan []byte, captureQueueSize),
+		done:  make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Fragment records a fragment travelling in dir for session
+func (c *Capture) Fragment(dir, session string, frag []byte) {
+	if c == nil || len(frag) < FragHeaderLen {
+		return
+	}
+	line := make([]byte, 0, 128)
+	line = append(line, `{"ts":`...)
+	line = strconv.AppendInt(line, time.Now().UnixNano(), 10)
+	line = append(line, `,"dir":"`...)
+	line = append(line, dir...)
+	line = append(line, `","sess":`...)
+	line = strconv.AppendQuote(line, session)
+	line = append(line, `,"id":`...)
+	line = strconv.AppendUint(line, uint64(binary.BigEndian.Uint16(frag[0:2])), 10)
+	line = append(line, `,"total":`...)
+	line = strconv.AppendInt(line, int64(FragTotal(frag)), 10)
+	line = append(line, `,"seq":`...)
+	line = strconv.AppendUint(line, uint64(frag[3]), 10)
+	headerLen := FragHeaderLen
+	if frag[2]&fragFlagFEC != 0 && len(frag) >= FECHeaderLen {
+		headerLen = FECHeaderLen
+		line = append(line, `,"parity":`...)
+		line = strconv.AppendUint(line, uint64(frag[4]), 10)
+	}
+	if frag[2]&fragFlagCompressed != 0 {
+		line = append(line, `,"compressed":true`...)
+	}
+	line = append(line, `,"len":`...)
+	line = strconv.AppendInt(line, int64(len(frag)-headerLen), 10)
+	line = append(line, "}\n"...)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.lines <- line:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many records were dropped because the writer fell behind
+func (c *Capture) Dropped() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.dropped.Load()
+}
+
+// Close writes out pending records and closes the file
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.lines)
+	}
+	c.mu.Unlock()
+	<-c.done
+	return c.file.Close()
+}
+
+func (c *Capture) run() {
+	defer close(c.done)
+	w := bufio.NewWriterSize(c.file, 64*1024)
+	defer w.Flush()
+
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				return
+			}
+			w.Write(line)
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
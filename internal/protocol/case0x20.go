@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	cryptorand "crypto/rand"
+)
+
+// randomizeCase flips the case of every ASCII letter in s at random
+// (draft-vixie-dnsext-dns0x20). Resolvers copy the question name into the
+// response byte for byte, so an off-path attacker forging a response has to
+// guess one bit per letter on top of the message ID.
+func randomizeCase(s string) string {
+	bits := make([]byte, (len(s)+7)/8)
+	cryptorand.Read(bits)
+
+	out := []byte(s)
+	for i, ch := range out {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case ch >= 'a' && ch <= 'z':
+			out[i] = ch - 'a' + 'A'
+		case ch >= 'A' && ch <= 'Z':
+			out[i] = ch - 'A' + 'a'
+		}
+	}
+	return string(out)
+}
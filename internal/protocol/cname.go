@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CNAME downstream: for networks that only pass CNAME chains reliably, a
+// client may ask with CNAME queries and get one fragment per response back as
+// the target name, base32 in labels under the tunnel domain:
+// [DATA-LABELS].[DOMAIN]. Only one CNAME may exist per owner name, so every
+// response carries a single fragment; a full fragment takes 205 characters,
+// which leaves room for a domain of up to MaxCNAMEDomainLen characters.
+
+const (
+	// MaxCNAMELen is the longest target name, in presentation form without the final dot
+	MaxCNAMELen = 253
+	// cnameLabelLen is the data label length, the DNS maximum
+	cnameLabelLen = 63
+)
+
+var (
+	cnameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	// MaxCNAMEDomainLen is the longest tunnel domain a full fragment still fits under
+	MaxCNAMEDomainLen = MaxCNAMELen - cnameDataLen(FragHeaderLen+MaxChunkSize) - 1
+
+	errCNAMETooLong = errors.New("fragment does not fit in a CNAME target under this domain")
+	errCNAMEDomain  = errors.New("CNAME target is not under the tunnel domain")
+)
+
+// cnameDataLen is the length of the data labels, dots between them included,
+// carrying n bytes
+func cnameDataLen(n int) int {
+	chars := cnameEncoding.EncodedLen(n)
+	return chars + (chars-1)/cnameLabelLen
+}
+
+// EncodeCNAME returns the fully qualified target name carrying frag under domain
+func EncodeCNAME(frag []byte, domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if cnameDataLen(len(frag))+1+len(domain) > MaxCNAMELen {
+		return "", errCNAMETooLong
+	}
+	return splitIntoLabels(cnameEncoding.EncodeToString(frag), cnameLabelLen) + "." + dns.Fqdn(domain), nil
+}
+
+// DecodeCNAME restores the fragment carried by a target name under domain.
+// Resolvers may change the case of the name, which base32 tolerates here.
+func DecodeCNAME(target, domain string) ([]byte, error) {
+	suffix := "." + strings.ToLower(dns.Fqdn(domain))
+	target = strings.ToLower(dns.Fqdn(target))
+	if !strings.HasSuffix(target, suffix) {
+		return nil, errCNAMEDomain
+	}
+	data := strings.ReplaceAll(strings.TrimSuffix(target, suffix), ".", "")
+	return cnameEncoding.DecodeString(strings.ToUpper(data))
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Packet compression: a packet that deflates to fewer bytes is sent deflated,
+// and each of its fragments carries fragFlagCompressed in the total byte so
+// the reassembler inflates it before handing it on. Packets that don't shrink
+// go as they are and cost only the attempt. QUIC encrypts everything past its
+// short header, so expect little from tunnel traffic: CompressionStats shows
+// what the attempt actually saves. A side only sends compressed fragments once
+// the peer advertised CapCompress, since older reassemblers can't parse them.
+
+const (
+	// fragFlagCompressed marks a fragment of a deflated packet in the total byte
+	fragFlagCompressed = 0x40
+	// maxInflatedSize bounds an inflated packet, far above any QUIC packet
+	maxInflatedSize = 64 * 1024
+)
+
+var errInflatedTooLarge = errors.New("inflated packet too large")
+
+// flateWriters reuses deflate state, which is large next to a packet
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// CompressionStats counts what a Compressor was given and what it sent
+type CompressionStats struct {
+	// Packets counts packets offered, Compressed those sent deflated
+	Packets, Compressed uint64
+	// RawBytes and SentBytes sum the packet sizes before and after
+	RawBytes, SentBytes uint64
+}
+
+// Ratio returns SentBytes/RawBytes, or 1 before any packet
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.SentBytes) / float64(s.RawBytes)
+}
+
+// Compressor deflates packets before fragmentation and counts the outcome.
+// The zero value is ready to use and safe for concurrent use.
+type Compressor struct {
+	packets, compressed atomic.Uint64
+	rawBytes, sentBytes atomic.Uint64
+}
+
+// Compress returns p deflated and true when that is shorter, p itself and false otherwise
+func (c *Compressor) Compress(p []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(p)
+	w.Close()
+	flateWriters.Put(w)
+
+	out, compressed := p, false
+	if buf.Len() < len(p) {
+		out, compressed = buf.Bytes(), true
+		c.compressed.Add(1)
+	}
+	c.packets.Add(1)
+	c.rawBytes.Add(uint64(len(p)))
+	c.sentBytes.Add(uint64(len(out)))
+	return out, compressed
+}
+
+// Stats returns a snapshot of the counters
+func (c *Compressor) Stats() CompressionStats {
+	return CompressionStats{
+		Packets:    c.packets.Load(),
+		Compressed: c.compressed.Load(),
+		RawBytes:   c.rawBytes.Load(),
+		SentBytes:  c.sentBytes.Load(),
+	}
+}
+
+// MarkCompressed flags the fragments of a packet that Compress deflated
+func MarkCompressed(frags [][]byte) {
+	for _, frag := range frags {
+		frag[2] |= fragFlagCompressed
+	}
+}
+
+// inflatePacket reverses Compress
+func inflatePacket(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxInflatedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxInflatedSize {
+		return nil, errInflatedTooLarge
+	}
+	return out, nil
+}
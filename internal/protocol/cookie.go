@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DNS cookies (RFC 7873): every query carries an EDNS0 COOKIE option with a
+// random client cookie per resolver, and a resolver that supports cookies
+// echoes it next to a server cookie of its own. An off-path attacker forging
+// responses then has to guess 64 more bits than the message ID. The resolver
+// answers the cookie, not the tunnel server behind it, so most paths never
+// echo one: responses without a cookie are accepted until the resolver has
+// echoed ours once, and dropped from then on. A wrong client cookie is always dropped.
+
+const (
+	// ClientCookieLen is the length of a client cookie
+	ClientCookieLen = 8
+	// MinServerCookieLen and MaxServerCookieLen bound a server cookie
+	MinServerCookieLen = 8
+	MaxServerCookieLen = 32
+)
+
+// cookieJar keeps the client cookie sent to each resolver and the server
+// cookie it last returned
+type cookieJar struct {
+	mu    sync.Mutex
+	peers map[string]*cookiePeer
+}
+
+type cookiePeer struct {
+	client   [ClientCookieLen]byte
+	server   []byte
+	verified bool // the resolver has echoed our cookie, so it must from now on
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{peers: make(map[string]*cookiePeer)}
+}
+
+// peerLocked returns the state for resolver, choosing its client cookie on first use
+func (j *cookieJar) peerLocked(resolver net.Addr) *cookiePeer {
+	p, ok := j.peers[resolver.String()]
+	if !ok {
+		p = &cookiePeer{}
+		cryptorand.Read(p.client[:])
+		j.peers[resolver.String()] = p
+	}
+	return p
+}
+
+// option returns the COOKIE option for a query to resolver: the client
+// cookie, followed by the resolver's server cookie once one is known
+func (j *cookieJar) option(resolver net.Addr) *dns.EDNS0_COOKIE {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	p := j.peerLocked(resolver)
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(p.client[:]) + hex.EncodeToString(p.server),
+	}
+}
+
+// check reports whether a response from resolver passes the cookie rules
+// and learns its server cookie. verified is true when this response is the
+// first to echo our cookie.
+func (j *cookieJar) check(resolver net.Addr, msg *dns.Msg) (ok, verified bool) {
+	var cookie []byte
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, isCookie := o.(*dns.EDNS0_COOKIE); isCookie {
+				cookie, _ = hex.DecodeString(c.Cookie)
+				break
+			}
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	p := j.peerLocked(resolver)
+	if cookie == nil {
+		return !p.verified, false
+	}
+	server := cookie[min(len(cookie), ClientCookieLen):]
+	if !bytes.Equal(cookie[:min(len(cookie), ClientCookieLen)], p.client[:]) ||
+		len(server) < MinServerCookieLen || len(server) > MaxServerCookieLen {
+		return false, false
+	}
+	p.server = append(p.server[:0], server...)
+	verified = !p.verified
+	p.verified = true
+	return true, verified
+}
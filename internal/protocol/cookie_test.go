@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// cookieResponse returns a response carrying cookie as its COOKIE option, none if nil
+func cookieResponse(cookie []byte) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("poll."+testDomain+".", dns.TypeTXT)
+	msg.Response = true
+	if cookie != nil {
+		msg.SetEdns0(1232, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+	}
+	return msg
+}
+
+func TestCookieJarCheck(t *testing.T) {
+	jar := newCookieJar()
+	resolver := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	client, err := hex.DecodeString(jar.option(resolver).Cookie)
+	if err != nil || len(client) != ClientCookieLen {
+		t.Fatalf("client cookie %x, %v", client, err)
+	}
+	server := bytes.Repeat([]byte{0x5A}, MinServerCookieLen)
+	wrongClient := append(bytes.Repeat([]byte{0xEE}, ClientCookieLen), server...)
+
+	// Until the resolver has echoed our cookie, answers without one are fine,
+	// but one echoing somebody else's cookie is not
+	if ok, verified := jar.check(resolver, cookieResponse(nil)); !ok || verified {
+		t.Errorf("no cookie from an unverified resolver: ok %v, verified %v", ok, verified)
+	}
+	if ok, _ := jar.check(resolver, cookieResponse(wrongClient)); ok {
+		t.Error("wrong client cookie accepted")
+	}
+	for _, size := range []int{0, MinServerCookieLen - 1, MaxServerCookieLen + 1} {
+		if ok, _ := jar.check(resolver, cookieResponse(append(bytes.Clone(client), make([]byte, size)...))); ok {
+			t.Errorf("%d byte server cookie accepted", size)
+		}
+	}
+
+	// The first echo verifies the resolver, and its server cookie goes out from then on
+	if ok, verified := jar.check(resolver, cookieResponse(append(bytes.Clone(client), server...))); !ok || !verified {
+		t.Fatalf("echoed cookie: ok %v, verified %v", ok, verified)
+	}
+	if got, want := jar.option(resolver).Cookie, hex.EncodeToString(client)+hex.EncodeToString(server); got != want {
+		t.Errorf("cookie sent %s, want %s", got, want)
+	}
+	if ok, verified := jar.check(resolver, cookieResponse(append(bytes.Clone(client), server...))); !ok || verified {
+		t.Errorf("second echo: ok %v, verified %v", ok, verified)
+	}
+
+	// Once verified, answers without a cookie or with a wrong one are dropped
+	if ok, _ := jar.check(resolver, cookieResponse(nil)); ok {
+		t.Error("no cookie accepted from a verified resolver")
+	}
+	if ok, _ := jar.check(resolver, cookieResponse(wrongClient)); ok {
+		t.Error("wrong client cookie accepted from a verified resolver")
+	}
+
+	// Each resolver is verified on its own
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 53}
+	if ok, _ := jar.check(other, cookieResponse(nil)); !ok {
+		t.Error("no cookie refused from another, unverified resolver")
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Downstream credit: QUIC writes as fast as its congestion window allows,
+// while the session's fragment queue only drains as fast as polls arrive, so
+// a burst can fill the queue and evict whole packets that QUIC then has to
+// retransmit over DNS. A client that asks for CapCredit counts the downstream
+// fragments it received and reports the running total on its polls,
+// poll.NONCE.c-<count>.SESSION.DOMAIN. The server keeps queued plus
+// unacknowledged fragments within a window by blocking the QUIC write until
+// acknowledgements free room, rather than dropping. Fragments still
+// unacknowledged after CreditLossTimeout count as lost so that lost
+// responses don't use up the window for good.
+
+const (
+	// CreditAckPrefix marks the label carrying the client's fragment count
+	CreditAckPrefix = "c-"
+	// DefaultCreditWindow is the default cap on a session's queued and
+	// unacknowledged downstream fragments
+	DefaultCreditWindow = 1000
+	// CreditLossTimeout is how long a sent fragment may go unacknowledged
+	// before it no longer counts against the window
+	CreditLossTimeout = 2 * time.Second
+	// CreditWait bounds how long a write waits for credit before it is
+	// queued anyway, leaving overflow to the spill queue
+	CreditWait = time.Second
+)
+
+// EncodeCreditAck returns the label reporting count downstream fragments received
+func EncodeCreditAck(count uint32) string {
+	return CreditAckPrefix + strconv.FormatUint(uint64(count), 10)
+}
+
+// ParseCreditAck decodes a credit label; ok is false if label isn't one
+func ParseCreditAck(label string) (count uint32, ok bool) {
+	if len(label) <= len(CreditAckPrefix) || !strings.EqualFold(label[:len(CreditAckPrefix)], CreditAckPrefix) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(label[len(CreditAckPrefix):], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
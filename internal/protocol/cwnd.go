@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// InitialCwnd is the window a DNS-layer congestion window starts from
+	InitialCwnd = 8
+	// MinCwnd is the smallest the window shrinks to on loss
+	MinCwnd = 2
+	// CwndLossTimeout: a data query unanswered for this long counts as lost
+	CwndLossTimeout = 1500 * time.Millisecond
+)
+
+// congestionWindow caps upstream data queries in flight (sent, not yet
+// answered or given up on) with AIMD: +1 per answer up to the slow-start
+// threshold, +1/window per answer beyond it, halved on loss at most once per
+// CwndLossTimeout so one burst of drops counts as a single congestion event.
+// It keeps the transport under the rate a resolver tolerates instead of
+// blasting the tx queue into its rate limiter.
+type congestionWindow struct {
+	mu           sync.Mutex
+	cond         *sync.Cond
+	window       float64
+	ssthresh     float64
+	max          float64
+	inflight     int
+	lastDecrease time.Time
+	closed       bool
+}
+
+// newCongestionWindow returns a window growing up to max, or nil if max is 0 (no cap)
+func newCongestionWindow(max int) *congestionWindow {
+	if max <= 0 {
+		return nil
+	}
+	w := &congestionWindow{
+		window:   float64(min(InitialCwnd, max)),
+		ssthresh: float64(max),
+		max:      float64(max),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// acquire blocks until a query may be sent; false once the window is closed
+func (w *congestionWindow) acquire() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.closed && float64(w.inflight) >= w.window {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.inflight++
+	return true
+}
+
+// ack releases a slot for an answered query and grows the window
+func (w *congestionWindow) ack() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.releaseLocked(1)
+	if w.window < w.ssthresh {
+		w.window++
+	} else {
+		w.window += 1 / w.window
+	}
+	w.window = min(w.window, w.max)
+}
+
+// loss releases n slots for lost queries and halves the window once per
+// CwndLossTimeout
+func (w *congestionWindow) loss(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.releaseLocked(n)
+	now := time.Now()
+	if now.Sub(w.lastDecrease) < CwndLossTimeout {
+		return
+	}
+	w.lastDecrease = now
+	w.window = max(w.window/2, MinCwnd)
+	w.ssthresh = w.window
+}
+
+// release frees a slot without touching the window (an answer that tells
+// nothing about congestion, e.g. a forged one)
+func (w *congestionWindow) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.releaseLocked(1)
+}
+
+func (w *congestionWindow) releaseLocked(n int) {
+	w.inflight = max(w.inflight-n, 0)
+	w.cond.Broadcast()
+}
+
+// size returns the current window and the queries in flight
+func (w *congestionWindow) size() (window, inflight int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int(w.window), w.inflight
+}
+
+// close wakes every waiter; acquire fails from now on
+func (w *congestionWindow) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// FrameHeaderLen is the length prefix in front of each packet of a coalesced blob
+const FrameHeaderLen = 2
+
+// MaxFramedPacket is the largest packet a frame can carry
+const MaxFramedPacket = 0xFFFF
+
+// ErrTruncatedFrame means a coalesced blob ended inside a length prefix or packet
+var ErrTruncatedFrame = errors.New("truncated packet frame")
+
+// AppendFrame appends pkt to dst with its [len:2] prefix. Packets longer than
+// MaxFramedPacket cannot be framed and are rejected.
+func AppendFrame(dst, pkt []byte) ([]byte, error) {
+	if len(pkt) > MaxFramedPacket {
+		return dst, errors.New("packet too large to frame")
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(pkt)))
+	return append(dst, pkt...), nil
+}
+
+// Deframer splits a reassembled blob of [len:2][pkt]... frames back into the
+// packets that were coalesced into it. Zero-length frames carry nothing and are
+// skipped. The returned packets alias the blob.
+type Deframer struct {
+	blob []byte
+	off  int
+}
+
+// NewDeframer returns a Deframer over blob
+func NewDeframer(blob []byte) *Deframer {
+	return &Deframer{blob: blob}
+}
+
+// Next returns the next packet, io.EOF once the blob is consumed, or
+// ErrTruncatedFrame if it ends mid-frame (packets before it are still valid)
+func (d *Deframer) Next() ([]byte, error) {
+	for {
+		rest := d.blob[d.off:]
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if len(rest) < FrameHeaderLen {
+			d.off = len(d.blob)
+			return nil, ErrTruncatedFrame
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < FrameHeaderLen+n {
+			d.off = len(d.blob)
+			return nil, ErrTruncatedFrame
+		}
+		d.off += FrameHeaderLen + n
+		if n == 0 {
+			continue
+		}
+		return rest[FrameHeaderLen : FrameHeaderLen+n], nil
+	}
+}
+
+// Deframe splits blob into its packets. On a truncated blob it returns the
+// packets decoded before the damage together with ErrTruncatedFrame.
+func Deframe(blob []byte) ([][]byte, error) {
+	var pkts [][]byte
+	d := NewDeframer(blob)
+	for {
+		pkt, err := d.Next()
+		if err == io.EOF {
+			return pkts, nil
+		}
+		if err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+	}
+}
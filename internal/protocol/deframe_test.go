@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDeframe(t *testing.T) {
+	big := bytes.Repeat([]byte{7}, MaxFramedPacket)
+	var blob []byte
+	for _, pkt := range [][]byte{[]byte("a"), {}, big, []byte("last")} {
+		var err error
+		if blob, err = AppendFrame(blob, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pkts, err := Deframe(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The zero-length frame carries nothing and is skipped
+	want := [][]byte{[]byte("a"), big, []byte("last")}
+	if len(pkts) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(pkts), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(pkts[i], want[i]) {
+			t.Errorf("packet %d: got %d bytes, want %d", i, len(pkts[i]), len(want[i]))
+		}
+	}
+}
+
+func TestDeframeTruncated(t *testing.T) {
+	blob, _ := AppendFrame(nil, []byte("whole"))
+	blob, _ = AppendFrame(blob, []byte("cut short"))
+	for _, cut := range []int{1, 5} {
+		pkts, err := Deframe(blob[:len(blob)-cut])
+		if !errors.Is(err, ErrTruncatedFrame) {
+			t.Errorf("cut %d: got error %v, want ErrTruncatedFrame", cut, err)
+		}
+		if len(pkts) != 1 || string(pkts[0]) != "whole" {
+			t.Errorf("cut %d: got %q, want the packet before the damage", cut, pkts)
+		}
+	}
+	// A lone byte can't even hold a length prefix
+	if _, err := Deframe([]byte{0}); !errors.Is(err, ErrTruncatedFrame) {
+		t.Errorf("got error %v for half a prefix, want ErrTruncatedFrame", err)
+	}
+}
+
+func TestAppendFrameTooLarge(t *testing.T) {
+	if _, err := AppendFrame(nil, make([]byte, MaxFramedPacket+1)); err == nil {
+		t.Error("framed a packet longer than a length prefix can describe")
+	}
+}
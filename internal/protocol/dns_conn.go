@@ -1,105 +1,595 @@
 package protocol
 
 import (
+	"crypto/tls"
 	"encoding/base32"
-	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
 )
 
 const (
 	TxQueueSize  = 2000
 	RxQueueSize  = 2000
 	NumTxWorkers = 32
+	// MaxTxWorkers caps --tx-workers
+	MaxTxWorkers = 256
+	// RxBufferSize: read buffer for resolver responses. A UDP datagram can't exceed
+	// 65535 bytes, so nothing the resolver sends is ever truncated by the read.
+	RxBufferSize = 65535
+	// MinRxBufferSize is the smallest DNS message every resolver may send (RFC 1035)
+	MinRxBufferSize = 512
 	// PollInterval: 25ms heartbeat for idle polling
 	PollInterval = 25 * time.Millisecond
-	WriteTimeout = 5 * time.Second
 	// IdleThreshold: Only poll when truly idle (no recent TX activity)
 	IdleThreshold = 100 * time.Millisecond
+	// DefaultIdlePollInterval: the heartbeat backs off up to this while polls come back empty
+	DefaultIdlePollInterval = 500 * time.Millisecond
 	// ParallelPolls: 20 is the sweet spot for this resolver
 	// Higher values cause DNS resolver congestion/rate limiting
 	// With max-frags=6: (20 * 900) / 0.2s RTT = ~90 KB/sec theoretical
 	// Actual measured: ~95 KB/sec
 	ParallelPolls = 20
+	// DefaultRedundancyThreshold: QUIC packets at least this large (handshake) are sent twice
+	DefaultRedundancyThreshold = 1000
+	// DefaultEDNSSize is the response size advertised in queries, the DNS
+	// Flag Day size that avoids IP fragmentation
+	DefaultEDNSSize = 1232
 )
 
 type DnsPacketConn struct {
 	Resolvers []*net.UDPAddr // Multiple resolvers for load balancing
 	Domain    string
-	SessionID string
-	Conn      *net.UDPConn
+	Conn      net.PacketConn
+
+	sessionID atomic.Pointer[string] // See SessionID and Rebind
 
 	rxQueue     chan []byte
 	txQueue     chan []byte
+	txSpill     *SpillQueue   // packets waiting for room in txQueue
 	pollTrigger chan struct{} // Async trigger for burst polling
+	pollWake    chan struct{} // Snaps a backed-off heartbeat back on upstream traffic
 	closeOnce   sync.Once
 	done        chan struct{}
+	engines     sync.WaitGroup // Engine goroutines; Close waits for them
 	lastTxTime  time.Time
 	mu          sync.Mutex // Protects lastTxTime
 	reassembler *Reassembler
+	chunkSize   int // Upstream fragment payload, see ChunkSize
+	pool        *resolverPool
+	queries     *queryTracker
+	logger      zerolog.Logger
+	txWorkers   int
+	rxBufSize   int
+	truncWarn   sync.Once
+	psk         []byte
+	case0x20    bool
+	caseWarn    sync.Once
+	cookies     *cookieJar // nil unless DNS cookies are on (see cookie.go)
+	cookieWarn  sync.Once
+	framed      bool
+	goodput     *TokenBucket
+	nacks       bool
+	cwnd        *congestionWindow // nil when in-flight data queries aren't capped
+	capture     *Capture
+	remote      remoteTransport // nil unless the resolvers are DoH or DoT
+
+	// tokenCounter numbers the session tokens so none is sent twice (see crypto.ReplayWindow)
+	tokenCounter atomic.Uint32
+
+	// Polling and redundancy tuning (see DnsConnOptions)
+	pollInterval        time.Duration
+	idlePollInterval    time.Duration
+	dryPolls            atomic.Int32 // polls answered empty since the last data
+	parallelPolls       int
+	pollTuner           *pollTuner // nil unless AdaptivePolls
+	idleThreshold       time.Duration
+	redundancyThreshold int
+	recordType          uint16
+	ednsSize            int
+	// FEC (see fec.go): parity ratio of upstream packets, applied once EnableFEC was called
+	fecRatio float64
+	fecOn    atomic.Bool
+	// Compression (see compress.go): asked for with Compress, on once EnableCompression was called
+	compress   bool
+	compressOn atomic.Bool
+	compressor Compressor
+	// Long polls (see longpoll.go): slots holds a token per poll to send
+	longPollHold  time.Duration
+	longPollSlots chan struct{}
+	// EDNS0 fallback (see edns.go): truncated responses seen, whether any
+	// response beat 512 bytes, and the size hint sent once EDNS0 looks stripped
+	truncated atomic.Int32
+	ednsWorks atomic.Bool
+	sizeHint  atomic.Int32
+	// Read deadline (see SetReadDeadline): deadlineWake is closed and
+	// replaced whenever the deadline changes, waking a blocked ReadFrom
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	deadlineWake chan struct{}
+	// reorder restores downstream packet order (see reorder.go); nil when off
+	reorder *Reorderer
+	// tcp retries truncated answers over TCP (see tcp_fallback.go); nil when off
+	tcp *tcpFallback
+	// Credit (see credit.go): downstream fragments received, reported on
+	// polls once EnableCredit was called
+	rxFrags  atomic.Uint32
+	creditOn atomic.Bool
+	// Fragment encryption (see fragment_cipher.go): the cipher agreed with
+	// the server, nil when off; keyReplies passes key exchange answers on
+	cipher     atomic.Pointer[crypto.FragmentCipher]
+	serverPins *crypto.PinSet
+	keyReplies chan []byte
 }
 
+// DnsConnOptions tunes a DnsPacketConn; zero values select the defaults
+type DnsConnOptions struct {
+	// Logger receives transport logs; nil uses the global zerolog logger
+	Logger *zerolog.Logger
+	// TxWorkers is the number of goroutines sending queries (default NumTxWorkers)
+	TxWorkers int
+	// RxBufferSize is the read buffer for a single response in bytes (default RxBufferSize)
+	RxBufferSize int
+	// PSK, if set, authenticates the session to the server with a token in the session label
+	PSK []byte
+	// Transport replaces the UDP socket used to reach the resolvers (e.g. an in-memory loopback)
+	Transport net.PacketConn
+	// Impairment simulates loss/duplication/reordering on the transport
+	Impairment Impairment
+	// Randomize0x20 randomizes the case of the non-data labels and drops
+	// responses that don't echo the question name exactly
+	Randomize0x20 bool
+	// Cookies sends an EDNS0 client cookie to each resolver (RFC 7873) and
+	// drops responses with a wrong one, or without one once the resolver has
+	// echoed it before (see cookie.go); ignored for DoH and DoT resolvers
+	Cookies bool
+	// Framed splits every reassembled downstream payload with a Deframer;
+	// set it only when the server coalesces packets with [len:2] framing
+	Framed bool
+	// MaxGoodput caps upstream QUIC bytes per second by blocking WriteTo
+	// (0 = unlimited)
+	MaxGoodput int
+	// Nacks piggybacks missing downstream fragments on polls so the server
+	// resends them without waiting for QUIC (servers without support ignore it)
+	Nacks bool
+	// MaxInflight caps upstream data queries awaiting an answer with an AIMD
+	// window that starts at InitialCwnd and grows up to this (0 = no cap)
+	MaxInflight int
+	// LongPolls keeps this many polls outstanding that the server holds until
+	// data is ready, instead of idle short polling (0 = short polls only)
+	LongPolls int
+	// LongPollHold is how long the server may hold each long poll (default DefaultLongPollHold)
+	LongPollHold time.Duration
+	// Capture, if set, records every fragment sent and received
+	Capture *Capture
+	// PollInterval is the idle polling heartbeat (default PollInterval)
+	PollInterval time.Duration
+	// IdlePollInterval caps the heartbeat as it doubles while whole bursts
+	// of polls come back empty; any data snaps it back to PollInterval
+	// (default DefaultIdlePollInterval, at most PollInterval = no backoff)
+	IdlePollInterval time.Duration
+	// ParallelPolls is how many polls each heartbeat or burst sends (default ParallelPolls)
+	ParallelPolls int
+	// AdaptivePolls treats ParallelPolls as a cap: the polls per burst are
+	// halved when polls are lost or refused and grow back as polls return
+	// data (see poll_tuner.go)
+	AdaptivePolls bool
+	// IdleThreshold is how long after the last upstream packet the heartbeat
+	// starts polling (default IdleThreshold)
+	IdleThreshold time.Duration
+	// RedundancyThreshold: QUIC packets at least this large are queued twice
+	// (0 = DefaultRedundancyThreshold, negative = never)
+	RedundancyThreshold int
+	// DoTConfig is the TLS configuration for tls:// resolvers; nil verifies
+	// them against the system roots by their host name
+	DoTConfig *tls.Config
+	// RecordType is the query type downstream data comes back in: dns.TypeTXT
+	// (the default), dns.TypeA for resolvers that mangle TXT (see arecord.go),
+	// dns.TypeCNAME for networks that only pass CNAME chains (see cname.go)
+	// or dns.TypeNULL for raw binary answers (see null.go)
+	RecordType uint16
+	// ReassemblyTimeout is how long a downstream packet may wait for missing
+	// fragments before it is given up on and a poll is sent at once (default ReassemblyTimeout)
+	ReassemblyTimeout time.Duration
+	// FECRatio adds this many Reed-Solomon parity fragments per data fragment
+	// (rounded up, at most MaxFECRatio) to upstream packets once EnableFEC is
+	// called, which the caller does when the server advertised CapFEC (0 = off)
+	FECRatio float64
+	// Compress deflates upstream packets that shrink once EnableCompression
+	// is called, which the caller does when the server advertised CapCompress
+	Compress bool
+	// EDNSSize is the response size advertised in queries (default
+	// DefaultEDNSSize, at most MaxEDNSSize); larger responses carry more
+	// fragments where the path passes them unfragmented
+	EDNSSize int
+	// ReorderWindow holds downstream packets arriving ahead of a missing one
+	// up to this long, so QUIC sees them in order, once EnableReorder is
+	// called, which the caller does when the server advertised CapSequence (0 = off)
+	ReorderWindow time.Duration
+	// TCPFallback is how many truncated UDP answers may be fetched again over
+	// TCP at once (see tcp_fallback.go); 0 = DefaultTCPFallback, negative =
+	// never. Ignored for DoH and DoT resolvers and a custom Transport.
+	TCPFallback int
+	// ReadBuffer and WriteBuffer are the OS buffer sizes in bytes requested
+	// for the resolver socket (0 = DefaultReadBuffer for reads and the OS
+	// default for writes, negative = the OS default). Ignored for DoH and DoT
+	// resolvers and a custom Transport.
+	ReadBuffer  int
+	WriteBuffer int
+	// EncryptFragments seals every fragment under a key agreed with the
+	// server before the constructor returns (see fragment_cipher.go); the
+	// server's identity key must be among ServerPins
+	EncryptFragments bool
+	ServerPins       *crypto.PinSet
+}
+
+// NewDnsPacketConn creates a DNS transport that logs through the global zerolog logger
 func NewDnsPacketConn(resolvers []string, domain, sessionID string) (*DnsPacketConn, error) {
-	// Resolve ALL resolvers for load balancing
+	return NewDnsPacketConnWithLogger(resolvers, domain, sessionID, log.Logger)
+}
+
+// NewDoTPacketConn creates a DNS transport that sends its queries over TLS
+// to the DoT resolver at server, host[:port] (RFC 7858), and logs through the
+// global zerolog logger. tlsConfig may be nil. NewDnsPacketConnWithOptions
+// takes tls:// resolvers as well.
+func NewDoTPacketConn(server, domain, sessionID string, tlsConfig *tls.Config) (*DnsPacketConn, error) {
+	if !IsDoTResolver(server) {
+		server = DoTScheme + server
+	}
+	return NewDnsPacketConnWithOptions([]string{server}, domain, sessionID, DnsConnOptions{DoTConfig: tlsConfig})
+}
+
+// NewDoHPacketConn creates a DNS transport that sends its queries to the DoH
+// resolver at dohURL (RFC 8484) and logs through the global zerolog logger.
+// NewDnsPacketConnWithOptions takes DoH resolver URLs as well.
+func NewDoHPacketConn(dohURL, domain, sessionID string) (*DnsPacketConn, error) {
+	return NewDnsPacketConn([]string{dohURL}, domain, sessionID)
+}
+
+// NewDnsPacketConnWithLogger creates a DNS transport that logs through the given logger.
+// Pass zerolog.Nop() to silence it entirely.
+func NewDnsPacketConnWithLogger(resolvers []string, domain, sessionID string, logger zerolog.Logger) (*DnsPacketConn, error) {
+	return NewDnsPacketConnWithOptions(resolvers, domain, sessionID, DnsConnOptions{Logger: &logger})
+}
+
+// NewDnsPacketConnWithOptions creates a DNS transport tuned by opts
+func NewDnsPacketConnWithOptions(resolvers []string, domain, sessionID string, opts DnsConnOptions) (*DnsPacketConn, error) {
+	logger := log.Logger
+	if opts.Logger != nil {
+		logger = *opts.Logger
+	}
+	txWorkers := opts.TxWorkers
+	if txWorkers <= 0 {
+		txWorkers = NumTxWorkers
+	}
+	if txWorkers > MaxTxWorkers {
+		return nil, fmt.Errorf("tx workers must be at most %d", MaxTxWorkers)
+	}
+	rxBufSize := opts.RxBufferSize
+	if rxBufSize <= 0 {
+		rxBufSize = RxBufferSize
+	}
+	if rxBufSize < MinRxBufferSize || rxBufSize > RxBufferSize {
+		return nil, fmt.Errorf("rx buffer size must be between %d and %d", MinRxBufferSize, RxBufferSize)
+	}
+
+	longPollHold := opts.LongPollHold
+	if longPollHold <= 0 {
+		longPollHold = DefaultLongPollHold
+	}
+	if opts.LongPolls < 0 {
+		return nil, fmt.Errorf("long polls cannot be negative")
+	}
+	recordType := opts.RecordType
+	if recordType == 0 {
+		recordType = dns.TypeTXT
+	}
+	switch recordType {
+	case dns.TypeTXT, dns.TypeA, dns.TypeNULL:
+	case dns.TypeCNAME:
+		if len(strings.TrimSuffix(domain, ".")) > MaxCNAMEDomainLen {
+			return nil, fmt.Errorf("CNAME records need a domain of at most %d characters", MaxCNAMEDomainLen)
+		}
+	default:
+		return nil, fmt.Errorf("record type must be TXT, A, CNAME or NULL")
+	}
+	ednsSize := opts.EDNSSize
+	if ednsSize == 0 {
+		ednsSize = DefaultEDNSSize
+	}
+	if ednsSize < MinResponseSize || ednsSize > MaxEDNSSize {
+		return nil, fmt.Errorf("EDNS size must be between %d and %d", MinResponseSize, MaxEDNSSize)
+	}
+	// Upstream fragments fill the query name: [data].[session].[domain]
+	suffixLen := len(crypto.SessionLabel(opts.PSK, sessionID, 0, time.Now())) + len(strings.TrimSuffix(domain, ".")) + 2
+	chunkSize := ChunkSizeFor(suffixLen)
+	if opts.EncryptFragments {
+		if opts.ServerPins == nil {
+			return nil, fmt.Errorf("fragment encryption needs the server's pinned keys")
+		}
+		chunkSize -= crypto.FragmentCipherOverhead
+	}
+	if chunkSize < MinChunkSize {
+		return nil, fmt.Errorf("domain is too long: queries would carry %d bytes, at least %d are needed", max(chunkSize, 0), MinChunkSize)
+	}
+
+	// Resolvers given as https:// URLs (DoH, see doh.go) or tls://host[:port]
+	// (DoT, see dot.go) bring their own transport
+	remote, err := newRemoteTransport(resolvers, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve ALL resolvers for load balancing (DoH/DoT ones stand behind placeholders)
 	var udpAddrs []*net.UDPAddr
-	for _, resolver := range resolvers {
-		rAddr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(resolver))
-		if err != nil {
-			return nil, err
+	if remote != nil {
+		udpAddrs = remote.Addrs()
+	} else {
+		for _, resolver := range resolvers {
+			rAddr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(resolver))
+			if err != nil {
+				return nil, err
+			}
+			udpAddrs = append(udpAddrs, rAddr)
+			logger.Info().Str("resolver", rAddr.String()).Int("index", len(udpAddrs)-1).Msg("Resolver configured")
 		}
-		udpAddrs = append(udpAddrs, rAddr)
-		log.Info().Str("resolver", rAddr.String()).Int("index", len(udpAddrs)-1).Msg("Resolver configured")
 	}
 
 	if len(udpAddrs) == 0 {
 		return nil, fmt.Errorf("no valid resolvers provided")
 	}
 
-	conn, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		return nil, err
+	conn := opts.Transport
+	if remote != nil {
+		conn = remote
+	}
+	if conn == nil {
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		// Increase OS buffer to avoid drops
+		readBuffer := opts.ReadBuffer
+		if readBuffer == 0 {
+			readBuffer = DefaultReadBuffer
+		}
+		SetUDPBuffers(udpConn, max(readBuffer, 0), max(opts.WriteBuffer, 0), logger)
+		conn = udpConn
+	}
+	if opts.Impairment.Active() {
+		logger.Warn().Float64("loss", opts.Impairment.LossRate).Float64("dup", opts.Impairment.DupRate).
+			Int("reorder", opts.Impairment.ReorderDepth).Msg("Simulating an impaired network on the DNS transport")
+		conn = NewImpairedConn(conn, opts.Impairment)
 	}
-	// Increase OS buffer to avoid drops
-	conn.SetReadBuffer(4 * 1024 * 1024)
 
-	log.Info().Int("count", len(udpAddrs)).Msg("Configured DNS resolvers for load balancing")
+	logger.Info().Int("count", len(udpAddrs)).Msg("Configured DNS resolvers for load balancing")
 
 	c := &DnsPacketConn{
 		Resolvers:   udpAddrs,
 		Domain:      domain,
-		SessionID:   sessionID,
 		Conn:        conn,
 		rxQueue:     make(chan []byte, RxQueueSize),
 		txQueue:     make(chan []byte, TxQueueSize),
+		txSpill:     NewSpillQueue(DefaultSpillSize),
 		pollTrigger: make(chan struct{}, 1), // Buffer 1 for auto-debouncing
+		pollWake:    make(chan struct{}, 1),
 		done:        make(chan struct{}),
 		reassembler: NewReassembler(),
+		chunkSize:   chunkSize,
+		pool:        newResolverPool(udpAddrs, logger),
+		queries:     newQueryTracker(),
+		logger:      logger,
+		txWorkers:   txWorkers,
+		rxBufSize:   rxBufSize,
+		psk:         opts.PSK,
+		case0x20:    opts.Randomize0x20,
+		framed:      opts.Framed,
+		goodput:     NewTokenBucket(opts.MaxGoodput),
+		nacks:       opts.Nacks,
+		cwnd:        newCongestionWindow(opts.MaxInflight),
+		keyReplies:  make(chan []byte, 1),
+	}
+
+	c.deadlineWake = make(chan struct{})
+	c.capture = opts.Capture
+	c.remote = remote
+	if opts.Cookies && remote == nil {
+		c.cookies = newCookieJar()
+	}
+	c.pollInterval = opts.PollInterval
+	if c.pollInterval <= 0 {
+		c.pollInterval = PollInterval
+	}
+	c.idlePollInterval = opts.IdlePollInterval
+	if c.idlePollInterval <= 0 {
+		c.idlePollInterval = DefaultIdlePollInterval
+	}
+	c.idlePollInterval = max(c.idlePollInterval, c.pollInterval)
+	c.parallelPolls = opts.ParallelPolls
+	if c.parallelPolls <= 0 {
+		c.parallelPolls = ParallelPolls
+	}
+	if opts.AdaptivePolls {
+		c.pollTuner = newPollTuner(c.parallelPolls)
+	}
+	c.idleThreshold = opts.IdleThreshold
+	if c.idleThreshold <= 0 {
+		c.idleThreshold = IdleThreshold
+	}
+	c.redundancyThreshold = opts.RedundancyThreshold
+	if c.redundancyThreshold == 0 {
+		c.redundancyThreshold = DefaultRedundancyThreshold
+	}
+	c.recordType = recordType
+	c.ednsSize = ednsSize
+	c.sessionID.Store(&sessionID)
+	c.fecRatio = opts.FECRatio
+	c.compress = opts.Compress
+	c.reassembler.Timeout = opts.ReassemblyTimeout
+	if opts.ReorderWindow > 0 {
+		c.reorder = NewReorderer(opts.ReorderWindow, c.deliver)
+	}
+	if tcpFallback := opts.TCPFallback; tcpFallback >= 0 && remote == nil && opts.Transport == nil {
+		if tcpFallback == 0 {
+			tcpFallback = DefaultTCPFallback
+		}
+		c.tcp = newTCPFallback(tcpFallback)
+	}
+	if opts.LongPolls > 0 {
+		c.longPollHold = longPollHold
+		c.longPollSlots = make(chan struct{}, opts.LongPolls)
+	}
+	c.serverPins = opts.ServerPins
+
+	// A downstream packet lost in reassembly: poll right away so QUIC's retransmit arrives sooner
+	c.reassembler.OnTimeout = func(packetID uint16, received, total int) {
+		c.logger.Debug().Uint16("pktID", packetID).Int("received", received).Int("total", total).Msg("Downstream packet lost in reassembly")
+		select {
+		case c.pollTrigger <- struct{}{}:
+		default:
+		}
 	}
 
 	c.startRxEngine()
 	c.startTxEngine()
 	c.startPollEngine()
 	c.startBurstEngine() // Async polling engine
+	if c.longPollSlots != nil {
+		c.startLongPollEngine()
+	}
+
+	// Nothing is sent under the session before its fragments can be sealed
+	if opts.EncryptFragments {
+		cipher, err := c.exchangeKeys(sessionID)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.cipher.Store(cipher)
+		logger.Info().Msg("Fragment encryption key agreed with the server")
+	}
 
 	return c, nil
 }
 
+// SetSocketBuffers overrides the OS read/write buffer sizes of the resolver socket (0 keeps current)
+func (c *DnsPacketConn) SetSocketBuffers(readBytes, writeBytes int) {
+	if udpConn, ok := c.Conn.(*net.UDPConn); ok {
+		SetUDPBuffers(udpConn, readBytes, writeBytes, c.logger)
+	}
+}
+
+// SetResolverStrategy selects how queries are spread across the resolver pool
+func (c *DnsPacketConn) SetResolverStrategy(s ResolverStrategy) {
+	c.pool.setStrategy(s)
+}
+
+// LastAnsweredResolver returns the index (in the list passed to the constructor)
+// of the resolver that answered most recently, or -1 if none has answered yet
+func (c *DnsPacketConn) LastAnsweredResolver() int {
+	return c.pool.lastAnsweredIndex()
+}
+
+// EnableFEC starts adding parity fragments to upstream packets at the
+// configured FECRatio; call it once the server advertised CapFEC
+func (c *DnsPacketConn) EnableFEC() {
+	c.fecOn.Store(c.fecRatio > 0)
+}
+
+// EnableCompression starts deflating upstream packets if Compress was set;
+// call it once the server advertised CapCompress
+func (c *DnsPacketConn) EnableCompression() {
+	c.compressOn.Store(c.compress)
+}
+
+// EnableReorder starts restoring downstream packet order if ReorderWindow was
+// set; call it once the server advertised CapSequence
+func (c *DnsPacketConn) EnableReorder() {
+	if c.reorder != nil {
+		c.reorder.Enable()
+	}
+}
+
+// EnableCredit starts reporting the downstream fragments received on polls;
+// call it once the server advertised CapCredit
+func (c *DnsPacketConn) EnableCredit() {
+	c.creditOn.Store(true)
+}
+
+// ReorderStats returns how often downstream reordering was undone, zero
+// when ReorderWindow is off
+func (c *DnsPacketConn) ReorderStats() ReorderStats {
+	if c.reorder == nil {
+		return ReorderStats{}
+	}
+	return c.reorder.Stats()
+}
+
+// CompressionStats returns what compressing upstream packets saved so far
+func (c *DnsPacketConn) CompressionStats() CompressionStats {
+	return c.compressor.Stats()
+}
+
+// ChunkSize returns the upstream fragment payload: as much as the query name
+// leaves room for next to the session label and domain (see ChunkSizeFor)
+func (c *DnsPacketConn) ChunkSize() int {
+	return c.chunkSize
+}
+
+// TxBacklog returns the number of fragments waiting to be sent upstream
+func (c *DnsPacketConn) TxBacklog() int {
+	return len(c.txQueue) + c.txSpill.Len()
+}
+
+// FragmentStats returns the downstream reassembly counters (loss seen on responses)
+func (c *DnsPacketConn) FragmentStats() FragmentStats {
+	return c.reassembler.Stats()
+}
+
 // SPOOFING: Lie to QUIC that we are UDP
 func (c *DnsPacketConn) LocalAddr() net.Addr {
 	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
 }
-func (c *DnsPacketConn) SetReadDeadline(t time.Time) error  { return nil }
 func (c *DnsPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline makes ReadFrom fail with os.ErrDeadlineExceeded once t has
+// passed. quic-go sets it to stop reading when a dial fails; without it the
+// failed dial never returns.
+func (c *DnsPacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineWake)
+	c.deadlineWake = make(chan struct{})
+	return nil
+}
+
+// Close stops the engines and closes the resolver socket. It returns once every
+// engine goroutine has exited, so nothing touches c.Conn afterwards.
 func (c *DnsPacketConn) Close() error {
-	c.closeOnce.Do(func() { close(c.done); c.Conn.Close() })
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.cwnd != nil {
+			c.cwnd.close()
+		}
+		if c.reorder != nil {
+			c.reorder.Stop()
+		}
+		c.Conn.Close()
+	})
+	c.engines.Wait()
 	return nil
 }
 
@@ -107,38 +597,67 @@ func (c *DnsPacketConn) Close() error {
 func (c *DnsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	// IGNORE 'addr' (It is the dummy 127.0.0.1 from QUIC)
 
+	// Goodput cap: hold QUIC back instead of letting it outrun the DNS channel
+	if c.goodput != nil {
+		if wait := c.goodput.Reserve(len(p)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-c.done:
+				return 0, net.ErrClosed
+			}
+		}
+	}
+
 	c.mu.Lock()
 	c.lastTxTime = time.Now()
 	c.mu.Unlock()
+	// The answer may need a poll: don't leave the heartbeat backed off
+	if c.dryPolls.Swap(0) > 0 {
+		select {
+		case c.pollWake <- struct{}{}:
+		default:
+		}
+	}
 
-	fragments := FragmentPacket(p)
+	packet, compressed := p, false
+	if c.compressOn.Load() {
+		packet, compressed = c.compressor.Compress(p)
+	}
+	fragments := FragmentPacket(packet, c.chunkSize)
+	if c.fecOn.Load() {
+		fragments = FragmentPacketFEC(packet, c.chunkSize, c.fecRatio)
+	}
+	if compressed {
+		MarkCompressed(fragments)
+	}
 
 	// Redundancy strategy:
 	// Handshake packets (Large) need redundancy but MUST BE PACED to avoid resolver drops.
 	redundancy := 1
-	if len(p) >= 1000 {
+	if c.redundancyThreshold > 0 && len(p) >= c.redundancyThreshold {
 		redundancy = 2
 	}
 
 	for r := 0; r < redundancy; r++ {
-		for _, frag := range fragments {
+		// Whole packets only, waiting for the tx workers to make room (see SpillQueue)
+		if !c.txSpill.WaitRoom(c.txQueue, len(fragments), c.done) {
 			select {
-			case c.txQueue <- frag:
-				// PACING FIX: Slight delay between queueing fragments
-				// This prevents the txWorkers from blasting the resolver instantly
-				if redundancy > 1 {
-					time.Sleep(2 * time.Millisecond)
-				}
-			case <-time.After(WriteTimeout):
-				log.Warn().Msg("TX Queue Full - Drop")
-				return 0, nil
 			case <-c.done:
 				return 0, net.ErrClosed
+			default:
 			}
 		}
-		// Wait longer between redundancy batches
+		if evicted := c.txSpill.Enqueue(c.txQueue, fragments); evicted > 0 {
+			c.logger.Warn().Int("packets", evicted).Int("spilled", c.txSpill.Len()).Msg("TX Queue Full - Dropped oldest packets")
+		}
+		// PACING FIX: Space out redundant copies so the txWorkers don't blast the
+		// resolver instantly (2ms per fragment, plus 10ms between copies)
 		if r < redundancy-1 {
-			time.Sleep(10 * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(len(fragments))*2*time.Millisecond + 10*time.Millisecond):
+			case <-c.done:
+				return 0, net.ErrClosed
+			}
 		}
 	}
 	return len(p), nil
@@ -146,55 +665,96 @@ func (c *DnsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 
 // READ: Return from Queue (Spoofing Address)
 func (c *DnsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	select {
-	case data := <-c.rxQueue:
-		n = copy(p, data)
-		// Return our Fake UDP Addr so QUIC accepts it
-		return n, c.LocalAddr(), nil
-	case <-c.done:
-		return 0, nil, net.ErrClosed
+	for {
+		c.deadlineMu.Lock()
+		deadline, wake := c.readDeadline, c.deadlineWake
+		c.deadlineMu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		select {
+		case data := <-c.rxQueue:
+			n = copy(p, data)
+			err = nil
+			addr = c.LocalAddr() // Return our Fake UDP Addr so QUIC accepts it
+		case <-c.done:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			// The deadline changed, start over with the new one
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return n, addr, err
 	}
 }
 
 // --- ENGINES ---
 
 func (c *DnsPacketConn) startTxEngine() {
-	for i := 0; i < NumTxWorkers; i++ {
+	for i := 0; i < c.txWorkers; i++ {
+		c.engines.Add(1)
 		go func() {
+			defer c.engines.Done()
 			msg := new(dns.Msg)
-			// Format: [DATA-LABELS].[SESSION].[DOMAIN]
-			suffix := "." + c.SessionID + "." + c.Domain + "."
 
 			for {
 				select {
 				case pkt := <-c.txQueue:
+					c.txSpill.Refill(c.txQueue)
+					// Congestion window: wait for an answer before exceeding it
+					if c.cwnd != nil && !c.cwnd.acquire() {
+						return
+					}
+					wire := pkt
+					if cipher := c.cipher.Load(); cipher != nil {
+						wire = cipher.Seal(pkt)
+					}
 					// Use NoPadding base32 to avoid = characters in DNS labels
-					encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(pkt)
+					encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(wire)
 
 					// Split encoded data into 57-char labels (matches Rust implementation)
 					// Using 57 instead of 63 provides safety margin and matches picoquic
-					dataLabels := splitIntoLabels(encoded, 57)
-					qname := dataLabels + suffix
+					dataLabels := splitIntoLabels(encoded, DataLabelLen)
+					// Format: [DATA-LABELS].[SESSION].[DOMAIN]
+					qname := dataLabels + "." + c.fixedLabels(c.sessionLabel()+"."+c.Domain+".")
+
+					msg.SetQuestion(qname, c.recordType)
 
-					msg.SetQuestion(qname, dns.TypeTXT)
+					// Load balance: pick next healthy resolver from pool
+					target := c.pool.pick()
 
-					// EDNS0: Signal support for large UDP packets (1232 bytes)
+					// EDNS0: Signal support for large UDP packets (EDNSSize bytes)
 					// Clear Extra first (msg is reused), then add OPT
 					msg.Extra = nil
-					opt := &dns.OPT{
-						Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
-					}
-					opt.SetUDPSize(1232)
-					msg.Extra = append(msg.Extra, opt)
+					msg.Extra = append(msg.Extra, c.queryOPT(target))
 
 					buf, _ := msg.Pack()
+					kind := queryPlain
+					if c.cwnd != nil {
+						kind = queryWindowed
+					}
+					c.queries.add(msg.Id, c.echoName(qname), kind)
 
 					// Send once - QUIC's built-in retransmission handles reliability
 					// Double-sending was causing 2x overhead and congestion
-					// Load balance: pick random resolver from pool
-					target := c.Resolvers[rand.Intn(len(c.Resolvers))]
-					c.Conn.WriteToUDP(buf, target)
-					log.Debug().Str("resolver", target.String()).Int("len", len(pkt)).Msg("TX sent")
+					c.Conn.WriteTo(buf, target)
+					c.capture.Fragment(CaptureUp, c.SessionID(), pkt)
+					c.logger.Debug().Str("resolver", target.String()).Int("len", len(pkt)).Msg("TX sent")
 				case <-c.done:
 					return
 				}
@@ -203,6 +763,135 @@ func (c *DnsPacketConn) startTxEngine() {
 	}
 }
 
+// deliver pushes a reassembled payload to QUIC, splitting it first when the
+// server coalesces several packets into one
+func (c *DnsPacketConn) deliver(payload []byte) {
+	pkts := [][]byte{payload}
+	if c.framed {
+		var err error
+		if pkts, err = Deframe(payload); err != nil {
+			c.logger.Debug().Err(err).Int("len", len(payload)).Int("packets", len(pkts)).Msg("Malformed coalesced payload")
+		}
+	}
+	for _, pkt := range pkts {
+		select {
+		case c.rxQueue <- pkt:
+		default:
+			c.logger.Warn().Msg("RX queue full, dropping packet")
+		}
+	}
+}
+
+// noteResponseSize watches for EDNS0 being stripped on the way back: truncated
+// responses while none ever exceeded 512 bytes. After EDNSFallbackThreshold of
+// them, polls ask the server to size responses for 512 bytes.
+func (c *DnsPacketConn) noteResponseSize(n int, truncated bool, from net.Addr) {
+	if n > MinResponseSize {
+		c.ednsWorks.Store(true)
+		return
+	}
+	if !truncated || c.ednsWorks.Load() {
+		return
+	}
+	if c.truncated.Add(1) == EDNSFallbackThreshold && c.sizeHint.CompareAndSwap(0, MinResponseSize) {
+		c.logger.Warn().Str("from", from.String()).Int("size", MinResponseSize).
+			Msg("DNS responses are being truncated, EDNS0 looks stripped on the path; asking the server for smaller responses (slower)")
+	}
+}
+
+// CongestionWindow returns the in-flight cap on upstream data queries and how
+// many are in flight; both are 0 when MaxInflight is off
+func (c *DnsPacketConn) CongestionWindow() (window, inflight int) {
+	if c.cwnd == nil {
+		return 0, 0
+	}
+	return c.cwnd.size()
+}
+
+// ResponseStats returns the largest response size and fragment count seen from each resolver
+func (c *DnsPacketConn) ResponseStats() []ResolverResponseStats {
+	stats := c.pool.responseStats()
+	if c.remote != nil {
+		for i := range stats {
+			stats[i].Resolver = c.remote.Resolver(stats[i].Resolver)
+		}
+	}
+	return stats
+}
+
+// ResponseSizeHint returns the response size the server is asked to keep to, or 0 if none
+func (c *DnsPacketConn) ResponseSizeHint() int {
+	return int(c.sizeHint.Load())
+}
+
+// fixedLabels returns the non-data part of a query name, case-randomized when 0x20 is enabled
+func (c *DnsPacketConn) fixedLabels(name string) string {
+	if !c.case0x20 {
+		return name
+	}
+	return randomizeCase(name)
+}
+
+// echoName returns the question name a response must echo, or "" when it isn't checked
+func (c *DnsPacketConn) echoName(qname string) string {
+	if !c.case0x20 {
+		return ""
+	}
+	return qname
+}
+
+// sessionLabel returns the session label, carrying the PSK token when configured
+func (c *DnsPacketConn) sessionLabel() string {
+	return c.sessionLabelFor(c.SessionID())
+}
+
+// sessionLabelFor returns the label for sessionID; each call takes the next
+// token counter, so every query's label is different
+func (c *DnsPacketConn) sessionLabelFor(sessionID string) string {
+	if len(c.psk) == 0 {
+		return sessionID
+	}
+	return crypto.SessionLabel(c.psk, sessionID, c.tokenCounter.Add(1), time.Now())
+}
+
+// SessionID returns the session the conn's queries are sent under
+func (c *DnsPacketConn) SessionID() string {
+	return *c.sessionID.Load()
+}
+
+// Rebind moves the conn to another session: from now on queries carry
+// sessionID, and polls only fetch the downstream queued for it. The QUIC
+// connection on top keeps running; the server sees its peer move to a new
+// address and validates the new path (see the client's migrate). Fragments
+// waiting on the old session are lost and retransmitted by QUIC. The new
+// session label must leave room for ChunkSize, as queued fragments were cut
+// to it. With fragment encryption the new session gets a key of its own first.
+func (c *DnsPacketConn) Rebind(sessionID string) error {
+	suffixLen := len(crypto.SessionLabel(c.psk, sessionID, 0, time.Now())) + len(strings.TrimSuffix(c.Domain, ".")) + 2
+	room := ChunkSizeFor(suffixLen)
+	if c.cipher.Load() != nil {
+		room -= crypto.FragmentCipherOverhead
+	}
+	if room < c.chunkSize {
+		return fmt.Errorf("session ID %q leaves room for %d bytes per query, %d are needed", sessionID, room, c.chunkSize)
+	}
+	if c.cipher.Load() != nil {
+		cipher, err := c.exchangeKeys(sessionID)
+		if err != nil {
+			return err
+		}
+		c.cipher.Store(cipher)
+	}
+	c.sessionID.Store(&sessionID)
+	c.logger.Info().Str("session", sessionID).Msg("Rebound DNS transport to a new session")
+	// Poll the new session at once: the server's path challenge waits there
+	select {
+	case c.pollTrigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
 // splitIntoLabels splits a string into DNS labels of max length
 func splitIntoLabels(s string, maxLen int) string {
 	if len(s) <= maxLen {
@@ -223,57 +912,131 @@ func splitIntoLabels(s string, maxLen int) string {
 }
 
 func (c *DnsPacketConn) startRxEngine() {
+	c.engines.Add(1)
 	go func() {
-		buf := make([]byte, 4096)
+		defer c.engines.Done()
+		buf := make([]byte, c.rxBufSize)
 		for {
-			n, srcAddr, err := c.Conn.ReadFromUDP(buf)
+			n, srcAddr, err := c.Conn.ReadFrom(buf)
 			if err != nil {
 				select {
 				case <-c.done:
 					return
 				default:
+					// Windows reports oversized datagrams as an error instead of truncating
+					c.logger.Debug().Err(err).Msg("Failed to read DNS response")
 					continue
 				}
 			}
 
+			// A datagram that exactly fills the buffer was most likely cut short by the
+			// kernel; unpacking it would fail and silently lose every fragment inside
+			if n == len(buf) {
+				c.truncWarn.Do(func() {
+					c.logger.Warn().Int("buffer", len(buf)).Msg("DNS response filled the read buffer and was likely truncated, raise --rx-buffer")
+				})
+				c.logger.Debug().Int("buffer", len(buf)).Str("from", srcAddr.String()).Msg("Dropping truncated DNS response")
+				continue
+			}
+
+			// Only accept replies from a configured resolver (blocks off-path injection)
+			if !c.pool.markAnswered(srcAddr) {
+				c.logger.Debug().Str("from", srcAddr.String()).Msg("Dropping response from unknown source")
+				continue
+			}
+
 			msg := new(dns.Msg)
 			if err := msg.Unpack(buf[:n]); err != nil {
-				log.Debug().Err(err).Msg("Failed to unpack DNS response")
+				c.logger.Debug().Err(err).Msg("Failed to unpack DNS response")
 				continue
 			}
 
-			gotData := false
-			for _, ans := range msg.Answer {
-				if txt, ok := ans.(*dns.TXT); ok {
-					// Join TXT chunks (miekg/dns may split at 255 chars)
-					encoded := strings.Join(txt.Txt, "")
-
-					// Decode base64 fragment
-					raw, err := base64.StdEncoding.DecodeString(encoded)
-					if err != nil {
-						log.Debug().Err(err).Int("len", len(encoded)).Msg("Failed to decode base64 TXT")
-						continue
-					}
+			// The response must answer one of our outstanding queries
+			if !msg.Response {
+				c.logger.Debug().Uint16("id", msg.Id).Str("from", srcAddr.String()).Msg("Dropping DNS message that is not a response")
+				continue
+			}
+			// Cookies: checked before the ID so a forgery doesn't use up the query
+			if c.cookies != nil {
+				ok, verified := c.cookies.check(srcAddr, msg)
+				if verified {
+					c.logger.Info().Str("resolver", srcAddr.String()).Msg("Resolver echoes DNS cookies; its responses without one are dropped from now on")
+				}
+				if !ok {
+					c.cookieWarn.Do(func() {
+						c.logger.Warn().Str("from", srcAddr.String()).Msg("Response carries a wrong or no DNS cookie; forged, or the resolver changed (disable --cookies)")
+					})
+					c.logger.Debug().Uint16("id", msg.Id).Str("from", srcAddr.String()).Msg("Dropping response with bad DNS cookie")
+					continue
+				}
+			}
+			query, ok := c.queries.take(msg.Id)
+			if !ok {
+				c.logger.Debug().Uint16("id", msg.Id).Str("from", srcAddr.String()).Msg("Dropping response with unknown query ID")
+				continue
+			}
+			// 0x20: the question must come back with exactly the case we sent
+			if qname := query.qname; qname != "" && (len(msg.Question) == 0 || msg.Question[0].Name != qname) {
+				c.caseWarn.Do(func() {
+					c.logger.Warn().Str("from", srcAddr.String()).Msg("Response question case does not match the query; forged, or the resolver does not preserve case (disable --0x20)")
+				})
+				c.logger.Debug().Uint16("id", msg.Id).Str("from", srcAddr.String()).Msg("Dropping response with mismatched 0x20 echo")
+				if query.kind == queryWindowed {
+					c.cwnd.release()
+				}
+				if query.kind == queryLongPoll {
+					c.returnLongPoll(1)
+				}
+				continue
+			}
+			if query.kind == queryKey {
+				c.takeKeyReply(msg)
+				continue
+			}
+			if query.kind == queryLongPoll {
+				// Answered (data or hold expired): re-issue it right away
+				c.returnLongPoll(1)
+			}
+			// An error answer is how many resolvers rate-limit: the congestion
+			// window and the poll tuner both count it as loss
+			refused := msg.Rcode != dns.RcodeSuccess
+			if query.kind == queryWindowed {
+				if refused {
+					c.cwnd.loss(1)
+				} else {
+					c.cwnd.ack()
+				}
+			}
+
+			c.noteResponseSize(n, msg.Truncated, srcAddr)
+
+			gotData, frags := c.ingestAnswers(msg, srcAddr)
+			// TC: the answer didn't fit; fetch it over TCP where allowed,
+			// otherwise the data waits for the next poll
+			retried := msg.Truncated && len(msg.Question) == 1 && c.retryOverTCP(msg.Question[0], srcAddr)
 
-					if len(raw) > 0 {
-						gotData = true
-						// Reassemble fragments into full packets (no per-fragment logging)
-						if fullPacket := c.reassembler.IngestChunk(raw); fullPacket != nil {
-							log.Info().Int("len", len(fullPacket)).Str("from", srcAddr.String()).Msg("Downstream packet complete")
-							// Push complete packet to QUIC
-							select {
-							case c.rxQueue <- fullPacket:
-							default:
-								log.Warn().Msg("RX queue full, dropping packet")
-							}
-						}
+			c.pool.noteResponse(srcAddr, n, frags)
+			// A truncated answer means data is waiting that didn't fit, whether
+			// the server or a resolver on the way cut it: poll again right away
+			// unless it is being fetched over TCP
+			pending := gotData || msg.Truncated && !retried
+			if query.kind == queryPoll && !pending {
+				c.dryPolls.Add(1)
+			}
+			if query.kind == queryPoll && c.pollTuner != nil {
+				if refused {
+					if c.pollTuner.loss(1) {
+						c.logger.Debug().Int("polls", c.pollTuner.polls()).Msg("Poll refused, polls per burst reduced")
 					}
+				} else {
+					c.pollTuner.answered(gotData)
 				}
 			}
 
 			// Turbo Poll: If we got data, trigger async burst polling
 			// Non-blocking: if BurstEngine is busy, signal is debounced
-			if gotData {
+			if pending {
+				c.dryPolls.Store(0)
 				select {
 				case c.pollTrigger <- struct{}{}:
 				default:
@@ -284,20 +1047,136 @@ func (c *DnsPacketConn) startRxEngine() {
 	}()
 }
 
+// ingestAnswers reassembles the fragments carried by a response's answers and
+// reports whether there were any and how many
+func (c *DnsPacketConn) ingestAnswers(msg *dns.Msg, srcAddr net.Addr) (gotData bool, frags int) {
+	cipher := c.cipher.Load()
+	c.answerFragments(msg, func(raw []byte) {
+		if cipher != nil {
+			var err error
+			if raw, err = cipher.Open(raw); err != nil {
+				c.logger.Debug().Err(err).Str("from", srcAddr.String()).Msg("Dropping downstream fragment")
+				return
+			}
+		}
+		gotData = true
+		frags++
+		c.rxFrags.Add(1)
+		c.capture.Fragment(CaptureDown, c.SessionID(), raw)
+		// Reassemble fragments into full packets (no per-fragment logging)
+		if fullPacket := c.reassembler.IngestChunk(raw); fullPacket != nil {
+			c.logger.Info().Int("len", len(fullPacket)).Str("from", srcAddr.String()).Msg("Downstream packet complete")
+			if c.reorder != nil {
+				c.reorder.Push(binary.BigEndian.Uint16(raw[0:2]), fullPacket)
+			} else {
+				c.deliver(fullPacket)
+			}
+		}
+	})
+	return gotData, frags
+}
+
+// answerFragments decodes the fragments carried by a response's answers and
+// passes each non-empty one to fn
+func (c *DnsPacketConn) answerFragments(msg *dns.Msg, fn func(raw []byte)) {
+	ingest := func(raw []byte) {
+		if len(raw) > 0 {
+			fn(raw)
+		}
+	}
+	var addrs []net.IP
+	for _, ans := range msg.Answer {
+		switch rr := ans.(type) {
+		case *dns.TXT:
+			// A fragment per character-string, padded or base64url (see txt.go)
+			raws, err := DecodeTXTRecord(rr.Txt)
+			if err != nil {
+				c.logger.Debug().Err(err).Int("strings", len(rr.Txt)).Msg("Failed to decode base64 TXT")
+				continue
+			}
+			for _, raw := range raws {
+				ingest(raw)
+			}
+		case *dns.A:
+			// A-record fragments span the whole answer, decoded below
+			addrs = append(addrs, rr.A)
+		case *dns.CNAME:
+			raw, err := DecodeCNAME(rr.Target, c.Domain)
+			if err != nil {
+				c.logger.Debug().Err(err).Str("target", rr.Target).Msg("Failed to decode CNAME")
+				continue
+			}
+			ingest(raw)
+		case *dns.NULL:
+			// Raw fragment bytes, nothing to decode
+			ingest([]byte(rr.Data))
+		}
+	}
+	if len(addrs) > 0 {
+		raws, err := DecodeARecords(addrs)
+		if err != nil {
+			c.logger.Debug().Err(err).Int("records", len(addrs)).Msg("Failed to decode A records")
+		}
+		for _, raw := range raws {
+			ingest(raw)
+		}
+	}
+}
+
 func (c *DnsPacketConn) startPollEngine() {
+	c.engines.Add(1)
 	go func() {
-		ticker := time.NewTicker(PollInterval)
+		defer c.engines.Done()
+		interval := c.pollInterval
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		expireTicker := time.NewTicker(c.reassembler.timeout() / 5)
+		defer expireTicker.Stop()
+		var sweep <-chan time.Time
+		if c.cwnd != nil || c.pollTuner != nil {
+			sweepTicker := time.NewTicker(CwndLossTimeout / 4)
+			defer sweepTicker.Stop()
+			sweep = sweepTicker.C
+		}
 		for {
 			select {
+			case <-expireTicker.C:
+				c.reassembler.Expire()
+			case <-sweep:
+				// Polls the resolver never answered: send fewer per burst
+				if c.pollTuner != nil && c.pollTuner.loss(c.queries.sweep(queryPoll, CwndLossTimeout)) {
+					c.logger.Debug().Int("polls", c.pollTuner.polls()).Msg("Polls lost, polls per burst reduced")
+				}
+				// Data queries the resolver never answered: shrink the window
+				if lost := c.queries.sweep(queryWindowed, CwndLossTimeout); lost > 0 && c.cwnd != nil {
+					c.cwnd.loss(lost)
+					window, inflight := c.cwnd.size()
+					c.logger.Debug().Int("lost", lost).Int("cwnd", window).Int("inflight", inflight).Msg("Upstream queries lost, congestion window reduced")
+				}
+			case <-c.pollWake:
+				if interval != c.pollInterval {
+					interval = c.pollInterval
+					ticker.Reset(interval)
+				}
 			case <-ticker.C:
 				// Only poll if idle (no recent TX activity)
 				c.mu.Lock()
-				idle := time.Since(c.lastTxTime) > IdleThreshold
+				idle := time.Since(c.lastTxTime) > c.idleThreshold
 				c.mu.Unlock()
 
-				if idle {
+				// Long polls already wait at the server for downstream data
+				if idle && c.longPollSlots == nil {
 					c.sendParallelPolls()
 				}
+				// Back off while whole bursts come back empty, snap back on data or upstream traffic
+				next := c.pollInterval
+				if idle && int(c.dryPolls.Load()) >= c.PollsPerBurst() {
+					next = min(interval*2, c.idlePollInterval)
+				}
+				if next != interval {
+					interval = next
+					ticker.Reset(interval)
+				}
 			case <-c.done:
 				return
 			}
@@ -308,7 +1187,9 @@ func (c *DnsPacketConn) startPollEngine() {
 // startBurstEngine handles async burst polling without blocking RxEngine
 // This reduces effective RTT by not adding dead time to the receive loop
 func (c *DnsPacketConn) startBurstEngine() {
+	c.engines.Add(1)
 	go func() {
+		defer c.engines.Done()
 		for {
 			select {
 			case <-c.pollTrigger:
@@ -324,8 +1205,9 @@ func (c *DnsPacketConn) startBurstEngine() {
 // sendParallelPolls sends multiple polls simultaneously to maximize throughput
 // Each poll has a unique nonce so resolver treats them as separate queries
 func (c *DnsPacketConn) sendParallelPolls() {
-	for i := 0; i < ParallelPolls; i++ {
-		c.sendPoll()
+	polls := c.PollsPerBurst()
+	for i := 0; i < polls; i++ {
+		c.sendPoll(0)
 		// Minimal pacing: 1ms every 8 polls to avoid UDP buffer overflow
 		// 32 polls complete in ~4ms instead of blocking RxEngine
 		if i > 0 && i%8 == 0 {
@@ -334,7 +1216,52 @@ func (c *DnsPacketConn) sendParallelPolls() {
 	}
 }
 
-func (c *DnsPacketConn) sendPoll() {
+// PollsPerBurst returns how many polls each heartbeat or burst sends:
+// ParallelPolls, or less while AdaptivePolls backs off
+func (c *DnsPacketConn) PollsPerBurst() int {
+	if c.pollTuner != nil {
+		return c.pollTuner.polls()
+	}
+	return c.parallelPolls
+}
+
+// startLongPollEngine keeps LongPolls long polls outstanding: every answered or lost
+// long poll returns its slot and is re-issued at once
+func (c *DnsPacketConn) startLongPollEngine() {
+	c.returnLongPoll(cap(c.longPollSlots))
+
+	c.engines.Add(1)
+	go func() {
+		defer c.engines.Done()
+		sweep := time.NewTicker(c.longPollHold)
+		defer sweep.Stop()
+		for {
+			select {
+			case <-c.longPollSlots:
+				c.sendPoll(c.longPollHold)
+			case <-sweep.C:
+				// Long polls the resolver dropped would otherwise hold their slot forever
+				c.returnLongPoll(c.queries.sweep(queryLongPoll, c.longPollHold+longPollGrace))
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// returnLongPoll hands n long-poll slots back to the engine
+func (c *DnsPacketConn) returnLongPoll(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case c.longPollSlots <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// sendPoll sends one poll; a hold above zero makes it a long poll
+func (c *DnsPacketConn) sendPoll(hold time.Duration) {
 	// "poll" is a magic keyword for the server
 	// Format: poll.NONCE.SESSION.DOMAIN. (nonce busts DNS cache)
 	// The random nonce ensures each poll is unique, preventing ISP/resolver
@@ -343,26 +1270,59 @@ func (c *DnsPacketConn) sendPoll() {
 	binary.BigEndian.PutUint32(nonce, rand.Uint32())
 	nonceStr := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(nonce)
 
-	qname := "poll." + nonceStr + "." + c.SessionID + "." + c.Domain + "."
+	// Selective repeat: name downstream fragments that went missing so the server resends them
+	labels := "poll." + nonceStr + "."
+	if c.nacks {
+		if nacks := c.reassembler.Nacks(MaxNacksPerLabel); len(nacks) > 0 {
+			labels += EncodeNackLabel(nacks) + "."
+			c.logger.Debug().Int("packets", len(nacks)).Msg("Requesting missing downstream fragments")
+		}
+	}
+	if hint := c.sizeHint.Load(); hint > 0 {
+		labels += EncodeSizeHint(int(hint)) + "."
+	}
+	if hold > 0 {
+		labels += EncodeHoldHint(hold) + "."
+	}
+	if c.creditOn.Load() {
+		labels += EncodeCreditAck(c.rxFrags.Load()) + "."
+	}
+	qname := c.fixedLabels(labels + c.sessionLabel() + "." + c.Domain + ".")
 	msg := new(dns.Msg)
-	msg.SetQuestion(qname, dns.TypeTXT)
+	msg.SetQuestion(qname, c.recordType)
+
+	// Load balance: pick next healthy resolver from pool
+	target := c.pool.pick()
 
-	// EDNS0: Signal support for large UDP packets (1232 bytes)
+	// EDNS0: Signal support for large UDP packets (EDNSSize bytes)
 	// This tells the resolver "Don't truncate! I can handle big responses!"
+	msg.Extra = append(msg.Extra, c.queryOPT(target))
+
+	buf, _ := msg.Pack()
+	kind := queryPoll
+	if hold > 0 {
+		kind = queryLongPoll
+	}
+	c.queries.add(msg.Id, c.echoName(qname), kind)
+	c.Conn.WriteTo(buf, target)
+	c.logger.Debug().Str("resolver", target.String()).Msg("Poll sent")
+}
+
+// queryOPT returns the OPT record of a query to target, carrying the
+// resolver's cookie when cookies are on
+func (c *DnsPacketConn) queryOPT(target net.Addr) *dns.OPT {
 	opt := &dns.OPT{
 		Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
 	}
-	opt.SetUDPSize(1232)
-	msg.Extra = append(msg.Extra, opt)
-
-	buf, _ := msg.Pack()
-	// Load balance: pick random resolver from pool
-	target := c.Resolvers[rand.Intn(len(c.Resolvers))]
-	c.Conn.WriteToUDP(buf, target)
-	log.Debug().Str("resolver", target.String()).Msg("Poll sent")
+	opt.SetUDPSize(uint16(c.ednsSize))
+	if c.cookies != nil {
+		opt.Option = append(opt.Option, c.cookies.option(target))
+	}
+	return opt
 }
 
+// SetDeadline sets the read deadline only (see SetReadDeadline): the engines
+// own the socket, and writes are queued rather than timed out
 func (c *DnsPacketConn) SetDeadline(t time.Time) error {
-	// Forward the call to the underlying UDP connection
-	return c.Conn.SetDeadline(t)
+	return c.SetReadDeadline(t)
 }
@@ -0,0 +1,593 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testDomain  = "t.example.com"
+	testSession = "abcdefgh"
+)
+
+// newTestConn opens a transport whose only resolver is a socket the test answers from
+func newTestConn(t *testing.T) (*DnsPacketConn, *net.UDPConn) {
+	t.Helper()
+	return newTestConnWithOptions(t, DnsConnOptions{})
+}
+
+// newTestConnWithOptions is newTestConn with a transport tuned by opts
+func newTestConnWithOptions(t *testing.T, opts DnsConnOptions) (*DnsPacketConn, *net.UDPConn) {
+	t.Helper()
+	resolver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resolver.Close() })
+	logger := zerolog.Nop()
+	opts.Logger = &logger
+	c, err := NewDnsPacketConnWithOptions([]string{resolver.LocalAddr().String()}, testDomain, testSession, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, resolver
+}
+
+// readQuery returns the next query the transport sent to resolver
+func readQuery(t *testing.T, resolver *net.UDPConn) *dns.Msg {
+	t.Helper()
+	buf := make([]byte, 4096)
+	resolver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := resolver.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// answerWith packs a TXT response to query carrying payload as one packet
+func answerWith(t *testing.T, query *dns.Msg, payload []byte) []byte {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	for _, frag := range FragmentPacket(payload, MaxChunkSize) {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{EncodeTXT(frag, false)},
+		})
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+// clientAddr is where the transport's socket receives responses
+func clientAddr(c *DnsPacketConn) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.Conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// nextPacket returns the next packet the transport delivers, nil if none comes within wait
+func nextPacket(t *testing.T, c *DnsPacketConn, wait time.Duration) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Time{})
+	buf := make([]byte, RxBufferSize)
+	n, _, err := c.ReadFrom(buf)
+	if os.IsTimeout(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestResponseFromUnknownSourceDropped(t *testing.T) {
+	c, resolver := newTestConn(t)
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	// The forged answer matches the outstanding query in every way but its source
+	query := readQuery(t, resolver)
+	if _, err := attacker.WriteToUDP(answerWith(t, query, []byte("forged")), clientAddr(c)); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextPacket(t, c, 300*time.Millisecond); got != nil {
+		t.Fatalf("delivered %q from an unknown source", got)
+	}
+
+	// The query is still outstanding, so the resolver's own answer gets through
+	if _, err := resolver.WriteToUDP(answerWith(t, query, []byte("genuine")), clientAddr(c)); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextPacket(t, c, 2*time.Second); !bytes.Equal(got, []byte("genuine")) {
+		t.Fatalf("got %q, want the resolver's answer", got)
+	}
+}
+
+func TestResponseWithUnknownIDDropped(t *testing.T) {
+	c, resolver := newTestConn(t)
+
+	query := readQuery(t, resolver)
+	forged := query.Copy()
+	forged.Id = query.Id + 1
+	if _, err := resolver.WriteToUDP(answerWith(t, forged, []byte("forged")), clientAddr(c)); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextPacket(t, c, 300*time.Millisecond); got != nil {
+		t.Fatalf("delivered %q answering no outstanding query", got)
+	}
+
+	// A second answer to the same query is a replay
+	resolver.WriteToUDP(answerWith(t, query, []byte("genuine")), clientAddr(c))
+	if got := nextPacket(t, c, 2*time.Second); !bytes.Equal(got, []byte("genuine")) {
+		t.Fatalf("got %q, want the resolver's answer", got)
+	}
+	resolver.WriteToUDP(answerWith(t, query, []byte("replayed")), clientAddr(c))
+	if got := nextPacket(t, c, 300*time.Millisecond); got != nil {
+		t.Fatalf("delivered %q answering an already answered query", got)
+	}
+}
+
+func TestCase0x20EchoVerified(t *testing.T) {
+	c, resolver := newTestConnWithOptions(t, DnsConnOptions{Randomize0x20: true})
+
+	query := readQuery(t, resolver)
+	name := query.Question[0].Name
+	if !strings.HasSuffix(strings.ToLower(name), "."+testSession+"."+testDomain+".") {
+		t.Fatalf("query name %q doesn't carry the session and domain", name)
+	}
+	if name == strings.ToLower(name) {
+		t.Fatalf("query name %q wasn't case-randomized", name)
+	}
+
+	// A resolver that folds case fails the echo check
+	folded := query.Copy()
+	folded.Question[0].Name = strings.ToLower(name)
+	resolver.WriteToUDP(answerWith(t, folded, []byte("folded")), clientAddr(c))
+	if got := nextPacket(t, c, 300*time.Millisecond); got != nil {
+		t.Fatalf("delivered %q from a response that didn't echo the query's case", got)
+	}
+
+	// One echoing the name byte for byte gets through
+	query = readQuery(t, resolver)
+	resolver.WriteToUDP(answerWith(t, query, []byte("echoed")), clientAddr(c))
+	if got := nextPacket(t, c, 2*time.Second); !bytes.Equal(got, []byte("echoed")) {
+		t.Fatalf("got %q, want the echoing response's packet", got)
+	}
+}
+
+// dataQueries collects the data (non-poll) queries resolver receives within wait
+func dataQueries(t *testing.T, resolver *net.UDPConn, wait time.Duration) []*dns.Msg {
+	t.Helper()
+	var queries []*dns.Msg
+	buf := make([]byte, 4096)
+	resolver.SetReadDeadline(time.Now().Add(wait))
+	defer resolver.SetReadDeadline(time.Time{})
+	for {
+		n, _, err := resolver.ReadFromUDP(buf)
+		if os.IsTimeout(err) {
+			return queries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(query.Question[0].Name, "poll.") {
+			queries = append(queries, query)
+		}
+	}
+}
+
+func TestMaxInflightHoldsQueries(t *testing.T) {
+	c, resolver := newTestConnWithOptions(t, DnsConnOptions{MaxInflight: 4})
+	for range 12 {
+		if _, err := c.WriteTo([]byte("upstream packet"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A silent resolver gets one window of data queries and no more
+	sent := dataQueries(t, resolver, 300*time.Millisecond)
+	if len(sent) != 4 {
+		t.Fatalf("%d data queries in flight, want the window of 4", len(sent))
+	}
+	if window, inflight := c.CongestionWindow(); window != 4 || inflight != 4 {
+		t.Fatalf("window %d with %d in flight, want 4 and 4", window, inflight)
+	}
+
+	// Each answer frees a slot for the next queued packet
+	for _, query := range sent {
+		answerPoll(t, c, resolver, query, false)
+	}
+	if more := dataQueries(t, resolver, 300*time.Millisecond); len(more) != 4 {
+		t.Fatalf("%d data queries after 4 answers, want 4", len(more))
+	}
+}
+
+func TestCongestionWindowAIMD(t *testing.T) {
+	w := newCongestionWindow(16)
+	if window, _ := w.size(); window != InitialCwnd {
+		t.Fatalf("starts at %d, want %d", window, InitialCwnd)
+	}
+	// Slow start: one more per answer, up to the cap
+	for range 12 {
+		w.ack()
+	}
+	if window, _ := w.size(); window != 16 {
+		t.Fatalf("%d after 12 answers, want the cap of 16", window)
+	}
+	// One burst of losses halves it once
+	w.loss(1)
+	w.loss(3)
+	if window, _ := w.size(); window != 8 {
+		t.Fatalf("%d after a burst of losses, want 8", window)
+	}
+	// Past the threshold it grows by about one per window of answers
+	for range 9 {
+		w.ack()
+	}
+	if window, _ := w.size(); window != 9 {
+		t.Errorf("%d after 9 answers in avoidance, want 9", window)
+	}
+}
+
+func TestPastDeadlineLeavesSocketReading(t *testing.T) {
+	c, resolver := newTestConn(t)
+	c.SetDeadline(time.Now().Add(-time.Second))
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 64))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if !os.IsTimeout(err) {
+			t.Fatalf("ReadFrom past the deadline returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom ignored the deadline")
+	}
+	c.SetDeadline(time.Time{})
+
+	// The deadline is the reader's: the rx engine kept the socket going
+	resolver.WriteToUDP(answerWith(t, readQuery(t, resolver), []byte("after")), clientAddr(c))
+	if got := nextPacket(t, c, 2*time.Second); !bytes.Equal(got, []byte("after")) {
+		t.Fatalf("got %q after clearing the deadline, want the answer", got)
+	}
+}
+
+// bigPacket is a packet whose single response is far over 4096 bytes
+func bigPacket() []byte {
+	packet := make([]byte, 50*MaxChunkSize)
+	for i := range packet {
+		packet[i] = byte(i * 7)
+	}
+	return packet
+}
+
+func TestResponseOver4096Bytes(t *testing.T) {
+	c, resolver := newTestConn(t)
+	packet := bigPacket()
+	response := answerWith(t, readQuery(t, resolver), packet)
+	if len(response) <= 4096 {
+		t.Fatalf("test response is only %d bytes", len(response))
+	}
+	resolver.WriteToUDP(response, clientAddr(c))
+	if got := nextPacket(t, c, 2*time.Second); !bytes.Equal(got, packet) {
+		t.Fatalf("got %d bytes from a %d-byte response, want the %d-byte packet", len(got), len(response), len(packet))
+	}
+}
+
+func TestResponseOverRxBufferDropped(t *testing.T) {
+	c, resolver := newTestConnWithOptions(t, DnsConnOptions{RxBufferSize: 4096})
+	query := readQuery(t, resolver)
+	resolver.WriteToUDP(answerWith(t, query, bigPacket()), clientAddr(c))
+	if got := nextPacket(t, c, 300*time.Millisecond); got != nil {
+		t.Fatalf("delivered %d bytes from a response cut short by the read buffer", len(got))
+	}
+	// The cut response didn't use up the query
+	resolver.WriteToUDP(answerWith(t, query, []byte("small")), clientAddr(c))
+	if got := nextPacket(t, c, 2*time.Second); !bytes.Equal(got, []byte("small")) {
+		t.Fatalf("got %q after a truncated response, want the next answer", got)
+	}
+}
+
+// answerPoll answers query with no data, truncated if asked
+func answerPoll(t *testing.T, c *DnsPacketConn, resolver *net.UDPConn, query *dns.Msg, truncated bool) {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	msg.Truncated = truncated
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.WriteToUDP(packed, clientAddr(c))
+}
+
+// waitDryPolls waits for the transport's dry poll count to reach want
+func waitDryPolls(t *testing.T, c *DnsPacketConn, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for c.dryPolls.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dry polls, want %d", c.dryPolls.Load(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTruncatedPollNotDry(t *testing.T) {
+	c, resolver := newTestConnWithOptions(t, DnsConnOptions{TCPFallback: -1})
+	answerPoll(t, c, resolver, readQuery(t, resolver), false)
+	waitDryPolls(t, c, 1)
+	// The server had data that didn't fit: poll on as if data had come
+	answerPoll(t, c, resolver, readQuery(t, resolver), true)
+	waitDryPolls(t, c, 0)
+}
+
+// tcpResolver serves DNS over TCP on resolver's address, answering every
+// query with packet and reporting the question names it was asked
+func tcpResolver(t *testing.T, resolver *net.UDPConn, packet []byte) (*dns.Server, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", resolver.LocalAddr().String())
+	if err != nil {
+		t.Skipf("TCP port of the test resolver is taken: %v", err)
+	}
+	asked := make(chan string, 8)
+	srv := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		asked <- r.Question[0].Name
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		for _, frag := range FragmentPacket(packet, MaxChunkSize) {
+			msg.Answer = append(msg.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{EncodeTXT(frag, false)},
+			})
+		}
+		w.WriteMsg(msg)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return srv, asked
+}
+
+func TestTruncatedAnswerFetchedOverTCP(t *testing.T) {
+	c, resolver := newTestConnWithOptions(t, DnsConnOptions{PSK: []byte("secret")})
+	srv, asked := tcpResolver(t, resolver, []byte("fetched"))
+
+	query := readQuery(t, resolver)
+	answerPoll(t, c, resolver, query, true)
+	if got := nextPacket(t, c, 3*time.Second); !bytes.Equal(got, []byte("fetched")) {
+		t.Fatalf("got %q, want the packet fetched over TCP", got)
+	}
+	// Same poll, new token: the truncated query's one is spent
+	udpName, tcpName := query.Question[0].Name, <-asked
+	udp, tcp := dns.SplitDomainName(udpName), dns.SplitDomainName(tcpName)
+	if len(tcp) != len(udp) || !slices.Equal(tcp[:2], udp[:2]) || tcp[2] == udp[2] || !slices.Equal(tcp[3:], udp[3:]) {
+		t.Errorf("retried %q as %q, want the same labels under a new session label", udpName, tcpName)
+	}
+	if stats := c.TCPFallbackStats(); stats.Retries != 1 || stats.Fetched != 1 {
+		t.Errorf("stats %+v, want one retry that fetched data", stats)
+	}
+
+	// A resolver whose TCP fails is left alone for TCPFallbackBackoff
+	srv.Shutdown()
+	answerPoll(t, c, resolver, readQuery(t, resolver), true)
+	deadline := time.Now().Add(3 * time.Second)
+	for c.tcp.usable(resolver.LocalAddr().String()) {
+		if time.Now().After(deadline) {
+			t.Fatal("failed TCP retry not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	answerPoll(t, c, resolver, readQuery(t, resolver), true)
+	time.Sleep(100 * time.Millisecond)
+	if stats := c.TCPFallbackStats(); stats.Retries != 2 {
+		t.Errorf("%d retries, want none during the backoff after the failed second", stats.Retries)
+	}
+}
+
+func TestWriteToOverloadEvictsWholePackets(t *testing.T) {
+	// One query in flight and a silent resolver: the tx queue and spill ring
+	// fill up, and the writes beyond them evict after SpillWait. Few polls,
+	// or they overflow the resolver's socket meanwhile.
+	c, resolver := newTestConnWithOptions(t, DnsConnOptions{MaxInflight: 1, ParallelPolls: 1, PollInterval: time.Second, TCPFallback: -1})
+	const frags = 3
+	chunk := c.chunkSize
+	// Every fragment of packet i starts with i, so the resolver can tell
+	// which packet each belongs to without reassembling (random packet IDs
+	// collide among this many)
+	packet := func(i int) []byte {
+		p := make([]byte, frags*chunk)
+		for j := range p {
+			p[j] = byte(i*31 + j)
+		}
+		for f := range frags {
+			binary.BigEndian.PutUint16(p[f*chunk:], uint16(i))
+		}
+		return p
+	}
+	const writers = 8
+	total := (TxQueueSize+DefaultSpillSize)/frags + 2*writers
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < total; i += writers {
+				c.WriteTo(packet(i), nil)
+			}
+		}()
+	}
+	wg.Wait()
+	evicted := int(c.txSpill.evicted.Load())
+	if evicted == 0 {
+		t.Fatal("nothing evicted, the test didn't overload the queue")
+	}
+
+	// The resolver comes back and answers everything, one query at a time
+	seen := make(map[uint16]map[int]bool)
+	whole := 0
+	suffix := "." + testSession + "." + testDomain + "."
+	buf := make([]byte, 4096)
+	for {
+		resolver.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := resolver.ReadFromUDP(buf)
+		if os.IsTimeout(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		answerPoll(t, c, resolver, query, false)
+		name := query.Question[0].Name
+		if strings.HasPrefix(name, "poll.") {
+			continue
+		}
+		frag, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ReplaceAll(strings.TrimSuffix(name, suffix), ".", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, payload := int(frag[3]), frag[FragHeaderLen:]
+		i := binary.BigEndian.Uint16(payload)
+		if !bytes.Equal(payload, packet(int(i))[seq*chunk:(seq+1)*chunk]) {
+			t.Fatalf("fragment %d of packet %d corrupted", seq, i)
+		}
+		if seen[i] == nil {
+			seen[i] = make(map[int]bool)
+		}
+		if seen[i][seq] = true; len(seen[i]) == frags {
+			if whole++; whole+evicted == total {
+				break
+			}
+		}
+	}
+
+	// Every packet went out whole or not at all, and nothing is left over
+	if whole+evicted != total || len(seen) != whole {
+		t.Errorf("%d packets sent whole, %d partly and %d evicted, want all %d whole or evicted", whole, len(seen)-whole, evicted, total)
+	}
+	if extra := dataQueries(t, resolver, 500*time.Millisecond); len(extra) > 0 {
+		t.Errorf("%d more fragments sent after every packet was accounted for", len(extra))
+	}
+}
+
+// lateConn is a transport counting calls that return after closed is set
+type lateConn struct {
+	*LoopbackConn
+	closed atomic.Bool
+	late   atomic.Int32
+}
+
+func (c *lateConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.LoopbackConn.ReadFrom(p)
+	if c.closed.Load() {
+		c.late.Add(1)
+	}
+	return n, addr, err
+}
+
+func (c *lateConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.LoopbackConn.WriteTo(p, addr)
+	if c.closed.Load() {
+		c.late.Add(1)
+	}
+	return n, err
+}
+
+// Close must not return while an engine still runs: run it under -race
+// against writers, readers and other Close calls, over and over, and check
+// that no engine touches the transport once it returned
+func TestCloseWaitsForEnginesUnderLoad(t *testing.T) {
+	// Every query gets an empty answer, so the rx engine stays busy
+	respond := func(query []byte) []byte {
+		msg := new(dns.Msg)
+		if msg.Unpack(query) != nil {
+			return nil
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(msg)
+		out, _ := reply.Pack()
+		return out
+	}
+	logger := zerolog.Nop()
+
+	for range 50 {
+		transport := &lateConn{LoopbackConn: NewLoopbackConn(respond)}
+		c, err := NewDnsPacketConnWithOptions([]string{LoopbackResolverAddr.String()}, testDomain, testSession, DnsConnOptions{
+			Logger:    &logger,
+			Transport: transport,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var users sync.WaitGroup
+		for range 4 {
+			users.Add(2)
+			go func() {
+				defer users.Done()
+				for {
+					if _, err := c.WriteTo([]byte("upstream packet"), nil); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer users.Done()
+				buf := make([]byte, 2048)
+				for {
+					if _, _, err := c.ReadFrom(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		var closers sync.WaitGroup
+		for range 3 {
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				c.Close()
+			}()
+		}
+		closers.Wait()
+		transport.closed.Store(true)
+		users.Wait()
+		time.Sleep(5 * time.Millisecond)
+		if n := transport.late.Load(); n > 0 {
+			t.Fatalf("engines used the transport %d times after Close returned", n)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DNS over HTTPS (RFC 8484): where UDP/53 is blocked but public DoH resolvers
+// are reachable, every query is POSTed as application/dns-message instead.
+// DoHConn is a net.PacketConn like LoopbackConn, so the tx, poll and burst
+// engines run unchanged and simply issue concurrent POSTs. Requests share a
+// pooled HTTP client: HTTP/2 resolvers multiplex them all on one connection,
+// HTTP/1.1 ones keep up to DoHMaxInflight connections alive.
+
+const (
+	// DoHMaxInflight caps the POSTs awaiting an answer; queries beyond it are
+	// dropped like on a full UDP socket and count as loss
+	DoHMaxInflight = 128
+	// DoHTimeout bounds one POST, connection setup included
+	DoHTimeout = 10 * time.Second
+	// dohContentType is the RFC 8484 media type of requests and answers
+	dohContentType = "application/dns-message"
+)
+
+// IsDoHURL reports whether a resolver is given as a DoH URL rather than host:port
+func IsDoHURL(resolver string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(resolver)), "https://")
+}
+
+// queuedReply is an answer waiting for ReadFrom, with the placeholder address it came from
+type queuedReply struct {
+	data []byte
+	addr net.Addr
+}
+
+// DoHConn sends every written DNS query to a DoH resolver and queues the
+// answer for ReadFrom. Each resolver URL stands behind a placeholder address
+// (see Addrs), which is what WriteTo takes and ReadFrom reports.
+type DoHConn struct {
+	client   *http.Client
+	urls     map[string]string // placeholder address -> resolver URL
+	addrs    []*net.UDPAddr
+	logger   zerolog.Logger
+	replies  chan queuedReply
+	inflight chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	once     sync.Once
+}
+
+// NewDoHConn creates a DoH transport for the given resolver URLs
+func NewDoHConn(urls []string, logger zerolog.Logger) (*DoHConn, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no DoH resolvers provided")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	// The default of 2 idle connections per host would redial for most polls
+	transport.MaxIdleConnsPerHost = DoHMaxInflight
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &DoHConn{
+		client:   &http.Client{Transport: transport, Timeout: DoHTimeout},
+		urls:     make(map[string]string),
+		logger:   logger,
+		replies:  make(chan queuedReply, RxQueueSize),
+		inflight: make(chan struct{}, DoHMaxInflight),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for i, raw := range urls {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			cancel()
+			return nil, fmt.Errorf("invalid DoH resolver %q", raw)
+		}
+		// 127.0.84.x: never a real resolver, and distinct per URL for the pool's statistics
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 84, byte(i+1)), Port: 443}
+		c.urls[addr.String()] = u.String()
+		c.addrs = append(c.addrs, addr)
+		logger.Info().Str("resolver", u.String()).Str("addr", addr.String()).Msg("DoH resolver configured")
+	}
+	return c, nil
+}
+
+// Addrs returns the placeholder address of each resolver URL, in order
+func (c *DoHConn) Addrs() []*net.UDPAddr {
+	return c.addrs
+}
+
+// Resolver returns the resolver URL behind a placeholder address, or addr itself if unknown
+func (c *DoHConn) Resolver(addr string) string {
+	if u, ok := c.urls[addr]; ok {
+		return u
+	}
+	return addr
+}
+
+func (c *DoHConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	resolver, ok := c.urls[addr.String()]
+	if !ok {
+		return 0, fmt.Errorf("unknown DoH resolver address %s", addr)
+	}
+	select {
+	case c.inflight <- struct{}{}:
+	default:
+		return len(p), nil
+	}
+	query := append([]byte(nil), p...)
+	go func() {
+		defer func() { <-c.inflight }()
+		reply, err := c.post(resolver, query)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.logger.Debug().Err(err).Str("resolver", resolver).Msg("DoH query failed")
+			}
+			return
+		}
+		select {
+		case c.replies <- queuedReply{data: reply, addr: addr}:
+		default:
+		}
+	}()
+	return len(p), nil
+}
+
+// post sends one query and returns the answer
+func (c *DoHConn) post(resolver string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, resolver, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Drain so the connection goes back to the pool
+		io.Copy(io.Discard, io.LimitReader(resp.Body, RxBufferSize))
+		return nil, fmt.Errorf("DoH resolver answered %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, RxBufferSize))
+}
+
+func (c *DoHConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case reply := <-c.replies:
+		return copy(p, reply.data), reply.addr, nil
+	case <-c.ctx.Done():
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// Close cancels the POSTs in flight and closes the pooled connections
+func (c *DoHConn) Close() error {
+	c.once.Do(func() {
+		c.cancel()
+		c.client.CloseIdleConnections()
+	})
+	return nil
+}
+
+func (c *DoHConn) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (c *DoHConn) SetDeadline(t time.Time) error      { return nil }
+func (c *DoHConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *DoHConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// newTestDoHConn opens a DoH transport whose only resolver is srv
+func newTestDoHConn(t *testing.T, srv *httptest.Server) *DoHConn {
+	t.Helper()
+	c, err := NewDoHConn([]string{srv.URL + "/dns-query"}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.client.Transport.(*http.Transport).TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	return c
+}
+
+// readDoHReply waits for one answer on c
+func readDoHReply(t *testing.T, c *DoHConn) (string, net.Addr) {
+	t.Helper()
+	type reply struct {
+		data string
+		addr net.Addr
+	}
+	read := make(chan reply, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := c.ReadFrom(buf)
+		if err == nil {
+			read <- reply{string(buf[:n]), addr}
+		}
+	}()
+	select {
+	case r := <-read:
+		return r.data, r.addr
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DoH answer")
+		return "", nil
+	}
+}
+
+func TestDoHPost(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method != http.MethodPost || r.URL.Path != "/dns-query":
+			http.Error(w, "bad request line", http.StatusBadRequest)
+		case r.Header.Get("Content-Type") != dohContentType || r.Header.Get("Accept") != dohContentType:
+			http.Error(w, "bad media type", http.StatusUnsupportedMediaType)
+		case string(body) == "refused":
+			// Past the 256 KB net/http discards on its own when a body is
+			// closed unread, so only the drain keeps the connection
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write(make([]byte, 256<<10+RxBufferSize/2))
+		default:
+			w.Header().Set("Content-Type", dohContentType)
+			w.Write(append([]byte("answer to "), body...))
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	c := newTestDoHConn(t, srv)
+	resolver := c.Addrs()[0]
+
+	// A query goes out as the body of an RFC 8484 POST and its answer is
+	// reported from the resolver's placeholder address
+	if n, err := c.WriteTo([]byte("query"), resolver); n != 5 || err != nil {
+		t.Fatalf("WriteTo: %d, %v", n, err)
+	}
+	if data, addr := readDoHReply(t, c); data != "answer to query" || addr.String() != resolver.String() {
+		t.Fatalf("got %q from %s", data, addr)
+	}
+
+	// An error status is no answer, and its body is drained so the next
+	// query reuses the connection
+	c.WriteTo([]byte("refused"), resolver)
+	for deadline := time.Now().Add(5 * time.Second); len(c.inflight) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("refused POST still in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.WriteTo([]byte("after"), resolver)
+	if data, _ := readDoHReply(t, c); data != "answer to after" {
+		t.Fatalf("got %q, want only the answer after the error status", data)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections, want the one reused", n)
+	}
+
+	if _, err := c.WriteTo([]byte("query"), &net.UDPAddr{IP: net.IPv4(127, 0, 84, 9), Port: 443}); err == nil {
+		t.Error("write to an unknown resolver address succeeded")
+	}
+}
+
+func TestDoHInflightAndClose(t *testing.T) {
+	arrived := make(chan string, 2*DoHMaxInflight)
+	cancelled := make(chan struct{}, 2*DoHMaxInflight)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		arrived <- string(body)
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	defer srv.Close()
+	c := newTestDoHConn(t, srv)
+	resolver := c.Addrs()[0]
+
+	// The resolver holds every POST: beyond DoHMaxInflight queries are dropped
+	for i := range DoHMaxInflight {
+		c.WriteTo([]byte(strconv.Itoa(i)), resolver)
+	}
+	for i := range DoHMaxInflight {
+		select {
+		case <-arrived:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d of %d POSTs arrived", i, DoHMaxInflight)
+		}
+	}
+	if n, err := c.WriteTo([]byte("over"), resolver); n != 4 || err != nil {
+		t.Fatalf("write over the cap: %d, %v", n, err)
+	}
+	select {
+	case q := <-arrived:
+		t.Fatalf("POST %q sent over the cap", q)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Close cancels every POST in flight and fails reads and writes
+	c.Close()
+	for i := range DoHMaxInflight {
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d POSTs cancelled by Close", i, DoHMaxInflight)
+		}
+	}
+	if _, _, err := c.ReadFrom(make([]byte, 512)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom after Close: %v", err)
+	}
+	if _, err := c.WriteTo([]byte("closed"), resolver); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo after Close: %v", err)
+	}
+}
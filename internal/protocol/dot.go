@@ -0,0 +1,297 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DNS over TLS (RFC 7858): some ISPs transparently proxy UDP/53 but leave
+// TCP/853 alone. DoTConn is a net.PacketConn like DoHConn: every resolver
+// gets one persistent TLS connection carrying queries and answers with a
+// [len:2] prefix. Queries are pipelined and answers may come back in any
+// order, which the engines already handle by matching on the query ID.
+
+const (
+	// DoTPort is the RFC 7858 port, used when a tls:// resolver names none
+	DoTPort = "853"
+	// DoTDialTimeout bounds connecting and the TLS handshake
+	DoTDialTimeout = 10 * time.Second
+	// DoTRedialDelay spaces reconnects to a resolver whose connection failed;
+	// queries written meanwhile are dropped and count as loss, as are those
+	// written while a dial is under way
+	DoTRedialDelay = time.Second
+	// dotWriteTimeout fails a connection that stopped taking queries
+	dotWriteTimeout = 10 * time.Second
+	// DoTScheme marks a resolver as DoT
+	DoTScheme = "tls://"
+)
+
+// IsDoTResolver reports whether a resolver is given as tls://host[:port]
+func IsDoTResolver(resolver string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(resolver)), DoTScheme)
+}
+
+// dotResolver is one resolver's connection, dialed on first use and again after failures
+type dotResolver struct {
+	hostport string
+	addr     *net.UDPAddr // placeholder the engines know the resolver by
+
+	mu       sync.Mutex // guards the fields below and serializes writes
+	conn     *tls.Conn
+	dialing  bool // a dial runs in the background (see DoTConn.dial)
+	failedAt time.Time
+}
+
+// DoTConn sends every written DNS query over a TLS connection to its
+// resolver and queues the answers for ReadFrom. Each resolver stands behind a
+// placeholder address (see Addrs), which is what WriteTo takes and ReadFrom reports.
+type DoTConn struct {
+	config    *tls.Config
+	resolvers map[string]*dotResolver // placeholder address -> resolver
+	addrs     []*net.UDPAddr
+	logger    zerolog.Logger
+	replies   chan queuedReply
+	ctx       context.Context
+	cancel    context.CancelFunc
+	once      sync.Once
+}
+
+// NewDoTConn creates a DoT transport for the given tls://host[:port]
+// resolvers. config may be nil; the server name defaults to each resolver's host.
+func NewDoTConn(resolvers []string, config *tls.Config, logger zerolog.Logger) (*DoTConn, error) {
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no DoT resolvers provided")
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &DoTConn{
+		config:    config,
+		resolvers: make(map[string]*dotResolver),
+		logger:    logger,
+		replies:   make(chan queuedReply, RxQueueSize),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	for i, raw := range resolvers {
+		hostport := strings.TrimSpace(raw)[len(DoTScheme):]
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(hostport, DoTPort)
+		}
+		if host, _, err := net.SplitHostPort(hostport); err != nil || host == "" {
+			cancel()
+			return nil, fmt.Errorf("invalid DoT resolver %q", raw)
+		}
+		// 127.0.85.x: never a real resolver, and distinct per resolver for the pool's statistics
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 85, byte(i+1)), Port: 853}
+		c.resolvers[addr.String()] = &dotResolver{hostport: hostport, addr: addr}
+		c.addrs = append(c.addrs, addr)
+		logger.Info().Str("resolver", DoTScheme+hostport).Str("addr", addr.String()).Msg("DoT resolver configured")
+	}
+	return c, nil
+}
+
+// Addrs returns the placeholder address of each resolver, in order
+func (c *DoTConn) Addrs() []*net.UDPAddr {
+	return c.addrs
+}
+
+// Resolver returns the resolver behind a placeholder address, or addr itself if unknown
+func (c *DoTConn) Resolver(addr string) string {
+	if r, ok := c.resolvers[addr]; ok {
+		return DoTScheme + r.hostport
+	}
+	return addr
+}
+
+func (c *DoTConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	r, ok := c.resolvers[addr.String()]
+	if !ok {
+		return 0, fmt.Errorf("unknown DoT resolver address %s", addr)
+	}
+	if len(p) > 0xFFFF {
+		return 0, fmt.Errorf("DNS message too large for DoT: %d bytes", len(p))
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn := c.connLocked(r)
+	if conn == nil {
+		// Lost like a UDP query the resolver never saw
+		return len(p), nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(dotWriteTimeout))
+	if _, err := conn.Write(frame); err != nil {
+		c.logger.Debug().Err(err).Str("resolver", r.hostport).Msg("DoT write failed, reconnecting")
+		c.dropLocked(r, conn)
+	}
+	return len(p), nil
+}
+
+// connLocked returns the resolver's connection. If there is none it starts a
+// dial in the background, unless one is already running or the last failure
+// is less than DoTRedialDelay ago, and returns nil: a handshake can take
+// seconds, and the tx workers writing meanwhile must not wait on it.
+func (c *DoTConn) connLocked(r *dotResolver) *tls.Conn {
+	if r.conn != nil || r.dialing {
+		return r.conn
+	}
+	if time.Since(r.failedAt) < DoTRedialDelay {
+		return nil
+	}
+	r.dialing = true
+	go c.dial(r)
+	return nil
+}
+
+// dial connects to the resolver and installs the connection for the next write
+func (c *DoTConn) dial(r *dotResolver) {
+	config := c.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(r.hostport)
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: DoTDialTimeout}, Config: config}
+	ctx, cancel := context.WithTimeout(c.ctx, DoTDialTimeout)
+	defer cancel()
+	nc, err := dialer.DialContext(ctx, "tcp", r.hostport)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialing = false
+	if err != nil {
+		r.failedAt = time.Now()
+		if c.ctx.Err() == nil {
+			c.logger.Warn().Err(err).Str("resolver", r.hostport).Msg("Failed to connect to DoT resolver")
+		}
+		return
+	}
+	if c.ctx.Err() != nil {
+		// Closed while dialing
+		nc.Close()
+		return
+	}
+	r.conn = nc.(*tls.Conn)
+	go c.readLoop(r, r.conn)
+}
+
+// dropLocked closes a failed connection so the next write redials
+func (c *DoTConn) dropLocked(r *dotResolver, conn *tls.Conn) {
+	conn.Close()
+	if r.conn == conn {
+		r.conn = nil
+		r.failedAt = time.Now()
+	}
+}
+
+// readLoop queues the answers arriving on conn until it fails
+func (c *DoTConn) readLoop(r *dotResolver, conn *tls.Conn) {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if c.ctx.Err() == nil {
+				c.logger.Debug().Err(err).Str("resolver", r.hostport).Msg("DoT connection closed")
+			}
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			break
+		}
+		select {
+		case c.replies <- queuedReply{data: msg, addr: r.addr}:
+		default:
+		}
+	}
+	r.mu.Lock()
+	c.dropLocked(r, conn)
+	r.mu.Unlock()
+}
+
+func (c *DoTConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case reply := <-c.replies:
+		return copy(p, reply.data), reply.addr, nil
+	case <-c.ctx.Done():
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// Close closes every resolver connection
+func (c *DoTConn) Close() error {
+	c.once.Do(func() {
+		c.cancel()
+		for _, r := range c.resolvers {
+			r.mu.Lock()
+			if r.conn != nil {
+				r.conn.Close()
+			}
+			r.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+func (c *DoTConn) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (c *DoTConn) SetDeadline(t time.Time) error      { return nil }
+func (c *DoTConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *DoTConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// remoteTransport is a transport that reaches its resolvers by URL or name
+// rather than UDP address, standing each behind a placeholder address
+type remoteTransport interface {
+	net.PacketConn
+	Addrs() []*net.UDPAddr
+	Resolver(addr string) string
+}
+
+// newRemoteTransport creates the DoH or DoT transport the resolvers ask for,
+// or returns nil for plain DNS resolvers
+func newRemoteTransport(resolvers []string, opts DnsConnOptions, logger zerolog.Logger) (remoteTransport, error) {
+	if len(resolvers) == 0 {
+		return nil, nil
+	}
+	var kind func(string) bool
+	switch {
+	case IsDoHURL(resolvers[0]):
+		kind = IsDoHURL
+	case IsDoTResolver(resolvers[0]):
+		kind = IsDoTResolver
+	default:
+		kind = func(r string) bool { return !IsDoHURL(r) && !IsDoTResolver(r) }
+	}
+	for _, resolver := range resolvers {
+		if !kind(resolver) {
+			return nil, fmt.Errorf("cannot mix DoH, DoT and plain DNS resolvers")
+		}
+	}
+	switch {
+	case IsDoHURL(resolvers[0]):
+		if opts.Transport != nil {
+			return nil, fmt.Errorf("DoH resolvers bring their own transport")
+		}
+		return NewDoHConn(resolvers, logger)
+	case IsDoTResolver(resolvers[0]):
+		if opts.Transport != nil {
+			return nil, fmt.Errorf("DoT resolvers bring their own transport")
+		}
+		return NewDoTConn(resolvers, opts.DoTConfig, logger)
+	}
+	return nil, nil
+}
@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/crypto"
+)
+
+// dotResolverStub is a DoT resolver on loopback that holds every handshake
+// until release is closed, hands each connection to the test and queues the
+// queries it reads from them, reporting on ended when a connection is gone
+type dotResolverStub struct {
+	addr    string
+	release chan struct{}
+	conns   chan *tls.Conn
+	queries chan string
+	ended   chan error
+}
+
+func newDoTResolverStub(t *testing.T) (*dotResolverStub, *tls.Config) {
+	t.Helper()
+	_, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := crypto.NewCertSet(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &dotResolverStub{
+		addr:    ln.Addr().String(),
+		release: make(chan struct{}),
+		conns:   make(chan *tls.Conn, 4),
+		queries: make(chan string, 64),
+		ended:   make(chan error, 4),
+	}
+	go func() {
+		for {
+			raw, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-s.release
+				conn := tls.Server(raw, crypto.GetRotatingTLSConfig(certs))
+				if err := conn.Handshake(); err != nil {
+					raw.Close()
+					return
+				}
+				s.conns <- conn
+				header := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(conn, header); err != nil {
+						s.ended <- err
+						return
+					}
+					msg := make([]byte, binary.BigEndian.Uint16(header))
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						s.ended <- err
+						return
+					}
+					s.queries <- string(msg)
+				}
+			}()
+		}
+	}()
+	return s, crypto.GetClientTLSConfig(certs.Fingerprint())
+}
+
+// answer writes one framed answer on conn
+func (s *dotResolverStub) answer(t *testing.T, conn *tls.Conn, msg string) {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := conn.Write(append(frame, msg...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitConn waits for the stub to accept a connection
+func (s *dotResolverStub) waitConn(t *testing.T) *tls.Conn {
+	t.Helper()
+	select {
+	case conn := <-s.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DoT connection")
+		return nil
+	}
+}
+
+// waitConnected waits until c holds a connection to r, or none if want is false
+func waitConnected(t *testing.T, r *dotResolver, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		connected := r.conn != nil
+		r.mu.Unlock()
+		if connected == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connected %v, want %v", connected, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readReplies reads n distinct answers from c, all from its one resolver
+func readReplies(t *testing.T, c *DoTConn, n int) map[string]bool {
+	t.Helper()
+	got := make(map[string]bool)
+	buf := make([]byte, 512)
+	for len(got) < n {
+		read := make(chan string, 1)
+		go func() {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil || addr.String() != c.Addrs()[0].String() {
+				read <- fmt.Sprintf("error %v from %v", err, addr)
+				return
+			}
+			read <- string(buf[:n])
+		}()
+		select {
+		case reply := <-read:
+			got[reply] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d answers", len(got), n)
+		}
+	}
+	return got
+}
+
+func TestDoTConn(t *testing.T) {
+	stub, config := newDoTResolverStub(t)
+	c, err := NewDoTConn([]string{DoTScheme + stub.addr}, config, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resolver := c.Addrs()[0]
+	r := c.resolvers[resolver.String()]
+
+	// Writes return at once while the handshake is held, and are dropped
+	start := time.Now()
+	for i := range 3 {
+		if n, err := c.WriteTo([]byte(fmt.Sprintf("dropped %d", i)), resolver); err != nil || n == 0 {
+			t.Fatalf("write during dial: %d, %v", n, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("writes waited %v for the dial", elapsed)
+	}
+	close(stub.release)
+	conn := stub.waitConn(t)
+	waitConnected(t, r, true)
+
+	// Queries are pipelined on the one connection and answers are matched
+	// whatever order they come back in
+	const pipelined = 10
+	for i := range pipelined {
+		if _, err := c.WriteTo([]byte(fmt.Sprintf("query %d", i)), resolver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range pipelined {
+		select {
+		case q := <-stub.queries:
+			if q != fmt.Sprintf("query %d", i) {
+				t.Fatalf("query %d arrived as %q", i, q)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d queries", i, pipelined)
+		}
+	}
+	for i := pipelined - 1; i >= 0; i-- {
+		stub.answer(t, conn, fmt.Sprintf("answer %d", i))
+	}
+	if got := readReplies(t, c, pipelined); len(got) != pipelined || !got["answer 0"] {
+		t.Errorf("answers %v", got)
+	}
+
+	// A connection the resolver closed is redialed after DoTRedialDelay
+	conn.Close()
+	waitConnected(t, r, false)
+	var redialed *tls.Conn
+	for deadline := time.Now().Add(5 * time.Second); redialed == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("no redial after the connection closed")
+		}
+		c.WriteTo([]byte("again"), resolver)
+		select {
+		case redialed = <-stub.conns:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	waitConnected(t, r, true)
+	if _, err := c.WriteTo([]byte("after redial"), resolver); err != nil {
+		t.Fatal(err)
+	}
+	for q := ""; q != "after redial"; {
+		select {
+		case q = <-stub.queries:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no query over the new connection")
+		}
+	}
+	stub.answer(t, redialed, "answer again")
+	readReplies(t, c, 1)
+
+	// Close closes the connection and fails reads and writes
+	<-stub.ended
+	c.Close()
+	select {
+	case err := <-stub.ended:
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("resolver read %v after Close, want EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open after Close")
+	}
+	if _, _, err := c.ReadFrom(make([]byte, 512)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom after Close: %v", err)
+	}
+	if _, err := c.WriteTo([]byte("closed"), resolver); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo after Close: %v", err)
+	}
+}
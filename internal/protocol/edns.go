@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// EDNS0 fallback: a middlebox that strips the OPT record leaves the resolver
+// answering the client with at most 512 bytes, so multi-fragment responses come
+// back truncated (TC set, no answers) and downstream silently stalls. Once the
+// client sees that, it asks the server to size responses for 512 bytes with an
+// extra poll label, poll.NONCE.e-512.SESSION.DOMAIN, which the server applies
+// to every response of the session.
+
+const (
+	// SizeHintPrefix marks the response size hint label
+	SizeHintPrefix = "e-"
+	// MinResponseSize is the response size every resolver must pass (RFC 1035)
+	MinResponseSize = 512
+	// EDNSFallbackThreshold is how many truncated responses, with none larger
+	// than MinResponseSize seen, switch the client to small responses
+	EDNSFallbackThreshold = 3
+	// EncodedFragmentRRLen is the wire size of one TXT answer carrying a full
+	// fragment: compressed name (2) + type/class/TTL/rdlength (10) + length
+	// byte (1) + base64 of FragHeaderLen+MaxChunkSize bytes (172)
+	EncodedFragmentRRLen = 185
+)
+
+// EncodeSizeHint returns the label asking the server to keep responses within size bytes
+func EncodeSizeHint(size int) string {
+	return SizeHintPrefix + strconv.Itoa(size)
+}
+
+// ParseSizeHint decodes a size hint label; ok is false if label isn't one.
+// Hints below MinResponseSize are raised to it.
+func ParseSizeHint(label string) (size int, ok bool) {
+	if len(label) <= len(SizeHintPrefix) || !strings.EqualFold(label[:len(SizeHintPrefix)], SizeHintPrefix) {
+		return 0, false
+	}
+	size, err := strconv.Atoi(label[len(SizeHintPrefix):])
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return max(size, MinResponseSize), true
+}
+
+// FragmentsForSize returns how many full fragments fit in a response of at
+// most limit bytes whose header, question and OPT take baseLen. At least one
+// fragment is always allowed so the session keeps making progress.
+func FragmentsForSize(limit, baseLen int) int {
+	return max((limit-baseLen)/EncodedFragmentRRLen, 1)
+}
@@ -0,0 +1,30 @@
+package protocol
+
+// QUIC application error codes the server closes connections with
+const (
+	// CloseCodeSessionInUse: another client's QUIC connection already owns this
+	// session ID; the client should reconnect under a freshly generated ID
+	CloseCodeSessionInUse = 0x5501
+	// CloseCodeShutdown: the server is shutting down (e.g. for a redeploy); the
+	// client should reconnect rather than wait for its idle timeout
+	CloseCodeShutdown = 0x5502
+	// CloseCodeSessionExpired: no query arrived for the session in the
+	// session lifetime, so the server forgot it; the client should reconnect
+	CloseCodeSessionExpired = 0x5503
+)
+
+// QUIC stream error codes the server resets streams with
+const (
+	// StreamCodeTooManyStreams: the session already has --max-streams-per-session
+	// streams open; the stream is refused before its target is dialed
+	StreamCodeTooManyStreams = 0x5511
+	// StreamCodePipeFailed: one direction of the tunneled connection failed, so
+	// the other is torn down too (either side may send it)
+	StreamCodePipeFailed = 0x5512
+	// StreamCodeClosed: the application closed its connection without waiting
+	// for the rest of the target's data
+	StreamCodeClosed = 0x5513
+	// StreamCodeIdle: no data moved either way for the stream idle timeout
+	// (--stream-idle-timeout), so the connection is presumed dead (either side may send it)
+	StreamCodeIdle = 0x5514
+)
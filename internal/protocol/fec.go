@@ -0,0 +1,253 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// Forward error correction: with a parity ratio set, FragmentPacketFEC adds
+// Reed-Solomon parity fragments to a packet so that any Total-Parity of its
+// fragments rebuild it. On lossy resolvers a dropped fragment then no longer
+// costs a nack round trip or a QUIC retransmit of the whole packet.
+//
+// FEC fragments set fragFlagFEC in the total byte and carry two more header bytes:
+//
+//	[PacketID:2][0x80|Total:1][SeqNum:1][Parity:1][LastLen:1]
+//
+// Total counts data and parity fragments, and seqs from Total-Parity on are
+// parity. Every fragment holds a shard of the packet's shard size, two bytes
+// less than its chunk size so FEC fragments are as long as full plain ones,
+// except the last data fragment, which holds LastLen. Fragments without the
+// flag keep the plain 4 byte header, and a side only sends FEC fragments once
+// the peer advertised CapFEC, since older reassemblers can't parse them.
+
+const (
+	// FECHeaderLen is the header length of FEC fragments
+	FECHeaderLen = 6
+	// MaxFECFragments caps data plus parity fragments per packet
+	MaxFECFragments = MaxFragments
+	// MaxFECRatio is the largest parity ratio: one parity fragment per data fragment
+	MaxFECRatio = 1.0
+
+	// fragFlagFEC marks an FEC fragment in the total byte
+	fragFlagFEC = 0x80
+)
+
+var errFECShards = errors.New("not enough fragments to rebuild the packet")
+
+// FragTotal returns the fragment count in a fragment's header, whatever its flags
+func FragTotal(frag []byte) int {
+	return int(frag[2] &^ (fragFlagFEC | fragFlagCompressed))
+}
+
+// FECParity returns the parity fragments a packet of dataFrags fragments gets
+// at ratio: at least one for any positive ratio
+func FECParity(dataFrags int, ratio float64) int {
+	if ratio <= 0 {
+		return 0
+	}
+	parity := int(math.Ceil(float64(dataFrags) * min(ratio, MaxFECRatio)))
+	return min(parity, MaxFECFragments-dataFrags)
+}
+
+// FragmentPacketFEC splits a packet like FragmentPacket and appends
+// FECParity(data fragments, ratio) Reed-Solomon parity fragments. A ratio of
+// 0 returns plain fragments.
+func FragmentPacketFEC(data []byte, chunkSize int, ratio float64) [][]byte {
+	shardSize := FragHeaderLen + chunkSize - FECHeaderLen
+	k := max((len(data)+shardSize-1)/shardSize, 1)
+	parity := FECParity(k, ratio)
+	if parity <= 0 {
+		return FragmentPacket(data, chunkSize)
+	}
+	packetID := uint16(rand.Intn(65535))
+	total := k + parity
+	lastLen := len(data) - (k-1)*shardSize
+
+	shards := make([][]byte, total)
+	for i := range k {
+		shard := make([]byte, shardSize)
+		copy(shard, data[i*shardSize:min((i+1)*shardSize, len(data))])
+		shards[i] = shard
+	}
+	for i := range parity {
+		shards[k+i] = make([]byte, shardSize)
+		for j := range k {
+			gfMulAdd(shards[k+i], shards[j], cauchyCoef(k, i, j))
+		}
+	}
+
+	frags := make([][]byte, total)
+	for seq, shard := range shards {
+		size := shardSize
+		if seq == k-1 {
+			size = lastLen
+		}
+		frag := make([]byte, FECHeaderLen+size)
+		binary.BigEndian.PutUint16(frag[0:2], packetID)
+		frag[2] = fragFlagFEC | uint8(total)
+		frag[3] = uint8(seq)
+		frag[4] = uint8(parity)
+		frag[5] = uint8(lastLen)
+		copy(frag[FECHeaderLen:], shard[:size])
+		frags[seq] = frag
+	}
+	return frags
+}
+
+// decodeFEC rebuilds a packet from any total-parity of its fragment payloads
+// (nil where missing); chunks is the pending packet's Chunks
+func decodeFEC(chunks [][]byte, parity, lastLen int) ([]byte, error) {
+	k := len(chunks) - parity
+	// Whenever a data fragment is missing a parity one arrived, which has the full shard size
+	shardSize := lastLen
+	for _, chunk := range chunks {
+		shardSize = max(shardSize, len(chunk))
+	}
+	shards := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		if chunk != nil {
+			shards[i] = make([]byte, shardSize)
+			copy(shards[i], chunk)
+		}
+	}
+
+	var missing []int
+	for j := range k {
+		if shards[j] == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) > 0 {
+		// Solve with the first k fragments that arrived: the rows of the
+		// systematic generator matrix they were made with, inverted
+		var rows []int
+		for i := range shards {
+			if shards[i] != nil && len(rows) < k {
+				rows = append(rows, i)
+			}
+		}
+		if len(rows) < k {
+			return nil, errFECShards
+		}
+		matrix := make([][]byte, k)
+		for r, row := range rows {
+			matrix[r] = make([]byte, k)
+			if row < k {
+				matrix[r][row] = 1
+			} else {
+				for j := range k {
+					matrix[r][j] = cauchyCoef(k, row-k, j)
+				}
+			}
+		}
+		inverse, err := gfInvert(matrix)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range missing {
+			shard := make([]byte, shardSize)
+			for r, row := range rows {
+				gfMulAdd(shard, shards[row], inverse[j][r])
+			}
+			shards[j] = shard
+		}
+	}
+
+	full := make([]byte, 0, (k-1)*shardSize+lastLen)
+	for j := range k - 1 {
+		full = append(full, shards[j]...)
+	}
+	return append(full, shards[k-1][:lastLen]...), nil
+}
+
+// GF(2^8) arithmetic over the polynomial 0x11d for the Reed-Solomon code
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := range 255 {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns 1/a for a != 0
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c*src into dst
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(c, b)
+	}
+}
+
+// cauchyCoef is the weight of data fragment j in parity fragment i of a
+// packet with k data fragments: 1/(x_i+y_j) with x_i = k+i and y_j = j. Every
+// square submatrix of a Cauchy matrix is invertible, so any k fragments decode.
+func cauchyCoef(k, i, j int) byte {
+	return gfInv(byte(k+i) ^ byte(j))
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := range n {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular FEC matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		if inv := gfInv(work[col][col]); inv != 1 {
+			for c := range work[col] {
+				work[col][c] = gfMul(work[col][c], inv)
+			}
+		}
+		for r := range n {
+			if r != col && work[r][col] != 0 {
+				gfMulAdd(work[r], work[col], work[r][col])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
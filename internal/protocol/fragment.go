@@ -10,8 +10,13 @@ import (
 // Header: [PacketID:2][TotalChunks:1][SeqNum:1] = 4 Bytes
 const FragHeaderLen = 4
 
-// Max payload per DNS query to stay safe (253 chars QNAME limit)
-// Calculation based on Rust reference implementation:
+// MaxFragments caps the fragments of one packet: the top two bits of the
+// total byte are flags (see fec.go and compress.go)
+const MaxFragments = 63
+
+// MaxChunkSize is the payload of downstream fragments, and of upstream ones
+// when the query name leaves no room for more. Calculation based on Rust
+// reference implementation:
 //   - DNS QNAME max length: 253 chars
 //   - Domain suffix (e.g., ".n.example.com."): ~20 chars typical
 //   - Session ID (e.g., ".abcd1234."): ~10 chars
@@ -24,33 +29,168 @@ const FragHeaderLen = 4
 //   - Rust formula: mtu = (240 - domain_len) / 1.6
 //   - For 20-char domain: ~137 bytes
 //
-// Use 124 bytes as default (provides extra safety margin for restrictive resolvers)
+// Use 124 bytes as default (provides extra safety margin for restrictive resolvers).
+// Upstream fragments are sized per connection with ChunkSizeFor instead.
 const MaxChunkSize = 124
 
+const (
+	// MaxQNameLen is the longest query name in presentation form, without the trailing dot
+	MaxQNameLen = 253
+	// DataLabelLen is the length of the labels base32 data is split into
+	// (57 instead of 63 leaves a safety margin and matches picoquic)
+	DataLabelLen = 57
+	// MinChunkSize is the smallest upstream fragment payload a domain may leave room for
+	MinChunkSize = 32
+)
+
+// ChunkSizeFor returns the largest upstream fragment payload whose query
+// name, the base32 data labels followed by a suffix of suffixLen characters
+// (".session.domain", leading dot included), stays within MaxQNameLen
+func ChunkSizeFor(suffixLen int) int {
+	budget := MaxQNameLen - suffixLen
+	chars := budget
+	// chars of data take (chars-1)/DataLabelLen more for the dots between labels
+	for chars > 0 && chars+(chars-1)/DataLabelLen > budget {
+		chars--
+	}
+	return chars*5/8 - FragHeaderLen
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// Reassembler reassembles fragmented packets
+const (
+	// ReassemblyTimeout: a packet still missing fragments after this long is given up on
+	ReassemblyTimeout = 5 * time.Second
+	// CompletedTTL: how long a delivered packet ID is remembered to drop duplicate fragments
+	CompletedTTL = 30 * time.Second
+	// MaxPendingPackets caps partially received packets held at once
+	MaxPendingPackets = 1000
+	// MaxPendingBytes caps the payload bytes buffered in partial packets
+	MaxPendingBytes = 512 * 1024
+)
+
+// Reassembler reassembles fragmented packets.
+//
+// Semantics:
+//   - Fragments may arrive in any order; a packet is returned exactly once, as soon
+//     as its last missing fragment arrives, with chunks concatenated in seq order.
+//   - Fragments of an already delivered packet ID are ignored for CompletedTTL
+//     (redundant copies and resolver duplicates).
+//   - A fragment whose total disagrees with the pending packet of the same ID means
+//     the ID was reused after the earlier instance was lost: the partial packet is
+//     discarded (reported via OnTimeout) and reassembly restarts.
+//   - Partial packets older than Timeout (default ReassemblyTimeout) are
+//     discarded, counted in PacketsLost and reported via OnTimeout, so the
+//     transport can react to the loss.
+//   - FEC packets (see fec.go) are rebuilt and returned as soon as Total-Parity
+//     of their fragments arrived; the remaining ones count as duplicates.
+//   - Fragments of a discarded packet (same ID and total) arriving within
+//     CompletedTTL are late: they can no longer complete it and are ignored.
+//
+// The maps are allocated on first use and released again once they empty
+// out, so an idle reassembler (e.g. of a quiet server session) costs only the
+// struct itself.
 type Reassembler struct {
-	pending   map[uint16]*pendingPacket
-	completed map[uint16]time.Time // Track recently completed packet IDs to ignore duplicates
-	mu        sync.Mutex
+	pending      map[uint16]*pendingPacket
+	pendingBytes int
+	completed    map[uint16]time.Time // Track recently completed packet IDs to ignore duplicates
+	discarded    map[uint16]discardedPacket
+	lastPrune    time.Time
+	mu           sync.Mutex
+
+	// OnTimeout, if set, is called (without the lock held) for every partially
+	// received packet that is discarded
+	OnTimeout func(packetID uint16, received, total int)
+	// Timeout is how long a partial packet may wait for its missing fragments
+	// (0 = ReassemblyTimeout); set it before the first IngestChunk
+	Timeout time.Duration
+
+	stats FragmentStats
+}
+
+// FragmentStats counts what a Reassembler has seen. Loss is inferred from
+// packet totals: a packet that completes had all of its fragments arrive, a
+// discarded partial packet was missing total-received of them. Packets none
+// of whose fragments arrived are invisible here (QUIC retransmits them under
+// a new packet ID), so LossRate is a lower bound.
+type FragmentStats struct {
+	// Fragments counts distinct fragments accepted
+	Fragments uint64
+	// Duplicates counts fragments ignored because they were already received
+	// (DuplicatesCompleted plus repeats of a slot a pending packet already holds)
+	Duplicates uint64
+	// DuplicatesCompleted counts duplicates of packets already delivered,
+	// typically resolver retries and cached answers
+	DuplicatesCompleted uint64
+	// Late counts fragments of packets already discarded as lost
+	Late uint64
+	// OutOfOrder counts fragments that arrived while a lower seq of the same
+	// packet was still missing
+	OutOfOrder uint64
+	// Packets counts packets delivered
+	Packets uint64
+	// PacketsLost counts partial packets discarded (timeout, eviction or ID reuse)
+	PacketsLost uint64
+	// Expected counts the fragments of every delivered or discarded packet
+	Expected uint64
+	// Missing counts the fragments of discarded packets that never arrived
+	Missing uint64
+	// Corrupt counts compressed packets that were complete but failed to inflate
+	Corrupt uint64
+}
+
+// LossRate returns Missing/Expected, or 0 before any packet was settled
+func (s FragmentStats) LossRate() float64 {
+	if s.Expected == 0 {
+		return 0
+	}
+	return float64(s.Missing) / float64(s.Expected)
+}
+
+// Add returns the sum of two snapshots
+func (s FragmentStats) Add(o FragmentStats) FragmentStats {
+	return FragmentStats{
+		Fragments:   s.Fragments + o.Fragments,
+		Duplicates:  s.Duplicates + o.Duplicates,
+		Packets:     s.Packets + o.Packets,
+		PacketsLost: s.PacketsLost + o.PacketsLost,
+		Expected:    s.Expected + o.Expected,
+		Missing:     s.Missing + o.Missing,
+		Corrupt:     s.Corrupt + o.Corrupt,
+
+		DuplicatesCompleted: s.DuplicatesCompleted + o.DuplicatesCompleted,
+		Late:                s.Late + o.Late,
+		OutOfOrder:          s.OutOfOrder + o.OutOfOrder,
+	}
 }
 
 type pendingPacket struct {
-	Chunks    [][]byte
-	Total     int
-	Received  int
-	CreatedAt time.Time
+	Chunks     [][]byte
+	Total      int
+	Parity     int  // FEC parity fragments among Total, 0 for plain packets
+	LastLen    int  // FEC only: length of the last data fragment
+	Compressed bool // Fragments of a deflated packet (see compress.go)
+	Received   int
+	Bytes      int
+	CreatedAt  time.Time
+	NackedAt   time.Time // Last time the gaps were reported (see Nacks)
+}
+
+type droppedPacket struct {
+	id              uint16
+	received, total int
+}
+
+type discardedPacket struct {
+	total int
+	at    time.Time
 }
 
 // NewReassembler creates a new Reassembler
 func NewReassembler() *Reassembler {
-	return &Reassembler{
-		pending:   make(map[uint16]*pendingPacket),
-		completed: make(map[uint16]time.Time),
-	}
+	return &Reassembler{lastPrune: time.Now()}
 }
 
 // IngestChunk processes a fragment and returns the full packet if complete
@@ -59,80 +199,312 @@ func (r *Reassembler) IngestChunk(data []byte) []byte {
 		return nil
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// Parse Header [ID:2][Total:1][Seq:1]
+	// Parse Header [ID:2][Total:1][Seq:1], plus [Parity:1][LastLen:1] for FEC
 	packetID := binary.BigEndian.Uint16(data[0:2])
 	total := int(data[2])
 	seq := int(data[3])
 	payload := data[4:]
-
-	// Check if this packet was recently completed (ignore duplicate fragments)
-	if _, wasCompleted := r.completed[packetID]; wasCompleted {
-		// Debug: log that we're ignoring duplicate
-		// log.Debug().Uint16("pktID", packetID).Msg("Ignoring duplicate fragment (already completed)")
+	compressed := total&fragFlagCompressed != 0
+	total &^= fragFlagCompressed
+	parity, lastLen := 0, 0
+	if total&fragFlagFEC != 0 {
+		if len(data) < FECHeaderLen {
+			return nil
+		}
+		total &^= fragFlagFEC
+		parity, lastLen = int(data[4]), int(data[5])
+		payload = data[FECHeaderLen:]
+		if parity == 0 || parity >= total {
+			return nil
+		}
+	}
+	if total == 0 || seq >= total {
 		return nil
 	}
 
-	// Cleanup old completed entries (keep for 30 seconds)
+	r.mu.Lock()
+	full, dropped := r.ingestLocked(packetID, total, parity, lastLen, seq, payload, compressed)
+	r.countDroppedLocked(dropped)
+	r.mu.Unlock()
+
+	r.report(dropped)
+	if full != nil && compressed {
+		var err error
+		if full, err = inflatePacket(full); err != nil {
+			r.mu.Lock()
+			r.stats.Corrupt++
+			r.mu.Unlock()
+			return nil
+		}
+	}
+	return full
+}
+
+func (r *Reassembler) ingestLocked(packetID uint16, total, parity, lastLen, seq int, payload []byte, compressed bool) ([]byte, []droppedPacket) {
 	now := time.Now()
-	for id, completedAt := range r.completed {
-		if now.Sub(completedAt) > 30*time.Second {
-			delete(r.completed, id)
+	dropped := r.pruneLocked(now)
+
+	// Check if this packet was recently completed (ignore duplicate fragments)
+	if _, wasCompleted := r.completed[packetID]; wasCompleted {
+		r.stats.Duplicates++
+		r.stats.DuplicatesCompleted++
+		return nil, dropped
+	}
+	if d, wasDiscarded := r.discarded[packetID]; wasDiscarded {
+		if d.total == total {
+			r.stats.Late++
+			return nil, dropped
 		}
+		// A different total: a new packet reusing the ID
+		delete(r.discarded, packetID)
 	}
 
 	pkt, exists := r.pending[packetID]
+	if exists && (pkt.Total != total || pkt.Parity != parity || pkt.Compressed != compressed) {
+		// Same ID, different shape: the earlier instance was lost mid-flight
+		dropped = append(dropped, droppedPacket{packetID, pkt.Received, pkt.Total})
+		r.removeLocked(packetID)
+		exists = false
+	}
 	if !exists {
-		// Cleanup old garbage (simplified)
-		if len(r.pending) > 1000 {
+		if len(r.pending) >= MaxPendingPackets {
+			dropped = append(dropped, r.evictOldestLocked())
+		}
+		if r.pending == nil {
 			r.pending = make(map[uint16]*pendingPacket)
 		}
 		pkt = &pendingPacket{
-			Chunks:    make([][]byte, total),
-			Total:     total,
-			CreatedAt: time.Now(),
+			Chunks:     make([][]byte, total),
+			Total:      total,
+			Parity:     parity,
+			LastLen:    lastLen,
+			Compressed: compressed,
+			CreatedAt:  now,
 		}
 		r.pending[packetID] = pkt
 	}
 
-	if seq < total && pkt.Chunks[seq] == nil {
+	if pkt.Chunks[seq] == nil {
+		for _, earlier := range pkt.Chunks[:seq] {
+			if earlier == nil {
+				r.stats.OutOfOrder++
+				break
+			}
+		}
 		pkt.Chunks[seq] = payload
 		pkt.Received++
+		pkt.Bytes += len(payload)
+		r.pendingBytes += len(payload)
+		r.stats.Fragments++
+	} else {
+		r.stats.Duplicates++
 	}
 
-	if pkt.Received == pkt.Total {
-		delete(r.pending, packetID)
-		r.completed[packetID] = now // Mark as completed to ignore future duplicates
+	if pkt.Received == pkt.Total-pkt.Parity {
 		var full []byte
-		for _, chunk := range pkt.Chunks {
-			full = append(full, chunk...)
+		if pkt.Parity > 0 {
+			var err error
+			if full, err = decodeFEC(pkt.Chunks, pkt.Parity, pkt.LastLen); err != nil {
+				// Can't happen with Total-Parity fragments: treat it as lost
+				dropped = append(dropped, droppedPacket{packetID, pkt.Received, pkt.Total})
+				r.removeLocked(packetID)
+				return nil, dropped
+			}
+		} else {
+			for _, chunk := range pkt.Chunks {
+				full = append(full, chunk...)
+			}
+		}
+		r.stats.Packets++
+		// Parity fragments that were not needed don't count as lost
+		r.stats.Expected += uint64(pkt.Total - pkt.Parity)
+		r.removeLocked(packetID)
+		if r.completed == nil {
+			r.completed = make(map[uint16]time.Time)
 		}
-		return full
+		r.completed[packetID] = now // Mark as completed to ignore future duplicates
+		return full, dropped
+	}
+
+	// Bound buffered payload: give up on the oldest partial packets first
+	for r.pendingBytes > MaxPendingBytes && len(r.pending) > 1 {
+		dropped = append(dropped, r.evictOldestLocked())
+	}
+	return nil, dropped
+}
+
+// removeLocked forgets a pending packet and releases the map once empty
+func (r *Reassembler) removeLocked(packetID uint16) {
+	if pkt, ok := r.pending[packetID]; ok {
+		r.pendingBytes -= pkt.Bytes
+		delete(r.pending, packetID)
+	}
+	if len(r.pending) == 0 {
+		r.pending = nil
+	}
+}
+
+// Expire discards timed-out partial packets; call periodically if traffic may stop
+func (r *Reassembler) Expire() {
+	r.mu.Lock()
+	r.lastPrune = time.Time{}
+	dropped := r.pruneLocked(time.Now())
+	r.countDroppedLocked(dropped)
+	r.mu.Unlock()
+	r.report(dropped)
+}
+
+// Reset frees every partial packet and the duplicate tracking, keeping the counters
+func (r *Reassembler) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending, r.pendingBytes = nil, 0
+	r.completed, r.discarded = nil, nil
+}
+
+// Stats returns a snapshot of the fragment counters
+func (r *Reassembler) Stats() FragmentStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Pending returns the partial packets waiting for fragments and the payload bytes they hold
+func (r *Reassembler) Pending() (packets, bytes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending), r.pendingBytes
+}
+
+// Nacks returns up to max partial packets whose gaps are due to be reported:
+// older than NackDelay and not reported within NackInterval. Only packets
+// with a missing seq below 16 are returned.
+func (r *Reassembler) Nacks(max int) []Nack {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var nacks []Nack
+	for id, pkt := range r.pending {
+		if len(nacks) >= max {
+			break
+		}
+		if now.Sub(pkt.CreatedAt) < NackDelay || now.Sub(pkt.NackedAt) < NackInterval {
+			continue
+		}
+		var missing uint16
+		for seq := 0; seq < pkt.Total && seq < nackMaxSeq; seq++ {
+			if pkt.Chunks[seq] == nil {
+				missing |= 1 << seq
+			}
+		}
+		if missing == 0 {
+			continue
+		}
+		pkt.NackedAt = now
+		nacks = append(nacks, Nack{PacketID: id, Missing: missing})
+	}
+	return nacks
+}
+
+func (r *Reassembler) countDroppedLocked(dropped []droppedPacket) {
+	now := time.Now()
+	for _, d := range dropped {
+		if r.discarded == nil {
+			r.discarded = make(map[uint16]discardedPacket)
+		}
+		r.discarded[d.id] = discardedPacket{total: d.total, at: now}
+		r.stats.PacketsLost++
+		r.stats.Expected += uint64(d.total)
+		r.stats.Missing += uint64(d.total - d.received)
+	}
+}
+
+// timeout returns Timeout or its default
+func (r *Reassembler) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return ReassemblyTimeout
+}
+
+// pruneLocked expires old completed IDs and timed-out partial packets (at
+// most once per second, or per fifth of a shorter Timeout)
+func (r *Reassembler) pruneLocked(now time.Time) []droppedPacket {
+	if now.Sub(r.lastPrune) < min(time.Second, r.timeout()/5) {
+		return nil
+	}
+	r.lastPrune = now
+
+	for id, completedAt := range r.completed {
+		if now.Sub(completedAt) > CompletedTTL {
+			delete(r.completed, id)
+		}
+	}
+	if len(r.completed) == 0 {
+		// Maps never shrink; drop it so an idle reassembler holds nothing
+		r.completed = nil
+	}
+	for id, d := range r.discarded {
+		if now.Sub(d.at) > CompletedTTL {
+			delete(r.discarded, id)
+		}
+	}
+	if len(r.discarded) == 0 {
+		r.discarded = nil
+	}
+
+	var dropped []droppedPacket
+	for id, pkt := range r.pending {
+		if now.Sub(pkt.CreatedAt) > r.timeout() {
+			dropped = append(dropped, droppedPacket{id, pkt.Received, pkt.Total})
+			r.removeLocked(id)
+		}
+	}
+	return dropped
+}
+
+func (r *Reassembler) evictOldestLocked() droppedPacket {
+	var oldestID uint16
+	var oldest *pendingPacket
+	for id, pkt := range r.pending {
+		if oldest == nil || pkt.CreatedAt.Before(oldest.CreatedAt) {
+			oldestID, oldest = id, pkt
+		}
+	}
+	r.removeLocked(oldestID)
+	return droppedPacket{oldestID, oldest.Received, oldest.Total}
+}
+
+func (r *Reassembler) report(dropped []droppedPacket) {
+	if r.OnTimeout == nil {
+		return
+	}
+	for _, d := range dropped {
+		r.OnTimeout(d.id, d.received, d.total)
 	}
-	return nil
 }
 
-// FragmentPacket splits a large packet into small chunks with headers
-func FragmentPacket(data []byte) [][]byte {
+// FragmentPacket splits a large packet into chunks of at most chunkSize
+// bytes with headers
+func FragmentPacket(data []byte, chunkSize int) [][]byte {
 	// 1. Generate Random Packet ID
 	packetID := uint16(rand.Intn(65535))
 
 	// 2. Calculate Split
 	totalLen := len(data)
-	totalChunks := (totalLen + MaxChunkSize - 1) / MaxChunkSize
+	totalChunks := (totalLen + chunkSize - 1) / chunkSize
 
 	// Safety check (should not happen with standard MTU)
-	if totalChunks > 255 {
-		totalChunks = 255
+	if totalChunks > MaxFragments {
+		totalChunks = MaxFragments
 	}
 
 	chunks := make([][]byte, totalChunks)
 
 	for i := 0; i < totalChunks; i++ {
-		start := i * MaxChunkSize
-		end := start + MaxChunkSize
+		start := i * chunkSize
+		end := start + chunkSize
 		if end > totalLen {
 			end = totalLen
 		}
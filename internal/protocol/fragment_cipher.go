@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"slipstream-go/internal/crypto"
+)
+
+// Fragment encryption (see crypto.FragmentCipher): before a session carries
+// any data, the client sends its ephemeral X25519 key in a query of its own,
+// key.<base32 key>.SESSION.DOMAIN, and the server answers with its identity
+// key and a confirmation as a single downstream fragment. From then on both
+// sides seal every fragment they send and drop any that fail to open.
+// Fragments shrink by crypto.FragmentCipherOverhead so sealed ones still fit
+// where plain ones did. A server that predates the exchange never confirms
+// it, and the transport refuses to start rather than fall back to plain
+// fragments.
+
+const (
+	// KeyExchangeLabel is the first label of a key exchange query
+	KeyExchangeLabel = "key"
+	// KeyExchangeRetry is how long a key exchange query waits for its answer before it is sent again
+	KeyExchangeRetry = 2 * time.Second
+	// KeyExchangeAttempts is how many times a key exchange query is sent before giving up
+	KeyExchangeAttempts = 5
+)
+
+// ErrKeyExchange means the server never confirmed a key exchange
+var ErrKeyExchange = errors.New("server did not complete the fragment key exchange; it may predate fragment encryption")
+
+// FragmentCipher returns the cipher sealing the conn's fragments, nil when
+// EncryptFragments is off
+func (c *DnsPacketConn) FragmentCipher() *crypto.FragmentCipher {
+	return c.cipher.Load()
+}
+
+// exchangeKeys agrees on a fragment cipher with the server for sessionID,
+// sending the query again every KeyExchangeRetry until an answer verifies
+func (c *DnsPacketConn) exchangeKeys(sessionID string) (*crypto.FragmentCipher, error) {
+	kx, err := crypto.NewFragmentKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	key := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(kx.PublicKey())
+	var lastErr error
+	for attempt := 0; attempt < KeyExchangeAttempts; attempt++ {
+		// A fresh session label each attempt: the server refuses a repeated token
+		qname := c.fixedLabels(KeyExchangeLabel + "." + strings.ToLower(key) + "." + c.sessionLabelFor(sessionID) + "." + c.Domain + ".")
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, c.recordType)
+		target := c.pool.pick()
+		msg.Extra = append(msg.Extra, c.queryOPT(target))
+		buf, _ := msg.Pack()
+		c.queries.add(msg.Id, c.echoName(qname), queryKey)
+		c.Conn.WriteTo(buf, target)
+		c.logger.Debug().Str("resolver", target.String()).Int("attempt", attempt+1).Msg("Key exchange sent")
+
+		retry := time.NewTimer(KeyExchangeRetry)
+	wait:
+		for {
+			select {
+			case reply := <-c.keyReplies:
+				cipher, err := kx.Finish(reply, c.serverPins.VerifyKey)
+				if err == nil {
+					retry.Stop()
+					return cipher, nil
+				}
+				// A stale or forged answer; keep waiting for the real one
+				c.logger.Debug().Err(err).Msg("Ignoring key exchange answer")
+				lastErr = err
+			case <-retry.C:
+				break wait
+			case <-c.done:
+				retry.Stop()
+				return nil, net.ErrClosed
+			}
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyExchange, lastErr)
+	}
+	return nil, ErrKeyExchange
+}
+
+// takeKeyReply hands the fragment answering a key exchange query to exchangeKeys
+func (c *DnsPacketConn) takeKeyReply(msg *dns.Msg) {
+	c.answerFragments(msg, func(raw []byte) {
+		select {
+		case c.keyReplies <- raw:
+		default:
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := NewReassembler()
+	r.Timeout = 50 * time.Millisecond
+	type loss struct{ received, total int }
+	var lost []loss
+	r.OnTimeout = func(_ uint16, received, total int) {
+		lost = append(lost, loss{received, total})
+	}
+
+	frags := FragmentPacket(bytes.Repeat([]byte{1}, 3*MaxChunkSize), MaxChunkSize)
+	if len(frags) != 3 {
+		t.Fatalf("got %d fragments, want 3", len(frags))
+	}
+	r.IngestChunk(frags[0])
+	r.IngestChunk(frags[2])
+	if packets, _ := r.Pending(); packets != 1 {
+		t.Fatalf("%d packets pending, want the partial one", packets)
+	}
+
+	time.Sleep(2 * r.Timeout)
+	// Stale packets are reaped as the next fragment comes in
+	other := FragmentPacket([]byte("other"), MaxChunkSize)
+	if got := r.IngestChunk(other[0]); !bytes.Equal(got, []byte("other")) {
+		t.Fatalf("got %q, want the unrelated packet", got)
+	}
+	if packets, held := r.Pending(); packets != 0 || held != 0 {
+		t.Errorf("%d packets of %d bytes still pending after the timeout", packets, held)
+	}
+	if len(lost) != 1 || lost[0] != (loss{2, 3}) {
+		t.Errorf("OnTimeout saw %v, want one packet with 2 of 3 fragments", lost)
+	}
+	stats := r.Stats()
+	if stats.PacketsLost != 1 || stats.Missing != 1 {
+		t.Errorf("stats count %d packets lost, %d fragments missing; want 1 and 1", stats.PacketsLost, stats.Missing)
+	}
+
+	// The missing fragment arriving now can't complete anything
+	if got := r.IngestChunk(frags[1]); got != nil {
+		t.Errorf("a late fragment completed a reaped packet")
+	}
+	if r.Stats().Late != 1 {
+		t.Errorf("late fragment not counted")
+	}
+}
+
+func TestReassemblerWithinTimeout(t *testing.T) {
+	r := NewReassembler()
+	r.Timeout = time.Second
+	data := bytes.Repeat([]byte{2}, 3*MaxChunkSize)
+	frags := FragmentPacket(data, MaxChunkSize)
+	r.IngestChunk(frags[2])
+	r.IngestChunk(frags[0])
+	time.Sleep(20 * time.Millisecond)
+	if got := r.IngestChunk(frags[1]); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want the %d-byte packet", len(got), len(data))
+	}
+}
+
+func TestReassemblerDuplicateAndOrderStats(t *testing.T) {
+	r := NewReassembler()
+	data := bytes.Repeat([]byte{3}, 3*MaxChunkSize)
+	frags := FragmentPacket(data, MaxChunkSize)
+	r.IngestChunk(frags[0])
+	r.IngestChunk(frags[0]) // Repeat of a slot the pending packet holds
+	r.IngestChunk(frags[2]) // Overtook the middle fragment
+	if got := r.IngestChunk(frags[1]); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want the %d-byte packet", len(got), len(data))
+	}
+	r.IngestChunk(frags[1]) // Resolver retry of a delivered packet
+
+	want := FragmentStats{Duplicates: 2, DuplicatesCompleted: 1, OutOfOrder: 1, Packets: 1}
+	stats := r.Stats()
+	if stats.Duplicates != want.Duplicates || stats.DuplicatesCompleted != want.DuplicatesCompleted ||
+		stats.OutOfOrder != want.OutOfOrder || stats.Late != 0 || stats.Packets != want.Packets {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	if sum := stats.Add(stats); sum.DuplicatesCompleted != 2 || sum.OutOfOrder != 2 || sum.Late != 0 {
+		t.Errorf("Add summed to %+v", sum)
+	}
+}
+
+// heapInUse returns the live heap after a collection
+func heapInUse() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// BenchmarkIdleReassemblers measures what 10k quiet sessions' reassemblers
+// hold once the packets they carried have aged out, with the maps released
+// as the reassembler does and kept allocated as it used to
+func BenchmarkIdleReassemblers(b *testing.B) {
+	const sessions = 10000
+	frags := FragmentPacket(bytes.Repeat([]byte{3}, 3*MaxChunkSize), MaxChunkSize)
+	for _, bm := range []struct {
+		name     string
+		keepMaps bool
+	}{
+		{"released", false},
+		{"kept", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				before := heapInUse()
+				rs := make([]*Reassembler, sessions)
+				for i := range rs {
+					r := NewReassembler()
+					r.IngestChunk(frags[0])
+					pending := r.pending
+					for _, frag := range frags[1:] {
+						r.IngestChunk(frag)
+					}
+					completed := r.completed
+					// The delivered packet's ID ages out of duplicate tracking
+					r.mu.Lock()
+					for id := range r.completed {
+						r.completed[id] = time.Now().Add(-2 * CompletedTTL)
+					}
+					r.mu.Unlock()
+					r.Expire()
+					if bm.keepMaps {
+						// Emptied, but maps never shrink
+						r.pending, r.completed = pending, completed
+					}
+					rs[i] = r
+				}
+				b.ReportMetric(float64(heapInUse()-before)/sessions, "B/session")
+				runtime.KeepAlive(rs)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket over bytes. The transport's WriteTo waits on
+// one before fragmenting when MaxGoodput is set, so QUIC's send loop blocks
+// and its rate settles at the cap instead of overrunning the DNS channel and
+// losing packets.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a bucket for bytesPerSec, or nil if the cap is off
+func NewTokenBucket(bytesPerSec int) *TokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	// A tenth of a second of credit, but never less than two full QUIC packets
+	burst := float64(bytesPerSec) / 10
+	if burst < 2*1500 {
+		burst = 2 * 1500
+	}
+	return &TokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Reserve takes n bytes of credit and returns how long the caller must wait
+// before sending them. Credit may go negative; later callers wait it off.
+func (l *TokenBucket) Reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
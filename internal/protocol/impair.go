@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ImpairmentFlushInterval: packets held back for reordering are released at least this often
+const ImpairmentFlushInterval = 20 * time.Millisecond
+
+// Impairment describes simulated network damage applied to a transport
+type Impairment struct {
+	// LossRate is the probability (0-1) that a packet is dropped
+	LossRate float64
+	// DupRate is the probability (0-1) that a packet is delivered twice
+	DupRate float64
+	// ReorderDepth holds up to this many packets back and releases them in random order (0 = in order)
+	ReorderDepth int
+}
+
+// Active reports whether any impairment is configured
+func (imp Impairment) Active() bool {
+	return imp.LossRate > 0 || imp.DupRate > 0 || imp.ReorderDepth > 0
+}
+
+type impairedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// impairer applies an Impairment to a packet stream and hands survivors to emit
+type impairer struct {
+	imp  Impairment
+	emit func(impairedPacket)
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	held []impairedPacket
+}
+
+func newImpairer(imp Impairment, emit func(impairedPacket), done <-chan struct{}) *impairer {
+	im := &impairer{imp: imp, emit: emit, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if imp.ReorderDepth > 0 {
+		go func() {
+			ticker := time.NewTicker(ImpairmentFlushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					im.flush()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return im
+}
+
+func (im *impairer) push(p impairedPacket) {
+	im.mu.Lock()
+	if im.rng.Float64() < im.imp.LossRate {
+		im.mu.Unlock()
+		return
+	}
+	copies := 1
+	if im.rng.Float64() < im.imp.DupRate {
+		copies = 2
+	}
+	if im.imp.ReorderDepth <= 0 {
+		im.mu.Unlock()
+		for i := 0; i < copies; i++ {
+			im.emit(p)
+		}
+		return
+	}
+
+	for i := 0; i < copies; i++ {
+		im.held = append(im.held, p)
+	}
+	var out []impairedPacket
+	for len(im.held) > im.imp.ReorderDepth {
+		idx := im.rng.Intn(len(im.held))
+		out = append(out, im.held[idx])
+		im.held = append(im.held[:idx], im.held[idx+1:]...)
+	}
+	im.mu.Unlock()
+	for _, o := range out {
+		im.emit(o)
+	}
+}
+
+func (im *impairer) flush() {
+	im.mu.Lock()
+	out := im.held
+	im.held = nil
+	// rng isn't safe for concurrent use: shuffle before push can get at it
+	im.rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	im.mu.Unlock()
+	for _, o := range out {
+		im.emit(o)
+	}
+}
+
+// ImpairedConn wraps a net.PacketConn and applies loss, duplication and
+// reordering to both directions. It is meant for exercising the tunnel's
+// redundancy and deduplication on a healthy network (tests, local dev).
+type ImpairedConn struct {
+	net.PacketConn
+
+	incoming chan impairedPacket
+	done     chan struct{}
+	once     sync.Once
+	tx       *impairer
+	rx       *impairer
+}
+
+// NewImpairedConn wraps conn with the given impairment
+func NewImpairedConn(conn net.PacketConn, imp Impairment) *ImpairedConn {
+	c := &ImpairedConn{
+		PacketConn: conn,
+		incoming:   make(chan impairedPacket, RxQueueSize),
+		done:       make(chan struct{}),
+	}
+	c.tx = newImpairer(imp, func(p impairedPacket) { conn.WriteTo(p.data, p.addr) }, c.done)
+	c.rx = newImpairer(imp, func(p impairedPacket) {
+		select {
+		case c.incoming <- p:
+		default:
+		}
+	}, c.done)
+
+	go func() {
+		buf := make([]byte, RxBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// Back off so a socket that keeps failing doesn't spin
+				select {
+				case <-c.done:
+					return
+				case <-time.After(ImpairmentFlushInterval):
+					continue
+				}
+			}
+			c.rx.push(impairedPacket{data: append([]byte(nil), buf[:n]...), addr: addr})
+		}
+	}()
+	return c
+}
+
+func (c *ImpairedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.tx.push(impairedPacket{data: append([]byte(nil), p...), addr: addr})
+	return len(p), nil
+}
+
+func (c *ImpairedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.incoming:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *ImpairedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingConn is a PacketConn whose reads fail with err, counting them
+type failingConn struct {
+	net.PacketConn
+	err   error
+	reads atomic.Int32
+}
+
+func (c *failingConn) ReadFrom([]byte) (int, net.Addr, error) {
+	c.reads.Add(1)
+	return 0, nil, c.err
+}
+
+func (c *failingConn) Close() error { return nil }
+
+func TestImpairedConnReadErrors(t *testing.T) {
+	failing := &failingConn{err: errors.New("socket broken")}
+	c := NewImpairedConn(failing, Impairment{ReorderDepth: 2})
+	time.Sleep(10 * ImpairmentFlushInterval)
+	c.Close()
+	if reads := failing.reads.Load(); reads > 20 {
+		t.Errorf("%d reads of a failing socket in %v, want it backed off", reads, 10*ImpairmentFlushInterval)
+	}
+
+	// A closed socket ends the read loop at once
+	closed := &failingConn{err: net.ErrClosed}
+	NewImpairedConn(closed, Impairment{})
+	time.Sleep(5 * ImpairmentFlushInterval)
+	if reads := closed.reads.Load(); reads != 1 {
+		t.Errorf("%d reads of a closed socket, want 1", reads)
+	}
+}
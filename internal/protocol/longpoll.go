@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Long polls: downstream data can only ride on answers to client queries, so
+// with short polls it waits for the next poll. A long poll asks the server to
+// hold the query until data is queued for the session or the hold expires,
+// poll.NONCE.w-<ms>.SESSION.DOMAIN, and the client keeps a fixed number of them
+// outstanding, re-issuing each as soon as it is answered. Servers without
+// support answer at once, which degrades to ordinary polling.
+
+const (
+	// HoldHintPrefix marks the long-poll hold label
+	HoldHintPrefix = "w-"
+	// DefaultLongPollHold stays below the ~1s after which common resolvers retry
+	DefaultLongPollHold = 800 * time.Millisecond
+	// MaxLongPollHold is the longest hold a server grants by default
+	MaxLongPollHold = 2 * time.Second
+	// longPollGrace is how long past its hold an unanswered long poll counts as lost
+	longPollGrace = time.Second
+)
+
+// EncodeHoldHint returns the label asking the server to hold a poll for up to hold
+func EncodeHoldHint(hold time.Duration) string {
+	return HoldHintPrefix + strconv.FormatInt(hold.Milliseconds(), 10)
+}
+
+// ParseHoldHint decodes a hold label; ok is false if label isn't one
+func ParseHoldHint(label string) (hold time.Duration, ok bool) {
+	if len(label) <= len(HoldHintPrefix) || !strings.EqualFold(label[:len(HoldHintPrefix)], HoldHintPrefix) {
+		return 0, false
+	}
+	ms, err := strconv.Atoi(label[len(HoldHintPrefix):])
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// LoopbackResolverAddr is the address loopback responses appear to come from.
+// Use it as the only resolver when the transport is a LoopbackConn.
+var LoopbackResolverAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 53), Port: 53}
+
+// LoopbackConn is an in-memory net.PacketConn that hands every written DNS
+// query to Respond and queues the reply for ReadFrom, so the client transport
+// can run against a server handler in the same process without sockets.
+// Wrap it in an ImpairedConn to exercise lossy paths.
+type LoopbackConn struct {
+	// Respond answers a packed query; a nil reply means no answer
+	Respond func(query []byte) []byte
+
+	replies chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewLoopbackConn creates a loopback transport answered by respond
+func NewLoopbackConn(respond func(query []byte) []byte) *LoopbackConn {
+	return &LoopbackConn{
+		Respond: respond,
+		replies: make(chan []byte, RxQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *LoopbackConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	query := append([]byte(nil), p...)
+	go func() {
+		reply := c.Respond(query)
+		if reply == nil {
+			return
+		}
+		select {
+		case c.replies <- reply:
+		case <-c.done:
+		default:
+		}
+	}()
+	return len(p), nil
+}
+
+func (c *LoopbackConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case reply := <-c.replies:
+		return copy(p, reply), LoopbackResolverAddr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *LoopbackConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *LoopbackConn) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (c *LoopbackConn) SetDeadline(t time.Time) error      { return nil }
+func (c *LoopbackConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *LoopbackConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Selective repeat beneath QUIC: the client names downstream fragments it is
+// missing in an extra poll label, poll.NONCE.<nack label>.SESSION.DOMAIN, and
+// the server re-queues just those from its recently sent packets. QUIC still
+// owns reliability; this only shortens the common single-fragment loss from a
+// QUIC retransmit timeout to one poll round trip. Data queries carry no nack
+// label since they are already sized to the 253-char name limit.
+//
+// Label: NackLabelPrefix + base32(entries), entry = [PacketID:2][Missing:2]
+// where bit i of Missing set means seq i is missing (seqs >= 16 are not named).
+
+const (
+	// NackLabelPrefix marks the nack label; '-' never occurs in base32 data
+	NackLabelPrefix = "n-"
+	// MaxNacksPerLabel keeps the label within the 63-char limit (8*4 bytes = 52 chars)
+	MaxNacksPerLabel = 8
+	// NackDelay: a partial packet must be this old before its gaps are reported,
+	// so fragments still in flight in other responses aren't requested again
+	NackDelay = 150 * time.Millisecond
+	// NackInterval: minimum time between two nacks for the same packet
+	NackInterval = 300 * time.Millisecond
+	// nackEntryLen is the encoded size of one Nack
+	nackEntryLen = 4
+	// nackMaxSeq is the number of seqs a Missing bitmap can name
+	nackMaxSeq = 16
+)
+
+// Nack names the missing fragments of one downstream packet
+type Nack struct {
+	PacketID uint16
+	// Missing has bit i set when seq i is missing
+	Missing uint16
+}
+
+// Seqs returns the missing sequence numbers in ascending order
+func (n Nack) Seqs() []int {
+	var seqs []int
+	for i := 0; i < nackMaxSeq; i++ {
+		if n.Missing&(1<<i) != 0 {
+			seqs = append(seqs, i)
+		}
+	}
+	return seqs
+}
+
+var nackEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EncodeNackLabel packs up to MaxNacksPerLabel nacks into one DNS label
+func EncodeNackLabel(nacks []Nack) string {
+	if len(nacks) > MaxNacksPerLabel {
+		nacks = nacks[:MaxNacksPerLabel]
+	}
+	raw := make([]byte, 0, len(nacks)*nackEntryLen)
+	for _, n := range nacks {
+		raw = binary.BigEndian.AppendUint16(raw, n.PacketID)
+		raw = binary.BigEndian.AppendUint16(raw, n.Missing)
+	}
+	return NackLabelPrefix + nackEncoding.EncodeToString(raw)
+}
+
+// ParseNackLabel decodes a nack label; ok is false if label isn't one
+func ParseNackLabel(label string) (nacks []Nack, ok bool) {
+	if len(label) <= len(NackLabelPrefix) || !strings.EqualFold(label[:len(NackLabelPrefix)], NackLabelPrefix) {
+		return nil, false
+	}
+	raw, err := nackEncoding.DecodeString(strings.ToUpper(label[len(NackLabelPrefix):]))
+	if err != nil || len(raw)%nackEntryLen != 0 {
+		return nil, false
+	}
+	for i := 0; i+nackEntryLen <= len(raw); i += nackEntryLen {
+		nacks = append(nacks, Nack{
+			PacketID: binary.BigEndian.Uint16(raw[i:]),
+			Missing:  binary.BigEndian.Uint16(raw[i+2:]),
+		})
+	}
+	return nacks, true
+}
@@ -0,0 +1,18 @@
+package protocol
+
+// NULL downstream: TXT answers full of base64 stand out to DPI, while NULL
+// records (type 10) carry opaque binary RDATA, so a client may ask with NULL
+// queries and get each fragment back raw as the RDATA of one record. NULL is
+// rarely seen in legitimate traffic and some resolvers filter it, which is
+// why it is opt-in on both sides. Raw bytes also fit more fragments in a
+// response than base64 does.
+
+// NULLRecordRRLen is the wire size of one NULL answer carrying a full
+// fragment: compressed name (2) + type/class/TTL/rdlength (10) +
+// FragHeaderLen+MaxChunkSize bytes
+const NULLRecordRRLen = 12 + FragHeaderLen + MaxChunkSize
+
+// NULLFragmentsForSize is FragmentsForSize for NULL responses
+func NULLFragmentsForSize(limit, baseLen int) int {
+	return max((limit-baseLen)/NULLRecordRRLen, 1)
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// pollTuner adapts how many polls a heartbeat or burst sends, between 1 and
+// ParallelPolls, to what the resolver absorbs: polls lost or answered with an
+// error halve the count at most once per CwndLossTimeout, and each poll
+// answered with data adds 1/count back. Empty answers leave it alone, so an
+// idle tunnel keeps its count for the next burst.
+type pollTuner struct {
+	mu           sync.Mutex
+	count        float64
+	max          float64
+	lastDecrease time.Time
+}
+
+// newPollTuner returns a tuner starting at and capped by max
+func newPollTuner(max int) *pollTuner {
+	return &pollTuner{count: float64(max), max: float64(max)}
+}
+
+// polls returns the polls to send per heartbeat or burst
+func (t *pollTuner) polls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int(t.count)
+}
+
+// answered records a poll answered without error, with data or empty
+func (t *pollTuner) answered(gotData bool) {
+	if !gotData {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count = min(t.count+1/t.count, t.max)
+}
+
+// loss records n lost or refused polls and reports whether the count was halved
+func (t *pollTuner) loss(n int) bool {
+	if n <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.lastDecrease) < CwndLossTimeout {
+		return false
+	}
+	t.count = max(t.count/2, 1)
+	t.lastDecrease = time.Now()
+	return true
+}
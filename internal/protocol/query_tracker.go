@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// QueryTimeout: how long a query ID stays valid for matching a response
+const QueryTimeout = 10 * time.Second
+
+// queryKind says what an outstanding query holds on to until it is answered
+type queryKind uint8
+
+const (
+	// queryPlain holds nothing
+	queryPlain queryKind = iota
+	// queryWindowed holds a congestion window slot
+	queryWindowed
+	// queryLongPoll holds a long-poll slot
+	queryLongPoll
+	// queryPoll holds nothing; its outcome paces and tunes the polls
+	queryPoll
+	// queryKey holds nothing; its answer completes a fragment key exchange
+	queryKey
+	numQueryKinds
+)
+
+// queryTracker remembers the DNS message IDs of outstanding queries so that
+// responses which don't answer one of our queries can be dropped
+type queryTracker struct {
+	mu        sync.Mutex
+	pending   map[uint16]pendingQuery
+	lastPrune time.Time
+	// orphaned counts, per kind, queries forgotten without an answer (ID
+	// reuse, expiry) since the last sweep of that kind
+	orphaned [numQueryKinds]int
+}
+
+type pendingQuery struct {
+	sentAt time.Time
+	qname  string // Exact question name, kept when the echo must be verified (0x20)
+	kind   queryKind
+}
+
+func newQueryTracker() *queryTracker {
+	return &queryTracker{
+		pending:   make(map[uint16]pendingQuery),
+		lastPrune: time.Now(),
+	}
+}
+
+// add records an outgoing query ID and, if non-empty, the exact question name to verify
+func (t *queryTracker) add(id uint16, qname string, kind queryKind) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if old, ok := t.pending[id]; ok {
+		t.orphaned[old.kind]++
+	}
+	t.pending[id] = pendingQuery{sentAt: now, qname: qname, kind: kind}
+
+	// Expire unanswered queries (lost or dropped by the resolver)
+	if now.Sub(t.lastPrune) > QueryTimeout {
+		for qid, q := range t.pending {
+			if now.Sub(q.sentAt) > QueryTimeout {
+				t.orphaned[q.kind]++
+				delete(t.pending, qid)
+			}
+		}
+		t.lastPrune = now
+	}
+}
+
+// take consumes an outstanding query ID and returns what was recorded for it;
+// ok is false if it was never sent or already answered
+func (t *queryTracker) take(id uint16) (q pendingQuery, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	q, ok = t.pending[id]
+	if !ok {
+		return pendingQuery{}, false
+	}
+	delete(t.pending, id)
+	return q, time.Since(q.sentAt) <= QueryTimeout
+}
+
+// sweep gives up whatever every query of kind unanswered for longer than
+// timeout holds and returns how many were given up. The queries stay
+// matchable as plain queries, so a late answer is still delivered.
+func (t *queryTracker) sweep(kind queryKind, timeout time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lost := t.orphaned[kind]
+	t.orphaned[kind] = 0
+	now := time.Now()
+	for id, q := range t.pending {
+		if q.kind == kind && now.Sub(q.sentAt) > timeout {
+			q.kind = queryPlain
+			t.pending[id] = q
+			lost++
+		}
+	}
+	return lost
+}
@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Downstream sequencing: parallel polls return packets in whatever order the
+// resolvers answer, which QUIC reads as loss and backs off for. A client that
+// asks for CapSequence gets its session's downstream packets numbered
+// consecutively in the packet ID (see SetPacketID), and a Reorderer holds
+// packets arriving ahead of a missing one until it shows up or the window
+// passes, so QUIC sees them in order without waiting long behind a real loss.
+
+// MaxReorderGap is the furthest a packet ID may be from the next expected one
+// before the Reorderer takes it for a new numbering and starts over
+const MaxReorderGap = 64
+
+// SetPacketID overwrites the packet ID of every fragment of one packet, plain
+// or FEC, with id
+func SetPacketID(frags [][]byte, id uint16) {
+	for _, frag := range frags {
+		binary.BigEndian.PutUint16(frag[0:2], id)
+	}
+}
+
+// ReorderStats counts what a Reorderer did
+type ReorderStats struct {
+	// Held counts packets that arrived ahead of a missing one and waited
+	Held uint64
+	// Corrected counts gaps filled within the window, i.e. reorderings undone
+	Corrected uint64
+	// Skipped counts gaps given up on after the window (lost packets)
+	Skipped uint64
+	// Late counts packets that arrived after their gap was skipped
+	Late uint64
+	// Resyncs counts jumps beyond MaxReorderGap that restarted the numbering
+	Resyncs uint64
+}
+
+// Reorderer restores the order of consecutively numbered packets before
+// passing them to deliver. It passes packets straight through until Enable is
+// called. Safe for concurrent use.
+type Reorderer struct {
+	window  time.Duration
+	deliver func([]byte)
+
+	mu      sync.Mutex
+	enabled bool
+	synced  bool
+	next    uint16 // ID of the packet expected next
+	held    map[uint16]heldPacket
+	timer   *time.Timer
+	stats   ReorderStats
+}
+
+type heldPacket struct {
+	data    []byte
+	arrived time.Time
+}
+
+// NewReorderer returns a Reorderer that holds packets for up to window
+func NewReorderer(window time.Duration, deliver func([]byte)) *Reorderer {
+	return &Reorderer{window: window, deliver: deliver, held: make(map[uint16]heldPacket)}
+}
+
+// Enable starts reordering; call it once the peer numbers packets (CapSequence)
+func (r *Reorderer) Enable() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enabled = true
+}
+
+// Push hands over packet id: it is delivered now, along with any held packets
+// it unblocks, or held until its predecessors arrive or the window passes
+func (r *Reorderer) Push(id uint16, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.enabled {
+		r.deliver(data)
+		return
+	}
+	if !r.synced {
+		r.synced, r.next = true, id
+	}
+
+	gap := int16(id - r.next)
+	switch {
+	case gap == 0:
+		r.deliver(data)
+		r.next++
+		if r.releaseLocked() {
+			r.stats.Corrected++
+		}
+	case gap < 0 && gap > -MaxReorderGap:
+		// Its gap was already skipped: late is still better than never
+		r.stats.Late++
+		r.deliver(data)
+	case gap > 0 && gap < MaxReorderGap:
+		if _, dup := r.held[id]; dup {
+			return
+		}
+		r.held[id] = heldPacket{data, time.Now()}
+		r.stats.Held++
+		if r.timer == nil {
+			r.timer = time.AfterFunc(r.window, r.expire)
+		}
+	default:
+		// A different numbering (e.g. packets sent before sequencing began):
+		// flush what is held in order and follow the new one
+		r.stats.Resyncs++
+		r.flushLocked()
+		r.deliver(data)
+		r.next = id + 1
+	}
+}
+
+// releaseLocked delivers held packets from next on while they are
+// consecutive and reports whether there were any
+func (r *Reorderer) releaseLocked() bool {
+	released := false
+	for {
+		p, ok := r.held[r.next]
+		if !ok {
+			break
+		}
+		delete(r.held, r.next)
+		r.deliver(p.data)
+		r.next++
+		released = true
+	}
+	if len(r.held) == 0 && r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	return released
+}
+
+// flushLocked delivers every held packet in ID order
+func (r *Reorderer) flushLocked() {
+	for len(r.held) > 0 {
+		r.skipLocked()
+	}
+}
+
+// skipLocked gives up on the gap before the lowest held packet and releases
+// what follows it
+func (r *Reorderer) skipLocked() {
+	lowest, first := r.next, true
+	for id := range r.held {
+		if first || int16(id-lowest) < 0 {
+			lowest, first = id, false
+		}
+	}
+	r.stats.Skipped++
+	r.next = lowest
+	r.releaseLocked()
+}
+
+// expire skips the gaps whose held packets waited the whole window and
+// rearms the timer for the rest
+func (r *Reorderer) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timer = nil
+	now := time.Now()
+	for len(r.held) > 0 {
+		oldest := now
+		for _, p := range r.held {
+			if p.arrived.Before(oldest) {
+				oldest = p.arrived
+			}
+		}
+		if wait := oldest.Add(r.window).Sub(now); wait > 0 {
+			r.timer = time.AfterFunc(wait, r.expire)
+			return
+		}
+		r.skipLocked()
+	}
+}
+
+// Stop drops held packets and stops the timer
+func (r *Reorderer) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	clear(r.held)
+}
+
+// Stats returns the counters so far
+func (r *Reorderer) Stats() ReorderStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
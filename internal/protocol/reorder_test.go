@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reorderSink collects what a Reorderer delivers, one byte per packet
+type reorderSink struct {
+	mu  sync.Mutex
+	got []byte
+}
+
+func (s *reorderSink) deliver(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.got = append(s.got, data[0])
+}
+
+func (s *reorderSink) delivered() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.got)
+}
+
+// newTestReorderer returns an enabled Reorderer holding packets for window
+func newTestReorderer(window time.Duration) (*Reorderer, *reorderSink) {
+	sink := &reorderSink{}
+	r := NewReorderer(window, sink.deliver)
+	r.Enable()
+	return r, sink
+}
+
+// push hands r the packets with the given IDs, each carrying its ID's low byte
+func push(r *Reorderer, ids ...uint16) {
+	for _, id := range ids {
+		r.Push(id, []byte{byte(id)})
+	}
+}
+
+func TestReordererInOrder(t *testing.T) {
+	// Until enabled, packets pass whatever their IDs
+	sink := &reorderSink{}
+	r := NewReorderer(time.Minute, sink.deliver)
+	push(r, 7, 3, 5)
+	if got := sink.delivered(); !slices.Equal(got, []byte{7, 3, 5}) {
+		t.Fatalf("before Enable delivered %v", got)
+	}
+
+	// Consecutive IDs are delivered as they come, across the wrap
+	r, sink = newTestReorderer(time.Minute)
+	push(r, 65534, 65535, 0, 1)
+	if got := sink.delivered(); !slices.Equal(got, []byte{0xFE, 0xFF, 0, 1}) {
+		t.Errorf("delivered %v", got)
+	}
+	if stats := r.Stats(); stats != (ReorderStats{}) {
+		t.Errorf("stats %+v, want none", stats)
+	}
+}
+
+func TestReordererHoldsPastGap(t *testing.T) {
+	r, sink := newTestReorderer(time.Minute)
+	defer r.Stop()
+	push(r, 1, 3, 4, 3)
+	if got := sink.delivered(); !slices.Equal(got, []byte{1}) {
+		t.Fatalf("delivered %v, want 3 and 4 held behind 2", got)
+	}
+	push(r, 2)
+	if got := sink.delivered(); !slices.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Fatalf("delivered %v after the gap filled", got)
+	}
+	if stats := r.Stats(); stats != (ReorderStats{Held: 2, Corrected: 1}) {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestReordererGapTimeout(t *testing.T) {
+	const window = 50 * time.Millisecond
+	r, sink := newTestReorderer(window)
+	defer r.Stop()
+	push(r, 1, 3, 5)
+	time.Sleep(window / 2)
+	if got := sink.delivered(); !slices.Equal(got, []byte{1}) {
+		t.Fatalf("delivered %v within the window", got)
+	}
+
+	// Past the window both gaps are given up on and the held packets go out in order
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.delivered()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := sink.delivered(); !slices.Equal(got, []byte{1, 3, 5}) {
+		t.Fatalf("delivered %v after the window", got)
+	}
+	// A packet from a skipped gap still goes out, and the next one straight after it
+	push(r, 2, 6)
+	if got := sink.delivered(); !slices.Equal(got, []byte{1, 3, 5, 2, 6}) {
+		t.Errorf("delivered %v", got)
+	}
+	if stats := r.Stats(); stats != (ReorderStats{Held: 2, Skipped: 2, Late: 1}) {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestReordererResyncFlushes(t *testing.T) {
+	r, sink := newTestReorderer(time.Minute)
+	defer r.Stop()
+	push(r, 10, 13, 12)
+
+	// A jump beyond MaxReorderGap is a new numbering: what is held goes
+	// out in order first, then packets follow the new IDs
+	push(r, 10+2*MaxReorderGap, 11+2*MaxReorderGap)
+	want := []byte{10, 12, 13, 10 + 2*MaxReorderGap, 11 + 2*MaxReorderGap}
+	if got := sink.delivered(); !slices.Equal(got, want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	if stats := r.Stats(); stats != (ReorderStats{Held: 2, Skipped: 1, Resyncs: 1}) {
+		t.Errorf("stats %+v", stats)
+	}
+}
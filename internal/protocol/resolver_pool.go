@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ResolverStrategy selects how outbound queries are spread across resolvers
+type ResolverStrategy int32
+
+const (
+	// StrategyRoundRobin cycles through all healthy resolvers to spread per-IP rate limits
+	StrategyRoundRobin ResolverStrategy = iota
+	// StrategyFailover sends everything to the first healthy resolver in list order
+	StrategyFailover
+)
+
+const (
+	// ResolverFailTimeout: a resolver that has not answered anything for this long
+	// since its oldest unanswered query is considered down
+	ResolverFailTimeout = 3 * time.Second
+	// ResolverRetryInterval: how long a down resolver is skipped before it is probed again
+	ResolverRetryInterval = 30 * time.Second
+)
+
+// ParseResolverStrategy parses the --resolver-strategy flag value
+func ParseResolverStrategy(s string) (ResolverStrategy, error) {
+	switch strings.ToLower(s) {
+	case "roundrobin", "round-robin", "rr":
+		return StrategyRoundRobin, nil
+	case "failover":
+		return StrategyFailover, nil
+	default:
+		return 0, fmt.Errorf("unknown resolver strategy %q (want roundrobin or failover)", s)
+	}
+}
+
+func (s ResolverStrategy) String() string {
+	switch s {
+	case StrategyRoundRobin:
+		return "roundrobin"
+	case StrategyFailover:
+		return "failover"
+	default:
+		return "unknown"
+	}
+}
+
+type resolverHealth struct {
+	firstUnanswered time.Time // Oldest query sent since the last response (zero if none)
+	downSince       time.Time // When the resolver was marked down (zero if healthy)
+}
+
+// resolverPool picks resolvers for outbound queries and tracks which ones still answer
+type resolverPool struct {
+	addrs    []*net.UDPAddr
+	strategy atomic.Int32
+	next     atomic.Uint32
+	// lastAnswered is the index+1 of the resolver that answered most recently (0 = none yet)
+	lastAnswered atomic.Int32
+
+	mu     sync.Mutex
+	health []resolverHealth
+	logger zerolog.Logger
+
+	// sizes tracks the largest responses each resolver delivered (see ResponseStats)
+	sizes []responseSizes
+}
+
+// responseSizes holds per-resolver query and response counters, updated by
+// pick and the RX engine
+type responseSizes struct {
+	queries   atomic.Uint64
+	responses atomic.Uint64
+	maxSize   atomic.Int64
+	maxFrags  atomic.Int64
+}
+
+// ResolverResponseStats reports the largest downstream answers seen from one resolver
+type ResolverResponseStats struct {
+	Resolver  string
+	Queries   uint64
+	Responses uint64
+	// MaxSize is the largest DNS response in bytes; above MinResponseSize means EDNS0 works on the path
+	MaxSize int
+	// MaxFragments is the most tunnel fragments a single response carried
+	MaxFragments int
+}
+
+// LossRate returns the share of queries that got no response, or 0 before
+// any query was sent. Queries still in flight count as lost.
+func (s ResolverResponseStats) LossRate() float64 {
+	if s.Queries == 0 || s.Responses >= s.Queries {
+		return 0
+	}
+	return 1 - float64(s.Responses)/float64(s.Queries)
+}
+
+// EDNS0 reports whether a response larger than the classic 512-byte limit came through
+func (s ResolverResponseStats) EDNS0() bool {
+	return s.MaxSize > MinResponseSize
+}
+
+func newResolverPool(addrs []*net.UDPAddr, logger zerolog.Logger) *resolverPool {
+	return &resolverPool{
+		addrs:  addrs,
+		health: make([]resolverHealth, len(addrs)),
+		logger: logger,
+		sizes:  make([]responseSizes, len(addrs)),
+	}
+}
+
+func (p *resolverPool) setStrategy(s ResolverStrategy) {
+	p.strategy.Store(int32(s))
+}
+
+// pick returns the resolver for the next query and records it as outstanding
+func (p *resolverPool) pick() *net.UDPAddr {
+	if len(p.addrs) == 1 {
+		p.markSent(0)
+		return p.addrs[0]
+	}
+
+	var idx int
+	switch ResolverStrategy(p.strategy.Load()) {
+	case StrategyFailover:
+		idx = p.firstHealthy(0)
+	default:
+		start := int(p.next.Add(1)-1) % len(p.addrs)
+		idx = p.firstHealthy(start)
+	}
+	p.markSent(idx)
+	return p.addrs[idx]
+}
+
+// firstHealthy returns the first healthy resolver starting at start (wrapping),
+// or a random one if every resolver is currently down
+func (p *resolverPool) firstHealthy(start int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(p.addrs); i++ {
+		idx := (start + i) % len(p.addrs)
+		if p.healthyLocked(idx, now) {
+			return idx
+		}
+	}
+	return rand.Intn(len(p.addrs))
+}
+
+func (p *resolverPool) healthyLocked(idx int, now time.Time) bool {
+	h := &p.health[idx]
+	if !h.downSince.IsZero() {
+		if now.Sub(h.downSince) < ResolverRetryInterval {
+			return false
+		}
+		// Give it another chance; it is marked down again if it stays silent
+		h.downSince = time.Time{}
+		h.firstUnanswered = time.Time{}
+		p.logger.Info().Str("resolver", p.addrs[idx].String()).Msg("Retrying resolver")
+		return true
+	}
+	if !h.firstUnanswered.IsZero() && now.Sub(h.firstUnanswered) > ResolverFailTimeout {
+		h.downSince = now
+		p.logger.Warn().Str("resolver", p.addrs[idx].String()).Msg("Resolver not answering, marking down")
+		return false
+	}
+	return true
+}
+
+func (p *resolverPool) markSent(idx int) {
+	p.sizes[idx].queries.Add(1)
+	p.mu.Lock()
+	if p.health[idx].firstUnanswered.IsZero() {
+		p.health[idx].firstUnanswered = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+// markAnswered records a response from addr; returns false if addr is not in the pool
+func (p *resolverPool) markAnswered(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	idx := p.indexOf(udpAddr)
+	if idx < 0 {
+		return false
+	}
+	p.mu.Lock()
+	h := &p.health[idx]
+	if !h.downSince.IsZero() {
+		p.logger.Info().Str("resolver", addr.String()).Msg("Resolver answering again")
+	}
+	h.firstUnanswered = time.Time{}
+	h.downSince = time.Time{}
+	p.mu.Unlock()
+	p.lastAnswered.Store(int32(idx + 1))
+	return true
+}
+
+// noteResponse records the size and fragment count of a response from addr
+func (p *resolverPool) noteResponse(addr net.Addr, size, frags int) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	idx := p.indexOf(udpAddr)
+	if idx < 0 {
+		return
+	}
+	s := &p.sizes[idx]
+	s.responses.Add(1)
+	storeMax(&s.maxSize, int64(size))
+	storeMax(&s.maxFrags, int64(frags))
+}
+
+// responseStats returns the response size counters of every resolver
+func (p *resolverPool) responseStats() []ResolverResponseStats {
+	stats := make([]ResolverResponseStats, len(p.addrs))
+	for i, addr := range p.addrs {
+		stats[i] = ResolverResponseStats{
+			Resolver:     addr.String(),
+			Queries:      p.sizes[i].queries.Load(),
+			Responses:    p.sizes[i].responses.Load(),
+			MaxSize:      int(p.sizes[i].maxSize.Load()),
+			MaxFragments: int(p.sizes[i].maxFrags.Load()),
+		}
+	}
+	return stats
+}
+
+// storeMax raises v to n if n is larger
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		cur := v.Load()
+		if n <= cur || v.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
+
+// lastAnsweredIndex returns the index of the resolver that answered most recently, or -1
+func (p *resolverPool) lastAnsweredIndex() int {
+	return int(p.lastAnswered.Load()) - 1
+}
+
+func (p *resolverPool) indexOf(addr *net.UDPAddr) int {
+	for i, a := range p.addrs {
+		if a.Port == addr.Port && a.IP.Equal(addr.IP) {
+			return i
+		}
+	}
+	return -1
+}
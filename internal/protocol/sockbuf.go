@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"net"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultReadBuffer is the OS receive buffer requested for tunnel sockets
+const DefaultReadBuffer = 4 * 1024 * 1024
+
+// SetUDPBuffers applies read/write buffer sizes to a UDP socket (0 leaves the OS default)
+// and warns when the kernel grants much less than requested (e.g. capped by rmem_max)
+func SetUDPBuffers(conn *net.UDPConn, readBytes, writeBytes int, logger zerolog.Logger) {
+	if readBytes > 0 {
+		if err := conn.SetReadBuffer(readBytes); err != nil {
+			logger.Warn().Err(err).Int("requested", readBytes).Msg("Failed to set UDP read buffer")
+		} else {
+			checkGrantedBuffer(conn, "read", readBytes, logger)
+		}
+	}
+	if writeBytes > 0 {
+		if err := conn.SetWriteBuffer(writeBytes); err != nil {
+			logger.Warn().Err(err).Int("requested", writeBytes).Msg("Failed to set UDP write buffer")
+		} else {
+			checkGrantedBuffer(conn, "write", writeBytes, logger)
+		}
+	}
+}
+
+func checkGrantedBuffer(conn *net.UDPConn, kind string, requested int, logger zerolog.Logger) {
+	granted, ok := socketBufferSize(conn, kind == "read")
+	if !ok {
+		return
+	}
+	// Linux reports double the usable size, so anything under half is a real cap
+	if granted < requested/2 {
+		logger.Warn().Str("buffer", kind).Int("requested", requested).Int("granted", granted).
+			Msg("Kernel granted a much smaller UDP buffer than requested (check net.core.rmem_max/wmem_max)")
+		return
+	}
+	logger.Debug().Str("buffer", kind).Int("requested", requested).Int("granted", granted).Msg("UDP buffer set")
+}
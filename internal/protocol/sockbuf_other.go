@@ -0,0 +1,10 @@
+//go:build !unix
+
+package protocol
+
+import "net"
+
+// socketBufferSize is not supported on this platform
+func socketBufferSize(conn *net.UDPConn, read bool) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package protocol
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// readBufferOf opens a transport with opts and returns its socket's granted read buffer
+func readBufferOf(t *testing.T, opts DnsConnOptions) int {
+	t.Helper()
+	logger := zerolog.Nop()
+	opts.Logger = &logger
+	c, err := NewDnsPacketConnWithOptions([]string{"127.0.0.1:53"}, "t.example.com", "abcdefgh", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	size, ok := socketBufferSize(c.Conn.(*net.UDPConn), true)
+	if !ok {
+		t.Skip("socket buffer sizes can't be read on this platform")
+	}
+	return size
+}
+
+func TestReadBufferOSDefault(t *testing.T) {
+	fresh, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	osDefault, ok := socketBufferSize(fresh, true)
+	fresh.Close()
+	if !ok {
+		t.Skip("socket buffer sizes can't be read on this platform")
+	}
+
+	if got := readBufferOf(t, DnsConnOptions{ReadBuffer: -1}); got != osDefault {
+		t.Errorf("negative ReadBuffer: got %d, want the OS default %d", got, osDefault)
+	}
+	if got := readBufferOf(t, DnsConnOptions{ReadBuffer: 8192}); got == osDefault {
+		t.Errorf("ReadBuffer 8192 left the OS default %d", got)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package protocol
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketBufferSize reads back SO_RCVBUF/SO_SNDBUF as granted by the kernel
+func socketBufferSize(conn *net.UDPConn, read bool) (int, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	opt := syscall.SO_SNDBUF
+	if read {
+		opt = syscall.SO_RCVBUF
+	}
+	var size int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil || sockErr != nil {
+		return 0, false
+	}
+	return size, true
+}
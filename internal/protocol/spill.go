@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fragment queues are bounded channels, and dropping single fragments when one
+// is full corrupts packets: the siblings already queued still cost a query or
+// a response slot each but can never be reassembled. A SpillQueue sits behind
+// such a channel and only ever moves whole packets: a packet that doesn't fit
+// in the channel completely waits in the spill ring, and when the ring is full
+// the oldest waiting packets are evicted whole, which QUIC retransmits cleanly.
+// QUIC takes a returned write for sent and an error would close the
+// connection, so its writers call WaitRoom first and, when even the ring is
+// full, wait for the consumer to make room before anything is evicted.
+
+const (
+	// DefaultSpillSize is the spill ring capacity in fragments
+	DefaultSpillSize = 2000
+	// SpillWait bounds how long WaitRoom holds a producer back before the
+	// oldest spilled packets are evicted after all
+	SpillWait = time.Second
+)
+
+// SpillQueue is a bounded ring of packets waiting for room in a fragment channel
+type SpillQueue struct {
+	mu       sync.Mutex
+	packets  [][][]byte // ring of packets, each its fragments
+	head     int
+	count    int // packets in the ring
+	frags    int // fragments in the ring
+	maxFrags int
+	// pending mirrors frags for lock-free checks on the consumer path
+	pending atomic.Int64
+	evicted atomic.Uint64
+}
+
+// NewSpillQueue creates a spill ring holding up to maxFrags fragments
+// (DefaultSpillSize if maxFrags <= 0)
+func NewSpillQueue(maxFrags int) *SpillQueue {
+	if maxFrags <= 0 {
+		maxFrags = DefaultSpillSize
+	}
+	return &SpillQueue{packets: make([][][]byte, 16), maxFrags: maxFrags}
+}
+
+// Enqueue puts all fragments of one packet on ch, or none of them: if ch can't
+// take the whole packet, or older packets are still spilled, it waits in the
+// ring. It returns the number of packets evicted to make room, counting the
+// packet itself if it is larger than the ring. Every producer of ch must go
+// through Enqueue.
+func (q *SpillQueue) Enqueue(ch chan []byte, frags [][]byte) (evicted int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.refillLocked(ch)
+	if q.count == 0 && cap(ch)-len(ch) >= len(frags) {
+		// Consumers only take from ch, so the room can't shrink under the lock
+		for _, frag := range frags {
+			ch <- frag
+		}
+		return 0
+	}
+
+	if len(frags) > q.maxFrags {
+		q.evicted.Add(1)
+		return 1
+	}
+	for q.frags+len(frags) > q.maxFrags {
+		q.popLocked()
+		evicted++
+	}
+	q.pushLocked(frags)
+	q.refillLocked(ch)
+	q.evicted.Add(uint64(evicted))
+	return evicted
+}
+
+// WaitRoom blocks until a packet of n fragments can be enqueued on ch without
+// evicting anything, SpillWait passes or done is closed, and reports whether
+// there is room. Producers that can wait call it before Enqueue, so a full
+// queue slows them down instead of dropping packets they believe were sent.
+func (q *SpillQueue) WaitRoom(ch chan []byte, n int, done <-chan struct{}) bool {
+	deadline := time.Now().Add(SpillWait)
+	for !q.fits(ch, n) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+// fits reports whether Enqueue would take n fragments without evicting
+func (q *SpillQueue) fits(ch chan []byte, n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count == 0 && cap(ch)-len(ch) >= n || q.frags+n <= q.maxFrags
+}
+
+// Refill moves spilled packets to ch while they fit whole. Consumers call it
+// after taking from ch; it returns at once when nothing is spilled.
+func (q *SpillQueue) Refill(ch chan []byte) {
+	if q.pending.Load() == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.refillLocked(ch)
+	q.mu.Unlock()
+}
+
+// Clear drops every spilled packet without counting them as evicted
+func (q *SpillQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.count > 0 {
+		q.popLocked()
+	}
+}
+
+// Len returns the number of spilled fragments
+func (q *SpillQueue) Len() int {
+	return int(q.pending.Load())
+}
+
+// Evicted returns the number of packets dropped whole since creation
+func (q *SpillQueue) Evicted() uint64 {
+	return q.evicted.Load()
+}
+
+func (q *SpillQueue) refillLocked(ch chan []byte) {
+	for q.count > 0 && cap(ch)-len(ch) >= len(q.packets[q.head]) {
+		for _, frag := range q.popLocked() {
+			ch <- frag
+		}
+	}
+}
+
+func (q *SpillQueue) pushLocked(frags [][]byte) {
+	if q.count == len(q.packets) {
+		// Grow the ring, unwrapping it in the process
+		grown := make([][][]byte, 2*len(q.packets))
+		for i := 0; i < q.count; i++ {
+			grown[i] = q.packets[(q.head+i)%len(q.packets)]
+		}
+		q.packets = grown
+		q.head = 0
+	}
+	q.packets[(q.head+q.count)%len(q.packets)] = frags
+	q.count++
+	q.frags += len(frags)
+	q.pending.Store(int64(q.frags))
+}
+
+func (q *SpillQueue) popLocked() [][]byte {
+	frags := q.packets[q.head]
+	q.packets[q.head] = nil
+	q.head = (q.head + 1) % len(q.packets)
+	q.count--
+	q.frags -= len(frags)
+	q.pending.Store(int64(q.frags))
+	return frags
+}
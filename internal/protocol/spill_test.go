@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// fullSpillQueue returns a channel of 4 fragments and a spill ring of 4, both
+// full of one-fragment packets numbered from 0
+func fullSpillQueue(t *testing.T) (chan []byte, *SpillQueue) {
+	t.Helper()
+	ch := make(chan []byte, 4)
+	q := NewSpillQueue(4)
+	for i := range 8 {
+		if evicted := q.Enqueue(ch, [][]byte{{byte(i)}}); evicted != 0 {
+			t.Fatalf("packet %d evicted %d while filling", i, evicted)
+		}
+	}
+	if len(ch) != 4 || q.Len() != 4 {
+		t.Fatalf("%d fragments queued and %d spilled, want 4 and 4", len(ch), q.Len())
+	}
+	return ch, q
+}
+
+func TestSpillQueueWaitsForConsumer(t *testing.T) {
+	ch, q := fullSpillQueue(t)
+	const drainAfter = 100 * time.Millisecond
+	go func() {
+		time.Sleep(drainAfter)
+		<-ch
+		q.Refill(ch)
+	}()
+
+	start := time.Now()
+	if !q.WaitRoom(ch, 1, nil) {
+		t.Fatal("no room after a consumer drained the queue")
+	}
+	if waited := time.Since(start); waited < drainAfter || waited >= SpillWait {
+		t.Errorf("waited %v, want until the consumer took a fragment after %v", waited, drainAfter)
+	}
+	if evicted := q.Enqueue(ch, [][]byte{{8}}); evicted != 0 {
+		t.Errorf("%d packets evicted although there was room", evicted)
+	}
+	// Nothing was lost or reordered
+	var got []byte
+	for len(ch) > 0 {
+		got = append(got, (<-ch)[0])
+		q.Refill(ch)
+	}
+	if want := []byte{1, 2, 3, 4, 5, 6, 7, 8}; !bytes.Equal(got, want) {
+		t.Errorf("drained packets %v, want %v", got, want)
+	}
+}
+
+func TestSpillQueueEvictsAfterSpillWait(t *testing.T) {
+	ch, q := fullSpillQueue(t)
+	start := time.Now()
+	if q.WaitRoom(ch, 1, nil) {
+		t.Fatal("room in a full queue nobody drains")
+	}
+	if waited := time.Since(start); waited < SpillWait {
+		t.Errorf("gave up after %v, want SpillWait (%v)", waited, SpillWait)
+	}
+	// Only now does the oldest spilled packet make way
+	if evicted := q.Enqueue(ch, [][]byte{{8}}); evicted != 1 || q.Evicted() != 1 {
+		t.Errorf("%d packets evicted (%d in total), want 1", evicted, q.Evicted())
+	}
+
+	// A closed done channel ends the wait early
+	done := make(chan struct{})
+	close(done)
+	start = time.Now()
+	if q.WaitRoom(ch, 1, done) || time.Since(start) >= SpillWait {
+		t.Error("WaitRoom kept waiting after done was closed")
+	}
+}
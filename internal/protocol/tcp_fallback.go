@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TCP fallback (RFC 7766): a resolver that can't fit an answer in the UDP
+// size sets TC and leaves the fragments out, as does the server when not even
+// one fits. The client asks the same resolver again over TCP, under a fresh
+// session token, where the answer isn't capped, and ingests what comes back
+// like any UDP answer. Retries run in the background, at most TCPFallback at
+// a time; truncated answers beyond that are left to the next poll. A resolver that refuses TCP
+// is not asked again for TCPFallbackBackoff.
+
+const (
+	// DefaultTCPFallback is how many TCP retries may run at once by default
+	DefaultTCPFallback = 4
+	// TCPFallbackTimeout bounds connecting, sending and reading one retry
+	TCPFallbackTimeout = 5 * time.Second
+	// TCPFallbackBackoff is how long a resolver whose TCP retry failed is left alone
+	TCPFallbackBackoff = 30 * time.Second
+)
+
+// tcpFallback retries truncated UDP queries over TCP, a bounded number at a time
+type tcpFallback struct {
+	slots  chan struct{}
+	client *dns.Client
+
+	mu     sync.Mutex
+	failed map[string]time.Time // resolver -> when its last retry failed
+
+	retries  atomic.Uint64
+	fetched  atomic.Uint64
+	worked   sync.Once
+	failWarn sync.Once
+}
+
+func newTCPFallback(concurrency int) *tcpFallback {
+	return &tcpFallback{
+		slots:  make(chan struct{}, concurrency),
+		client: &dns.Client{Net: "tcp", Timeout: TCPFallbackTimeout},
+		failed: make(map[string]time.Time),
+	}
+}
+
+// usable reports whether resolver hasn't failed a retry in the last TCPFallbackBackoff
+func (t *tcpFallback) usable(resolver string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at, ok := t.failed[resolver]
+	if ok && time.Since(at) >= TCPFallbackBackoff {
+		delete(t.failed, resolver)
+		return true
+	}
+	return !ok
+}
+
+func (t *tcpFallback) fail(resolver string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed[resolver] = time.Now()
+}
+
+// TCPFallbackStats counts truncated answers retried over TCP
+type TCPFallbackStats struct {
+	// Retries counts queries sent again over TCP
+	Retries uint64
+	// Fetched counts retries answered with downstream data
+	Fetched uint64
+}
+
+// TCPFallbackStats returns the TCP retry counters, zero when TCPFallback is off
+func (c *DnsPacketConn) TCPFallbackStats() TCPFallbackStats {
+	if c.tcp == nil {
+		return TCPFallbackStats{}
+	}
+	return TCPFallbackStats{Retries: c.tcp.retries.Load(), Fetched: c.tcp.fetched.Load()}
+}
+
+// reissueName returns name under a fresh session label: with a PSK the
+// truncated query's token is spent. The labels before it (data or poll
+// nonce) are kept as sent, the rest is case-randomized anew with 0x20.
+func (c *DnsPacketConn) reissueName(name string) string {
+	labels := dns.SplitDomainName(name)
+	keep := len(labels) - dns.CountLabel(c.Domain+".") - 1
+	if keep < 0 {
+		return name
+	}
+	prefix := strings.Join(labels[:keep], ".")
+	if prefix != "" {
+		prefix += "."
+	}
+	return prefix + c.fixedLabels(c.sessionLabel()+"."+c.Domain+".")
+}
+
+// retryOverTCP asks resolver again over TCP for the question a truncated
+// answer was for, in the background. It returns false if it didn't: the
+// fallback is off, busy or backing off from this resolver.
+func (c *DnsPacketConn) retryOverTCP(question dns.Question, resolver net.Addr) bool {
+	if c.tcp == nil || !c.tcp.usable(resolver.String()) {
+		return false
+	}
+	select {
+	case c.tcp.slots <- struct{}{}:
+	default:
+		return false
+	}
+	c.tcp.retries.Add(1)
+
+	c.engines.Add(1)
+	go func() {
+		defer c.engines.Done()
+		defer func() { <-c.tcp.slots }()
+
+		name := c.reissueName(question.Name)
+		query := new(dns.Msg)
+		query.SetQuestion(name, question.Qtype)
+		query.Extra = append(query.Extra, c.queryOPT(resolver))
+		resp, _, err := c.tcp.client.Exchange(query, resolver.String())
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if err != nil {
+			c.tcp.fail(resolver.String())
+			c.tcp.failWarn.Do(func() {
+				c.logger.Warn().Err(err).Str("resolver", resolver.String()).Msg("Resolver truncates UDP answers and is unreachable over TCP; truncated answers are left to the next poll")
+			})
+			c.logger.Debug().Err(err).Str("resolver", resolver.String()).Msg("TCP retry failed")
+			return
+		}
+		// 0x20 randomized names come back as sent, or the answer is not ours
+		if c.case0x20 && (len(resp.Question) == 0 || resp.Question[0].Name != name) {
+			c.logger.Debug().Str("from", resolver.String()).Msg("Dropping TCP answer with mismatched 0x20 echo")
+			return
+		}
+		gotData, frags := c.ingestAnswers(resp, resolver)
+		c.logger.Debug().Str("resolver", resolver.String()).Int("frags", frags).Msg("Fetched truncated answer over TCP")
+		if gotData {
+			c.tcp.fetched.Add(1)
+			c.tcp.worked.Do(func() {
+				c.logger.Info().Str("resolver", resolver.String()).Msg("Fetching truncated DNS answers over TCP")
+			})
+			c.dryPolls.Store(0)
+			select {
+			case c.pollTrigger <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return true
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// TXT downstream: each fragment is one TXT answer in base64. Clients that
+// advertise CapRawBase64 get base64url without padding (RFC 4648 section 5),
+// which drops the '=' a full fragment ends in. DecodeTXT accepts both
+// alphabets, padded or not, so packets sent before the capability exchange
+// (the QUIC handshake) and answers from old servers still decode.
+//
+// Clients that advertise CapTXTMulti get every fragment of a response in one
+// TXT record instead, one character-string per fragment, which saves the
+// 12-byte record header per fragment: a 4096-byte response carries 23 full
+// fragments instead of 21.
+
+const (
+	// RawEncodedFragmentRRLen is EncodedFragmentRRLen for unpadded base64url:
+	// 171 characters for FragHeaderLen+MaxChunkSize bytes instead of 172
+	RawEncodedFragmentRRLen = 184
+	// txtRRHeaderLen is the wire size of a TXT answer before its strings:
+	// compressed name (2) + type/class/TTL/rdlength (10)
+	txtRRHeaderLen = 12
+	// MaxEDNSSize is the largest response size a client may advertise
+	MaxEDNSSize = 4096
+	// MaxFragsPerResponse is the most full fragments a MaxEDNSSize response
+	// carries, in a multi-string TXT answer
+	MaxFragsPerResponse = (MaxEDNSSize - txtRRHeaderLen) / (EncodedFragmentRRLen - txtRRHeaderLen)
+)
+
+// EncodeTXT returns the TXT string carrying frag, base64url without padding
+// if raw, standard padded base64 otherwise
+func EncodeTXT(frag []byte, raw bool) string {
+	if raw {
+		return base64.RawURLEncoding.EncodeToString(frag)
+	}
+	return base64.StdEncoding.EncodeToString(frag)
+}
+
+// DecodeTXT restores a fragment encoded by EncodeTXT either way. The two
+// alphabets differ only in the characters for 62 and 63, so the standard
+// ones are mapped onto the URL ones and padding is dropped.
+func DecodeTXT(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// DecodeTXTRecord restores the fragments of one TXT answer: one per
+// character-string, or, if a string doesn't decode on its own, a single
+// fragment split across the strings
+func DecodeTXTRecord(strs []string) ([][]byte, error) {
+	frags := make([][]byte, 0, len(strs))
+	for _, s := range strs {
+		frag, err := DecodeTXT(s)
+		if err != nil {
+			frag, err = DecodeTXT(strings.Join(strs, ""))
+			if err != nil {
+				return nil, err
+			}
+			return [][]byte{frag}, nil
+		}
+		frags = append(frags, frag)
+	}
+	return frags, nil
+}
+
+// RawFragmentsForSize is FragmentsForSize for sessions getting base64url
+func RawFragmentsForSize(limit, baseLen int) int {
+	return max((limit-baseLen)/RawEncodedFragmentRRLen, 1)
+}
+
+// MultiTXTFragmentsForSize is FragmentsForSize for sessions getting
+// multi-string TXT answers, base64url if raw
+func MultiTXTFragmentsForSize(limit, baseLen int, raw bool) int {
+	perFrag := EncodedFragmentRRLen - txtRRHeaderLen
+	if raw {
+		perFrag = RawEncodedFragmentRRLen - txtRRHeaderLen
+	}
+	return max((limit-baseLen-txtRRHeaderLen)/perFrag, 1)
+}
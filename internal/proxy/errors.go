@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Sentinel errors returned (wrapped) by this package; test with errors.Is
+var (
+	ErrUnsupportedNetwork  = errors.New("socks5: only TCP is supported")
+	ErrInvalidAddress      = errors.New("invalid address")
+	ErrInvalidPort         = errors.New("invalid port")
+	ErrDomainTooLong       = errors.New("domain name too long")
+	ErrUnsupportedAddrType = errors.New("unsupported address type")
+	ErrUnexpectedVersion   = errors.New("socks5: unexpected version")
+	ErrNoAcceptableAuth    = errors.New("socks5: no acceptable authentication method")
+	ErrUnexpectedAuth      = errors.New("socks5: unexpected auth method")
+	ErrUsernameRequired    = errors.New("socks5: username required but not provided")
+	ErrAuthFailed          = errors.New("socks5: authentication failed")
+	ErrFragmented          = errors.New("socks5: fragmented UDP datagrams are not supported")
+	ErrDatagramTooLarge    = errors.New("datagram too large")
+	ErrTargetNotAllowed    = errors.New("target not allowed by policy")
+)
+
+// ReplyError is returned when the SOCKS5 proxy answers CONNECT with a failure code
+type ReplyError struct {
+	Code byte
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("socks5: connect failed with code %d: %s", e.Code, replyCodeToString(e.Code))
+}
+
+// ReplyCodeForError maps an error from this package or from dialing a
+// target to the SOCKS5 reply code a SOCKS5 server should send back for it
+func ReplyCodeForError(err error) byte {
+	var replyErr *ReplyError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ReplySuccess
+	case errors.As(err, &replyErr):
+		return replyErr.Code
+	case errors.Is(err, ErrUnsupportedAddrType), errors.Is(err, ErrDomainTooLong):
+		return ReplyAddressNotSupported
+	case errors.Is(err, ErrUnsupportedNetwork):
+		return ReplyCommandNotSupported
+	case errors.Is(err, ErrNoAcceptableAuth), errors.Is(err, ErrAuthFailed), errors.Is(err, ErrUsernameRequired),
+		errors.Is(err, ErrTargetNotAllowed):
+		return ReplyConnectionNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr), errors.As(err, &netErr) && netErr.Timeout():
+		// A name that doesn't resolve or a target that never answers is as good as unreachable
+		return ReplyHostUnreachable
+	default:
+		return ReplyGeneralFailure
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplyCodeForError(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	_, refused := net.Dial("tcp", closedAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, timedOut := (&net.Dialer{}).DialContext(ctx, "tcp", "192.0.2.1:443")
+
+	// A TLS handshake with a target that doesn't speak TLS
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	go func() {
+		if c, err := plain.Accept(); err == nil {
+			c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			c.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", plain.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsFailed := tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+	conn.Close()
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"nil", nil, ReplySuccess},
+		{"refused", refused, ReplyConnectionRefused},
+		{"timeout", timedOut, ReplyHostUnreachable},
+		{"no such host", &net.DNSError{Err: "no such host", Name: "nx.invalid", IsNotFound: true}, ReplyHostUnreachable},
+		{"policy", fmt.Errorf("target: %w", ErrTargetNotAllowed), ReplyConnectionNotAllowed},
+		{"upstream reply", &ReplyError{Code: ReplyTTLExpired}, ReplyTTLExpired},
+		{"tls handshake", tlsFailed, ReplyGeneralFailure},
+		{"other", errors.New("boom"), ReplyGeneralFailure},
+	} {
+		if tt.err == nil && tt.name != "nil" {
+			t.Fatalf("%s: no error to map", tt.name)
+		}
+		if got := ReplyCodeForError(tt.err); got != tt.want {
+			t.Errorf("%s (%v): got reply 0x%02x, want 0x%02x", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
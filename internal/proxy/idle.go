@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// IdleWatch tears down a tunneled connection once no data moved either way
+// for its timeout: a target gone half-open, or a peer that vanished without
+// a reset, would otherwise hold the stream and both sockets forever. Writes
+// through Writer count as activity. A nil *IdleWatch never expires.
+type IdleWatch struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the last write
+	expired atomic.Bool
+	timer   *time.Timer
+}
+
+// NewIdleWatch calls expire once nothing was written for timeout, or returns
+// nil if timeout <= 0. Stop it when the connection ends.
+func NewIdleWatch(timeout time.Duration, expire func()) *IdleWatch {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &IdleWatch{timeout: timeout}
+	w.last.Store(time.Now().UnixNano())
+	w.timer = time.AfterFunc(timeout, func() {
+		// Writes since the timer was armed push the deadline out instead
+		if idle := time.Since(time.Unix(0, w.last.Load())); idle < w.timeout {
+			w.timer.Reset(w.timeout - idle)
+			return
+		}
+		w.expired.Store(true)
+		expire()
+	})
+	return w
+}
+
+// Writer returns dst with every write counted as activity
+func (w *IdleWatch) Writer(dst io.Writer) io.Writer {
+	if w == nil {
+		return dst
+	}
+	return &idleWriter{w: dst, watch: w}
+}
+
+// Expired reports whether the watch tore the connection down
+func (w *IdleWatch) Expired() bool {
+	return w != nil && w.expired.Load()
+}
+
+// Stop disarms the watch
+func (w *IdleWatch) Stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+type idleWriter struct {
+	w     io.Writer
+	watch *IdleWatch
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	iw.watch.last.Store(time.Now().UnixNano())
+	return iw.w.Write(p)
+}
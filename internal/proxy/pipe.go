@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+)
+
+// How one direction of a pipe ended, as reported by Ending
+const (
+	EndingEOF     = "eof"
+	EndingReset   = "reset"
+	EndingTimeout = "timeout"
+	EndingIdle    = "idle"
+	EndingError   = "error"
+)
+
+// ErrHalfCloseUnsupported ends a direction whose destination can't be half-closed;
+// Pipe then tears down the whole connection as a full close would
+var ErrHalfCloseUnsupported = errors.New("destination does not support half-close")
+
+// ErrIdle stands for the errors of a pipe an IdleWatch tore down
+var ErrIdle = errors.New("no data moved for the idle timeout")
+
+// Ending classifies the error a pipe direction stopped with: a nil error or
+// io.EOF is a clean end of data, a reset covers TCP resets, broken pipes and
+// canceled QUIC streams or connections, and timeouts include QUIC idle
+// timeouts; ErrIdle is a stream that went idle (see IdleWatch)
+func Ending(err error) string {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, ErrHalfCloseUnsupported) {
+		return EndingEOF
+	}
+	if errors.Is(err, ErrIdle) {
+		return EndingIdle
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return EndingTimeout
+	}
+	var streamErr *quic.StreamError
+	var appErr *quic.ApplicationError
+	if errors.As(err, &streamErr) || errors.As(err, &appErr) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed) {
+		return EndingReset
+	}
+	return EndingError
+}
+
+// CloseWrite half-closes c, telling the peer no more data follows while data
+// keeps flowing the other way. It reports false if c can't half-close (only
+// TCP and TLS connections and the like can), in which case nothing is done.
+func CloseWrite(c any) bool {
+	hc, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+	hc.CloseWrite()
+	return true
+}
+
+// Pipe runs both directions of a tunneled connection and returns once both
+// have ended. up and down each copy one direction and, at a clean end of
+// data, half-close their destination (see CloseWrite) so the other direction
+// keeps flowing until its own source is done, instead of a full close
+// truncating it. When either returns an error, abort is called once to stop
+// the other direction too, except when up ends with ErrHalfCloseUnsupported:
+// the response may still be on its way, so down runs to its end first.
+func Pipe(up, down func() error, abort func()) (upErr, downErr error) {
+	upDone := make(chan error, 1)
+	downDone := make(chan error, 1)
+	go func() { upDone <- up() }()
+	go func() { downDone <- down() }()
+
+	aborted := false
+	for upDone != nil || downDone != nil {
+		var err error
+		select {
+		case upErr = <-upDone:
+			err, upDone = upErr, nil
+			if errors.Is(err, ErrHalfCloseUnsupported) {
+				err = nil
+			}
+		case downErr = <-downDone:
+			err, downDone = downErr, nil
+		}
+		if err != nil && !aborted {
+			aborted = true
+			abort()
+		}
+	}
+	return upErr, downErr
+}
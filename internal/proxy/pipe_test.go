@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { dialed.Close(); remote.Close() })
+	return dialed.(*net.TCPConn), remote.(*net.TCPConn)
+}
+
+// noHalfClose hides CloseWrite, like a destination that can't half-close
+type noHalfClose struct{ net.Conn }
+
+// pipeBetween relays app <-> dest the way the mains do and returns Pipe's result
+func pipeBetween(app net.Conn, dest net.Conn) (upErr, downErr error) {
+	return Pipe(func() error {
+		if _, err := io.Copy(dest, app); err != nil {
+			return err
+		}
+		if !CloseWrite(dest) {
+			return ErrHalfCloseUnsupported
+		}
+		return nil
+	}, func() error {
+		if _, err := io.Copy(app, dest); err != nil {
+			return err
+		}
+		CloseWrite(app)
+		return nil
+	}, func() {
+		app.Close()
+		dest.Close()
+	})
+}
+
+// serveSlowly reads a request to EOF (or for a moment if the request never
+// ends), then writes response in pieces with pauses, like a download that
+// outlives the upload
+func serveSlowly(conn net.Conn, response []byte, waitForEOF bool) {
+	if waitForEOF {
+		io.Copy(io.Discard, conn)
+	} else {
+		conn.Read(make([]byte, 64))
+	}
+	for len(response) > 0 {
+		n := min(len(response), 16*1024)
+		conn.Write(response[:n])
+		response = response[n:]
+		time.Sleep(5 * time.Millisecond)
+	}
+	conn.Close()
+}
+
+func TestPipeDoesNotTruncateDownload(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		halfClose bool
+	}{
+		{"half-close", true},
+		{"no half-close", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			app, appProxy := tcpPair(t)
+			destProxy, dest := tcpPair(t)
+			response := make([]byte, 512*1024)
+			rand.Read(response)
+			go serveSlowly(dest, response, tt.halfClose)
+
+			var proxyDest net.Conn = destProxy
+			if !tt.halfClose {
+				proxyDest = noHalfClose{destProxy}
+			}
+			type result struct{ up, down error }
+			done := make(chan result, 1)
+			go func() {
+				up, down := pipeBetween(appProxy, proxyDest)
+				done <- result{up, down}
+			}()
+
+			// The app sends its request and is done sending at once
+			app.Write([]byte("GET /big"))
+			app.CloseWrite()
+			app.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got, err := io.ReadAll(app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, response) {
+				t.Fatalf("app got %d of %d response bytes", len(got), len(response))
+			}
+
+			r := <-done
+			if r.down != nil {
+				t.Errorf("download ended with %v", r.down)
+			}
+			switch {
+			case tt.halfClose && r.up != nil:
+				t.Errorf("upload ended with %v", r.up)
+			case !tt.halfClose && !errors.Is(r.up, ErrHalfCloseUnsupported):
+				t.Errorf("upload ended with %v, want ErrHalfCloseUnsupported", r.up)
+			}
+		})
+	}
+}
+
+func TestPipeAbortsOnError(t *testing.T) {
+	aborted := make(chan struct{})
+	failure := errors.New("target reset")
+	upErr, downErr := Pipe(func() error {
+		return failure
+	}, func() error {
+		<-aborted
+		return net.ErrClosed
+	}, func() { close(aborted) })
+	if upErr != failure || !errors.Is(downErr, net.ErrClosed) {
+		t.Errorf("got %v, %v; want the failure and the aborted direction's error", upErr, downErr)
+	}
+}
+
+// slowTunnel accepts writes into a queue that drains at a fixed pace and
+// records the largest queue it saw when a write arrived
+type slowTunnel struct {
+	bytes.Buffer
+	queued  atomic.Int64
+	maxSeen atomic.Int64
+}
+
+func (s *slowTunnel) Write(p []byte) (int, error) {
+	q := s.queued.Load()
+	if q > s.maxSeen.Load() {
+		s.maxSeen.Store(q)
+	}
+	s.queued.Add(int64(len(p)))
+	return s.Buffer.Write(p)
+}
+
+func (s *slowTunnel) drain(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(2 * time.Millisecond):
+		}
+		if s.queued.Add(-4096) < 0 {
+			s.queued.Store(0)
+		}
+	}
+}
+
+func TestWindowedCopyWaitsForBacklog(t *testing.T) {
+	const window = 32 * 1024
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	tunnel := &slowTunnel{}
+	stop := make(chan struct{})
+	defer close(stop)
+	go tunnel.drain(stop)
+
+	n, err := WindowedCopy(tunnel, bytes.NewReader(data), window, func() int { return int(tunnel.queued.Load()) })
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d of %d bytes: %v", n, len(data), err)
+	}
+	if !bytes.Equal(tunnel.Bytes(), data) {
+		t.Fatal("copy corrupted the data")
+	}
+	if got := tunnel.maxSeen.Load(); got > window {
+		t.Errorf("wrote with %d bytes queued, window is %d", got, window)
+	}
+}
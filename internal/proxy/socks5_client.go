@@ -2,11 +2,12 @@ package proxy
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
+	"strings"
 )
 
 // SOCKS5 constants per RFC 1928
@@ -62,7 +63,7 @@ func NewSOCKS5DialerWithAuth(proxyAddr, username, password string) *SOCKS5Dialer
 // Dial connects to the target address through the SOCKS5 proxy
 func (d *SOCKS5Dialer) Dial(network, addr string) (net.Conn, error) {
 	if network != "tcp" && network != "tcp4" && network != "tcp6" {
-		return nil, errors.New("socks5: only TCP is supported")
+		return nil, ErrUnsupportedNetwork
 	}
 
 	// Connect to proxy
@@ -112,7 +113,7 @@ func (d *SOCKS5Dialer) handshake(conn net.Conn) error {
 	}
 
 	if resp[0] != SOCKS5Version {
-		return fmt.Errorf("socks5: unexpected version %d", resp[0])
+		return fmt.Errorf("%w %d", ErrUnexpectedVersion, resp[0])
 	}
 
 	switch resp[1] {
@@ -121,16 +122,16 @@ func (d *SOCKS5Dialer) handshake(conn net.Conn) error {
 	case AuthUserPassword:
 		return d.authenticateUserPassword(conn)
 	case AuthNoAcceptable:
-		return errors.New("socks5: no acceptable authentication method")
+		return ErrNoAcceptableAuth
 	default:
-		return fmt.Errorf("socks5: unexpected auth method %d", resp[1])
+		return fmt.Errorf("%w %d", ErrUnexpectedAuth, resp[1])
 	}
 }
 
 // authenticateUserPassword performs username/password authentication (RFC 1929)
 func (d *SOCKS5Dialer) authenticateUserPassword(conn net.Conn) error {
 	if d.Username == "" {
-		return errors.New("socks5: username required but not provided")
+		return ErrUsernameRequired
 	}
 
 	// Auth request: version, ulen, username, plen, password
@@ -152,7 +153,7 @@ func (d *SOCKS5Dialer) authenticateUserPassword(conn net.Conn) error {
 	}
 
 	if resp[1] != 0x00 {
-		return errors.New("socks5: authentication failed")
+		return ErrAuthFailed
 	}
 
 	return nil
@@ -162,33 +163,24 @@ func (d *SOCKS5Dialer) authenticateUserPassword(conn net.Conn) error {
 func (d *SOCKS5Dialer) connect(conn net.Conn, addr string) error {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return fmt.Errorf("socks5: invalid address: %w", err)
+		return fmt.Errorf("socks5: %w: %w", ErrInvalidAddress, err)
 	}
 
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("socks5: invalid port: %w", err)
+		return fmt.Errorf("socks5: %w: %w", ErrInvalidPort, err)
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("socks5: %w: %d", ErrInvalidPort, port)
 	}
 
 	// Build CONNECT request
 	req := []byte{SOCKS5Version, CmdConnect, 0x00} // version, cmd, reserved
 
 	// Append address
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			req = append(req, AddrTypeIPv4)
-			req = append(req, ip4...)
-		} else {
-			req = append(req, AddrTypeIPv6)
-			req = append(req, ip...)
-		}
-	} else {
-		// Domain name
-		if len(host) > 255 {
-			return errors.New("socks5: domain name too long")
-		}
-		req = append(req, AddrTypeDomain, byte(len(host)))
-		req = append(req, host...)
+	req, err = appendHost(req, host)
+	if err != nil {
+		return fmt.Errorf("socks5: %w", err)
 	}
 
 	// Append port (big endian)
@@ -205,11 +197,11 @@ func (d *SOCKS5Dialer) connect(conn net.Conn, addr string) error {
 	}
 
 	if resp[0] != SOCKS5Version {
-		return fmt.Errorf("socks5: unexpected version %d in response", resp[0])
+		return fmt.Errorf("%w %d in response", ErrUnexpectedVersion, resp[0])
 	}
 
 	if resp[1] != ReplySuccess {
-		return fmt.Errorf("socks5: connect failed with code %d: %s", resp[1], replyCodeToString(resp[1]))
+		return &ReplyError{Code: resp[1]}
 	}
 
 	// Read and discard bound address (we don't need it)
@@ -260,89 +252,183 @@ func replyCodeToString(code byte) string {
 	}
 }
 
+// TargetFlagSNI is set in the address type byte of a target header when a
+// [1 byte len][name] TLS server name follows the port. The server then speaks
+// TLS to the target presenting that name, and the stream carries plaintext.
+// Headers without flags keep the original format, so older clients still work.
+const TargetFlagSNI = 0x80
+
+// TargetFlagDeferStatus is set in the address type byte when the client does
+// not wait for the status byte before sending data (fast connect): the server
+// then sends its success status in front of the target's first bytes rather
+// than in a packet of its own. Only servers advertising
+// protocol.CapDeferStatus accept it.
+const TargetFlagDeferStatus = 0x40
+
+// TargetFlagUDP is set in the address type byte to open a UDP association
+// (SOCKS5 UDP ASSOCIATE) rather than a TCP connection: after the status byte
+// the stream carries datagram frames both ways (see WriteDatagram), each
+// naming its own destination, so the header's address is not dialed. Only
+// servers advertising protocol.CapUDP accept it.
+const TargetFlagUDP = 0x20
+
+// targetFlagMask covers the address type bits reserved for flags
+const targetFlagMask = 0xF0
+
+// Target is a tunnel destination with an optional TLS server name override
+type Target struct {
+	Addr string // host:port to connect to
+	SNI  string // if set, the server originates TLS to Addr presenting this name
+	// DeferStatus asks the server to send the success status with the first downstream data
+	DeferStatus bool
+	// UDP opens a UDP association; Addr is then only the client's source hint
+	UDP bool
+}
+
 // ParseTargetAddress parses a SOCKS5-style address from a reader
 // Format: [1 byte type][address][2 bytes port BE]
+// A TLS name override, if present, is discarded; use ParseTarget to get it.
 func ParseTargetAddress(r io.Reader) (string, error) {
+	t, err := ParseTarget(r)
+	return t.Addr, err
+}
+
+// ParseTarget parses a target header written by WriteTarget
+func ParseTarget(r io.Reader) (Target, error) {
 	typeBuf := make([]byte, 1)
 	if _, err := io.ReadFull(r, typeBuf); err != nil {
-		return "", fmt.Errorf("read address type: %w", err)
+		return Target{}, fmt.Errorf("read address type: %w", err)
+	}
+	flags := typeBuf[0] & targetFlagMask
+	if flags&^(TargetFlagSNI|TargetFlagDeferStatus|TargetFlagUDP) != 0 {
+		return Target{}, fmt.Errorf("%w: %d", ErrUnsupportedAddrType, typeBuf[0])
 	}
 
 	var host string
-	switch typeBuf[0] {
+	switch typeBuf[0] &^ targetFlagMask {
 	case AddrTypeIPv4:
 		ipBuf := make([]byte, 4)
 		if _, err := io.ReadFull(r, ipBuf); err != nil {
-			return "", fmt.Errorf("read IPv4: %w", err)
+			return Target{}, fmt.Errorf("read IPv4: %w", err)
 		}
 		host = net.IP(ipBuf).String()
 
 	case AddrTypeDomain:
 		lenBuf := make([]byte, 1)
 		if _, err := io.ReadFull(r, lenBuf); err != nil {
-			return "", fmt.Errorf("read domain length: %w", err)
+			return Target{}, fmt.Errorf("read domain length: %w", err)
 		}
 		domainBuf := make([]byte, lenBuf[0])
 		if _, err := io.ReadFull(r, domainBuf); err != nil {
-			return "", fmt.Errorf("read domain: %w", err)
+			return Target{}, fmt.Errorf("read domain: %w", err)
 		}
 		host = string(domainBuf)
 
 	case AddrTypeIPv6:
 		ipBuf := make([]byte, 16)
 		if _, err := io.ReadFull(r, ipBuf); err != nil {
-			return "", fmt.Errorf("read IPv6: %w", err)
+			return Target{}, fmt.Errorf("read IPv6: %w", err)
 		}
-		host = net.IP(ipBuf).String()
+		host = netip.AddrFrom16([16]byte(ipBuf)).String()
 
 	default:
-		return "", fmt.Errorf("unknown address type: %d", typeBuf[0])
+		return Target{}, fmt.Errorf("%w: %d", ErrUnsupportedAddrType, typeBuf[0])
 	}
 
 	portBuf := make([]byte, 2)
 	if _, err := io.ReadFull(r, portBuf); err != nil {
-		return "", fmt.Errorf("read port: %w", err)
+		return Target{}, fmt.Errorf("read port: %w", err)
 	}
 	port := binary.BigEndian.Uint16(portBuf)
+	t := Target{Addr: net.JoinHostPort(host, strconv.Itoa(int(port))), DeferStatus: flags&TargetFlagDeferStatus != 0, UDP: flags&TargetFlagUDP != 0}
 
-	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+	if flags&TargetFlagSNI != 0 {
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return Target{}, fmt.Errorf("read SNI length: %w", err)
+		}
+		sniBuf := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(r, sniBuf); err != nil {
+			return Target{}, fmt.Errorf("read SNI: %w", err)
+		}
+		t.SNI = string(sniBuf)
+	}
+	return t, nil
 }
 
 // WriteTargetAddress writes a target address in SOCKS5 format
 // Format: [1 byte type][address][2 bytes port BE]
 func WriteTargetAddress(w io.Writer, addr string) error {
-	host, portStr, err := net.SplitHostPort(addr)
+	return WriteTarget(w, Target{Addr: addr})
+}
+
+// WriteTarget writes a target header; with t.SNI set the type byte carries
+// TargetFlagSNI and the name follows the port, with t.DeferStatus it carries
+// TargetFlagDeferStatus and with t.UDP TargetFlagUDP
+func WriteTarget(w io.Writer, t Target) error {
+	host, portStr, err := net.SplitHostPort(t.Addr)
 	if err != nil {
-		return fmt.Errorf("parse address: %w", err)
+		return fmt.Errorf("%w: %w", ErrInvalidAddress, err)
 	}
 
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("parse port: %w", err)
+		return fmt.Errorf("%w: %w", ErrInvalidPort, err)
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("%w: %d", ErrInvalidPort, port)
 	}
 
-	var buf []byte
-
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			buf = append(buf, AddrTypeIPv4)
-			buf = append(buf, ip4...)
-		} else {
-			buf = append(buf, AddrTypeIPv6)
-			buf = append(buf, ip...)
-		}
-	} else {
-		// Domain name
-		if len(host) > 255 {
-			return errors.New("domain name too long")
-		}
-		buf = append(buf, AddrTypeDomain, byte(len(host)))
-		buf = append(buf, host...)
+	buf, err := appendHost(nil, host)
+	if err != nil {
+		return err
 	}
 
 	// Port in big endian
 	buf = append(buf, byte(port>>8), byte(port))
 
+	if t.SNI != "" {
+		if len(t.SNI) > 255 {
+			return ErrDomainTooLong
+		}
+		buf[0] |= TargetFlagSNI
+		buf = append(buf, byte(len(t.SNI)))
+		buf = append(buf, t.SNI...)
+	}
+	if t.DeferStatus {
+		buf[0] |= TargetFlagDeferStatus
+	}
+	if t.UDP {
+		buf[0] |= TargetFlagUDP
+	}
+
 	_, err = w.Write(buf)
 	return err
 }
+
+// appendHost appends host as a SOCKS5 address type and address. IP literals
+// go as IPv4 or IPv6 exactly as written, so an IPv4-mapped IPv6 address stays
+// IPv6 and ParseTarget renders the same text back; anything else is a domain.
+// A zone names an interface on this machine and means nothing to the peer.
+func appendHost(buf []byte, host string) ([]byte, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Zone() != "" {
+			return nil, fmt.Errorf("%w: zoned IPv6 address %s", ErrInvalidAddress, host)
+		}
+		if ip.Is4() {
+			a := ip.As4()
+			return append(append(buf, AddrTypeIPv4), a[:]...), nil
+		}
+		a := ip.As16()
+		return append(append(buf, AddrTypeIPv6), a[:]...), nil
+	}
+	if strings.Contains(host, ":") {
+		// A colon never appears in a domain; this is a malformed IPv6 literal
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, host)
+	}
+	if len(host) > 255 {
+		return nil, ErrDomainTooLong
+	}
+	buf = append(buf, AddrTypeDomain, byte(len(host)))
+	return append(buf, host...), nil
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTargetAddressRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		addr string
+		want string // "" = addr itself
+		typ  byte
+	}{
+		{"compressed IPv6", "[2606:4700:4700::1111]:443", "", AddrTypeIPv6},
+		{"expanded IPv6", "[2606:4700:4700:0:0:0:0:1111]:443", "[2606:4700:4700::1111]:443", AddrTypeIPv6},
+		{"loopback IPv6", "[::1]:8080", "", AddrTypeIPv6},
+		{"IPv4-mapped IPv6", "[::ffff:192.0.2.1]:443", "", AddrTypeIPv6},
+		{"IPv4", "192.0.2.1:80", "", AddrTypeIPv4},
+		{"domain", "example.com:443", "", AddrTypeDomain},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteTargetAddress(&buf, tt.addr); err != nil {
+				t.Fatal(err)
+			}
+			if typ := buf.Bytes()[0]; typ != tt.typ {
+				t.Errorf("address type %d, want %d", typ, tt.typ)
+			}
+			got, err := ParseTarget(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.addr
+			}
+			if got.Addr != want {
+				t.Errorf("got %s back, want %s", got.Addr, want)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left after the header", buf.Len())
+			}
+
+			WriteTargetAddress(&buf, tt.addr)
+			if addr, err := ParseTargetAddress(&buf); err != nil || addr != want {
+				t.Errorf("ParseTargetAddress: got %s, %v; want %s", addr, err, want)
+			}
+		})
+	}
+
+	// A zone only means something on the machine that wrote it
+	if err := WriteTargetAddress(io.Discard, "[fe80::1%eth0]:443"); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("zoned IPv6: got %v, want ErrInvalidAddress", err)
+	}
+}
+
+func TestSOCKS5ConnectIPv6(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	defer proxy.Close()
+
+	requests := make(chan []byte, 1)
+	go func() {
+		// version, command, reserved, type, 16-byte address, port
+		req := make([]byte, 4+16+2)
+		if _, err := io.ReadFull(proxy, req); err != nil {
+			close(requests)
+			return
+		}
+		requests <- req
+		proxy.Write([]byte{SOCKS5Version, ReplySuccess, 0x00, AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	}()
+
+	d := NewSOCKS5Dialer("unused:1080")
+	if err := d.connect(client, "[2606:4700:4700::1111]:443"); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{SOCKS5Version, CmdConnect, 0x00, AddrTypeIPv6},
+		0x26, 0x06, 0x47, 0x00, 0x47, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x11, 0x11, 0x01, 0xBB)
+	if got := <-requests; !bytes.Equal(got, want) {
+		t.Errorf("CONNECT request %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import "io"
+
+// DeferredStatusWriter writes the 0x00 success status in front of the first
+// data written to W, so a stream opened with TargetFlagDeferStatus gets the
+// status and the target's first bytes in one write
+type DeferredStatusWriter struct {
+	W    io.Writer
+	sent bool
+}
+
+func (d *DeferredStatusWriter) Write(p []byte) (int, error) {
+	if d.sent {
+		return d.W.Write(p)
+	}
+	d.sent = true
+	buf := make([]byte, 0, 1+len(p))
+	buf = append(buf, 0x00)
+	buf = append(buf, p...)
+	n, err := d.W.Write(buf)
+	return max(n-1, 0), err
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// UDP associations ride on one tunnel stream opened with TargetFlagUDP. The
+// stream is a byte pipe, so every datagram travels as a frame:
+//
+//	[len:2][address type][address][port:2][payload]
+//
+// where len covers everything after itself and the address is in target
+// header format (without flags). Upstream it names the destination, downstream
+// the source the datagram came from.
+
+// WriteDatagram writes one datagram frame in a single write
+func WriteDatagram(w io.Writer, addr string, payload []byte) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0})
+	if err := WriteTargetAddress(&buf, addr); err != nil {
+		return err
+	}
+	buf.Write(payload)
+	frame := buf.Bytes()
+	if len(frame)-2 > 0xFFFF {
+		return fmt.Errorf("%w: %d bytes", ErrDatagramTooLarge, len(payload))
+	}
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a frame written by WriteDatagram
+func ReadDatagram(r io.Reader) (addr string, payload []byte, err error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return "", nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return "", nil, fmt.Errorf("read datagram: %w", err)
+	}
+	return splitAddress(frame)
+}
+
+// ParseUDPRequest splits a SOCKS5 UDP request (RFC 1928 section 7),
+// [RSV:2][FRAG:1][address][payload], into its destination and payload.
+// Fragmented datagrams return ErrFragmented.
+func ParseUDPRequest(packet []byte) (addr string, payload []byte, err error) {
+	if len(packet) < 4 {
+		return "", nil, fmt.Errorf("%w: short UDP request", ErrInvalidAddress)
+	}
+	if packet[2] != 0 {
+		return "", nil, ErrFragmented
+	}
+	return splitAddress(packet[3:])
+}
+
+// BuildUDPRequest wraps payload in a SOCKS5 UDP request header naming addr
+func BuildUDPRequest(addr string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0})
+	if err := WriteTargetAddress(&buf, addr); err != nil {
+		return nil, err
+	}
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// splitAddress parses the flagless address at the start of b and returns the rest
+func splitAddress(b []byte) (string, []byte, error) {
+	if len(b) == 0 || b[0]&targetFlagMask != 0 {
+		return "", nil, fmt.Errorf("%w in datagram", ErrUnsupportedAddrType)
+	}
+	r := bytes.NewReader(b)
+	addr, err := ParseTargetAddress(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
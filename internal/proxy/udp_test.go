@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	datagrams := []struct {
+		addr    string
+		payload []byte
+	}{
+		{"192.0.2.1:53", []byte("query")},
+		{"[2001:db8::1]:443", bytes.Repeat([]byte{0xAB}, 1200)},
+		{"example.com:123", nil},
+	}
+	for _, d := range datagrams {
+		if err := WriteDatagram(&stream, d.addr, d.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Frames follow each other on the stream without any other delimiting
+	for _, d := range datagrams {
+		addr, payload, err := ReadDatagram(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != d.addr || !bytes.Equal(payload, d.payload) {
+			t.Errorf("got %s with %d bytes, want %s with %d", addr, len(payload), d.addr, len(d.payload))
+		}
+	}
+	if _, _, err := ReadDatagram(&stream); err != io.EOF {
+		t.Errorf("read past the last frame: %v, want EOF", err)
+	}
+
+	// A frame cut short is an error, not a clean end of the association
+	WriteDatagram(&stream, "192.0.2.1:53", []byte("query"))
+	stream.Truncate(stream.Len() - 1)
+	if _, _, err := ReadDatagram(&stream); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated frame: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	if err := WriteDatagram(io.Discard, "192.0.2.1:53", make([]byte, 0xFFFF)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("oversized payload: got %v, want ErrDatagramTooLarge", err)
+	}
+}
+
+func TestUDPRequestRoundTrip(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:53", "[2001:db8::1]:443", "example.com:123"} {
+		packet, err := BuildUDPRequest(addr, []byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packet[:3], []byte{0, 0, 0}) {
+			t.Errorf("%s: header starts % x, want RSV and FRAG zero", addr, packet[:3])
+		}
+		got, payload, err := ParseUDPRequest(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != addr || string(payload) != "payload" {
+			t.Errorf("got %s %q back, want %s %q", got, payload, addr, "payload")
+		}
+	}
+
+	packet, _ := BuildUDPRequest("192.0.2.1:53", []byte("payload"))
+	packet[2] = 1
+	if _, _, err := ParseUDPRequest(packet); !errors.Is(err, ErrFragmented) {
+		t.Errorf("FRAG 1: got %v, want ErrFragmented", err)
+	}
+	if _, _, err := ParseUDPRequest([]byte{0, 0, 0}); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("short request: got %v, want ErrInvalidAddress", err)
+	}
+	// The target header's flag bits have no place in a datagram address
+	packet, _ = BuildUDPRequest("192.0.2.1:53", nil)
+	packet[3] |= TargetFlagUDP
+	if _, _, err := ParseUDPRequest(packet); !errors.Is(err, ErrUnsupportedAddrType) {
+		t.Errorf("flagged address type: got %v, want ErrUnsupportedAddrType", err)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// DefaultStreamWindow is how many bytes the tunnel may hold queued before copies pause
+	DefaultStreamWindow = 64 * 1024
+	// windowCopyBuffer is the single buffer a windowed copy reads into
+	windowCopyBuffer = 16 * 1024
+	// windowPollInterval is how often a paused copy rechecks the backlog
+	windowPollInterval = 5 * time.Millisecond
+	// windowMaxWait bounds a single pause so a stalled tunnel surfaces as a write error
+	windowMaxWait = time.Second
+)
+
+// WindowedCopy copies src to dst like io.Copy, but reads through one fixed
+// buffer and, before every write, waits while backlog reports more than
+// window bytes accepted by the tunnel and not yet shipped. A fast local
+// producer thus runs at most about window bytes ahead of the DNS transport
+// instead of piling data up in QUIC and transport queues. A nil backlog or a
+// window <= 0 only bounds the buffer.
+func WindowedCopy(dst io.Writer, src io.Reader, window int, backlog func() int) (int64, error) {
+	buf := make([]byte, windowCopyBuffer)
+	var written int64
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if backlog != nil && window > 0 {
+				waitForWindow(window, backlog)
+			}
+			wn, werr := dst.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
+			}
+			if wn != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+func waitForWindow(window int, backlog func() int) {
+	deadline := time.Now().Add(windowMaxWait)
+	for backlog() > window && time.Now().Before(deadline) {
+		time.Sleep(windowPollInterval)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+
+	"slipstream-go/internal/crypto"
+)
+
+// CertSelector picks the TLS certificate for a QUIC handshake by the tunnel
+// domain of the connecting session. QUIC-in-DNS carries no SNI, but quic-go
+// hands GetCertificate the connection's remote address, which is the
+// SessionAddr of a session that the DNS handler has already tied to the
+// domain its queries arrived on.
+//
+// The maps are fixed at startup, but each certificate can be rotated in place
+// (see crypto.CertSet): new handshakes and key exchanges get the new key while
+// established connections keep the old one.
+type CertSelector struct {
+	Sessions *SessionManager
+	// ByDomain maps a lowercase tunnel domain to its certificate
+	ByDomain map[string]*crypto.CertSet
+	// Default serves domains without their own certificate; may be nil
+	Default *crypto.CertSet
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cs *CertSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.Conn != nil {
+		if sess := cs.Sessions.Get(hello.Conn.RemoteAddr().String()); sess != nil {
+			if certs, ok := cs.ByDomain[sess.Domain()]; ok {
+				return certs.Certificate(), nil
+			}
+		}
+	}
+	if cs.Default == nil {
+		return nil, errors.New("no certificate for this session's domain")
+	}
+	return cs.Default.Certificate(), nil
+}
+
+// IdentityKey returns the private key currently behind the certificate of
+// domain (or the default one), nil if there is none
+func (cs *CertSelector) IdentityKey(domain string) ed25519.PrivateKey {
+	certs, ok := cs.ByDomain[domain]
+	if !ok {
+		certs = cs.Default
+	}
+	if certs == nil {
+		return nil
+	}
+	return certs.PrivateKey()
+}
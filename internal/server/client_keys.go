@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"slipstream-go/internal/crypto"
+)
+
+// ClientKeys is an allowlist of per-client pre-shared keys. A client passes
+// its own key as --psk and proves it with the usual session token (see
+// crypto.SessionLabel), so the label carries no client name: the token's key
+// ID (crypto.SessionKeyID) narrows the search to the keys sharing it, usually
+// one. Every query is verified, so once a line is removed from the file and
+// the keys are replaced (see Replace), that client's next query is refused.
+type ClientKeys struct {
+	table atomic.Pointer[clientKeyTable]
+}
+
+type clientKeyTable struct {
+	keys []clientKey
+	// byID maps a key ID to the indexes of the keys that have it
+	byID map[uint16][]int
+}
+
+type clientKey struct {
+	name string
+	key  []byte
+}
+
+// LoadClientKeys reads a --client-keys file: one "NAME KEY" pair per line,
+// blank lines and lines starting with # ignored
+func LoadClientKeys(path string) (*ClientKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := &clientKeyTable{byID: make(map[uint16][]int)}
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want NAME KEY", path, line)
+		}
+		if names[fields[0]] {
+			return nil, fmt.Errorf("%s:%d: duplicate client name %q", path, line, fields[0])
+		}
+		names[fields[0]] = true
+		key := []byte(fields[1])
+		id := crypto.SessionKeyID(key)
+		table.byID[id] = append(table.byID[id], len(table.keys))
+		table.keys = append(table.keys, clientKey{name: fields[0], key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(table.keys) == 0 {
+		return nil, fmt.Errorf("%s: no client keys", path)
+	}
+	k := &ClientKeys{}
+	k.table.Store(table)
+	return k, nil
+}
+
+// Replace atomically switches to the keys of next, e.g. the file loaded again
+func (k *ClientKeys) Replace(next *ClientKeys) {
+	k.table.Store(next.table.Load())
+}
+
+// Len returns the number of client keys
+func (k *ClientKeys) Len() int {
+	return len(k.table.Load().keys)
+}
+
+// Verify checks a session token against the client keys with its key ID and
+// returns the name of the client whose key matches and the token's query counter
+func (k *ClientKeys) Verify(sessionID, token string, now time.Time) (string, uint32, bool) {
+	id, ok := crypto.SessionTokenKeyID(token)
+	if !ok {
+		return "", 0, false
+	}
+	table := k.table.Load()
+	for _, i := range table.byID[id] {
+		if counter, ok := crypto.VerifySessionToken(table.keys[i].key, sessionID, token, now); ok {
+			return table.keys[i].name, counter, true
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"slipstream-go/internal/crypto"
+)
+
+// writeClientKeys writes a --client-keys file and returns its path
+func writeClientKeys(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clients.keys")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClientKeysVerify(t *testing.T) {
+	keys, err := LoadClientKeys(writeClientKeys(t, "# team\nalice key-a\n\nbob key-b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Len() != 2 {
+		t.Fatalf("loaded %d keys, want 2", keys.Len())
+	}
+	now := time.Now()
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"key-a", "alice"},
+		{"key-b", "bob"},
+		{"key-c", ""},
+	} {
+		token := crypto.SessionToken([]byte(tt.key), testSession, 7, now)
+		name, counter, ok := keys.Verify(testSession, token, now)
+		if name != tt.want || ok != (tt.want != "") {
+			t.Errorf("token of %s: got %q, %v; want %q", tt.key, name, ok, tt.want)
+		}
+		if ok && counter != 7 {
+			t.Errorf("token of %s: counter %d, want 7", tt.key, counter)
+		}
+	}
+	if _, _, ok := keys.Verify(testSession, "not-a-token", now); ok {
+		t.Error("accepted a malformed token")
+	}
+}
+
+func TestClientKeysSharedKeyID(t *testing.T) {
+	// Key IDs are 16 bits: find two keys that share one
+	byID := make(map[uint16]string)
+	var first, second string
+	for i := 0; second == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		id := crypto.SessionKeyID([]byte(key))
+		if other, ok := byID[id]; ok {
+			first, second = other, key
+		}
+		byID[id] = key
+	}
+	keys, err := LoadClientKeys(writeClientKeys(t, "one "+first+"\ntwo "+second+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for key, want := range map[string]string{first: "one", second: "two"} {
+		token := crypto.SessionToken([]byte(key), testSession, 1, now)
+		if name, _, ok := keys.Verify(testSession, token, now); !ok || name != want {
+			t.Errorf("token of %s: got %q, %v; want %q", key, name, ok, want)
+		}
+	}
+}
+
+func TestClientKeysReplace(t *testing.T) {
+	keys, err := LoadClientKeys(writeClientKeys(t, "alice key-a\nbob key-b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := LoadClientKeys(writeClientKeys(t, "alice key-a\ncarol key-c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Replace(next)
+
+	now := time.Now()
+	for key, want := range map[string]bool{"key-a": true, "key-b": false, "key-c": true} {
+		token := crypto.SessionToken([]byte(key), testSession, 1, now)
+		if _, _, ok := keys.Verify(testSession, token, now); ok != want {
+			t.Errorf("token of %s accepted: %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestLoadClientKeysErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing key":    "alice\n",
+		"duplicate name": "alice key-a\nalice key-b\n",
+		"empty":          "# nobody yet\n",
+	} {
+		if _, err := LoadClientKeys(writeClientKeys(t, content)); err == nil {
+			t.Errorf("%s: loaded without error", name)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"slipstream-go/internal/protocol"
+)
+
+// cookieSecret keys the server cookies of one server run
+type cookieSecret [32]byte
+
+func newCookieSecret() *cookieSecret {
+	var s cookieSecret
+	cryptorand.Read(s[:])
+	return &s
+}
+
+// serverCookie returns the 16-byte server cookie for a client cookie and
+// source IP, laid out as in RFC 9018 (version 1, reserved, timestamp, hash)
+// but hashed with HMAC-SHA256 rather than SipHash
+func (s *cookieSecret) serverCookie(client []byte, ip string, now time.Time) []byte {
+	cookie := make([]byte, 8, 16)
+	cookie[0] = 1
+	binary.BigEndian.PutUint32(cookie[4:], uint32(now.Unix()))
+	mac := hmac.New(sha256.New, s[:])
+	mac.Write(client)
+	mac.Write(cookie)
+	mac.Write([]byte(ip))
+	return mac.Sum(cookie)[:16]
+}
+
+// echoCookie adds to opt the COOKIE option answering the one in reqOpt (RFC
+// 7873): the client cookie followed by a fresh server cookie. Requests
+// without a well-formed cookie get none.
+func (s *cookieSecret) echoCookie(reqOpt, opt *dns.OPT, from net.Addr) {
+	for _, o := range reqOpt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		cookie, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(cookie) != protocol.ClientCookieLen &&
+			(len(cookie) < protocol.ClientCookieLen+protocol.MinServerCookieLen || len(cookie) > protocol.ClientCookieLen+protocol.MaxServerCookieLen) {
+			return
+		}
+		client := cookie[:protocol.ClientCookieLen]
+		server := s.serverCookie(client, sourceIP(from), time.Now())
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(client) + hex.EncodeToString(server),
+		})
+		return
+	}
+}
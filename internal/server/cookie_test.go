@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"slipstream-go/internal/protocol"
+)
+
+// echoedCookie returns the cookie s answers a request cookie (hex) from source with, "" if none
+func echoedCookie(s *cookieSecret, cookie string, source net.Addr) string {
+	reqOpt := &dns.OPT{Option: []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}}}
+	opt := &dns.OPT{}
+	s.echoCookie(reqOpt, opt, source)
+	if len(opt.Option) == 0 {
+		return ""
+	}
+	return opt.Option[0].(*dns.EDNS0_COOKIE).Cookie
+}
+
+func TestEchoCookie(t *testing.T) {
+	s := newCookieSecret()
+	client := strings.Repeat("c1", protocol.ClientCookieLen)
+
+	// A client cookie alone or with a server cookie of 8 to 32 bytes is answered
+	// with the client cookie and a fresh 16-byte server cookie
+	for _, server := range []int{0, protocol.MinServerCookieLen, 16, protocol.MaxServerCookieLen} {
+		got := echoedCookie(s, client+strings.Repeat("5a", server), testSource)
+		if len(got) != 2*(protocol.ClientCookieLen+16) || !strings.HasPrefix(got, client) {
+			t.Errorf("with a %d byte server cookie: echoed %q", server, got)
+		}
+	}
+
+	// Malformed cookies get none
+	for _, cookie := range []string{
+		"",
+		strings.Repeat("c1", protocol.ClientCookieLen-1),
+		client + strings.Repeat("5a", protocol.MinServerCookieLen-1),
+		client + strings.Repeat("5a", protocol.MaxServerCookieLen+1),
+		client[:15] + "zz",
+	} {
+		if got := echoedCookie(s, cookie, testSource); got != "" {
+			t.Errorf("%q: echoed %q", cookie, got)
+		}
+	}
+
+	// The server cookie is bound to the client cookie and source address
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+	first, _ := hex.DecodeString(echoedCookie(s, client, testSource))
+	fromOther, _ := hex.DecodeString(echoedCookie(s, client, other))
+	if bytes.Equal(first[protocol.ClientCookieLen+8:], fromOther[protocol.ClientCookieLen+8:]) {
+		t.Error("same server cookie for two sources")
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"slipstream-go/internal/protocol"
+)
+
+// creditState tracks a session's downstream fragments sent and acknowledged
+// for the credit window (see protocol/credit.go). Counts wrap at 2^32 and
+// are compared by their difference.
+type creditState struct {
+	mu    sync.Mutex
+	sent  uint32 // fragments handed to responses
+	acked uint32 // the client's count of fragments received
+	// history holds the sent count after each recent response, oldest first,
+	// so fragments sent more than CreditLossTimeout ago can be written off
+	history []creditMark
+}
+
+type creditMark struct {
+	at   time.Time
+	sent uint32
+}
+
+// EnableCredit makes downstream writes wait for credit (see
+// VirtualConn.CreditWindow); set once the client asked for CapCredit
+func (s *Session) EnableCredit() {
+	s.creditOn.Store(true)
+}
+
+// Credit reports whether downstream writes wait for credit
+func (s *Session) Credit() bool {
+	return s.creditOn.Load()
+}
+
+// CountSent records n fragments handed to a response
+func (s *Session) CountSent(n int) {
+	if n == 0 || !s.Credit() {
+		return
+	}
+	c := &s.credit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settleLocked()
+	c.sent += uint32(n)
+	c.history = append(c.history, creditMark{time.Now(), c.sent})
+}
+
+// Ack records the client's count of downstream fragments received
+func (s *Session) Ack(count uint32) {
+	c := &s.credit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int32(count-c.acked) > 0 {
+		c.acked = count
+	}
+}
+
+// carryCredit takes over from's sent and acknowledged counts. Each session
+// is locked in turn: both may be live, polled and written to meanwhile.
+func (s *Session) carryCredit(from *Session) {
+	from.credit.mu.Lock()
+	sent, acked := from.credit.sent, from.credit.acked
+	from.credit.mu.Unlock()
+	c := &s.credit
+	c.mu.Lock()
+	c.sent, c.acked = sent, acked
+	c.mu.Unlock()
+}
+
+// Outstanding returns the downstream fragments counting against the credit
+// window: queued ones and those sent in the last CreditLossTimeout that the
+// client hasn't acknowledged
+func (s *Session) Outstanding() int {
+	c := &s.credit
+	c.mu.Lock()
+	c.settleLocked()
+	inflight := max(int(int32(c.sent-c.acked)), 0)
+	c.mu.Unlock()
+	return s.Backlog() + inflight
+}
+
+// settleLocked writes off fragments sent more than CreditLossTimeout ago as
+// if the client had acknowledged them
+func (c *creditState) settleLocked() {
+	cutoff := time.Now().Add(-protocol.CreditLossTimeout)
+	drop := 0
+	for drop < len(c.history) && c.history[drop].at.Before(cutoff) {
+		if int32(c.history[drop].sent-c.acked) > 0 {
+			c.acked = c.history[drop].sent
+		}
+		drop++
+	}
+	if drop > 0 {
+		c.history = append(c.history[:0], c.history[drop:]...)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"slipstream-go/internal/protocol"
+)
+
+// slowClientTransfer writes packets downstream as fast as the session takes
+// them while a client polls for two fragments at a time, acknowledging what it
+// received if credit is on, and stops polling for longer than
+// protocol.SpillWait partway through. It returns the packets delivered, the
+// largest backlog seen and the packets evicted from the queue.
+func slowClientTransfer(t *testing.T, credit bool, packets int) (got [][]byte, maxBacklog int, evicted uint64) {
+	t.Helper()
+	h := newTestHandler()
+	h.MaxFragsPerResponse = 2
+	h.Injector.Metrics = &Metrics{}
+	h.Injector.CreditWindow = 12
+	sess := h.Sessions.GetOrCreate(testSession)
+	// Room for 24 fragments, twice the credit window
+	sess.FragQueue = make(chan []byte, 16)
+	sess.spill = protocol.NewSpillQueue(8)
+	if credit {
+		sess.EnableCredit()
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := range packets {
+			h.Injector.WriteTo([]byte(fmt.Sprintf("packet %d", i)), &SessionAddr{SessionID: testSession})
+		}
+	}()
+
+	var received uint32
+	deadline := time.Now().Add(20 * time.Second)
+	for poll := 0; ; poll++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("transfer still running after %d of %d packets", len(got), packets)
+		}
+		if poll == 10 {
+			time.Sleep(protocol.SpillWait + 500*time.Millisecond)
+		}
+		maxBacklog = max(maxBacklog, sess.Backlog())
+		qname := fmt.Sprintf("poll.n%d.%s.%s.%s", poll, protocol.EncodeCreditAck(received), testSession, testDomain)
+		frags := answerFragments(t, ask(t, h, qname))
+		for _, frag := range frags {
+			received++
+			got = append(got, frag[protocol.FragHeaderLen:])
+		}
+		if len(frags) == 0 {
+			select {
+			case <-written:
+				return got, maxBacklog, h.Injector.Metrics.dropped.Load()
+			default:
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestCreditKeepsSlowClientFromDrops(t *testing.T) {
+	const packets = 150
+	got, maxBacklog, evicted := slowClientTransfer(t, true, packets)
+	if evicted != 0 {
+		t.Errorf("%d packets dropped with credit", evicted)
+	}
+	// One packet may go over the window once it has been waited for
+	if maxBacklog > 12+1 {
+		t.Errorf("backlog reached %d fragments, over the credit window of 12", maxBacklog)
+	}
+	if len(got) != packets {
+		t.Fatalf("%d of %d packets delivered", len(got), packets)
+	}
+	for i, packet := range got {
+		if want := []byte(fmt.Sprintf("packet %d", i)); !bytes.Equal(packet, want) {
+			t.Fatalf("packet %d is %q, want %q", i, packet, want)
+		}
+	}
+}
+
+func TestNoCreditDropsForSlowClient(t *testing.T) {
+	// Without credit nothing holds the writer back but a full queue, which
+	// evicts packets once the client has been away for protocol.SpillWait
+	_, maxBacklog, evicted := slowClientTransfer(t, false, 150)
+	if maxBacklog <= 12+1 {
+		t.Errorf("backlog peaked at %d fragments without credit, want the queue filled", maxBacklog)
+	}
+	if evicted == 0 {
+		t.Error("no packets dropped without credit, the stall is too short to test credit")
+	}
+}
+
+func TestMigrateCarriesCreditWhileLive(t *testing.T) {
+	sessions := newTestSessions(SessionOptions{})
+	old := sessions.GetOrCreate("sessaaaa")
+	old.EnableCredit()
+	old.CountSent(30)
+	old.Ack(10)
+	sess := sessions.GetOrCreate("sessbbbb")
+
+	// The new session is already polled while the connection moves to it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 1000 {
+			sess.Outstanding()
+			sess.Ack(0)
+		}
+	}()
+	sessions.Migrate("sessaaaa", "sessbbbb")
+	<-done
+
+	if !sess.Credit() {
+		t.Fatal("credit not carried to the new session")
+	}
+	if n := sess.Outstanding(); n != 20 {
+		t.Errorf("%d fragments outstanding after the move, want 20", n)
+	}
+}
@@ -1,28 +1,168 @@
 package server
 
 import (
+	"crypto/ed25519"
 	"encoding/base32"
-	"encoding/base64"
+	"errors"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
 )
 
+// ResponsePadBlockSize is the RFC 8467 recommended block size for padded responses
+const ResponsePadBlockSize = 468
+
+// MaxResponseHold bounds ResponseHold: common recursive resolvers retry or give
+// up on an unanswered query after about a second, and a held answer must beat that
+const MaxResponseHold = 900 * time.Millisecond
+
 type DNSHandler struct {
 	Sessions *SessionManager
 	// Injector allows us to push reassembled UDP packets into the QUIC listener
 	Injector *VirtualConn
 	// AllowedDomains contains the list of registered tunnel domains
+	// (swap it with Reconfigure once queries are being served)
 	AllowedDomains map[string]bool
-	// MaxFragsPerResponse is the max number of fragments to pack per DNS response
+	// MaxFragsPerResponse is the max number of fragments to pack per DNS
+	// response (swap it with Reconfigure once queries are being served)
+	MaxFragsPerResponse int
+	// PadBlockSize pads EDNS0 responses to a multiple of this many bytes (RFC 7830/8467); 0 disables
+	PadBlockSize int
+	// PSK, if set, requires every query's session label to carry a valid token
+	PSK []byte
+	// ClientKeys, if set, requires the same, with the token made with one of
+	// its per-client keys (or PSK when both are set)
+	ClientKeys *ClientKeys
+	// Sources, if set, restricts which source IPs are served
+	Sources *SourceFilter
+	// Framed splits every reassembled upstream payload with a protocol.Deframer;
+	// set it only when clients coalesce packets with [len:2] framing
+	Framed bool
+	// DropRejected silently drops queries for unregistered domains, from
+	// disallowed sources, over a rate limit or with an invalid or replayed
+	// token instead of answering REFUSED, so the server can't be used as a reflector
+	DropRejected bool
+	// MaxPollHold caps how long a long poll is held waiting for downstream
+	// data (see protocol.ParseHoldHint); 0 answers every poll at once
+	MaxPollHold time.Duration
+	// ResponseHold holds every poll or data query that finds nothing queued
+	// for up to this long, so it can answer with data instead of empty
+	// (clients need not ask for it; at most MaxResponseHold)
+	ResponseHold time.Duration
+	// RecordTypes lists the query types besides TXT answered in kind (A,
+	// CNAME, NULL); other queries get TXT answers. nil answers all in kind.
+	RecordTypes map[uint16]bool
+	// SessionLimiter and SourceLimiter, if set, cap the queries per second of
+	// each session and of each source IP; queries over the cap are refused
+	// like rejected ones (see DropRejected). Swap them with Reconfigure once
+	// queries are being served.
+	SessionLimiter *RateLimiter
+	SourceLimiter  *RateLimiter
+	// IdentityKey, if set, returns the Ed25519 key of a tunnel domain, which
+	// answers clients' fragment key exchanges (see fragment_cipher.go)
+	IdentityKey func(domain string) ed25519.PrivateKey
+	// Capture, if set, records every fragment received and sent
+	Capture *protocol.Capture
+	// Metrics, if set, counts queries and fragments (see Metrics)
+	Metrics *Metrics
+	// Logger receives handler logs; nil falls back to the global zerolog logger
+	Logger *zerolog.Logger
+
+	// confMu guards the fields Reconfigure swaps
+	confMu sync.RWMutex
+
+	counters   handlerCounters
+	rejectLog  sampledLog
+	limitLog   sampledLog
+	sessionLog sampledLog
+	// cookies keys the server cookies echoed to clients (see cookie.go)
+	cookieOnce sync.Once
+	cookies    *cookieSecret
+}
+
+// Stats returns a snapshot of the handler counters
+func (h *DNSHandler) Stats() HandlerStats {
+	stats := HandlerStats{
+		RejectedQueries: h.counters.rejected.Load(),
+	}
+	if h.Sessions != nil {
+		stats.Sessions = h.Sessions.Stats()
+		for _, s := range stats.Sessions {
+			stats.Upstream = stats.Upstream.Add(s.Upstream)
+		}
+	}
+	return stats
+}
+
+// HandlerConfig is the part of a DNSHandler's configuration that can change
+// while queries are being served (e.g. on SIGHUP)
+type HandlerConfig struct {
+	AllowedDomains      map[string]bool
 	MaxFragsPerResponse int
+	SessionLimiter      *RateLimiter
+	SourceLimiter       *RateLimiter
+}
+
+// Config returns the handler's current HandlerConfig
+func (h *DNSHandler) Config() HandlerConfig {
+	h.confMu.RLock()
+	defer h.confMu.RUnlock()
+	return HandlerConfig{
+		AllowedDomains:      h.AllowedDomains,
+		MaxFragsPerResponse: h.MaxFragsPerResponse,
+		SessionLimiter:      h.SessionLimiter,
+		SourceLimiter:       h.SourceLimiter,
+	}
+}
+
+// Reconfigure swaps in c; queries already being handled finish with the
+// previous configuration, and sessions are unaffected
+func (h *DNSHandler) Reconfigure(c HandlerConfig) {
+	h.confMu.Lock()
+	defer h.confMu.Unlock()
+	h.AllowedDomains = c.AllowedDomains
+	h.MaxFragsPerResponse = c.MaxFragsPerResponse
+	h.SessionLimiter = c.SessionLimiter
+	h.SourceLimiter = c.SourceLimiter
+}
+
+// logger returns the configured logger or the global one
+func (h *DNSHandler) logger() *zerolog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return &log.Logger
 }
 
 func (h *DNSHandler) HandleDNS(w dns.ResponseWriter, r *dns.Msg) {
 	if len(r.Question) == 0 {
 		return
 	}
+	h.Metrics.addQuery()
+	conf := h.Config()
+
+	if !h.Sources.Allowed(w.RemoteAddr()) {
+		h.counters.rejected.Add(1)
+		if ok, suppressed := h.rejectLog.allow(RejectLogInterval); ok {
+			h.logger().Warn().Str("source", w.RemoteAddr().String()).Int("suppressed", suppressed).Msg("Rejected query from disallowed source")
+		}
+		if !h.DropRejected {
+			h.refuse(w, r)
+		}
+		return
+	}
+	if !conf.SourceLimiter.Allow(sourceIP(w.RemoteAddr())) {
+		h.refuseRateLimited(w, r, "source", w.RemoteAddr().String())
+		return
+	}
 
 	// Format: [DATA-LABELS...].[SESSION].[DOMAIN]
 	// Example: AAAA.BBBB.sess123.n.godevgo.ir.
@@ -36,30 +176,24 @@ func (h *DNSHandler) HandleDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	// Find matching domain by checking suffix against allowed domains
 	// Domain can have 2+ parts (e.g., "tunnel.local" or "n.godevgo.ir")
-	var matchedDomain string
-	var domainLabelCount int
-
-	qNameLower := strings.ToLower(qName)
-	for domain := range h.AllowedDomains {
-		domainWithDot := strings.ToLower(domain) + "."
-		if strings.HasSuffix(qNameLower, "."+domainWithDot) || qNameLower == domainWithDot {
-			matchedDomain = domain
-			domainLabelCount = len(dns.SplitDomainName(domain))
-			break
-		}
-	}
+	matchedDomain, domainLabelCount := tunnelDomain(qName, conf.AllowedDomains)
 
 	if matchedDomain == "" {
-		// Extract domain for logging (try last 2-3 labels)
-		var domainForLog string
-		if len(labels) >= 2 {
-			domainForLog = strings.ToLower(labels[len(labels)-2] + "." + labels[len(labels)-1])
+		total := h.counters.rejected.Add(1)
+		// Sampled logging: a scan flood must not flood the log too
+		if ok, suppressed := h.rejectLog.allow(RejectLogInterval); ok {
+			// Extract domain for logging (try last 2-3 labels)
+			var domainForLog string
+			if len(labels) >= 2 {
+				domainForLog = strings.ToLower(labels[len(labels)-2] + "." + labels[len(labels)-1])
+			}
+			h.logger().Warn().Str("domain", domainForLog).Str("query", qName).Int("suppressed", suppressed).Uint64("total", total).Msg("Rejected query for unregistered domain")
+		}
+		if h.DropRejected {
+			return
 		}
-		log.Warn().Str("domain", domainForLog).Str("query", qName).Msg("Rejected query for unregistered domain")
 		// Send REFUSED response
-		msg := new(dns.Msg)
-		msg.SetRcode(r, dns.RcodeRefused)
-		w.WriteMsg(msg)
+		h.refuse(w, r)
 		return
 	}
 
@@ -74,73 +208,418 @@ func (h *DNSHandler) HandleDNS(w dns.ResponseWriter, r *dns.Msg) {
 	sessionIdx := len(labels) - domainLabelCount - 1
 	sessionID := strings.ToLower(labels[sessionIdx])
 
+	// Client authentication: the label is "<id>-<token>" keyed by the PSK or a client key
+	var client string
+	var counter uint32
+	authenticated := len(h.PSK) > 0 || h.ClientKeys != nil
+	if authenticated {
+		id, token := crypto.SplitSessionLabel(sessionID)
+		valid := false
+		if token != "" {
+			now := time.Now()
+			if len(h.PSK) > 0 {
+				counter, valid = crypto.VerifySessionToken(h.PSK, id, token, now)
+			}
+			if !valid && h.ClientKeys != nil {
+				client, counter, valid = h.ClientKeys.Verify(id, token, now)
+			}
+		}
+		if !valid {
+			h.logger().Debug().Str("sess", sessionID).Msg("Refusing session with invalid token")
+			h.reject(w, r)
+			return
+		}
+		sessionID = id
+	}
+
+	if !conf.SessionLimiter.Allow(sessionID) {
+		h.refuseRateLimited(w, r, "sess", sessionID)
+		return
+	}
+
 	// Data labels are everything before session
 	dataLabels := labels[:sessionIdx]
 	dataLabel := strings.Join(dataLabels, "")
 
 	sess := h.Sessions.GetOrCreate(sessionID)
+	if sess == nil {
+		// Draining or at --max-sessions: only sessions that already exist are served
+		if h.Sessions.Draining() {
+			h.logger().Debug().Str("sess", sessionID).Msg("Refusing new session while draining")
+		} else if ok, suppressed := h.sessionLog.allow(RejectLogInterval); ok {
+			h.logger().Warn().Str("sess", sessionID).Int("sessions", h.Sessions.Count()).Int("suppressed", suppressed).Msg("Session limit reached, refusing new session")
+		}
+		h.refuse(w, r)
+		return
+	}
+	// A token is good for several minutes, so a query seen before is refused:
+	// otherwise anyone on the path could replay it, e.g. to steal a poll's answer
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	if authenticated && !sess.AcceptToken(counter, tcp) {
+		h.logger().Debug().Str("sess", sessionID).Uint32("counter", counter).Msg("Refusing replayed query")
+		h.reject(w, r)
+		return
+	}
+	sess.SetDomain(strings.ToLower(matchedDomain))
+	if client != "" {
+		sess.SetClient(client)
+	}
 
 	// 1. INGEST UPSTREAM (Reassembly)
-	// If it's not a "poll" query, it contains data chunks
-	// Note: dataLabel is case-preserved for base32, but poll check should be case-insensitive
-	if !strings.HasPrefix(strings.ToLower(dataLabel), "poll") {
+	// If it's not a "poll" or key exchange query, it contains data chunks
+	if !isPollQuery(dataLabels) && !isKeyQuery(dataLabels) {
 		// DNS labels are often lowercased by resolvers.
 		// Standard Base32 requires Uppercase. Fix it here:
 		normalizedData := strings.ToUpper(dataLabel)
 
 		// Use NoPadding base32 to match client encoding (avoids = in DNS labels)
 		raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(normalizedData)
+		if cipher := sess.Cipher(); err == nil && cipher != nil {
+			raw, err = cipher.Open(raw)
+		}
 		if err == nil {
+			h.Capture.Fragment(protocol.CaptureUp, sessionID, raw)
+			h.Metrics.addFragmentIn()
+			sess.AddBytesUp(len(raw))
 			// Pass chunk to reassembler (no per-fragment logging - too noisy)
 			if fullPacket := sess.Reassembler.IngestChunk(raw); fullPacket != nil {
+				h.Metrics.addReassembled()
 				// Inject packet into QUIC Listener
 				if h.Injector != nil {
-					h.Injector.InjectPacket(fullPacket, sessionID)
-					log.Info().Int("len", len(fullPacket)).Str("sess", sessionID).Msg("Upstream packet complete")
+					h.inject(fullPacket, sessionID)
+					h.logger().Info().Int("len", len(fullPacket)).Str("sess", sessionID).Msg("Upstream packet complete")
 				}
 			}
+		} else if errors.Is(err, crypto.ErrFragmentAuth) {
+			h.logger().Debug().Str("sess", sessionID).Msg("Dropping upstream fragment that failed authentication")
 		} else {
-			log.Warn().Err(err).Int("len", len(dataLabel)).Msg("Base32 decode failed")
+			h.logger().Warn().Err(err).Int("len", len(dataLabel)).Msg("Base32 decode failed")
 		}
 	}
 	// Note: Poll queries not logged (too frequent)
 
+	// Polls may carry hints: downstream fragments the client is missing
+	// (selective repeat), the response size that survives its path, how
+	// long the poll may be held for data (long poll) and how many fragments
+	// it received (credit)
+	var hold time.Duration
+	if isPollQuery(dataLabels) {
+		for _, label := range dataLabels[1:] {
+			if d, ok := protocol.ParseHoldHint(label); ok {
+				hold = min(d, h.MaxPollHold)
+				continue
+			}
+			if count, ok := protocol.ParseCreditAck(label); ok {
+				sess.Ack(count)
+				continue
+			}
+			if nacks, ok := protocol.ParseNackLabel(label); ok {
+				if n := sess.Resend(nacks); n > 0 {
+					h.logger().Debug().Str("sess", sessionID).Int("fragments", n).Msg("Resending nacked fragments")
+				}
+			} else if size, ok := protocol.ParseSizeHint(label); ok && size != sess.ResponseLimit() {
+				sess.SetResponseLimit(size)
+				h.logger().Info().Str("sess", sessionID).Int("size", size).Msg("Client asked for smaller responses (EDNS0 stripped on its path)")
+			}
+		}
+	}
+
 	// 2. SEND DOWNSTREAM (Fragment packing with size limit)
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.Compress = true
 
-	// EDNS0: Copy OPT record from request to response
-	// This confirms to the resolver that we support large UDP packets (up to 1232 bytes)
-	if opt := r.IsEdns0(); opt != nil {
+	// EDNS0: answer with our own OPT record (see responseOPT)
+	if opt := h.responseOPT(w, r); opt != nil {
 		msg.Extra = append(msg.Extra, opt)
 	}
 
 	// Pack multiple fragments per response (configurable via --max-frags)
 	// Each base64-encoded fragment is ~180 bytes (132 raw * 4/3 base64 + header)
 	// Packing more fragments reduces round-trips dramatically
-	maxFrags := h.MaxFragsPerResponse
+	maxFrags := conf.MaxFragsPerResponse
 	if maxFrags <= 0 {
 		maxFrags = 10 // default increased from 5 for better throughput
 	}
-	fragsSent := 0
 
-	// Send fragments from queue until limit reached
-	for fragsSent < maxFrags {
-		select {
-		case frag := <-sess.FragQueue:
-			encoded := base64.StdEncoding.EncodeToString(frag)
+	// Never pack more than the response may carry: 512 bytes without EDNS0,
+	// the requester's UDP size (at most MaxEDNSSize) with it, less if the
+	// client reported that larger responses don't reach it. Over TCP, where
+	// truncated answers are fetched again, MaxEDNSSize.
+	sizeLimit := ednsSize(r)
+	if hint := sess.ResponseLimit(); hint > 0 && hint < sizeLimit {
+		sizeLimit = hint
+	}
+	if tcp {
+		sizeLimit = protocol.MaxEDNSSize
+	}
+	// A queries get their fragments packed into addresses (see protocol.EncodeARecords),
+	// CNAME queries one fragment as the target name (see protocol.EncodeCNAME)
+	// and NULL queries a fragment per record as raw RDATA (see protocol/null.go)
+	answerType := r.Question[0].Qtype
+	if answerType != dns.TypeA && answerType != dns.TypeCNAME && answerType != dns.TypeNULL || h.RecordTypes != nil && !h.RecordTypes[answerType] {
+		answerType = dns.TypeTXT
+	}
+	if answerType == dns.TypeCNAME && len(matchedDomain) > protocol.MaxCNAMEDomainLen {
+		// Clients refuse CNAME mode for such domains, a fragment wouldn't fit
+		answerType = dns.TypeTXT
+	}
+	switch answerType {
+	case dns.TypeA:
+		maxFrags = min(maxFrags, protocol.ARecordFragmentsForSize(sizeLimit, msg.Len()))
+	case dns.TypeCNAME:
+		maxFrags = 1
+	case dns.TypeNULL:
+		maxFrags = min(maxFrags, protocol.NULLFragmentsForSize(sizeLimit, msg.Len()))
+	default:
+		if sess.TXTMulti() {
+			maxFrags = min(maxFrags, protocol.MultiTXTFragmentsForSize(sizeLimit, msg.Len(), sess.RawBase64()))
+		} else if sess.RawBase64() {
+			maxFrags = min(maxFrags, protocol.RawFragmentsForSize(sizeLimit, msg.Len()))
+		} else {
+			maxFrags = min(maxFrags, protocol.FragmentsForSize(sizeLimit, msg.Len()))
+		}
+	}
+
+	// Key exchange: the answer is the server's half instead of downstream data
+	if isKeyQuery(dataLabels) {
+		reply, err := h.answerKeyExchange(sess, dataLabels)
+		if err != nil {
+			h.logger().Debug().Err(err).Str("sess", sessionID).Msg("Refusing key exchange")
+			h.refuse(w, r)
+			return
+		}
+		h.packAnswers(msg, answerType, qName, matchedDomain, sess.RawBase64(), sess.TXTMulti(), [][]byte{reply})
+		if h.PadBlockSize > 0 {
+			padResponse(msg, h.PadBlockSize, sizeLimit)
+		}
+		w.WriteMsg(msg)
+		h.logger().Debug().Str("sess", sessionID).Msg("Fragment key agreed")
+		return
+	}
+
+	// Long poll: hold the answer until there is something to send
+	if hold == 0 {
+		hold = min(h.ResponseHold, MaxResponseHold)
+	}
+	if hold > 0 {
+		sess.WaitReady(hold)
+	}
+
+	// Take whole packets from the queue where possible (serialized per session)
+	frags := sess.NextFragments(maxFrags)
+
+	// The per-fragment budgets above are estimates (the question and the
+	// record names compress differently per query), so check the packed
+	// message against the limit and hand back what doesn't fit
+	n := len(frags)
+	sealed := sealFragments(sess, frags)
+	h.packAnswers(msg, answerType, qName, matchedDomain, sess.RawBase64(), sess.TXTMulti(), sealed)
+	for n > 1 && msg.Len() > sizeLimit {
+		n--
+		h.packAnswers(msg, answerType, qName, matchedDomain, sess.RawBase64(), sess.TXTMulti(), sealed[:n])
+	}
+	if n == 1 && msg.Len() > sizeLimit {
+		// Not even one fragment fits: say so rather than send an oversized
+		// message the resolver would truncate anyway, and let the client poll again
+		msg.Answer = nil
+		msg.Truncated = true
+		n = 0
+		h.logger().Debug().Str("sess", sessionID).Int("size", sizeLimit).Msg("Response size too small for a fragment, answering truncated")
+	}
+	sess.PutBack(frags[n:])
+	frags = frags[:n]
+
+	sess.CountSent(len(frags))
+	h.Metrics.addFragmentsOut(len(frags))
+	for _, frag := range frags {
+		h.Capture.Fragment(protocol.CaptureDown, sessionID, frag)
+	}
+
+	if h.PadBlockSize > 0 {
+		padResponse(msg, h.PadBlockSize, sizeLimit)
+	}
+	w.WriteMsg(msg)
+}
+
+// packAnswers replaces msg's answers with records carrying frags as
+// answerType, TXT strings in rawBase64 and multiString form as negotiated
+func (h *DNSHandler) packAnswers(msg *dns.Msg, answerType uint16, qName, domain string, rawBase64, multiString bool, frags [][]byte) {
+	msg.Answer = nil
+	var txtStrings []string
+	for _, frag := range frags {
+		switch answerType {
+		case dns.TypeA:
+			// Packed together below
+		case dns.TypeCNAME:
+			target, err := protocol.EncodeCNAME(frag, domain)
+			if err != nil {
+				h.logger().Warn().Err(err).Str("domain", domain).Msg("Dropping downstream fragment")
+				continue
+			}
+			msg.Answer = append(msg.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: qName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 0},
+				Target: target,
+			})
+		case dns.TypeNULL:
+			msg.Answer = append(msg.Answer, &dns.NULL{
+				Hdr:  dns.RR_Header{Name: qName, Rrtype: dns.TypeNULL, Class: dns.ClassINET, Ttl: 0},
+				Data: string(frag),
+			})
+		default:
+			encoded := protocol.EncodeTXT(frag, rawBase64)
+			if multiString {
+				// One record for the whole response, below
+				txtStrings = append(txtStrings, encoded)
+				continue
+			}
 			msg.Answer = append(msg.Answer, &dns.TXT{
 				Hdr: dns.RR_Header{Name: qName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
 				Txt: []string{encoded},
 			})
-			fragsSent++
-		default:
-			// Queue is empty
-			goto sendResponse
 		}
 	}
+	if len(txtStrings) > 0 {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: qName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+			Txt: txtStrings,
+		})
+	}
+	if answerType == dns.TypeA {
+		for _, addr := range protocol.EncodeARecords(frags) {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: qName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+				A:   addr,
+			})
+		}
+	}
+}
+
+// refuseRateLimited answers a query over a --max-qps-* cap with REFUSED, or
+// not at all with DropRejected; key names the session or source over its cap
+func (h *DNSHandler) refuseRateLimited(w dns.ResponseWriter, r *dns.Msg, field, key string) {
+	if ok, suppressed := h.limitLog.allow(RejectLogInterval); ok {
+		h.logger().Warn().Str(field, key).Int("suppressed", suppressed).Msg("Query rate limit exceeded, refusing")
+	}
+	h.reject(w, r)
+}
+
+// reject counts a rejected query and answers it with REFUSED, or not at all
+// with DropRejected
+func (h *DNSHandler) reject(w dns.ResponseWriter, r *dns.Msg) {
+	h.counters.rejected.Add(1)
+	if h.DropRejected {
+		return
+	}
+	h.refuse(w, r)
+}
 
-sendResponse:
+// refuse answers r with REFUSED
+func (h *DNSHandler) refuse(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetRcode(r, dns.RcodeRefused)
+	if opt := h.responseOPT(w, r); opt != nil {
+		msg.Extra = append(msg.Extra, opt)
+	}
 	w.WriteMsg(msg)
 }
+
+// responseOPT returns the OPT record answering r's, with the UDP size the
+// response is packed for (see ednsSize) and a cookie (see cookie.go), or nil
+// when r has none
+func (h *DNSHandler) responseOPT(w dns.ResponseWriter, r *dns.Msg) *dns.OPT {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return nil
+	}
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+	}
+	opt.SetUDPSize(uint16(ednsSize(r)))
+	h.cookieOnce.Do(func() { h.cookies = newCookieSecret() })
+	h.cookies.echoCookie(reqOpt, opt, w.RemoteAddr())
+	return opt
+}
+
+// ednsSize returns the response size r allows: its EDNS0 UDP size clamped
+// to MinResponseSize..MaxEDNSSize, or MinResponseSize without an OPT record
+func ednsSize(r *dns.Msg) int {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return protocol.MinResponseSize
+	}
+	return min(max(int(reqOpt.UDPSize()), protocol.MinResponseSize), protocol.MaxEDNSSize)
+}
+
+// sourceIP returns the IP of a query's source address, the rate limit key
+func sourceIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	return addr.String()
+}
+
+// inject hands a reassembled payload to QUIC, splitting coalesced packets first when Framed
+func (h *DNSHandler) inject(payload []byte, sessionID string) {
+	if !h.Framed {
+		h.Injector.InjectPacket(payload, sessionID)
+		return
+	}
+	pkts, err := protocol.Deframe(payload)
+	if err != nil {
+		h.logger().Debug().Err(err).Str("sess", sessionID).Int("len", len(payload)).Int("packets", len(pkts)).Msg("Malformed coalesced payload")
+	}
+	for _, pkt := range pkts {
+		h.Injector.InjectPacket(pkt, sessionID)
+	}
+}
+
+// isPollQuery reports whether the data labels form a poll (poll.NONCE).
+// The whole first label must be "poll": a data fragment is at least
+// FragHeaderLen+1 bytes, so its first base32 label is never shorter than 8 chars,
+// and data that merely starts with "POLL" is never mistaken for a poll.
+func isPollQuery(dataLabels []string) bool {
+	return len(dataLabels) > 0 && strings.EqualFold(dataLabels[0], "poll")
+}
+
+// padResponse adds an EDNS0 Padding option so the packed response length is a
+// multiple of blockSize, hiding how many fragments it carries. A response
+// whose next multiple would pass limit, the size it was packed for, is padded
+// to limit instead, the largest size that still fits. Responses without
+// EDNS0, or already over limit, are left alone.
+func padResponse(msg *dns.Msg, blockSize, limit int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	// Option header (code + length) is 4 bytes
+	unpadded := msg.Len() + 4
+	if unpadded > limit {
+		return
+	}
+	padded := min((unpadded+blockSize-1)/blockSize*blockSize, limit)
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padded-unpadded)})
+}
+
+// tunnelDomain returns the allowed domain qName falls under and its label
+// count, or "" if none. With nested domains (t.example.com and
+// x.t.example.com) the longest wins: the shorter one would take the inner
+// domain's first label for the session ID.
+func tunnelDomain(qName string, domains map[string]bool) (string, int) {
+	var matched string
+	var labelCount int
+	qNameLower := strings.ToLower(qName)
+	for domain := range domains {
+		domainWithDot := strings.ToLower(domain) + "."
+		if !strings.HasSuffix(qNameLower, "."+domainWithDot) && qNameLower != domainWithDot {
+			continue
+		}
+		if n := len(dns.SplitDomainName(domain)); n > labelCount {
+			matched, labelCount = domain, n
+		}
+	}
+	return matched, labelCount
+}
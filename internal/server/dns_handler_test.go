@@ -0,0 +1,507 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base32"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+)
+
+const (
+	testDomain  = "t.example.com"
+	testSession = "abcdefgh"
+)
+
+var testSource = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+
+// newTestHandler returns a handler for testDomain that logs nowhere
+func newTestHandler() *DNSHandler {
+	logger := zerolog.Nop()
+	sessions := NewSessionManager()
+	sessions.Logger = &logger
+	injector := NewVirtualConn(sessions)
+	injector.Logger = &logger
+	return &DNSHandler{
+		Sessions:            sessions,
+		Injector:            injector,
+		AllowedDomains:      map[string]bool{testDomain: true},
+		MaxFragsPerResponse: 6,
+		Logger:              &logger,
+	}
+}
+
+// ask sends h a TXT query for qname from testSource and returns the answer, nil if none
+func ask(t *testing.T, h *DNSHandler, qname string) *dns.Msg {
+	t.Helper()
+	return askFrom(t, h, qname, testSource)
+}
+
+// askFrom sends h a TXT query for qname from source and returns the answer, nil if none
+func askFrom(t *testing.T, h *DNSHandler, qname string, source net.Addr) *dns.Msg {
+	t.Helper()
+	return askSized(t, h, qname, dns.TypeTXT, 1232, source)
+}
+
+// askSized sends h a qtype query for qname from source offering udpSize
+// bytes of EDNS0, none if 0, and returns the answer, nil if none
+func askSized(t *testing.T, h *DNSHandler, qname string, qtype uint16, udpSize uint16, source net.Addr) *dns.Msg {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(qname), qtype)
+	if udpSize > 0 {
+		query.SetEdns0(udpSize, false)
+	}
+	w := &loopbackWriter{remote: source}
+	h.HandleDNS(w, query)
+	if w.reply == nil {
+		return nil
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(w.reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// dataName returns the query name carrying frag upstream for session
+func dataName(frag []byte, session string) string {
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(frag)
+	var labels []string
+	for len(encoded) > protocol.DataLabelLen {
+		labels = append(labels, encoded[:protocol.DataLabelLen])
+		encoded = encoded[protocol.DataLabelLen:]
+	}
+	labels = append(labels, encoded)
+	return strings.Join(labels, ".") + "." + session + "." + testDomain
+}
+
+// txtResponse builds an EDNS0 response to a TXT query with answers of n bytes in total
+func txtResponse(n int) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion("poll.abcdefgh.t.example.com.", dns.TypeTXT)
+	query.SetEdns0(4096, false)
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	msg.Compress = true
+	msg.SetEdns0(4096, false)
+	for n > 0 {
+		size := min(n, 255)
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{strings.Repeat("a", size)},
+		})
+		n -= size
+	}
+	return msg
+}
+
+func TestPadResponse(t *testing.T) {
+	const limit = 1232
+	for _, tt := range []struct {
+		name    string
+		payload int
+		want    int
+	}{
+		{"small", 10, ResponsePadBlockSize},
+		{"two blocks", 600, 2 * ResponsePadBlockSize},
+		// The next block, 1404, would pass the limit: the limit is the last bucket
+		{"between last block and limit", 1000, limit},
+		{"just under the limit", 1100, limit},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := txtResponse(tt.payload)
+			padResponse(msg, ResponsePadBlockSize, limit)
+			if got := msg.Len(); got != tt.want {
+				t.Errorf("padded to %d bytes, want %d", got, tt.want)
+			}
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packed) != tt.want {
+				t.Errorf("packs to %d bytes, want %d", len(packed), tt.want)
+			}
+		})
+	}
+}
+
+func TestPadResponseOverLimit(t *testing.T) {
+	msg := txtResponse(1400)
+	before := msg.Len()
+	padResponse(msg, ResponsePadBlockSize, 1232)
+	if msg.Len() != before {
+		t.Errorf("response over the limit grew from %d to %d bytes", before, msg.Len())
+	}
+}
+
+func TestDataStartingWithPollIsNotAPoll(t *testing.T) {
+	h := newTestHandler()
+
+	// An FEC fragment of packet 0x7b96 with 48 fragments encodes as "POLL..."
+	frag := []byte{0x7b, 0x96, 0xb0, 0x00, 1, 20}
+	frag = append(frag, []byte("twenty bytes of data")...)
+	qname := dataName(frag, testSession)
+	if !strings.HasPrefix(qname, "POLL") {
+		t.Fatalf("test fragment encodes as %s", qname)
+	}
+
+	if reply := ask(t, h, qname); reply == nil || reply.Rcode != dns.RcodeSuccess {
+		t.Fatalf("data query answered %v", reply)
+	}
+	if packets, _ := h.Sessions.Get(testSession).Reassembler.Pending(); packets != 1 {
+		t.Errorf("reassembler holds %d packets, want the data fragment's", packets)
+	}
+
+	// A real poll carries no data
+	ask(t, h, "poll.x1y2z3."+testSession+"."+testDomain)
+	if packets, _ := h.Sessions.Get(testSession).Reassembler.Pending(); packets != 1 {
+		t.Errorf("reassembler holds %d packets after a poll, want 1", packets)
+	}
+}
+
+func TestIsPollQuery(t *testing.T) {
+	for _, tt := range []struct {
+		labels []string
+		want   bool
+	}{
+		{[]string{"poll", "x1y2"}, true},
+		{[]string{"POLL", "x1y2"}, true},
+		{[]string{"POLLAAAAAAAAAAAA"}, false},
+		{[]string{"pollaaaa", "poll"}, false},
+		{nil, false},
+	} {
+		if got := isPollQuery(tt.labels); got != tt.want {
+			t.Errorf("isPollQuery(%q) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestReplayedQueryRefused(t *testing.T) {
+	h := newTestHandler()
+	h.PSK = []byte("secret")
+	label := func(counter uint32) string {
+		return crypto.SessionLabel(h.PSK, testSession, counter, time.Now())
+	}
+	expect := func(qname string, want int) {
+		t.Helper()
+		reply := ask(t, h, qname)
+		if reply == nil {
+			t.Fatalf("no answer to %s", qname)
+		}
+		if reply.Rcode != want {
+			t.Fatalf("%s: got %s, want %s", qname, dns.RcodeToString[reply.Rcode], dns.RcodeToString[want])
+		}
+	}
+
+	first := "poll." + label(1) + "." + testDomain
+	expect(first, dns.RcodeSuccess)
+	expect(first, dns.RcodeRefused)
+	expect("poll."+label(3)+"."+testDomain, dns.RcodeSuccess)
+	// Queries overtaking each other on the way are not replays
+	expect("poll."+label(2)+"."+testDomain, dns.RcodeSuccess)
+	expect("poll."+testSession+"."+testDomain, dns.RcodeRefused)
+
+	// With DropRejected neither gets an answer to reflect
+	h.DropRejected = true
+	for _, qname := range []string{first, "poll." + testSession + "." + testDomain} {
+		if reply := ask(t, h, qname); reply != nil {
+			t.Errorf("%s answered %s with DropRejected", qname, dns.RcodeToString[reply.Rcode])
+		}
+	}
+	expect("poll."+label(4)+"."+testDomain, dns.RcodeSuccess)
+}
+
+// injected returns the packets the handler handed to QUIC within wait
+func injected(h *DNSHandler, wait time.Duration) [][]byte {
+	var pkts [][]byte
+	timeout := time.After(wait)
+	for {
+		select {
+		case bundle := <-h.Injector.Incoming:
+			pkts = append(pkts, bundle.Data)
+		case <-timeout:
+			return pkts
+		}
+	}
+}
+
+func TestCoalescedPacketsInjected(t *testing.T) {
+	first, second := []byte("first QUIC packet"), bytes.Repeat([]byte{0xAB}, 300)
+	blob, _ := protocol.AppendFrame(nil, first)
+	blob, _ = protocol.AppendFrame(blob, second)
+
+	for _, framed := range []bool{true, false} {
+		h := newTestHandler()
+		h.Framed = framed
+		for _, frag := range protocol.FragmentPacket(blob, protocol.MaxChunkSize) {
+			ask(t, h, dataName(frag, testSession))
+		}
+		got := injected(h, 100*time.Millisecond)
+		if !framed {
+			if len(got) != 1 || !bytes.Equal(got[0], blob) {
+				t.Errorf("unframed: injected %d packets, want the payload as is", len(got))
+			}
+			continue
+		}
+		if len(got) != 2 || !bytes.Equal(got[0], first) || !bytes.Equal(got[1], second) {
+			t.Errorf("framed: injected %d packets, want both coalesced packets in order", len(got))
+		}
+	}
+}
+
+func TestNestedDomainsMatchLongest(t *testing.T) {
+	inner := "x." + testDomain
+	domains := map[string]bool{testDomain: true, inner: true, "example.com": true}
+	for _, tt := range []struct {
+		qname, want string
+	}{
+		{"data.sess." + testDomain + ".", testDomain},
+		{"data.sess." + inner + ".", inner},
+		{"DATA.SESS.X.T.EXAMPLE.COM.", inner},
+		{"data.sess.y.example.com.", "example.com"},
+		{"data.sess.xt.example.com.", "example.com"},
+		{"data.sess.example.org.", ""},
+	} {
+		// Map order varies from run to run, so ask more than once
+		for range 10 {
+			if got, _ := tunnelDomain(tt.qname, domains); got != tt.want {
+				t.Fatalf("%s matched %q, want %q", tt.qname, got, tt.want)
+			}
+		}
+	}
+
+	// The session label is the one before the inner domain, not its first label
+	h := newTestHandler()
+	h.AllowedDomains = domains
+	frag := protocol.FragmentPacket([]byte("packet"), protocol.MaxChunkSize)[0]
+	ask(t, h, strings.TrimSuffix(dataName(frag, testSession), testDomain)+inner)
+	if sess := h.Sessions.Get(testSession); sess == nil || sess.Domain() != inner {
+		t.Fatalf("session %v, want %s under %s", sess, testSession, inner)
+	}
+	if h.Sessions.Get("x") != nil {
+		t.Error("inner domain's first label taken for a session")
+	}
+}
+
+func TestSessionReassemblyTimeout(t *testing.T) {
+	sessions := NewSessionManagerWithOptions(SessionOptions{ReassemblyTimeout: 40 * time.Millisecond})
+	logger := zerolog.Nop()
+	sessions.Logger = &logger
+	h := newTestHandler()
+	h.Sessions = sessions
+	h.Injector = NewVirtualConn(sessions)
+
+	frags := protocol.FragmentPacket(bytes.Repeat([]byte{3}, 3*protocol.MaxChunkSize), protocol.MaxChunkSize)
+	ask(t, h, dataName(frags[0], testSession))
+	ask(t, h, dataName(frags[1], testSession))
+	time.Sleep(100 * time.Millisecond)
+	other := protocol.FragmentPacket([]byte("next"), protocol.MaxChunkSize)
+	ask(t, h, dataName(other[0], testSession))
+
+	sess := sessions.GetOrCreate(testSession)
+	if packets, _ := sess.Reassembler.Pending(); packets != 0 {
+		t.Errorf("%d partial packets still pending past --reassembly-timeout", packets)
+	}
+	if lost := sess.Reassembler.Stats().PacketsLost; lost != 1 {
+		t.Errorf("%d packets lost, want the partial one", lost)
+	}
+}
+
+// answerFragments returns the fragments carried by reply's TXT or NULL answers
+func answerFragments(t *testing.T, reply *dns.Msg) [][]byte {
+	t.Helper()
+	var frags [][]byte
+	for _, rr := range reply.Answer {
+		switch rr := rr.(type) {
+		case *dns.TXT:
+			decoded, err := protocol.DecodeTXTRecord(rr.Txt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frags = append(frags, decoded...)
+		case *dns.NULL:
+			frags = append(frags, []byte(rr.Data))
+		}
+	}
+	return frags
+}
+
+// sealSession gives sess a fragment cipher as the key exchange would and
+// returns the client's half
+func sealSession(t *testing.T, sess *Session) *crypto.FragmentCipher {
+	t.Helper()
+	_, identity, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange, err := crypto.NewFragmentKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCipher, reply, err := crypto.AnswerFragmentKeyExchange(identity, exchange.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCipher, err := exchange.Finish(reply, func(ed25519.PublicKey) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.cipher.Store(serverCipher)
+	return clientCipher
+}
+
+func TestResponseTrimmedToSizeLimit(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		sealed bool
+	}{
+		{"TXT", dns.TypeTXT, false},
+		{"NULL", dns.TypeNULL, false},
+		// Sealed fragments are larger than the per-fragment budgets assume
+		{"sealed TXT", dns.TypeTXT, true},
+		{"sealed NULL", dns.TypeNULL, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler()
+			h.RecordTypes = map[uint16]bool{tt.qtype: true}
+			sess := h.Sessions.GetOrCreate(testSession)
+			var cipher *crypto.FragmentCipher
+			if tt.sealed {
+				cipher = sealSession(t, sess)
+			}
+			var queued [][]byte
+			for i := range 6 {
+				frags := protocol.FragmentPacket(bytes.Repeat([]byte{byte(i)}, protocol.MaxChunkSize), protocol.MaxChunkSize)
+				sess.Enqueue(frags)
+				queued = append(queued, frags...)
+			}
+
+			// Without EDNS0 a response carries 512 bytes: the rest waits for later polls
+			var got [][]byte
+			for i := 0; i < len(queued) && len(got) < len(queued); i++ {
+				w := &loopbackWriter{remote: testSource}
+				query := new(dns.Msg)
+				query.SetQuestion(dns.Fqdn("poll.n"+strconv.Itoa(i)+"."+testSession+"."+testDomain), tt.qtype)
+				h.HandleDNS(w, query)
+				if len(w.reply) > protocol.MinResponseSize {
+					t.Fatalf("%d-byte response to a query without EDNS0", len(w.reply))
+				}
+				reply := new(dns.Msg)
+				if err := reply.Unpack(w.reply); err != nil {
+					t.Fatal(err)
+				}
+				if reply.Truncated {
+					t.Fatal("truncated although a fragment fits")
+				}
+				for _, frag := range answerFragments(t, reply) {
+					if cipher != nil {
+						opened, err := cipher.Open(frag)
+						if err != nil {
+							t.Fatal(err)
+						}
+						frag = opened
+					}
+					got = append(got, frag)
+				}
+			}
+			if len(got) != len(queued) {
+				t.Fatalf("%d fragments delivered, want %d", len(got), len(queued))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], queued[i]) {
+					t.Fatalf("fragment %d out of order", i)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncatedWhenNoFragmentFits(t *testing.T) {
+	h := newTestHandler()
+	sess := h.Sessions.GetOrCreate(testSession)
+	big := bytes.Repeat([]byte{7}, 600)
+	sess.Enqueue([][]byte{big})
+
+	reply := askSized(t, h, "poll.n1."+testSession+"."+testDomain, dns.TypeNULL, 0, testSource)
+	if !reply.Truncated || len(reply.Answer) != 0 {
+		t.Fatalf("got TC=%v with %d answers for a fragment over 512 bytes, want TC and none", reply.Truncated, len(reply.Answer))
+	}
+	// The fragment went back to the queue for a poll that has room for it
+	reply = askSized(t, h, "poll.n2."+testSession+"."+testDomain, dns.TypeNULL, 1232, testSource)
+	if frags := answerFragments(t, reply); reply.Truncated || len(frags) != 1 || !bytes.Equal(frags[0], big) {
+		t.Fatalf("got TC=%v with %d fragments on a larger poll, want the held back fragment", reply.Truncated, len(frags))
+	}
+}
+
+func TestTruncatedAnswerRefetchedOverTCPWithPSK(t *testing.T) {
+	h := newTestHandler()
+	h.PSK = []byte("secret")
+	sess := h.Sessions.GetOrCreate(testSession)
+	big := bytes.Repeat([]byte{7}, 600)
+	sess.Enqueue([][]byte{big})
+	qname := "poll.n1." + crypto.SessionLabel(h.PSK, testSession, 1, time.Now()) + "." + testDomain
+	tcpSource := &net.TCPAddr{IP: testSource.IP, Port: testSource.Port}
+
+	reply := askSized(t, h, qname, dns.TypeNULL, 0, testSource)
+	if reply == nil || reply.Rcode != dns.RcodeSuccess || !reply.Truncated {
+		t.Fatalf("got %v over UDP, want NOERROR with TC", reply)
+	}
+	// The same query again over TCP is the re-ask of the truncated answer
+	reply = askSized(t, h, qname, dns.TypeNULL, 0, tcpSource)
+	if frags := answerFragments(t, reply); reply.Rcode != dns.RcodeSuccess || len(frags) != 1 || !bytes.Equal(frags[0], big) {
+		t.Fatalf("got %s with %d fragments over TCP, want the fragment", dns.RcodeToString[reply.Rcode], len(frags))
+	}
+	// Only once, over either transport
+	for _, source := range []net.Addr{tcpSource, testSource} {
+		if reply := askSized(t, h, qname, dns.TypeNULL, 0, source); reply.Rcode != dns.RcodeRefused {
+			t.Errorf("third ask from %v got %s, want REFUSED", source, dns.RcodeToString[reply.Rcode])
+		}
+	}
+}
+
+// timedPoll polls testSession and returns the fragments answered and how long the answer took
+func timedPoll(t *testing.T, h *DNSHandler, nonce string) ([][]byte, time.Duration) {
+	t.Helper()
+	start := time.Now()
+	reply := ask(t, h, "poll."+nonce+"."+testSession+"."+testDomain)
+	return answerFragments(t, reply), time.Since(start)
+}
+
+func TestResponseHold(t *testing.T) {
+	h := newTestHandler()
+	h.ResponseHold = 300 * time.Millisecond
+	h.Sessions.GetOrCreate(testSession)
+
+	// Nothing arrives: answered empty once the hold runs out
+	frags, took := timedPoll(t, h, "n1")
+	if len(frags) != 0 || took < 250*time.Millisecond {
+		t.Fatalf("empty poll answered with %d fragments after %v, want none after the 300ms hold", len(frags), took)
+	}
+
+	// Data arriving during the hold is answered right away
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.Injector.WriteTo([]byte("downstream"), &SessionAddr{SessionID: testSession})
+	}()
+	frags, took = timedPoll(t, h, "n2")
+	if len(frags) != 1 || took > 250*time.Millisecond {
+		t.Fatalf("poll answered with %d fragments after %v, want the packet as soon as it came", len(frags), took)
+	}
+
+	// The hold never runs into the resolver's retry
+	h.ResponseHold = 5 * time.Second
+	if _, took = timedPoll(t, h, "n3"); took > MaxResponseHold+200*time.Millisecond {
+		t.Errorf("empty poll held for %v, want at most %v", took, MaxResponseHold)
+	}
+}
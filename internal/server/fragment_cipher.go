@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+)
+
+// errRekey: a session's fragments are already sealed under another client key
+var errRekey = errors.New("session already has a fragment key")
+
+// ExchangeKeys answers the client's key exchange (see crypto.FragmentCipher)
+// with identity and returns the reply to send back. From then on the
+// session's fragments are sealed. A retried exchange with the same client
+// key gets the same reply and keeps the cipher, so its counters never
+// restart under the same keys; a different key is refused.
+func (s *Session) ExchangeKeys(identity ed25519.PrivateKey, clientKey []byte) ([]byte, error) {
+	s.cipherMu.Lock()
+	defer s.cipherMu.Unlock()
+	if s.cipher.Load() != nil {
+		if bytes.Equal(clientKey, s.keyPeer) {
+			return s.keyReply, nil
+		}
+		return nil, errRekey
+	}
+	cipher, reply, err := crypto.AnswerFragmentKeyExchange(identity, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	s.keyPeer, s.keyReply = bytes.Clone(clientKey), reply
+	s.cipher.Store(cipher)
+	return reply, nil
+}
+
+// Cipher returns the session's fragment cipher, nil until the client ran the key exchange
+func (s *Session) Cipher() *crypto.FragmentCipher {
+	return s.cipher.Load()
+}
+
+// sealFragments returns frags sealed with the session's cipher, or frags itself without one
+func sealFragments(sess *Session, frags [][]byte) [][]byte {
+	cipher := sess.Cipher()
+	if cipher == nil {
+		return frags
+	}
+	sealed := make([][]byte, len(frags))
+	for i, frag := range frags {
+		sealed[i] = cipher.Seal(frag)
+	}
+	return sealed
+}
+
+// answerKeyExchange runs the key exchange of a key.<base32 key> query on sess
+// with the identity key of the session's domain
+func (h *DNSHandler) answerKeyExchange(sess *Session, dataLabels []string) ([]byte, error) {
+	if h.IdentityKey == nil {
+		return nil, errors.New("no identity key for fragment encryption")
+	}
+	identity := h.IdentityKey(sess.Domain())
+	if identity == nil {
+		return nil, errors.New("no identity key for the session's domain")
+	}
+	clientKey, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.Join(dataLabels[1:], "")))
+	if err != nil {
+		return nil, err
+	}
+	if len(clientKey) != crypto.FragmentKeySize {
+		return nil, errors.New("key exchange key has the wrong size")
+	}
+	return sess.ExchangeKeys(identity, clientKey)
+}
+
+// isKeyQuery reports whether the data labels form a key exchange
+// (key.<base32 key>); like "poll", the label is too short to start a fragment
+func isKeyQuery(dataLabels []string) bool {
+	return len(dataLabels) > 1 && strings.EqualFold(dataLabels[0], protocol.KeyExchangeLabel)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+)
+
+// tunnelPair is a client transport and a QUIC server joined in-process
+// through the loopback harness
+type tunnelPair struct {
+	handler  *DNSHandler
+	listener *quic.Listener
+	client   *quic.Conn
+}
+
+// newTunnelPair runs the QUIC handshake over a loopback transport damaged by
+// imp and starts a server that echoes every stream back
+func newTunnelPair(t *testing.T, imp protocol.Impairment) *tunnelPair {
+	t.Helper()
+	return newTunnelPairServing(t, imp, nil, echoStream)
+}
+
+// newTunnelPairServing is newTunnelPair with the server's VirtualConn tuned by
+// configure, if set, and every stream the client opens passed to serve
+func newTunnelPairServing(t testing.TB, imp protocol.Impairment, configure func(*VirtualConn), serve func(*quic.Stream)) *tunnelPair {
+	t.Helper()
+	pub, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := crypto.GetTLSConfig(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestHandler()
+	if configure != nil {
+		configure(h.Injector)
+	}
+	transport := &quic.Transport{Conn: h.Injector, VerifySourceAddress: func(net.Addr) bool { return true }}
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:          30 * time.Second,
+		InitialPacketSize:       600,
+		DisablePathMTUDiscovery: true,
+	}
+	listener, err := transport.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveStreams(listener, serve)
+
+	logger := zerolog.Nop()
+	dnsConn, err := protocol.NewDnsPacketConnWithOptions([]string{protocol.LoopbackResolverAddr.String()}, testDomain, testSession, protocol.DnsConnOptions{
+		Logger:     &logger,
+		Transport:  protocol.NewLoopbackConn(h.LoopbackResponder(testSource)),
+		Impairment: imp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dnsConn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	pins := crypto.NewPinSet([]string{crypto.PublicKeyFingerprint(pub)})
+	client, err := quic.Dial(ctx, dnsConn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, crypto.GetClientTLSConfigPinSet(pins), quicConfig)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	t.Cleanup(func() { client.CloseWithError(0, "") })
+	return &tunnelPair{handler: h, listener: listener, client: client}
+}
+
+// serveStreams passes every stream of every connection listener accepts to serve
+func serveStreams(listener *quic.Listener, serve func(*quic.Stream)) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go serve(stream)
+			}
+		}()
+	}
+}
+
+// echoStream sends everything read from stream back
+func echoStream(stream *quic.Stream) {
+	io.Copy(stream, stream)
+	stream.Close()
+}
+
+// echo sends data through a new stream and returns what comes back
+func (p *tunnelPair) echo(t *testing.T, data []byte) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	stream, err := p.client.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(60 * time.Second))
+	go func() {
+		stream.Write(data)
+		stream.Close()
+	}()
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("read after %d of %d bytes: %v", len(got), len(data), err)
+	}
+	return got
+}
+
+func TestTunnelOverImpairedTransport(t *testing.T) {
+	if testing.Short() {
+		t.Skip("transfers over a simulated lossy link")
+	}
+	for _, tt := range []struct {
+		name string
+		imp  protocol.Impairment
+	}{
+		{"clean", protocol.Impairment{}},
+		{"loss", protocol.Impairment{LossRate: 0.1}},
+		{"duplication", protocol.Impairment{DupRate: 0.3}},
+		{"reordering", protocol.Impairment{ReorderDepth: 4}},
+		{"all", protocol.Impairment{LossRate: 0.05, DupRate: 0.2, ReorderDepth: 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTunnelPair(t, tt.imp)
+			data := make([]byte, 32*1024)
+			rand.Read(data)
+			if got := p.echo(t, data); !bytes.Equal(got, data) {
+				t.Fatalf("got %d bytes back, want the %d sent intact", len(got), len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// helpEscaper escapes HELP text as the text exposition format requires
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Metrics counts tunnel traffic for a Prometheus scrape. DNSHandler,
+// VirtualConn and SessionManager increment it when their Metrics field is
+// set; a nil *Metrics counts nothing.
+type Metrics struct {
+	// Sessions backs the active sessions gauge; nil reports 0
+	Sessions *SessionManager
+
+	queries         atomic.Uint64
+	fragmentsIn     atomic.Uint64
+	fragmentsOut    atomic.Uint64
+	reassembled     atomic.Uint64
+	dropped         atomic.Uint64
+	creditTimeouts  atomic.Uint64
+	sessionsCreated atomic.Uint64
+}
+
+func (m *Metrics) addQuery() {
+	if m != nil {
+		m.queries.Add(1)
+	}
+}
+
+func (m *Metrics) addFragmentIn() {
+	if m != nil {
+		m.fragmentsIn.Add(1)
+	}
+}
+
+func (m *Metrics) addFragmentsOut(n int) {
+	if m != nil {
+		m.fragmentsOut.Add(uint64(n))
+	}
+}
+
+func (m *Metrics) addReassembled() {
+	if m != nil {
+		m.reassembled.Add(1)
+	}
+}
+
+func (m *Metrics) addDropped(n int) {
+	if m != nil {
+		m.dropped.Add(uint64(n))
+	}
+}
+
+func (m *Metrics) addCreditTimeout() {
+	if m != nil {
+		m.creditTimeouts.Add(1)
+	}
+}
+
+func (m *Metrics) addSessionCreated() {
+	if m != nil {
+		m.sessionsCreated.Add(1)
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metric := func(name, kind, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, helpEscaper.Replace(help), name, kind, name, value)
+	}
+	metric("slipstream_queries_received_total", "counter", "DNS queries received.", m.queries.Load())
+	metric("slipstream_fragments_injected_total", "counter", "Upstream fragments decoded and handed to reassembly.", m.fragmentsIn.Load())
+	metric("slipstream_fragments_sent_total", "counter", "Downstream fragments sent in DNS responses.", m.fragmentsOut.Load())
+	metric("slipstream_packets_reassembled_total", "counter", "Upstream packets reassembled from their fragments.", m.reassembled.Load())
+	metric("slipstream_packets_dropped_total", "counter", "Packets dropped because a session's FragQueue or the QUIC input queue was full.", m.dropped.Load())
+	metric("slipstream_credit_timeouts_total", "counter", "Downstream packets queued without credit after waiting a second for the client to catch up.", m.creditTimeouts.Load())
+	metric("slipstream_sessions_created_total", "counter", "Sessions created.", m.sessionsCreated.Load())
+	var active int
+	if m.Sessions != nil {
+		active = m.Sessions.Count()
+	}
+	metric("slipstream_sessions_active", "gauge", "Live sessions.", uint64(active))
+}
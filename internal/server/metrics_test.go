@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricFamily is one metric parsed from the text exposition format
+type metricFamily struct {
+	help, kind string
+	samples    []metricSample
+}
+
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// unescape resolves the escapes the format allows: \\ and \n everywhere, and
+// \" in label values
+func unescape(s string, quotes bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("trailing backslash in %q", s)
+		}
+		switch {
+		case s[i] == '\\':
+			b.WriteByte('\\')
+		case s[i] == 'n':
+			b.WriteByte('\n')
+		case s[i] == '"' && quotes:
+			b.WriteByte('"')
+		default:
+			return "", fmt.Errorf("bad escape \\%c in %q", s[i], s)
+		}
+	}
+	return b.String(), nil
+}
+
+// parseLabels parses the inside of a sample's {...}
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok || !labelName.MatchString(name) {
+			return nil, fmt.Errorf("bad label in %q", s)
+		}
+		end := 0
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return nil, fmt.Errorf("unterminated value for label %s", name)
+		}
+		value, err := unescape(rest[:end], true)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := labels[name]; dup {
+			return nil, fmt.Errorf("label %s repeated", name)
+		}
+		labels[name] = value
+		s = strings.TrimPrefix(rest[end+1:], ",")
+	}
+	return labels, nil
+}
+
+// parseExposition parses text exposition format output, failing t on
+// anything a Prometheus scrape would reject: bad names or escapes, HELP or
+// TYPE repeated or coming after the family's samples, untyped samples
+func parseExposition(t *testing.T, text string) map[string]*metricFamily {
+	t.Helper()
+	if !strings.HasSuffix(text, "\n") {
+		t.Fatal("output doesn't end with a newline")
+	}
+	families := make(map[string]*metricFamily)
+	family := func(name string) *metricFamily {
+		if families[name] == nil {
+			families[name] = &metricFamily{}
+		}
+		return families[name]
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(format string, args ...any) {
+			t.Helper()
+			t.Fatalf("line %d %q: %s", i+1, line, fmt.Sprintf(format, args...))
+		}
+		if line == "" {
+			continue
+		}
+		if comment, ok := strings.CutPrefix(line, "# "); ok {
+			keyword, rest, _ := strings.Cut(comment, " ")
+			name, value, _ := strings.Cut(rest, " ")
+			switch keyword {
+			case "HELP":
+				if !metricName.MatchString(name) {
+					fail("bad metric name")
+				}
+				f := family(name)
+				if f.help != "" || len(f.samples) > 0 {
+					fail("HELP repeated or after samples")
+				}
+				help, err := unescape(value, false)
+				if err != nil {
+					fail("%v", err)
+				}
+				f.help = help
+			case "TYPE":
+				if !metricName.MatchString(name) {
+					fail("bad metric name")
+				}
+				f := family(name)
+				if f.kind != "" || len(f.samples) > 0 {
+					fail("TYPE repeated or after samples")
+				}
+				switch value {
+				case "counter", "gauge", "histogram", "summary", "untyped":
+				default:
+					fail("unknown type %q", value)
+				}
+				f.kind = value
+			}
+			continue
+		}
+
+		var name, labelText, valueText string
+		if open := strings.IndexByte(line, '{'); open >= 0 {
+			closing := strings.LastIndexByte(line, '}')
+			if closing < open {
+				fail("unterminated labels")
+			}
+			name, labelText, valueText = line[:open], line[open+1:closing], strings.TrimPrefix(line[closing+1:], " ")
+		} else {
+			name, valueText, _ = strings.Cut(line, " ")
+		}
+		if !metricName.MatchString(name) {
+			fail("bad metric name")
+		}
+		labels, err := parseLabels(labelText)
+		if err != nil {
+			fail("%v", err)
+		}
+		valueText, _, _ = strings.Cut(valueText, " ") // Optional timestamp
+		value, err := strconv.ParseFloat(valueText, 64)
+		if err != nil {
+			fail("bad value: %v", err)
+		}
+		f := families[name]
+		if f == nil || f.kind == "" {
+			fail("sample without a TYPE line")
+		}
+		f.samples = append(f.samples, metricSample{labels: labels, value: value})
+	}
+	return families
+}
+
+func TestMetricsExposition(t *testing.T) {
+	h := newTestHandler()
+	m := &Metrics{Sessions: h.Sessions}
+	h.Metrics, h.Sessions.Metrics, h.Injector.Metrics = m, m, m
+	for i := range 3 {
+		ask(t, h, fmt.Sprintf("poll.n%d.%s.%s", i, testSession, testDomain))
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	families := parseExposition(t, rec.Body.String())
+
+	want := map[string]float64{
+		"slipstream_queries_received_total":    3,
+		"slipstream_fragments_injected_total":  0,
+		"slipstream_fragments_sent_total":      0,
+		"slipstream_packets_reassembled_total": 0,
+		"slipstream_packets_dropped_total":     0,
+		"slipstream_credit_timeouts_total":     0,
+		"slipstream_sessions_created_total":    1,
+		"slipstream_sessions_active":           1,
+	}
+	if len(families) != len(want) {
+		t.Errorf("got %d metrics, want %d", len(families), len(want))
+	}
+	for name, value := range want {
+		f := families[name]
+		switch {
+		case f == nil:
+			t.Errorf("%s missing", name)
+		case f.help == "":
+			t.Errorf("%s has no HELP", name)
+		case strings.HasSuffix(name, "_total") != (f.kind == "counter"):
+			t.Errorf("%s is a %s", name, f.kind)
+		case len(f.samples) != 1 || f.samples[0].value != value:
+			t.Errorf("%s samples %v, want one of %v", name, f.samples, value)
+		}
+	}
+
+	// HELP text survives backslashes and newlines
+	help := `C:\path` + "\nsecond line"
+	if got, err := unescape(helpEscaper.Replace(help), false); err != nil || got != help {
+		t.Errorf("escaped HELP read back as %q, %v", got, err)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitPruneInterval: buckets idle long enough to be full again are dropped this often
+	rateLimitPruneInterval = 10 * time.Second
+	// maxRateBuckets bounds the keys tracked, so a flood of spoofed sources
+	// can't grow the map without end; past it unknown keys share one bucket
+	maxRateBuckets = 1 << 16
+)
+
+// RateLimiter caps queries per second per key (a session ID or source IP)
+// with token buckets holding one second of queries, so short bursts such as
+// a client's parallel polls pass while a sustained flood is refused. A nil
+// *RateLimiter allows everything.
+type RateLimiter struct {
+	rate float64 // queries per second, also the burst
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastPrune time.Time
+	// overflow limits every key that found the map full, together
+	overflow rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for qps queries per second per key, or nil if qps <= 0
+func NewRateLimiter(qps int) *RateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:      float64(qps),
+		buckets:   make(map[string]*rateBucket),
+		lastPrune: time.Now(),
+		overflow:  rateBucket{tokens: float64(qps), last: time.Now()},
+	}
+}
+
+// QPS returns the limit the limiter was created with, 0 for a nil limiter
+func (l *RateLimiter) QPS() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.rate)
+}
+
+// Allow takes a query's worth of credit from key's bucket and reports whether there was any
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= rateLimitPruneInterval {
+		l.pruneLocked(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			// Fail closed: a flood past the cap gets one key's worth in all
+			b = &l.overflow
+		} else {
+			b = &rateBucket{tokens: l.rate, last: now}
+			l.buckets[key] = b
+		}
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneLocked forgets buckets that have refilled completely
+func (l *RateLimiter) pruneLocked(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.rate {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
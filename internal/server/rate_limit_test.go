@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := NewRateLimiter(10)
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if l.Allow("client") {
+			allowed++
+		}
+	}
+	// One second of burst, plus whatever refilled while the loop ran
+	if allowed < 10 || allowed > 11 {
+		t.Errorf("allowed %d of 100 back-to-back queries at 10 qps, want the burst of 10", allowed)
+	}
+	if !l.Allow("other") {
+		t.Error("one key's flood limited another")
+	}
+	if NewRateLimiter(0) != nil || !(*RateLimiter)(nil).Allow("x") {
+		t.Error("a zero limit should be a nil limiter that allows everything")
+	}
+}
+
+func TestRateLimiterFloodOfKeys(t *testing.T) {
+	const qps = 10
+	l := NewRateLimiter(qps)
+	// Fill the table with spoofed sources, one query each
+	for i := 0; i < maxRateBuckets; i++ {
+		l.Allow(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff))
+	}
+	if len(l.buckets) != maxRateBuckets {
+		t.Fatalf("tracking %d keys, want the cap of %d", len(l.buckets), maxRateBuckets)
+	}
+
+	// New keys past the cap share one bucket instead of going unlimited
+	allowed := 0
+	for i := 0; i < 1000; i++ {
+		if l.Allow(fmt.Sprintf("192.168.%d.%d", i>>8, i&0xff)) {
+			allowed++
+		}
+	}
+	if allowed < qps || allowed > qps+1 {
+		t.Errorf("allowed %d queries from 1000 new keys past the cap, want one key's burst of %d", allowed, qps)
+	}
+	if len(l.buckets) != maxRateBuckets {
+		t.Errorf("the table grew to %d keys", len(l.buckets))
+	}
+	// Keys already tracked keep their own buckets
+	if !l.Allow("10.0.0.1") {
+		t.Error("a tracked key was refused by the flood of new ones")
+	}
+}
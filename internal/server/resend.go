@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/binary"
+
+	"slipstream-go/internal/protocol"
+)
+
+const (
+	// ResendWindow is how many recently sent downstream packets a session keeps for nacks
+	ResendWindow = 64
+	// MaxResendQueue caps fragments waiting to be resent per session
+	MaxResendQueue = 64
+)
+
+// sentWindow remembers the fragments of the last ResendWindow downstream
+// packets by packet ID. Packet IDs are random, so a reused ID simply replaces
+// the older packet. Guarded by Session.drainMu.
+type sentWindow struct {
+	byID  map[uint16][][]byte
+	order []uint16 // Insertion order for eviction
+}
+
+// record remembers a fragment as it is handed to a DNS response
+func (w *sentWindow) record(frag []byte) {
+	if len(frag) < protocol.FragHeaderLen {
+		return
+	}
+	id := binary.BigEndian.Uint16(frag[0:2])
+	total, seq := protocol.FragTotal(frag), int(frag[3])
+	if total == 0 || seq >= total {
+		return
+	}
+
+	if w.byID == nil {
+		w.byID = make(map[uint16][][]byte)
+	}
+	frags, ok := w.byID[id]
+	if !ok || len(frags) != total {
+		if !ok {
+			if len(w.order) >= ResendWindow {
+				delete(w.byID, w.order[0])
+				w.order = w.order[1:]
+			}
+			w.order = append(w.order, id)
+		}
+		frags = make([][]byte, total)
+		w.byID[id] = frags
+	}
+	frags[seq] = frag
+}
+
+// lookup returns the recorded fragments a nack names
+func (w *sentWindow) lookup(n protocol.Nack) [][]byte {
+	frags := w.byID[n.PacketID]
+	var out [][]byte
+	for _, seq := range n.Seqs() {
+		if seq < len(frags) && frags[seq] != nil {
+			out = append(out, frags[seq])
+		}
+	}
+	return out
+}
+
+// Resend queues the fragments named by nacks ahead of new downstream data and
+// returns how many were found. Fragments of packets that fell out of the
+// window are left to QUIC.
+func (s *Session) Resend(nacks []protocol.Nack) int {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	queued := 0
+	for _, n := range nacks {
+		for _, frag := range s.sent.lookup(n) {
+			if len(s.resend) >= MaxResendQueue {
+				return queued
+			}
+			s.resend = append(s.resend, frag)
+			queued++
+		}
+	}
+	return queued
+}
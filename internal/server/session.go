@@ -2,50 +2,700 @@ package server
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
 )
 
 type Session struct {
 	ID          string
 	Queue       chan []byte   // Full QUIC packets (for backward compat)
-	FragQueue   chan []byte   // Pre-fragmented chunks for DNS responses
-	Reassembler *Reassembler
+	FragQueue   chan []byte   // Pre-fragmented chunks for DNS responses, filled through Enqueue
+	Reassembler *protocol.Reassembler
 	LastSeen    time.Time
 	mu          sync.Mutex
+	domain      string       // Tunnel domain the session's queries arrive on
+	client      string       // Name of the client key the session authenticated with (see ClientKeys)
+	sizeHint    atomic.Int32 // Response size the client asked for, 0 = none (see protocol.ParseSizeHint)
+
+	// drainMu serializes FragQueue draining so concurrent responses don't interleave
+	// fragments of the same packet; carry holds a packet start deferred to the next response
+	drainMu sync.Mutex
+	carry   []byte
+	// spill holds whole packets that didn't fit in FragQueue
+	spill *protocol.SpillQueue
+	// sent keeps recently sent packets and resend holds nacked fragments that
+	// go out before anything else (see Resend)
+	sent   sentWindow
+	resend [][]byte
+
+	// streams counts the QUIC streams currently open on the session (see OpenStream)
+	streams atomic.Int32
+	// fec is set once the client asked for FEC downstream in its capability hello
+	fec atomic.Bool
+	// compress is set once the client asked for compression downstream
+	compress atomic.Bool
+	// creditOn is set once the client asked for CapCredit, and credit counts
+	// the fragments sent and acknowledged since (see credit.go)
+	creditOn atomic.Bool
+	credit   creditState
+	// sequence is set once the client asked for consecutive downstream packet
+	// IDs, the last of which is lastPacketID (see NextPacketID)
+	sequence     atomic.Bool
+	lastPacketID atomic.Uint32
+	// rawBase64 is set once the client asked for unpadded base64url TXT
+	// answers, txtMulti once it asked for all of a response's in one record
+	rawBase64 atomic.Bool
+	txtMulti  atomic.Bool
+	// cipher seals downstream and opens upstream fragments once the client
+	// ran the key exchange (see fragment_cipher.go)
+	cipherMu sync.Mutex
+	cipher   atomic.Pointer[crypto.FragmentCipher]
+	keyPeer  []byte
+	keyReply []byte
+	// replay holds the session token counters seen, replayTCP those seen
+	// again over TCP (see AcceptToken)
+	replay, replayTCP crypto.ReplayWindow
+	// bytesUp and bytesDown count upstream fragment bytes received and
+	// downstream packet bytes queued (see AddBytesUp, AddBytesDown)
+	bytesUp, bytesDown atomic.Uint64
+
+	// ready is closed (and replaced) whenever downstream data is queued, waking held long polls
+	readyMu sync.Mutex
+	ready   chan struct{}
+}
+
+// Ready returns a channel that is closed the next time downstream data is queued
+func (s *Session) Ready() <-chan struct{} {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	if s.ready == nil {
+		s.ready = make(chan struct{})
+	}
+	return s.ready
+}
+
+// NotifyReady wakes everyone waiting on Ready
+func (s *Session) NotifyReady() {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	if s.ready != nil {
+		close(s.ready)
+		s.ready = nil
+	}
+}
+
+// WaitReady blocks until downstream data is queued or hold passes and reports
+// whether data is waiting
+func (s *Session) WaitReady(hold time.Duration) bool {
+	ready := s.Ready()
+	if s.Backlog() > 0 {
+		return true
+	}
+	timer := time.NewTimer(hold)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return s.Backlog() > 0
+	}
+}
+
+// OpenStream accounts a new stream unless max (> 0) are already open, and
+// reports whether it was accepted; accepted streams end with CloseStream
+func (s *Session) OpenStream(max int) bool {
+	for {
+		n := s.streams.Load()
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if s.streams.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// CloseStream releases a stream accounted by OpenStream
+func (s *Session) CloseStream() {
+	s.streams.Add(-1)
+}
+
+// Streams returns the number of open streams
+func (s *Session) Streams() int {
+	return int(s.streams.Load())
+}
+
+// EnableFEC records that the client rebuilds FEC packets and wants them downstream
+func (s *Session) EnableFEC() {
+	s.fec.Store(true)
+}
+
+// FEC reports whether downstream packets may carry parity fragments
+func (s *Session) FEC() bool {
+	return s.fec.Load()
+}
+
+// EnableCompression records that the client inflates compressed packets
+// and wants them downstream
+func (s *Session) EnableCompression() {
+	s.compress.Store(true)
+}
+
+// Compression reports whether downstream packets may be compressed
+func (s *Session) Compression() bool {
+	return s.compress.Load()
+}
+
+// EnableSequence records that the client restores downstream packet order
+// and wants packet IDs that count up
+func (s *Session) EnableSequence() {
+	s.sequence.Store(true)
+}
+
+// Sequence reports whether downstream packets get consecutive IDs
+func (s *Session) Sequence() bool {
+	return s.sequence.Load()
+}
+
+// NextPacketID returns the ID of the session's next downstream packet
+func (s *Session) NextPacketID() uint16 {
+	return uint16(s.lastPacketID.Add(1))
+}
+
+// EnableRawBase64 records that the client decodes unpadded base64url
+func (s *Session) EnableRawBase64() {
+	s.rawBase64.Store(true)
+}
+
+// RawBase64 reports whether TXT answers use unpadded base64url
+func (s *Session) RawBase64() bool {
+	return s.rawBase64.Load()
+}
+
+// EnableTXTMulti records that the client decodes a fragment per
+// character-string of a TXT record
+func (s *Session) EnableTXTMulti() {
+	s.txtMulti.Store(true)
+}
+
+// TXTMulti reports whether a response's TXT fragments share one record
+func (s *Session) TXTMulti() bool {
+	return s.txtMulti.Load()
+}
+
+// AddBytesUp counts upstream fragment bytes received for the session
+func (s *Session) AddBytesUp(n int) {
+	s.bytesUp.Add(uint64(n))
+}
+
+// AddBytesDown counts downstream packet bytes queued for the session
+func (s *Session) AddBytesDown(n int) {
+	s.bytesDown.Add(uint64(n))
+}
+
+// SetDomain records the tunnel domain of the session; the first one wins
+func (s *Session) SetDomain(domain string) {
+	s.mu.Lock()
+	if s.domain == "" {
+		s.domain = domain
+	}
+	s.mu.Unlock()
+}
+
+// Domain returns the tunnel domain the session was opened on
+func (s *Session) Domain() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domain
+}
+
+// SetClient records the client key the session authenticated with; the first one wins
+func (s *Session) SetClient(name string) {
+	s.mu.Lock()
+	if s.client == "" {
+		s.client = name
+	}
+	s.mu.Unlock()
+}
+
+// AcceptToken records the counter of a query's session token and reports
+// whether the query is new rather than a replay. Over TCP a counter already
+// seen is accepted once more: that is how a truncated UDP answer is fetched
+// again, by the resolver itself or by the client's TCP fallback.
+func (s *Session) AcceptToken(counter uint32, tcp bool) bool {
+	if s.replay.Accept(counter) {
+		if tcp {
+			s.replayTCP.Accept(counter)
+		}
+		return true
+	}
+	return tcp && s.replayTCP.Accept(counter)
+}
+
+// Client returns the name of the client key the session authenticated with, if any
+func (s *Session) Client() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// SetResponseLimit records the response size the client asked the server to keep to
+func (s *Session) SetResponseLimit(size int) {
+	s.sizeHint.Store(int32(size))
+}
+
+// ResponseLimit returns the client's response size hint, or 0 if it sent none
+func (s *Session) ResponseLimit() int {
+	return int(s.sizeHint.Load())
+}
+
+// Enqueue queues the fragments of one downstream packet, all or none of them,
+// and returns how many whole packets were dropped to make room
+func (s *Session) Enqueue(frags [][]byte) int {
+	return s.spill.Enqueue(s.FragQueue, frags)
+}
+
+// WaitRoom blocks until n fragments fit in the queue without evicting
+// anything or protocol.SpillWait passes, and reports whether they fit
+func (s *Session) WaitRoom(n int) bool {
+	return s.spill.WaitRoom(s.FragQueue, n, nil)
+}
+
+// NextFragments pulls up to max fragments for one DNS response. Draining is
+// serialized per session and a packet that would not fit in the remaining slots
+// is deferred whole to the next response, so a single lost response takes out
+// as few packets as possible. Packets larger than max are still split.
+// Fragments queued by Resend go out first.
+func (s *Session) NextFragments(max int) [][]byte {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	var frags [][]byte
+	for len(frags) < max {
+		var frag []byte
+		if len(s.resend) > 0 {
+			// Nacked fragments first: they complete packets the client is waiting on
+			frag, s.resend = s.resend[0], s.resend[1:]
+			if len(s.resend) == 0 {
+				s.resend = nil
+			}
+			frags = append(frags, frag)
+			continue
+		}
+		if s.carry != nil {
+			frag, s.carry = s.carry, nil
+		} else {
+			select {
+			case frag = <-s.FragQueue:
+				s.spill.Refill(s.FragQueue)
+			default:
+				return frags
+			}
+		}
+
+		// Header [ID:2][Total:1][Seq:1]: a packet starts at seq 0
+		if len(frags) > 0 && len(frag) >= protocol.FragHeaderLen && frag[3] == 0 {
+			total := protocol.FragTotal(frag)
+			if total > max-len(frags) && total <= max {
+				s.carry = frag
+				return frags
+			}
+		}
+		s.sent.record(frag)
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// PutBack returns fragments taken by NextFragments that didn't fit in the
+// response after all; they go out first on the next poll
+func (s *Session) PutBack(frags [][]byte) {
+	if len(frags) == 0 {
+		return
+	}
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	s.resend = append(append([][]byte(nil), frags...), s.resend...)
+}
+
+// Close drops everything queued for the session and frees its reassembly
+// buffers; the SessionManager calls it once the session is forgotten
+func (s *Session) Close() {
+	s.drainMu.Lock()
+	s.carry, s.resend, s.sent = nil, nil, sentWindow{}
+	s.spill.Clear()
+	for drained := false; !drained; {
+		select {
+		case <-s.FragQueue:
+		case <-s.Queue:
+		default:
+			drained = true
+		}
+	}
+	s.drainMu.Unlock()
+	s.Reassembler.Reset()
+	// Held long polls answer now rather than at the end of their hold
+	s.NotifyReady()
+}
+
+// Backlog returns the number of downstream fragments waiting for a poll
+func (s *Session) Backlog() int {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	n := len(s.FragQueue) + s.spill.Len() + len(s.resend)
+	if s.carry != nil {
+		n++
+	}
+	return n
+}
+
+// SessionTTL is how long a session lives without a query before it is
+// forgotten, unless SessionOptions.TTL says otherwise
+const SessionTTL = 5 * time.Minute
+
+// SessionDrainTimeout bounds how long a closing session waits for polls to pick up its last fragments
+const SessionDrainTimeout = 5 * time.Second
+
+// Drain waits until every queued downstream fragment has been handed to a
+// DNS response or the deadline passes. Returns true if the queue emptied.
+func (s *Session) Drain(deadline time.Time) bool {
+	for {
+		if s.Backlog() == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 type SessionManager struct {
 	store *cache.Cache
+	// owners maps a session ID to the QUIC connection that owns it (see Claim)
+	ownersMu sync.Mutex
+	owners   map[string]any
+	// draining rejects new sessions while known ones keep being served
+	draining atomic.Bool
+	// Metrics, if set, counts sessions created (see Metrics)
+	Metrics *Metrics
+	// Logger receives session logs; nil falls back to the global zerolog logger
+	Logger *zerolog.Logger
+	// OnExpire, if set, is called with the ID and owner (see Claim) of a
+	// session that expired while a connection still owned it, so the
+	// connection can be closed; it is not called while draining
+	OnExpire func(id string, owner any)
+
+	// createMu serializes session creation so maxSessions holds
+	createMu    sync.Mutex
+	maxSessions int
+	// reassemblyTimeout is every new session's Reassembler.Timeout
+	reassemblyTimeout time.Duration
+}
+
+// SessionOptions tunes a SessionManager; zero values select the defaults
+type SessionOptions struct {
+	// TTL is how long a session lives without a query (default SessionTTL)
+	TTL time.Duration
+	// MaxSessions caps live sessions; GetOrCreate refuses new ones beyond it
+	// (0 = unlimited)
+	MaxSessions int
+	// ReassemblyTimeout is how long an upstream packet may wait for missing
+	// fragments before it is given up on (default protocol.ReassemblyTimeout)
+	ReassemblyTimeout time.Duration
+	// Logger receives session logs; nil falls back to the global zerolog logger
+	Logger *zerolog.Logger
+}
+
+// logger returns the configured logger or the global one
+func (sm *SessionManager) logger() *zerolog.Logger {
+	if sm.Logger != nil {
+		return sm.Logger
+	}
+	return &log.Logger
 }
 
 func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		// 5 minute default expiration, cleanup every 10 minutes
-		// Sessions are refreshed on every access via GetOrCreate
-		store: cache.New(5*time.Minute, 10*time.Minute),
+	return NewSessionManagerWithOptions(SessionOptions{})
+}
+
+// NewSessionManagerWithOptions creates a SessionManager tuned by opts
+func NewSessionManagerWithOptions(opts SessionOptions) *SessionManager {
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = SessionTTL
 	}
+	sm := &SessionManager{
+		// Sessions are refreshed on every access via GetOrCreate; expired
+		// ones are swept every minute (or TTL) so their connections close in time
+		store:       cache.New(ttl, min(ttl, time.Minute)),
+		owners:      make(map[string]any),
+		maxSessions: opts.MaxSessions,
+		Logger:      opts.Logger,
+
+		reassemblyTimeout: opts.ReassemblyTimeout,
+	}
+	sm.store.OnEvicted(sm.evicted)
+	return sm
 }
 
-func (sm *SessionManager) GetOrCreate(id string) *Session {
+// evicted closes a session leaving the store, removed or expired. A
+// connection still owning it was not done with it: no query arrived for
+// the session's lifetime, so the client is gone or stuck and the connection is handed to
+// OnExpire rather than left waiting for its idle timeout.
+func (sm *SessionManager) evicted(id string, val any) {
+	val.(*Session).Close()
+	sm.ownersMu.Lock()
+	owner, owned := sm.owners[id]
+	delete(sm.owners, id)
+	sm.ownersMu.Unlock()
+	if owned && sm.OnExpire != nil && !sm.Draining() {
+		sm.logger().Info().Str("sess", id).Msg("Session expired with its connection open, closing it")
+		sm.OnExpire(id, owner)
+	}
+}
+
+// StartDraining stops creating new sessions; existing sessions are unaffected
+func (sm *SessionManager) StartDraining() {
+	sm.draining.Store(true)
+}
+
+// Draining reports whether the manager is rejecting new sessions
+func (sm *SessionManager) Draining() bool {
+	return sm.draining.Load()
+}
+
+// Get returns an existing session without creating or refreshing it
+func (sm *SessionManager) Get(id string) *Session {
 	if val, found := sm.store.Get(id); found {
-		sess := val.(*Session)
-		// Refresh TTL on every access to keep session alive
-		sm.store.Set(id, sess, cache.DefaultExpiration)
+		return val.(*Session)
+	}
+	return nil
+}
+
+// Remove forgets a session. Unlike expiry it leaves the connection owning
+// the session alone: whoever removes it is done with the session.
+func (sm *SessionManager) Remove(id string) {
+	sm.ownersMu.Lock()
+	delete(sm.owners, id)
+	sm.ownersMu.Unlock()
+	sm.store.Delete(id)
+}
+
+// DrainAll waits for every session's downstream queue to empty or the deadline to pass
+func (sm *SessionManager) DrainAll(deadline time.Time) {
+	for _, item := range sm.store.Items() {
+		item.Object.(*Session).Drain(deadline)
+	}
+}
+
+// CloseAll refuses new sessions, waits until every session's queued
+// downstream fragments were picked up by polls or the deadline passes, and
+// removes the sessions. It returns the number of sessions that still had
+// fragments queued at the deadline.
+func (sm *SessionManager) CloseAll(deadline time.Time) int {
+	sm.StartDraining()
+	var wg sync.WaitGroup
+	var undelivered atomic.Int32
+	for id, item := range sm.store.Items() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !item.Object.(*Session).Drain(deadline) {
+				undelivered.Add(1)
+			}
+			sm.Remove(id)
+		}()
+	}
+	wg.Wait()
+	return int(undelivered.Load())
+}
+
+// Stats returns upstream fragment counters and open streams for every live session
+func (sm *SessionManager) Stats() []SessionStats {
+	items := sm.store.Items()
+	stats := make([]SessionStats, 0, len(items))
+	for id, item := range items {
+		sess := item.Object.(*Session)
+		stats = append(stats, SessionStats{ID: id, Upstream: sess.Reassembler.Stats(), Streams: sess.Streams()})
+	}
+	return stats
+}
+
+// Snapshot returns the state of every live session, for debugging stuck tunnels
+func (sm *SessionManager) Snapshot() []SessionStat {
+	items := sm.store.Items()
+	snapshot := make([]SessionStat, 0, len(items))
+	for id, item := range items {
+		sess := item.Object.(*Session)
 		sess.mu.Lock()
-		sess.LastSeen = time.Now()
+		lastSeen := sess.LastSeen
 		sess.mu.Unlock()
+		pending, pendingBytes := sess.Reassembler.Pending()
+		snapshot = append(snapshot, SessionStat{
+			ID:             id,
+			Domain:         sess.Domain(),
+			Client:         sess.Client(),
+			LastSeen:       lastSeen,
+			Streams:        sess.Streams(),
+			PendingPackets: pending,
+			PendingBytes:   pendingBytes,
+			FragQueue:      len(sess.FragQueue),
+			Backlog:        sess.Backlog(),
+			BytesUp:        sess.bytesUp.Load(),
+			BytesDown:      sess.bytesDown.Load(),
+			FEC:            sess.FEC(),
+			Compression:    sess.Compression(),
+		})
+	}
+	return snapshot
+}
+
+// Migrate follows a QUIC connection its client moved from one session ID to
+// another (see protocol.DnsPacketConn.Rebind): the new session gets what the
+// client negotiated on the old one, and the old one, which no poll will ask
+// for again, is forgotten along with its queued fragments
+func (sm *SessionManager) Migrate(from, to string) {
+	old, sess := sm.Get(from), sm.Get(to)
+	if old != nil && sess != nil {
+		if old.FEC() {
+			sess.EnableFEC()
+		}
+		if old.Compression() {
+			sess.EnableCompression()
+		}
+		if old.RawBase64() {
+			sess.EnableRawBase64()
+		}
+		if old.TXTMulti() {
+			sess.EnableTXTMulti()
+		}
+		if old.Sequence() {
+			// Carry the numbering on, or the client would take the restart for a jump
+			sess.lastPacketID.Store(old.lastPacketID.Load())
+			sess.EnableSequence()
+		}
+		if old.Credit() {
+			// The client's count runs on across the move
+			sess.carryCredit(old)
+			sess.EnableCredit()
+		}
+		if limit := old.ResponseLimit(); limit > 0 && sess.ResponseLimit() == 0 {
+			sess.SetResponseLimit(limit)
+		}
+	}
+	sm.Remove(from)
+}
+
+// Claim ties a session ID to the QUIC connection owner. It returns false if a
+// different connection already owns the ID: two clients generated the same
+// session ID, their fragments share one queue, and the newcomer must be
+// turned away (protocol.CloseCodeSessionInUse) so it retries under a new ID.
+func (sm *SessionManager) Claim(id string, owner any) bool {
+	sm.ownersMu.Lock()
+	defer sm.ownersMu.Unlock()
+	if cur, ok := sm.owners[id]; ok && cur != owner {
+		return false
+	}
+	sm.owners[id] = owner
+	return true
+}
+
+// Release gives up owner's claim on a session ID
+func (sm *SessionManager) Release(id string, owner any) {
+	sm.ownersMu.Lock()
+	defer sm.ownersMu.Unlock()
+	if sm.owners[id] == owner {
+		delete(sm.owners, id)
+	}
+}
+
+// StreamCount returns the number of streams open across all sessions
+func (sm *SessionManager) StreamCount() int {
+	n := 0
+	for _, item := range sm.store.Items() {
+		n += item.Object.(*Session).Streams()
+	}
+	return n
+}
+
+// Count returns the number of live sessions
+func (sm *SessionManager) Count() int {
+	return sm.store.ItemCount()
+}
+
+// GetOrCreate returns the session for id, creating it if needed.
+// Returns nil for unknown sessions while draining or once MaxSessions are live.
+func (sm *SessionManager) GetOrCreate(id string) *Session {
+	if sess := sm.touch(id); sess != nil {
 		return sess
 	}
 
+	if sm.draining.Load() {
+		return nil
+	}
+	sm.createMu.Lock()
+	defer sm.createMu.Unlock()
+	// Another query may have created it meanwhile
+	if sess := sm.touch(id); sess != nil {
+		return sess
+	}
+	// Setting over a session that expired but wasn't swept yet would skip
+	// evicted: take it out through Delete so it is closed and its owner told
+	sm.store.Delete(id)
+	if sm.Full() {
+		return nil
+	}
+
 	sess := &Session{
 		ID:          id,
 		Queue:       make(chan []byte, 2000), // Full packets (legacy)
 		FragQueue:   make(chan []byte, 4000), // Fragments for DNS responses
-		Reassembler: NewReassembler(),
+		Reassembler: protocol.NewReassembler(),
 		LastSeen:    time.Now(),
+		spill:       protocol.NewSpillQueue(protocol.DefaultSpillSize),
+	}
+	sess.Reassembler.Timeout = sm.reassemblyTimeout
+	sess.Reassembler.OnTimeout = func(packetID uint16, received, total int) {
+		sm.logger().Debug().Str("sess", id).Uint16("pktID", packetID).Int("received", received).Int("total", total).Msg("Upstream packet lost in reassembly")
 	}
 	sm.store.Set(id, sess, cache.DefaultExpiration)
+	sm.Metrics.addSessionCreated()
 	return sess
 }
+
+// touch returns the live session for id with its lifetime renewed, or nil
+func (sm *SessionManager) touch(id string) *Session {
+	val, found := sm.store.Get(id)
+	if !found {
+		return nil
+	}
+	sess := val.(*Session)
+	// Refresh TTL on every access to keep session alive. Replace fails once
+	// the session expired, even just now: it leaves through evicted instead.
+	if sm.store.Replace(id, sess, cache.DefaultExpiration) != nil {
+		return nil
+	}
+	sess.mu.Lock()
+	sess.LastSeen = time.Now()
+	sess.mu.Unlock()
+	return sess
+}
+
+// Full reports whether MaxSessions sessions are live, so new ones are refused
+func (sm *SessionManager) Full() bool {
+	if sm.maxSessions <= 0 || sm.store.ItemCount() < sm.maxSessions {
+		return false
+	}
+	// Expired sessions count until the janitor sweeps them: sweep them now
+	// rather than turn a client away for them
+	sm.store.DeleteExpired()
+	return sm.store.ItemCount() >= sm.maxSessions
+}
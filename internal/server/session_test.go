@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog"
+)
+
+// newTestSessions returns a session manager tuned by opts that logs nowhere
+func newTestSessions(opts SessionOptions) *SessionManager {
+	logger := zerolog.Nop()
+	sessions := NewSessionManagerWithOptions(opts)
+	sessions.Logger = &logger
+	return sessions
+}
+
+func TestMaxSessions(t *testing.T) {
+	const limit = 3
+	sessions := newTestSessions(SessionOptions{MaxSessions: limit})
+	for i := range limit {
+		if sessions.GetOrCreate(fmt.Sprintf("sess%d", i)) == nil {
+			t.Fatalf("session %d of %d refused", i+1, limit)
+		}
+	}
+	if !sessions.Full() {
+		t.Errorf("not full with %d of %d sessions", sessions.Count(), limit)
+	}
+	if sessions.GetOrCreate("extra") != nil {
+		t.Fatalf("session %d created past --max-sessions %d", limit+1, limit)
+	}
+	// Live sessions are still served, and a removed one frees its slot
+	if sessions.GetOrCreate("sess0") == nil {
+		t.Fatal("existing session refused at the limit")
+	}
+	sessions.Remove("sess0")
+	if sessions.GetOrCreate("extra") == nil {
+		t.Fatal("new session refused after one was removed")
+	}
+}
+
+func TestMaxSessionsRefused(t *testing.T) {
+	h := newTestHandler()
+	h.Sessions = newTestSessions(SessionOptions{MaxSessions: 2})
+	h.Injector = NewVirtualConn(h.Sessions)
+	for i, id := range []string{"sessaaaa", "sessbbbb", "sesscccc"} {
+		reply := ask(t, h, "poll.x1."+id+"."+testDomain)
+		want := dns.RcodeSuccess
+		if i == 2 {
+			want = dns.RcodeRefused
+		}
+		if reply == nil || reply.Rcode != want {
+			t.Fatalf("session %d: got %v, want %s", i+1, reply, dns.RcodeToString[want])
+		}
+	}
+	if n := h.Sessions.Count(); n != 2 {
+		t.Errorf("%d sessions allocated, want 2", n)
+	}
+}
+
+func TestSessionTTL(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	sessions := newTestSessions(SessionOptions{TTL: ttl, MaxSessions: 1})
+	expired := make(chan string, 1)
+	sessions.OnExpire = func(id string, owner any) { expired <- id }
+
+	// Every query renews the lifetime
+	sessions.GetOrCreate("kept")
+	sessions.Claim("kept", "conn")
+	for range 5 {
+		time.Sleep(ttl / 2)
+		if sessions.GetOrCreate("kept") == nil {
+			t.Fatal("session expired although queried within its TTL")
+		}
+	}
+
+	// Left alone it expires, its connection is closed and its slot freed
+	select {
+	case id := <-expired:
+		if id != "kept" {
+			t.Fatalf("OnExpire called for %q", id)
+		}
+	case <-time.After(10 * ttl):
+		t.Fatal("session still live long past its TTL")
+	}
+	if sessions.Get("kept") != nil {
+		t.Error("expired session still returned")
+	}
+	if sessions.GetOrCreate("next") == nil {
+		t.Error("new session refused after the only one expired")
+	}
+}
+
+func TestSessionIDCollision(t *testing.T) {
+	sessions := newTestSessions(SessionOptions{})
+	const id = "abcde12345"
+	first, second := "first conn", "second conn"
+
+	if !sessions.Claim(id, first) {
+		t.Fatal("first claim refused")
+	}
+	// The owner's own connection may claim again, e.g. when it migrates back
+	if !sessions.Claim(id, first) {
+		t.Error("owner refused its own session ID")
+	}
+	if sessions.Claim(id, second) {
+		t.Fatal("second connection claimed an owned session ID")
+	}
+	// Only the owner's release frees the ID
+	sessions.Release(id, second)
+	if sessions.Claim(id, second) {
+		t.Fatal("a refused connection released the owner's claim")
+	}
+	sessions.Release(id, first)
+	if !sessions.Claim(id, second) {
+		t.Error("claim refused after the owner released the ID")
+	}
+}
+
+func TestExpiredSessionEvictedBeforeSweep(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	sessions := newTestSessions(SessionOptions{TTL: ttl, MaxSessions: 1})
+	// No janitor: expired sessions stay in the store until something evicts them
+	sessions.store = cache.New(ttl, 0)
+	sessions.store.OnEvicted(sessions.evicted)
+	var expired []string
+	sessions.OnExpire = func(id string, owner any) { expired = append(expired, id) }
+
+	old := sessions.GetOrCreate("sessaaaa")
+	sessions.Claim("sessaaaa", "conn")
+	time.Sleep(2 * ttl)
+	// The same ID comes back as a new session, and the expired one is closed
+	// and its connection told rather than overwritten
+	sess := sessions.GetOrCreate("sessaaaa")
+	if sess == nil || sess == old {
+		t.Fatalf("got %p for an expired session (was %p), want a new one", sess, old)
+	}
+	if len(expired) != 1 || expired[0] != "sessaaaa" {
+		t.Fatalf("OnExpire saw %v, want the expired session", expired)
+	}
+	if !sessions.Claim("sessaaaa", "other conn") {
+		t.Error("the expired session's owner still holds its ID")
+	}
+
+	// An expired session doesn't hold a slot against --max-sessions
+	time.Sleep(2 * ttl)
+	if sessions.GetOrCreate("sessbbbb") == nil {
+		t.Fatal("new session refused for a slot held by an expired one")
+	}
+	if n := sessions.Count(); n != 1 {
+		t.Errorf("%d sessions in the store, want 1", n)
+	}
+	if len(expired) != 2 || expired[1] != "sessaaaa" {
+		t.Errorf("OnExpire saw %v, want the swept session too", expired)
+	}
+}
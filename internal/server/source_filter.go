@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SourceFilter restricts which IPs may send queries to the DNS server.
+// Deny entries win over allow entries; an empty allow list allows everyone.
+//
+// Behind a recursive resolver every query arrives from the recursive's egress
+// IPs, so the lists must name those resolvers rather than the end clients.
+// Clients that query the server directly appear with their own address.
+type SourceFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewSourceFilter parses allow/deny lists of CIDRs or bare IPs
+func NewSourceFilter(allow, deny []string) (*SourceFilter, error) {
+	f := &SourceFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", e)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", e, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Allowed reports whether a query from addr may be served
+func (f *SourceFilter) Allowed(addr net.Addr) bool {
+	if f == nil || (len(f.allow) == 0 && len(f.deny) == 0) {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return len(f.allow) == 0
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether the filter has no rules
+func (f *SourceFilter) Empty() bool {
+	return f == nil || (len(f.allow) == 0 && len(f.deny) == 0)
+}
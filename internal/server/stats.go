@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"slipstream-go/internal/protocol"
+)
+
+// RejectLogInterval: rejected queries are logged at most once per interval
+const RejectLogInterval = 10 * time.Second
+
+// HandlerStats is a snapshot of DNS handler counters
+type HandlerStats struct {
+	// RejectedQueries counts queries for unregistered domains or with invalid sessions
+	RejectedQueries uint64
+	// Upstream sums the upstream fragment counters of all live sessions
+	Upstream protocol.FragmentStats
+	// Sessions holds per-session upstream fragment counters
+	Sessions []SessionStats
+}
+
+// SessionStats is a snapshot of one session's upstream reassembly and streams
+type SessionStats struct {
+	ID       string
+	Upstream protocol.FragmentStats
+	// Streams is the number of QUIC streams open on the session
+	Streams int
+}
+
+// SessionStat is a snapshot of one session's state (see SessionManager.Snapshot)
+type SessionStat struct {
+	ID       string    `json:"id"`
+	Domain   string    `json:"domain"`
+	Client   string    `json:"client,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	// Streams is the number of QUIC streams open on the session
+	Streams int `json:"streams"`
+	// PendingPackets and PendingBytes describe upstream packets still missing fragments
+	PendingPackets int `json:"pending_packets"`
+	PendingBytes   int `json:"pending_bytes"`
+	// FragQueue is the FragQueue depth, Backlog every downstream fragment
+	// waiting for a poll (FragQueue, spilled, resends)
+	FragQueue int `json:"frag_queue"`
+	Backlog   int `json:"backlog"`
+	// BytesUp counts upstream fragment bytes received, BytesDown downstream packet bytes queued
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+	FEC         bool   `json:"fec"`
+	Compression bool   `json:"compression"`
+}
+
+// handlerCounters holds the live counters behind HandlerStats
+type handlerCounters struct {
+	rejected atomic.Uint64
+}
+
+// sampledLog lets through one log line per interval and counts what it suppressed
+type sampledLog struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether to log now and how many events were suppressed since the last log
+func (s *sampledLog) allow(interval time.Duration) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.last) < interval {
+		s.suppressed++
+		return false, 0
+	}
+	suppressed := s.suppressed
+	s.last = now
+	s.suppressed = 0
+	return true, suppressed
+}
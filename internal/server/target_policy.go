@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"slipstream-go/internal/proxy"
+)
+
+// TargetPolicy restricts the destinations streams may be tunneled to. It is
+// loaded from a file of "directive value..." lines (# starts a comment):
+//
+//	deny-cidr 10.0.0.0/8 172.16.0.0/12 192.168.0.0/16
+//	allow-domain example.com
+//	allow-port 80 443 8000-8100
+//
+// Deny entries win over allow entries, and each allow list, once it has
+// entries, admits only what it names:
+//   - ports: allow-port / deny-port, single ports or ranges
+//   - names: allow-domain / deny-domain match the domain and its subdomains;
+//     with any allow-domain entry a target given as a bare IP is refused
+//   - addresses: allow-cidr / deny-cidr apply to every address dialed, so a
+//     name resolving into a denied range is refused too
+//
+// A nil *TargetPolicy allows everything.
+type TargetPolicy struct {
+	allowNets, denyNets       []*net.IPNet
+	allowDomains, denyDomains []string
+	allowPorts, denyPorts     []portRange
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+// LoadTargetPolicy reads a policy file
+func LoadTargetPolicy(path string) (*TargetPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &TargetPolicy{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: %s needs a value", path, line, fields[0])
+		}
+		if err := p.add(fields[0], fields[1:]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *TargetPolicy) add(directive string, values []string) error {
+	switch directive {
+	case "allow-cidr", "deny-cidr":
+		nets, err := parseCIDRs(values)
+		if err != nil {
+			return err
+		}
+		if directive == "allow-cidr" {
+			p.allowNets = append(p.allowNets, nets...)
+		} else {
+			p.denyNets = append(p.denyNets, nets...)
+		}
+	case "allow-domain", "deny-domain":
+		for _, v := range values {
+			d := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(v, "*."), "."))
+			if d == "" || net.ParseIP(d) != nil {
+				return fmt.Errorf("invalid domain %q", v)
+			}
+			if directive == "allow-domain" {
+				p.allowDomains = append(p.allowDomains, d)
+			} else {
+				p.denyDomains = append(p.denyDomains, d)
+			}
+		}
+	case "allow-port", "deny-port":
+		for _, v := range values {
+			r, err := parsePortRange(v)
+			if err != nil {
+				return err
+			}
+			if directive == "allow-port" {
+				p.allowPorts = append(p.allowPorts, r)
+			} else {
+				p.denyPorts = append(p.denyPorts, r)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown directive %q", directive)
+	}
+	return nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(loStr)
+	hi := lo
+	if err == nil && isRange {
+		hi, err = strconv.Atoi(hiStr)
+	}
+	if err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return portRange{}, fmt.Errorf("invalid port or range %q", s)
+	}
+	return portRange{lo, hi}, nil
+}
+
+// Check vets a target as the client named it (host:port). An IP literal is
+// checked against the address rules here; a name's addresses are left to
+// CheckAddress at dial time. The error wraps proxy.ErrTargetNotAllowed.
+func (p *TargetPolicy) Check(target string) error {
+	if p == nil {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	if matchPort(p.denyPorts, port) || (len(p.allowPorts) > 0 && !matchPort(p.allowPorts, port)) {
+		return fmt.Errorf("%w: port %d", proxy.ErrTargetNotAllowed, port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if len(p.allowDomains) > 0 {
+			return fmt.Errorf("%w: bare IP %s with a domain allowlist", proxy.ErrTargetNotAllowed, host)
+		}
+		return p.checkIP(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchDomain(p.denyDomains, host) || (len(p.allowDomains) > 0 && !matchDomain(p.allowDomains, host)) {
+		return fmt.Errorf("%w: domain %s", proxy.ErrTargetNotAllowed, host)
+	}
+	return nil
+}
+
+// CheckAddress vets an address about to be dialed (ip:port), which for a
+// named target is one the name resolved to
+func (p *TargetPolicy) CheckAddress(address string) error {
+	if p == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %s", proxy.ErrTargetNotAllowed, address)
+	}
+	return p.checkIP(ip)
+}
+
+func (p *TargetPolicy) checkIP(ip net.IP) error {
+	if matchNet(p.denyNets, ip) || (len(p.allowNets) > 0 && !matchNet(p.allowNets, ip)) {
+		return fmt.Errorf("%w: address %s", proxy.ErrTargetNotAllowed, ip)
+	}
+	return nil
+}
+
+// HasAddressRules reports whether the policy has CIDR rules, which only see
+// resolved addresses when the server dials targets itself
+func (p *TargetPolicy) HasAddressRules() bool {
+	return p != nil && len(p.allowNets)+len(p.denyNets) > 0
+}
+
+func matchPort(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(domains []string, host string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedAddressSpace (RFC 6598) and thisNetwork (0.0.0.0/8, which Linux
+// dials as the local host) are internal without a net.IP predicate of their own
+var sharedAddressSpace, thisNetwork = mustCIDR("100.64.0.0/10"), mustCIDR("0.0.0.0/8")
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// CheckPublicAddress refuses an address about to be dialed (ip:port) that
+// is internal to the server's network: loopback, private, shared (CGNAT),
+// link-local (which holds cloud metadata endpoints such as 169.254.169.254),
+// multicast or unspecified. The error wraps proxy.ErrTargetNotAllowed.
+func CheckPublicAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %s", proxy.ErrTargetNotAllowed, address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip) || thisNetwork.Contains(ip) {
+		return fmt.Errorf("%w: internal address %s", proxy.ErrTargetNotAllowed, ip)
+	}
+	return nil
+}
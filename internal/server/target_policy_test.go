@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"slipstream-go/internal/proxy"
+)
+
+func TestCheckPublicAddress(t *testing.T) {
+	for _, address := range []string{
+		"127.0.0.1:80",
+		"10.1.2.3:22",
+		"172.16.0.1:443",
+		"192.168.1.1:80",
+		"100.64.0.1:80",
+		"169.254.169.254:80",
+		"224.0.0.1:5353",
+		"0.0.0.0:80",
+		"0.1.2.3:80",
+		"[::1]:80",
+		"[fe80::1]:80",
+		"[fd00::1]:80",
+		"[ff02::1]:80",
+		"[::]:80",
+		"[::ffff:127.0.0.1]:80",
+		// Not resolved yet: only addresses are checked
+		"example.com:80",
+	} {
+		if err := CheckPublicAddress(address); !errors.Is(err, proxy.ErrTargetNotAllowed) {
+			t.Errorf("%s: got %v, want a refusal", address, err)
+		}
+	}
+	for _, address := range []string{"8.8.8.8:53", "1.1.1.1:443", "[2001:4860:4860::8888]:53"} {
+		if err := CheckPublicAddress(address); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+}
+
+// loadPolicy loads a policy file holding text
+func loadPolicy(t *testing.T, text string) (*TargetPolicy, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadTargetPolicy(path)
+}
+
+func TestLoadTargetPolicy(t *testing.T) {
+	p, err := loadPolicy(t, `# comment
+allow-port 80 443 8000-8100  # trailing comment
+
+deny-cidr 10.0.0.0/8 fd00::/8
+allow-domain *.Example.com. example.org
+deny-domain bad.example.com
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []portRange{{80, 80}, {443, 443}, {8000, 8100}}; !slices.Equal(p.allowPorts, want) {
+		t.Errorf("allowed ports %v, want %v", p.allowPorts, want)
+	}
+	if len(p.denyNets) != 2 || !p.HasAddressRules() {
+		t.Errorf("denied networks %v", p.denyNets)
+	}
+	if strings.Join(p.allowDomains, " ") != "example.com example.org" || strings.Join(p.denyDomains, " ") != "bad.example.com" {
+		t.Errorf("domains allowed %v, denied %v", p.allowDomains, p.denyDomains)
+	}
+
+	for _, tt := range []struct {
+		text, err string
+	}{
+		{"allow-port", "needs a value"},
+		{"allow-port 0", "invalid port"},
+		{"allow-port 65536", "invalid port"},
+		{"allow-port 90-80", "invalid port"},
+		{"allow-port 80-", "invalid port"},
+		{"deny-port http", "invalid port"},
+		{"allow-cidr 10.0.0.0/33", "10.0.0.0/33"},
+		{"allow-domain 192.0.2.1", "invalid domain"},
+		{"deny-domain *.", "invalid domain"},
+		{"# fine\nallow-ports 80", ":2: unknown directive"},
+	} {
+		if _, err := loadPolicy(t, tt.text); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got %v, want an error with %q", tt.text, err, tt.err)
+		}
+	}
+}
+
+func TestTargetPolicyCheck(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		target  string
+		allowed bool
+	}{
+		// Ports: single ports and inclusive ranges
+		{"allow-port 443 8000-8100", "example.com:443", true},
+		{"allow-port 443 8000-8100", "example.com:8000", true},
+		{"allow-port 443 8000-8100", "example.com:8100", true},
+		{"allow-port 443 8000-8100", "example.com:8101", false},
+		{"allow-port 443 8000-8100", "example.com:80", false},
+		{"deny-port 25 6000-6100", "example.com:6050", false},
+		{"deny-port 25 6000-6100", "example.com:6101", true},
+
+		// Domains match themselves and their subdomains, case and root dot aside
+		{"allow-domain example.com", "example.com:443", true},
+		{"allow-domain example.com", "www.EXAMPLE.com.:443", true},
+		{"allow-domain example.com", "notexample.com:443", false},
+		{"allow-domain example.com", "example.com.evil.net:443", false},
+		{"allow-domain *.example.com", "a.b.example.com:443", true},
+		{"deny-domain example.com", "api.example.com:443", false},
+		{"deny-domain example.com", "example.net:443", true},
+		// With a domain allowlist a bare IP can't be vetted by name
+		{"allow-domain example.com", "192.0.2.1:443", false},
+
+		// Deny wins over allow
+		{"allow-domain example.com\ndeny-domain bad.example.com", "bad.example.com:443", false},
+		{"allow-domain example.com\ndeny-domain bad.example.com", "x.bad.example.com:443", false},
+		{"allow-domain example.com\ndeny-domain bad.example.com", "good.example.com:443", true},
+		{"allow-port 1-65535\ndeny-port 25", "example.com:25", false},
+		{"allow-port 1-65535\ndeny-port 25", "example.com:587", true},
+		{"allow-cidr 10.0.0.0/8\ndeny-cidr 10.1.0.0/16", "10.1.2.3:80", false},
+		{"allow-cidr 10.0.0.0/8\ndeny-cidr 10.1.0.0/16", "10.2.0.1:80", true},
+		{"allow-cidr 10.0.0.0/8\ndeny-cidr 10.1.0.0/16", "192.0.2.1:80", false},
+		// Address rules leave names to CheckAddress
+		{"deny-cidr 0.0.0.0/0", "example.com:80", true},
+	} {
+		p, err := loadPolicy(t, tt.policy)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.policy, err)
+		}
+		err = p.Check(tt.target)
+		if tt.allowed && err != nil {
+			t.Errorf("%q, %s: %v", tt.policy, tt.target, err)
+		}
+		if !tt.allowed && !errors.Is(err, proxy.ErrTargetNotAllowed) {
+			t.Errorf("%q, %s: got %v, want a refusal", tt.policy, tt.target, err)
+		}
+	}
+
+	// Resolved addresses get the address rules, the nil policy allows everything
+	p, err := loadPolicy(t, "allow-cidr 192.0.2.0/24\ndeny-cidr 192.0.2.128/25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckAddress("192.0.2.1:443"); err != nil {
+		t.Errorf("allowed address: %v", err)
+	}
+	for _, address := range []string{"192.0.2.200:443", "198.51.100.1:443"} {
+		if err := p.CheckAddress(address); !errors.Is(err, proxy.ErrTargetNotAllowed) {
+			t.Errorf("%s: got %v, want a refusal", address, err)
+		}
+	}
+	var none *TargetPolicy
+	if none.Check("192.0.2.1:25") != nil || none.CheckAddress("127.0.0.1:22") != nil {
+		t.Error("nil policy refused a target")
+	}
+}
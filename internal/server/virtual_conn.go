@@ -6,7 +6,9 @@ import (
 	"net"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"slipstream-go/internal/crypto"
 	"slipstream-go/internal/protocol"
 )
 
@@ -17,6 +19,36 @@ type VirtualConn struct {
 	// Incoming is where reassembled packets from DNSHandler are waiting
 	// to be read by the QUIC listener.
 	Incoming chan PacketBundle
+	// RedundancyThreshold: QUIC packets at least this large are queued twice
+	// (0 = protocol.DefaultRedundancyThreshold, negative = never)
+	RedundancyThreshold int
+	// FECRatio adds Reed-Solomon parity fragments to downstream packets of
+	// sessions whose client asked for FEC (see Session.EnableFEC); 0 = off
+	FECRatio float64
+	// Compress deflates downstream packets that shrink for sessions whose
+	// client asked for compression (see Session.EnableCompression)
+	Compress bool
+	// MaxBacklog caps a session's fragments waiting for a poll: WriteTo
+	// waits up to protocol.SpillWait for polls to bring the queue below it,
+	// so QUIC's turn-taking among streams, not a deep FIFO, decides what
+	// goes out next (0 = off)
+	MaxBacklog int
+	// CreditWindow caps the queued and unacknowledged downstream fragments of
+	// sessions whose client asked for credit (see Session.EnableCredit):
+	// WriteTo waits up to protocol.CreditWait for acknowledgements to make
+	// room instead of overflowing the queue (0 = off)
+	CreditWindow int
+	// Metrics, if set, counts packets dropped on full queues (see Metrics)
+	Metrics *Metrics
+	// Logger receives conn logs; nil falls back to the global zerolog logger
+	Logger *zerolog.Logger
+
+	compressor protocol.Compressor
+}
+
+// CompressionStats returns what compressing downstream packets saved so far
+func (vc *VirtualConn) CompressionStats() protocol.CompressionStats {
+	return vc.compressor.Stats()
 }
 
 type PacketBundle struct {
@@ -31,13 +63,22 @@ func NewVirtualConn(sm *SessionManager) *VirtualConn {
 	}
 }
 
+// logger returns the configured logger or the global one
+func (vc *VirtualConn) logger() *zerolog.Logger {
+	if vc.Logger != nil {
+		return vc.Logger
+	}
+	return &log.Logger
+}
+
 // InjectPacket is called by DNSHandler when a full packet is reassembled.
 func (vc *VirtualConn) InjectPacket(data []byte, sessionID string) {
 	addr := &SessionAddr{SessionID: sessionID}
 	select {
 	case vc.Incoming <- PacketBundle{Data: data, Addr: addr}:
 	default:
-		log.Warn().Str("sess", sessionID).Msg("InjectPacket: Incoming channel full, dropping")
+		vc.Metrics.addDropped(1)
+		vc.logger().Warn().Str("sess", sessionID).Msg("InjectPacket: Incoming channel full, dropping")
 	}
 }
 
@@ -54,33 +95,102 @@ func (vc *VirtualConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 func (vc *VirtualConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	sessAddr, ok := addr.(*SessionAddr)
 	if !ok {
-		log.Error().Str("addrType", fmt.Sprintf("%T", addr)).Msg("WriteTo: invalid address type")
+		vc.logger().Error().Str("addrType", fmt.Sprintf("%T", addr)).Msg("WriteTo: invalid address type")
 		return 0, errors.New("invalid address type")
 	}
 
-	sess := vc.Sessions.GetOrCreate(sessAddr.SessionID)
-	fragments := protocol.FragmentPacket(p)
+	// Only queries renew a session: a server retransmitting into a session
+	// the client left must not keep it alive
+	sess := vc.Sessions.Get(sessAddr.SessionID)
+	if sess == nil {
+		// Session expired, removed or never admitted, nobody will poll for this
+		return len(p), nil
+	}
+	sess.AddBytesDown(len(p))
+	packet, compressed := p, false
+	if vc.Compress && sess.Compression() {
+		packet, compressed = vc.compressor.Compress(p)
+	}
+	// Sealed fragments (see Session.Cipher) must still fit where plain ones do
+	chunkSize := protocol.MaxChunkSize
+	if sess.Cipher() != nil {
+		chunkSize -= crypto.FragmentCipherOverhead
+	}
+	fragments := protocol.FragmentPacket(packet, chunkSize)
+	if vc.FECRatio > 0 && sess.FEC() {
+		fragments = protocol.FragmentPacketFEC(packet, chunkSize, vc.FECRatio)
+	}
+	if compressed {
+		protocol.MarkCompressed(fragments)
+	}
+	if sess.Sequence() {
+		protocol.SetPacketID(fragments, sess.NextPacketID())
+	}
 
 	// Smart Redundancy: Large packets (handshake) get 2x redundancy
+	threshold := vc.RedundancyThreshold
+	if threshold == 0 {
+		threshold = protocol.DefaultRedundancyThreshold
+	}
 	redundancy := 1
-	if len(p) >= 1000 {
+	if threshold > 0 && len(p) >= threshold {
 		redundancy = 2
 	}
 
+	// Wake long polls held for this session once the fragments are queued
+	defer sess.NotifyReady()
+
+	// Credit: hold QUIC back until the client has taken enough of what's
+	// queued, rather than evicting packets it has to send again
+	if vc.CreditWindow > 0 && sess.Credit() {
+		vc.waitCredit(sess, redundancy*len(fragments))
+	}
+	// Fairness: quic-go takes turns among the streams with data to send, but
+	// only for what it hasn't written yet. Keeping the queue below it short
+	// stops a bulk stream's backlog from delaying every other stream's next
+	// packet by the time it takes polls to drain it.
+	if vc.MaxBacklog > 0 {
+		waitBelow(vc.MaxBacklog, redundancy*len(fragments), protocol.SpillWait, sess.Backlog)
+	}
+
+	// Whole packets only, waiting for polls to make room (see protocol.SpillQueue)
 	for r := 0; r < redundancy; r++ {
-		for _, frag := range fragments {
-			select {
-			case sess.FragQueue <- frag:
-			default:
-				log.Warn().Str("sess", sessAddr.SessionID).Msg("FragQueue full, dropping fragment")
-				return 0, nil
-			}
+		sess.WaitRoom(len(fragments))
+		if evicted := sess.Enqueue(fragments); evicted > 0 {
+			vc.Metrics.addDropped(evicted)
+			vc.logger().Warn().Str("sess", sessAddr.SessionID).Int("packets", evicted).Msg("FragQueue full, dropped oldest packets")
 		}
 	}
 
 	return len(p), nil
 }
 
+// waitCredit blocks until n more fragments fit in sess's credit window or
+// protocol.CreditWait passes. A packet larger than the window goes out once
+// nothing else is outstanding.
+func (vc *VirtualConn) waitCredit(sess *Session, n int) {
+	if outstanding, ok := waitBelow(vc.CreditWindow, n, protocol.CreditWait, sess.Outstanding); !ok {
+		vc.Metrics.addCreditTimeout()
+		vc.logger().Debug().Str("sess", sess.ID).Int("outstanding", outstanding).Msg("No downstream credit in time, queueing anyway")
+	}
+}
+
+// waitBelow blocks until count() is 0 or leaves room for n more below limit,
+// or wait passes. It returns the last count and whether there was room.
+func waitBelow(limit, n int, wait time.Duration, count func() int) (int, bool) {
+	deadline := time.Now().Add(wait)
+	for {
+		current := count()
+		if current == 0 || current+n <= limit {
+			return current, true
+		}
+		if time.Now().After(deadline) {
+			return current, false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
 // Close: Required by interface
 func (vc *VirtualConn) Close() error { return nil }
 
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"slipstream-go/internal/protocol"
+)
+
+// fullSession returns a handler whose testSession has room for 8 fragments,
+// 4 queued and 4 spilled, and fills it with one-fragment packets
+func fullSession(t *testing.T) (*DNSHandler, *Session) {
+	t.Helper()
+	h := newTestHandler()
+	h.Injector.Metrics = &Metrics{}
+	sess := h.Sessions.GetOrCreate(testSession)
+	sess.FragQueue = make(chan []byte, 4)
+	sess.spill = protocol.NewSpillQueue(4)
+	for range 8 {
+		h.Injector.WriteTo([]byte("packet"), &SessionAddr{SessionID: testSession})
+	}
+	if backlog := sess.Backlog(); backlog != 8 {
+		t.Fatalf("backlog %d after filling, want 8", backlog)
+	}
+	return h, sess
+}
+
+// writeAsync writes a packet to testSession and reports when the write returns
+func writeAsync(h *DNSHandler) <-chan time.Time {
+	returned := make(chan time.Time, 1)
+	go func() {
+		h.Injector.WriteTo([]byte("one more"), &SessionAddr{SessionID: testSession})
+		returned <- time.Now()
+	}()
+	return returned
+}
+
+func TestWriteToWaitsForPoll(t *testing.T) {
+	h, sess := fullSession(t)
+	returned := writeAsync(h)
+	select {
+	case <-returned:
+		t.Fatal("write to a full queue returned at once")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	polled := time.Now()
+	if reply := ask(t, h, "poll.n1."+testSession+"."+testDomain); reply == nil || len(reply.Answer) == 0 {
+		t.Fatal("poll got no fragments")
+	}
+	select {
+	case at := <-returned:
+		if at.Sub(polled) >= protocol.SpillWait {
+			t.Errorf("write returned %v after the poll made room", at.Sub(polled))
+		}
+	case <-time.After(2 * protocol.SpillWait):
+		t.Fatal("write still blocked after a poll made room")
+	}
+	if dropped := h.Injector.Metrics.dropped.Load(); dropped != 0 {
+		t.Errorf("%d packets dropped although a poll made room", dropped)
+	}
+	if backlog := sess.Backlog(); backlog > 8 {
+		t.Errorf("backlog %d, over the queue's room", backlog)
+	}
+}
+
+func TestWriteToEvictsAfterSpillWait(t *testing.T) {
+	h, _ := fullSession(t)
+	start := time.Now()
+	at := <-writeAsync(h)
+	if waited := at.Sub(start); waited < protocol.SpillWait {
+		t.Errorf("write to a full queue returned after %v, want it held for SpillWait (%v)", waited, protocol.SpillWait)
+	}
+	if dropped := h.Injector.Metrics.dropped.Load(); dropped != 1 {
+		t.Errorf("%d packets dropped, want the oldest spilled one", dropped)
+	}
+}
+
+// numberedPacket is packet i of size bytes, its content derived from i
+func numberedPacket(i, size int) []byte {
+	packet := make([]byte, size)
+	for j := range packet {
+		packet[j] = byte(i*31 + j)
+	}
+	packet[0] = byte(i)
+	return packet
+}
+
+func TestWriteToOverloadEvictsWholePackets(t *testing.T) {
+	const (
+		writers    = 6
+		perWriter  = 4
+		packetSize = 3 * protocol.MaxChunkSize // 3 fragments each
+	)
+	h := newTestHandler()
+	h.Injector.Metrics = &Metrics{}
+	sess := h.Sessions.GetOrCreate(testSession)
+	// Sequential packet IDs: random ones may collide among 24 packets
+	sess.EnableSequence()
+	// Room for 5 packets, 2 queued and 3 spilled
+	sess.FragQueue = make(chan []byte, 6)
+	sess.spill = protocol.NewSpillQueue(9)
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				h.Injector.WriteTo(numberedPacket(w*perWriter+i, packetSize), &SessionAddr{SessionID: testSession})
+			}
+		}()
+	}
+	written := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(written)
+	}()
+
+	// No polls for longer than SpillWait: the held writers evict
+	time.Sleep(protocol.SpillWait + 300*time.Millisecond)
+	client := protocol.NewReassembler()
+	delivered := make(map[byte]bool)
+	deadline := time.Now().Add(20 * time.Second)
+	for poll := 0; ; poll++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("overload still running after %d packets delivered", len(delivered))
+		}
+		frags := answerFragments(t, ask(t, h, fmt.Sprintf("poll.n%d.%s.%s", poll, testSession, testDomain)))
+		for _, frag := range frags {
+			if packet := client.IngestChunk(frag); packet != nil {
+				if !bytes.Equal(packet, numberedPacket(int(packet[0]), packetSize)) {
+					t.Fatalf("packet %d reassembled corrupted", packet[0])
+				}
+				delivered[packet[0]] = true
+			}
+		}
+		if len(frags) > 0 {
+			continue
+		}
+		select {
+		case <-written:
+		default:
+			continue
+		}
+		if sess.Backlog() == 0 {
+			break
+		}
+	}
+
+	// Every packet either arrived whole or was evicted whole
+	dropped := h.Injector.Metrics.dropped.Load()
+	if dropped == 0 {
+		t.Error("nothing evicted, the test didn't overload the queue")
+	}
+	if got := uint64(len(delivered)) + dropped; got != writers*perWriter {
+		t.Errorf("%d packets delivered and %d evicted, want %d in all", len(delivered), dropped, writers*perWriter)
+	}
+	if packets, _ := client.Pending(); packets != 0 {
+		t.Errorf("%d partial packets left at the client", packets)
+	}
+}
+
+// bulkRequest asks the fairness benchmark's server for a bulk download
+const bulkRequest = 'B'
+
+// serveBulkOrEcho sends bulkSize bytes on a stream opening with bulkRequest
+// and echoes any other stream
+func serveBulkOrEcho(bulkSize int) func(*quic.Stream) {
+	return func(stream *quic.Stream) {
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(stream, first); err != nil {
+			stream.Close()
+			return
+		}
+		if first[0] == bulkRequest {
+			stream.Write(make([]byte, bulkSize))
+			stream.Close()
+			return
+		}
+		stream.Write(first)
+		echoStream(stream)
+	}
+}
+
+// BenchmarkDownstreamFairness runs one bulk download next to three
+// interactive streams, each echoing 100 bytes eight times, with the session's
+// downstream queue unbounded and capped by MaxBacklog. It reports the
+// download's throughput and the echoes' median and 90th percentile round
+// trip, so the cap's cost to the one can be weighed against its gain for the other.
+func BenchmarkDownstreamFairness(b *testing.B) {
+	const (
+		bulkSize    = 256 * 1024
+		interactive = 3
+		echoes      = 8
+		echoSize    = 100
+		timeout     = 60 * time.Second
+	)
+	for _, bm := range []struct {
+		name       string
+		maxBacklog int
+	}{
+		{"queue=off", 0},
+		{"queue=256", 256},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			p := newTunnelPairServing(b, protocol.Impairment{}, func(vc *VirtualConn) { vc.MaxBacklog = bm.maxBacklog }, serveBulkOrEcho(bulkSize))
+			open := func() *quic.Stream {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				stream, err := p.client.OpenStreamSync(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				stream.SetDeadline(time.Now().Add(timeout))
+				return stream
+			}
+
+			var bulkTime time.Duration
+			var rtts []time.Duration
+			for b.Loop() {
+				var wg sync.WaitGroup
+				var mu sync.Mutex
+				errs := make(chan error, interactive+1)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					start := time.Now()
+					stream := open()
+					stream.Write([]byte{bulkRequest})
+					n, err := io.Copy(io.Discard, stream)
+					if err == nil && n != bulkSize {
+						err = fmt.Errorf("downloaded %d of %d bytes", n, bulkSize)
+					}
+					errs <- err
+					mu.Lock()
+					bulkTime += time.Since(start)
+					mu.Unlock()
+				}()
+				for range interactive {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						// Let the download fill the queue first
+						time.Sleep(50 * time.Millisecond)
+						stream := open()
+						defer stream.Close()
+						msg, reply := make([]byte, echoSize), make([]byte, echoSize)
+						for range echoes {
+							start := time.Now()
+							stream.Write(msg)
+							if _, err := io.ReadFull(stream, reply); err != nil {
+								errs <- err
+								return
+							}
+							mu.Lock()
+							rtts = append(rtts, time.Since(start))
+							mu.Unlock()
+						}
+						errs <- nil
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			slices.Sort(rtts)
+			b.ReportMetric(float64(bulkSize*b.N)/1024/bulkTime.Seconds(), "bulk-KB/s")
+			b.ReportMetric(float64(rtts[len(rtts)/2].Microseconds())/1000, "echo-p50-ms")
+			b.ReportMetric(float64(rtts[len(rtts)*9/10].Microseconds())/1000, "echo-p90-ms")
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package telemetry
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// ExportInterval: how often buffered spans are sent to the collector
+	ExportInterval = 5 * time.Second
+	// MaxBufferedSpans: spans beyond this are dropped if the collector is unreachable
+	MaxBufferedSpans = 4096
+)
+
+// Tracer records spans and exports them to an OpenTelemetry collector using
+// OTLP/HTTP with JSON encoding. A nil *Tracer is valid and records nothing,
+// so call sites don't need to check whether tracing is enabled.
+type Tracer struct {
+	url     string
+	service string
+	client  *http.Client
+	logger  zerolog.Logger
+
+	mu      sync.Mutex
+	pending []*Span
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewTracer starts a tracer exporting to endpoint (e.g. http://collector:4318)
+// and logging export failures to logger. Returns nil if endpoint is empty.
+func NewTracer(endpoint, service string, logger zerolog.Logger) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	t := &Tracer{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+		done:    make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.exportLoop()
+	return t
+}
+
+// Shutdown flushes buffered spans and stops the exporter
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	t.wg.Wait()
+}
+
+// Start begins a span; parent may be nil for a root span
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		spanID: randomHex(8),
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return s
+}
+
+func (t *Tracer) record(s *Span) {
+	t.mu.Lock()
+	if len(t.pending) < MaxBufferedSpans {
+		t.pending = append(t.pending, s)
+	}
+	t.mu.Unlock()
+}
+
+func (t *Tracer) exportLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(ExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.done:
+			t.flush()
+			return
+		}
+	}
+}
+
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.payload(spans))
+	if err != nil {
+		t.logger.Debug().Err(err).Msg("Failed to encode spans")
+		return
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.logger.Debug().Err(err).Int("spans", len(spans)).Msg("Failed to export spans")
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.logger.Debug().Int("status", resp.StatusCode).Int("spans", len(spans)).Msg("Collector rejected spans")
+	}
+}
+
+// --- OTLP JSON encoding ---
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+func (t *Tracer) payload(spans []*Span) map[string]any {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, s.encode())
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttr{strAttr("service.name", t.service)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "slipstream"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func strAttr(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	cryptorand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// --- Spans ---
+
+// Span is a timed operation. All methods are no-ops on a nil *Span.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []otlpAttr
+	errMsg string
+	ended  atomic.Bool
+}
+
+// SetString attaches a string attribute
+func (s *Span) SetString(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, strAttr(key, value))
+	s.mu.Unlock()
+}
+
+// SetInt attaches an integer attribute
+func (s *Span) SetInt(key string, value int64) {
+	if s == nil {
+		return
+	}
+	v := strconv.FormatInt(value, 10)
+	s.mu.Lock()
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: otlpValue{IntValue: &v}})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil || !s.ended.CompareAndSwap(false, true) {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.record(s)
+}
+
+func (s *Span) encode() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := otlpStatus{}
+	if s.errMsg != "" {
+		status = otlpStatus{Code: 2, Message: s.errMsg} // STATUS_CODE_ERROR
+	}
+	return otlpSpan{
+		TraceID:      s.traceID,
+		SpanID:       s.spanID,
+		ParentSpanID: s.parentID,
+		Name:         s.name,
+		Kind:         1, // SPAN_KIND_INTERNAL
+		Start:        fmt.Sprint(s.start.UnixNano()),
+		End:          fmt.Sprint(s.end.UnixNano()),
+		Attributes:   s.attrs,
+		Status:       status,
+	}
+}
+
+// CountingWriter counts bytes written through it; the count is safe to read
+// while writes are still in progress
+type CountingWriter struct {
+	W io.Writer
+	n atomic.Int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes written so far
+func (c *CountingWriter) Count() int64 {
+	return c.n.Load()
+}
@@ -0,0 +1,217 @@
+// Package testutil holds development and test infrastructure that stands in
+// for the parts of the path we don't control, such as recursive resolvers.
+package testutil
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// ResolverOptions configures how a Resolver mistreats the traffic it forwards
+type ResolverOptions struct {
+	// Upstream is the tunnel server's DNS address (host:port)
+	Upstream string
+	// CacheTTL serves repeated questions from a cache for this long (0 = no caching)
+	CacheTTL time.Duration
+	// MaxResponseSize truncates larger responses to an empty answer with TC set (0 = no limit)
+	MaxResponseSize int
+	// LowercaseQuestions forwards and answers with lowercased names, like
+	// resolvers that don't preserve case (breaks 0x20 echo checks)
+	LowercaseQuestions bool
+	// DropRate drops this fraction (0-1) of queries without answering
+	DropRate float64
+	// RateLimit drops queries beyond this many per second, like public
+	// resolvers protecting themselves (0 = unlimited)
+	RateLimit int
+	// Timeout bounds each upstream exchange (default 2s)
+	Timeout time.Duration
+	// Logger receives resolver logs; nil falls back to the global zerolog logger
+	Logger *zerolog.Logger
+}
+
+// Resolver is a recursive-resolver stub: it forwards every query to the tunnel
+// server and relays the answer, optionally caching, truncating, dropping or
+// case-folding along the way the way real recursives do.
+type Resolver struct {
+	opts   ResolverOptions
+	client *dns.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedAnswer
+	rng   *rand.Rand
+	// Rate limit token bucket (one second of burst)
+	tokens   float64
+	lastFill time.Time
+}
+
+type cachedAnswer struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// NewResolver creates a resolver stub forwarding to opts.Upstream
+func NewResolver(opts ResolverOptions) *Resolver {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	return &Resolver{
+		opts:   opts,
+		client: &dns.Client{Net: "udp", Timeout: opts.Timeout, UDPSize: dns.MaxMsgSize},
+		cache:  make(map[string]cachedAnswer),
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// logger returns the configured logger or the global one
+func (r *Resolver) logger() *zerolog.Logger {
+	if r.opts.Logger != nil {
+		return r.opts.Logger
+	}
+	return &log.Logger
+}
+
+// ListenAndServe answers queries on a UDP address until the socket fails
+func (r *Resolver) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return r.Serve(conn)
+}
+
+// Serve answers queries arriving on conn until it is closed
+func (r *Resolver) Serve(conn net.PacketConn) error {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply := r.Handle(query); reply != nil {
+				conn.WriteTo(reply, from)
+			}
+		}()
+	}
+}
+
+// Handle answers one packed query and returns the packed reply, or nil if the
+// query is dropped. It fits protocol.NewLoopbackConn for socket-free setups.
+func (r *Resolver) Handle(query []byte) []byte {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil || len(req.Question) == 0 {
+		return nil
+	}
+	if r.drop() || r.limited() {
+		return nil
+	}
+
+	q := req.Question[0]
+	if r.opts.LowercaseQuestions {
+		q.Name = strings.ToLower(q.Name)
+	}
+	key := strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype]
+
+	resp := r.cached(key)
+	if resp == nil {
+		fwd := req.Copy()
+		fwd.Id = dns.Id()
+		fwd.Question[0] = q
+		var err error
+		resp, _, err = r.client.Exchange(fwd, r.opts.Upstream)
+		if err != nil {
+			r.logger().Debug().Err(err).Str("qname", q.Name).Msg("Upstream exchange failed")
+			fail := new(dns.Msg)
+			fail.SetRcode(req, dns.RcodeServerFailure)
+			packed, _ := fail.Pack()
+			return packed
+		}
+		r.store(key, resp)
+	}
+
+	// Relay under the client's ID and question, compressed, as a recursive would
+	reply := resp.Copy()
+	reply.Id = req.Id
+	reply.Question = []dns.Question{q}
+	reply.Compress = true
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	if r.opts.MaxResponseSize > 0 && len(packed) > r.opts.MaxResponseSize {
+		reply.Answer, reply.Ns, reply.Extra = nil, nil, nil
+		reply.Truncated = true
+		packed, _ = reply.Pack()
+	}
+	return packed
+}
+
+func (r *Resolver) drop() bool {
+	if r.opts.DropRate <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64() < r.opts.DropRate
+}
+
+// limited reports whether the query exceeds RateLimit
+func (r *Resolver) limited() bool {
+	if r.opts.RateLimit <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.lastFill.IsZero() {
+		r.tokens = float64(r.opts.RateLimit)
+	} else {
+		r.tokens = min(r.tokens+now.Sub(r.lastFill).Seconds()*float64(r.opts.RateLimit), float64(r.opts.RateLimit))
+	}
+	r.lastFill = now
+	if r.tokens < 1 {
+		return true
+	}
+	r.tokens--
+	return false
+}
+
+func (r *Resolver) cached(key string) *dns.Msg {
+	if r.opts.CacheTTL <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil
+	}
+	return entry.msg
+}
+
+func (r *Resolver) store(key string, msg *dns.Msg) {
+	if r.opts.CacheTTL <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, e := range r.cache {
+		if now.After(e.expires) {
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = cachedAnswer{msg: msg, expires: now.Add(r.opts.CacheTTL)}
+}
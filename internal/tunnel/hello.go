@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/protocol"
+)
+
+// HelloTimeout bounds the capability exchange on a fresh tunnel
+const HelloTimeout = 20 * time.Second
+
+// ErrHelloNotSent: the hello stream could not be opened or written
+var ErrHelloNotSent = errors.New("capability hello not sent")
+
+// Negotiate exchanges protocol versions and capabilities with the server over
+// conn (see ExchangeHello) and logs what the operator should do about any
+// feature the client relies on (required) that the server doesn't offer. It
+// returns what the server advertised, none if the exchange failed.
+func Negotiate(conn *quic.Conn, dnsConn *protocol.DnsPacketConn, required protocol.Capabilities, logger zerolog.Logger) protocol.Capabilities {
+	server, err := ExchangeHello(conn, dnsConn, required, logger)
+	if errors.Is(err, ErrHelloNotSent) {
+		return 0
+	}
+	ReportCapabilities(required, server, err, logger)
+	return server.Caps
+}
+
+// ExchangeHello sends the capability hello on a stream of its own and reads
+// the server's reply. Upstream FEC and compression start on dnsConn once the
+// server confirmed it can undo them, reordering once it numbers downstream
+// packets and credit reports once it holds downstream to them.
+func ExchangeHello(conn *quic.Conn, dnsConn *protocol.DnsPacketConn, required protocol.Capabilities, logger zerolog.Logger) (protocol.Hello, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HelloTimeout)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed to open capability stream")
+		return protocol.Hello{}, ErrHelloNotSent
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(HelloTimeout))
+
+	if err := protocol.WriteHello(stream, protocol.Hello{Version: protocol.ProtocolVersion, Caps: required}); err != nil {
+		logger.Debug().Err(err).Msg("Failed to send capability hello")
+		return protocol.Hello{}, ErrHelloNotSent
+	}
+	server, err := protocol.ReadHelloReply(stream)
+	if err == nil {
+		if server.Caps.Has(protocol.CapFEC) {
+			dnsConn.EnableFEC()
+		}
+		if server.Caps.Has(protocol.CapCompress) {
+			dnsConn.EnableCompression()
+		}
+		if server.Caps.Has(protocol.CapSequence) {
+			dnsConn.EnableReorder()
+		}
+		if server.Caps.Has(protocol.CapCredit) {
+			dnsConn.EnableCredit()
+		}
+	}
+	return server, err
+}
+
+// ReportCapabilities compares the server's answer to the client's needs and
+// logs one actionable line per mismatch
+func ReportCapabilities(required protocol.Capabilities, server protocol.Hello, err error, logger zerolog.Logger) {
+	if errors.Is(err, protocol.ErrHelloUnsupported) {
+		logger.Warn().Stringer("required", required).
+			Msg("Server predates capability negotiation; features it lacks degrade silently, upgrade the server")
+		return
+	}
+	if err != nil {
+		logger.Debug().Err(err).Msg("Capability exchange failed")
+		return
+	}
+
+	switch {
+	case server.Version < protocol.ProtocolVersion:
+		logger.Warn().Uint8("server_version", server.Version).Uint8("client_version", protocol.ProtocolVersion).
+			Msg("Server speaks an older protocol version; upgrade the server")
+	case server.Version > protocol.ProtocolVersion:
+		logger.Warn().Uint8("server_version", server.Version).Uint8("client_version", protocol.ProtocolVersion).
+			Msg("Server speaks a newer protocol version; upgrade the client")
+	}
+
+	missing := server.Caps.Missing(required)
+	for _, c := range missing.List() {
+		logger.Warn().Stringer("capability", c).Str("action", c.Hint()).Msg("Server lacks a capability this client relies on")
+	}
+	if missing == 0 {
+		logger.Debug().Stringer("server_caps", server.Caps).Uint8("server_version", server.Version).Msg("Server capabilities confirmed")
+	}
+}
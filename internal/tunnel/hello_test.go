@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/protocol"
+)
+
+func TestReportCapabilitiesMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).Level(zerolog.InfoLevel)
+	required := protocol.CapNack | protocol.CapFEC | protocol.CapCompress
+	ReportCapabilities(required, protocol.Hello{Version: protocol.ProtocolVersion, Caps: protocol.CapNack | protocol.CapFEC}, nil, logger)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want one warning for compress:\n%s", len(lines), &buf)
+	}
+	if !strings.Contains(lines[0], `"capability":"compress"`) || !strings.Contains(lines[0], protocol.CapCompress.Hint()) {
+		t.Errorf("warning doesn't name compress and what to do about it: %s", lines[0])
+	}
+}
+
+func TestReportCapabilitiesMatch(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).Level(zerolog.InfoLevel)
+	caps := protocol.CapNack | protocol.CapFEC
+	ReportCapabilities(caps, protocol.Hello{Version: protocol.ProtocolVersion, Caps: caps | protocol.CapUDP}, nil, logger)
+	if buf.Len() != 0 {
+		t.Errorf("warned although the server has everything:\n%s", &buf)
+	}
+}
+
+func TestReportCapabilitiesOldServer(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).Level(zerolog.InfoLevel)
+	ReportCapabilities(protocol.CapNack, protocol.Hello{}, protocol.ErrHelloUnsupported, logger)
+	if !strings.Contains(buf.String(), "predates capability negotiation") {
+		t.Errorf("no warning about a server without negotiation:\n%s", &buf)
+	}
+
+	buf.Reset()
+	ReportCapabilities(0, protocol.Hello{Version: protocol.ProtocolVersion + 1}, nil, logger)
+	if !strings.Contains(buf.String(), "upgrade the client") {
+		t.Errorf("no warning about a newer protocol version:\n%s", &buf)
+	}
+}
@@ -0,0 +1,107 @@
+// Package tunnel is the client side setup shared by the command line client
+// and the slipstream library: session IDs, the QUIC configuration, the
+// handshake over a DNS transport and the capability exchange that follows it.
+package tunnel
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+
+	"slipstream-go/internal/protocol"
+)
+
+// QUIC defaults of a new tunnel
+const (
+	// Random packet size in optimal range for Iran: 512-768 bytes
+	DefaultMinPacketSize = 512
+	DefaultMaxPacketSize = 768
+	DefaultKeepAlive     = 30 * time.Second
+	DefaultIdleTimeout   = 60 * time.Second
+)
+
+// BaseCaps are the server capabilities every client relies on
+const BaseCaps = protocol.CapSizeHint | protocol.CapRawBase64 | protocol.CapTXTMulti | protocol.CapCredit
+
+// RequiredCaps returns the server capabilities a transport configured with
+// opts relies on, to be checked by the capability exchange
+func RequiredCaps(opts protocol.DnsConnOptions) protocol.Capabilities {
+	caps := BaseCaps
+	if opts.Nacks {
+		caps |= protocol.CapNack
+	}
+	if opts.LongPolls > 0 {
+		caps |= protocol.CapLongPoll
+	}
+	if opts.FECRatio > 0 {
+		caps |= protocol.CapFEC
+	}
+	if opts.Compress {
+		caps |= protocol.CapCompress
+	}
+	if opts.ReorderWindow > 0 {
+		caps |= protocol.CapSequence
+	}
+	switch opts.RecordType {
+	case dns.TypeA:
+		caps |= protocol.CapARecords
+	case dns.TypeCNAME:
+		caps |= protocol.CapCNAME
+	case dns.TypeNULL:
+		caps |= protocol.CapNULL
+	}
+	return caps
+}
+
+// SessionID creates a random session ID using crypto/rand
+// 10 chars of 36 symbols (~51 bits): collisions are negligible even with many
+// clients per server, and the server refuses a second connection on an ID
+// that is still owned (see protocol.CloseCodeSessionInUse). Every label byte
+// comes out of the QNAME data budget, so the ID is kept short.
+func SessionID() string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 10)
+	cryptorand.Read(b)
+	for i := range b {
+		b[i] = charset[int(b[i])%len(charset)]
+	}
+	return string(b)
+}
+
+// RandomPacketSize returns a random packet size between min and max bytes
+func RandomPacketSize(minSize, maxSize uint16) uint16 {
+	if minSize >= maxSize {
+		return minSize
+	}
+	b := make([]byte, 2)
+	cryptorand.Read(b)
+	rangeSize := maxSize - minSize + 1
+	return minSize + (binary.BigEndian.Uint16(b) % rangeSize)
+}
+
+// QUICConfig returns the QUIC configuration of a tunnel with the default
+// keepalive and idle timeout and an initial packet size of packetSize
+// (see RandomPacketSize)
+func QUICConfig(packetSize uint16) *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:            DefaultKeepAlive,
+		MaxIdleTimeout:             DefaultIdleTimeout,
+		MaxStreamReceiveWindow:     6 * 1024 * 1024,
+		MaxConnectionReceiveWindow: 15 * 1024 * 1024,
+		InitialPacketSize:          packetSize,
+		DisablePathMTUDiscovery:    true,
+	}
+}
+
+// Dial runs the QUIC handshake with the server over dnsConn
+func Dial(ctx context.Context, dnsConn *protocol.DnsPacketConn, tlsConfig *tls.Config, quicConfig *quic.Config) (*quic.Conn, error) {
+	// Dummy address for QUIC, the DNS transport ignores it
+	dummyAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	return quic.Dial(ctx, dnsConn, dummyAddr, tlsConfig, quicConfig)
+}
@@ -0,0 +1,23 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionID(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 1000 {
+		id := SessionID()
+		if len(id) != 10 {
+			t.Fatalf("session ID %q has %d characters, want 10", id, len(id))
+		}
+		if strings.Trim(id, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+			t.Fatalf("session ID %q isn't lowercase alphanumeric", id)
+		}
+		if seen[id] {
+			t.Fatalf("session ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
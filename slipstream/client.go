@@ -0,0 +1,290 @@
+// Package slipstream embeds the tunnel client in other Go programs: a Client
+// opens TCP connections through the DNS tunnel without the SOCKS5 listener,
+// so it plugs into anything that takes a dial function:
+//
+//	client, err := slipstream.NewClient(slipstream.Config{
+//		Resolvers:    []string{"8.8.8.8:53"},
+//		Domain:       "t.example.com",
+//		Fingerprints: []string{fingerprint},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	httpClient := &http.Client{Transport: &http.Transport{DialContext: client.DialContext}}
+package slipstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/tunnel"
+)
+
+// Defaults for zero Config fields, matching the command line client
+const (
+	DefaultALPN          = "slipstream"
+	DefaultMinPacketSize = tunnel.DefaultMinPacketSize
+	DefaultMaxPacketSize = tunnel.DefaultMaxPacketSize
+	DefaultKeepAlive     = tunnel.DefaultKeepAlive
+	DefaultIdleTimeout   = tunnel.DefaultIdleTimeout
+)
+
+var (
+	// ErrClosed is returned by DialContext after Close
+	ErrClosed = errors.New("slipstream: client closed")
+	// ErrUnsupportedNetwork is returned for networks other than TCP
+	ErrUnsupportedNetwork = errors.New("slipstream: only TCP is supported")
+)
+
+// ReplyError means the server could not connect to the target; Code is the
+// SOCKS5 reply code it answered with (e.g. 0x05 for connection refused)
+type ReplyError = proxy.ReplyError
+
+// Config configures a Client; zero values select the defaults
+type Config struct {
+	// Resolvers are the DNS resolvers to tunnel through: host:port, https:// DoH
+	// URLs or tls://host[:port] DoT resolvers (all of one kind)
+	Resolvers []string
+	// Domain is the tunnel domain the server is registered for
+	Domain string
+	// Fingerprints pins the server's public key, as printed by the server
+	// (any one of them may match, to allow for key rotation)
+	Fingerprints []string
+	// PSK authenticates the session to a server started with --psk
+	PSK string
+	// ALPN must match the server's --alpn (default DefaultALPN)
+	ALPN string
+	// RecordType is the query type downstream data comes back in: "txt"
+	// (the default), "a", "cname" or "null", as the client's --record-type
+	RecordType string
+	// MinPacketSize and MaxPacketSize bound the random initial QUIC packet size
+	// (default DefaultMinPacketSize to DefaultMaxPacketSize)
+	MinPacketSize, MaxPacketSize uint16
+	// KeepAlive is the QUIC keepalive period (default DefaultKeepAlive)
+	KeepAlive time.Duration
+	// IdleTimeout is how long a silent tunnel lasts before it is reconnected (default DefaultIdleTimeout)
+	IdleTimeout time.Duration
+	// EncryptFragments seals every DNS fragment under a key agreed with the
+	// pinned server, as the client's --encrypt-fragments (the server must
+	// support it)
+	EncryptFragments bool
+	// Logger receives tunnel logs; nil falls back to the global zerolog logger
+	Logger *zerolog.Logger
+}
+
+// Client dials TCP connections through the tunnel. It connects on the first
+// dial and reconnects on demand whenever the tunnel has dropped, under a new
+// DNS session. A Client is safe for concurrent use.
+type Client struct {
+	cfg          Config
+	dnsOptions   protocol.DnsConnOptions
+	requiredCaps protocol.Capabilities
+	tlsPins      *crypto.PinSet
+	logger       zerolog.Logger
+
+	// mu serializes connecting; conn may be loaded without it
+	mu      sync.Mutex
+	conn    atomic.Pointer[quic.Conn]
+	dnsConn *protocol.DnsPacketConn
+	closed  atomic.Bool
+}
+
+// NewClient checks cfg and creates a client. It doesn't touch the network:
+// the tunnel comes up with Connect or the first DialContext.
+func NewClient(cfg Config) (*Client, error) {
+	if len(cfg.Resolvers) == 0 {
+		return nil, errors.New("slipstream: at least one resolver is required")
+	}
+	if cfg.Domain == "" {
+		return nil, errors.New("slipstream: domain is required")
+	}
+	if len(cfg.Fingerprints) == 0 {
+		return nil, errors.New("slipstream: at least one server fingerprint is required")
+	}
+	if cfg.ALPN == "" {
+		cfg.ALPN = DefaultALPN
+	}
+	if cfg.MinPacketSize == 0 {
+		cfg.MinPacketSize = DefaultMinPacketSize
+	}
+	if cfg.MaxPacketSize == 0 {
+		cfg.MaxPacketSize = DefaultMaxPacketSize
+	}
+	if cfg.MinPacketSize > cfg.MaxPacketSize {
+		return nil, errors.New("slipstream: MinPacketSize exceeds MaxPacketSize")
+	}
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = DefaultKeepAlive
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	recordType, err := protocol.ParseRecordType(cfg.RecordType)
+	if err != nil {
+		return nil, fmt.Errorf("slipstream: %w", err)
+	}
+
+	c := &Client{cfg: cfg, tlsPins: crypto.NewPinSet(cfg.Fingerprints), logger: log.Logger}
+	if cfg.Logger != nil {
+		c.logger = *cfg.Logger
+	}
+	c.dnsOptions = protocol.DnsConnOptions{
+		Logger:           &c.logger,
+		RecordType:       recordType,
+		Nacks:            true,
+		EncryptFragments: cfg.EncryptFragments,
+		ServerPins:       c.tlsPins,
+	}
+	if cfg.PSK != "" {
+		c.dnsOptions.PSK = []byte(cfg.PSK)
+	}
+	c.requiredCaps = tunnel.RequiredCaps(c.dnsOptions)
+	return c, nil
+}
+
+// Connect brings the tunnel up if it isn't, waiting for the QUIC handshake
+// at most until ctx is done
+func (c *Client) Connect(ctx context.Context) error {
+	_, err := c.connection(ctx, nil)
+	return err
+}
+
+// connection returns a live QUIC connection other than stale, connecting a new one if needed
+func (c *Client) connection(ctx context.Context, stale *quic.Conn) (*quic.Conn, error) {
+	if conn := c.conn.Load(); conn != nil && conn != stale && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	// Another dial may have reconnected while this one waited
+	if conn := c.conn.Load(); conn != nil && conn != stale && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	c.closeLocked()
+
+	sessionID := tunnel.SessionID()
+	dnsConn, err := protocol.NewDnsPacketConnWithOptions(c.cfg.Resolvers, c.cfg.Domain, sessionID, c.dnsOptions)
+	if err != nil {
+		return nil, fmt.Errorf("slipstream: %w", err)
+	}
+	tlsConfig := crypto.GetClientTLSConfigPinSet(c.tlsPins)
+	tlsConfig.NextProtos = []string{c.cfg.ALPN}
+	quicConfig := tunnel.QUICConfig(tunnel.RandomPacketSize(c.cfg.MinPacketSize, c.cfg.MaxPacketSize))
+	quicConfig.KeepAlivePeriod = c.cfg.KeepAlive
+	quicConfig.MaxIdleTimeout = c.cfg.IdleTimeout
+
+	c.logger.Info().Str("session", sessionID).Str("domain", c.cfg.Domain).Msg("Establishing QUIC connection over DNS")
+	conn, err := tunnel.Dial(ctx, dnsConn, tlsConfig, quicConfig)
+	if err != nil {
+		dnsConn.Close()
+		return nil, fmt.Errorf("slipstream: connect: %w", err)
+	}
+	c.logger.Info().Str("session", sessionID).Msg("QUIC tunnel established")
+	// FEC, compression, reordering and credit only start once the server
+	// confirms it supports them
+	go tunnel.Negotiate(conn, dnsConn, c.requiredCaps, c.logger)
+	c.dnsConn = dnsConn
+	c.conn.Store(conn)
+	return conn, nil
+}
+
+// closeLocked closes the current connection and its DNS transport, if any
+func (c *Client) closeLocked() {
+	if conn := c.conn.Swap(nil); conn != nil {
+		conn.CloseWithError(0, "client shutting down")
+	}
+	if c.dnsConn != nil {
+		c.dnsConn.Close()
+		c.dnsConn = nil
+	}
+}
+
+// DialContext connects to addr (host:port) through the tunnel; only TCP
+// networks are supported. The returned connection is ready to use: the server
+// has connected to the target. A tunnel that dropped is reconnected first.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrUnsupportedNetwork}
+	}
+	conn, err := c.connection(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil && conn.Context().Err() != nil {
+		// The tunnel just dropped: once more on a new one
+		if conn, err = c.connection(ctx, conn); err != nil {
+			return nil, err
+		}
+		stream, err = conn.OpenStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("slipstream: open stream: %w", err)
+	}
+
+	if err := c.negotiateTarget(ctx, stream, addr); err != nil {
+		stream.CancelRead(protocol.StreamCodePipeFailed)
+		stream.CancelWrite(protocol.StreamCodePipeFailed)
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: tunnelAddr(addr), Err: err}
+	}
+	return &streamConn{stream: stream, local: conn.LocalAddr(), remote: tunnelAddr(addr)}, nil
+}
+
+// Dial is DialContext without a context
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// negotiateTarget sends the target header and waits for the server's status
+func (c *Client) negotiateTarget(ctx context.Context, stream *quic.Stream, addr string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+		defer stream.SetDeadline(time.Time{})
+	}
+	// A context canceled without a deadline still ends the wait
+	stop := context.AfterFunc(ctx, func() { stream.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := proxy.WriteTargetAddress(stream, addr); err != nil {
+		return err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(stream, status); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if status[0] != proxy.ReplySuccess {
+		return &ReplyError{Code: status[0]}
+	}
+	return nil
+}
+
+// Close shuts the tunnel down; connections dialed through it fail afterwards
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+	return nil
+}
@@ -0,0 +1,309 @@
+package slipstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+
+	"slipstream-go/internal/crypto"
+	"slipstream-go/internal/protocol"
+	"slipstream-go/internal/proxy"
+	"slipstream-go/internal/server"
+	"slipstream-go/internal/testutil"
+)
+
+const testDomain = "t.example.com"
+
+// tcpEcho runs a TCP echo server on loopback and returns its address
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveTunnel answers h's sessions with a QUIC server that completes the
+// capability hello, passing the hellos it gets to hellos, and connects every
+// other stream to its target like the server's direct mode
+func serveTunnel(t *testing.T, h *server.DNSHandler, certs *crypto.CertSet, hellos chan<- protocol.Hello) {
+	t.Helper()
+	transport := &quic.Transport{Conn: h.Injector, VerifySourceAddress: func(net.Addr) bool { return true }}
+	listener, err := transport.Listen(crypto.GetSelectingTLSConfig(certs.GetCertificate), &quic.Config{DisablePathMTUDiscovery: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	serveStream := func(stream *quic.Stream) {
+		defer stream.Close()
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(stream, first); err != nil {
+			return
+		}
+		if first[0] == protocol.HelloMarker {
+			if hello, err := protocol.ReadHello(stream); err == nil {
+				hellos <- hello
+				protocol.WriteHelloReply(stream, protocol.Hello{Version: protocol.ProtocolVersion, Caps: protocol.CapNack})
+			}
+			return
+		}
+		target, err := proxy.ParseTarget(io.MultiReader(bytes.NewReader(first), stream))
+		if err != nil {
+			return
+		}
+		conn, err := net.Dial("tcp", target.Addr)
+		if err != nil {
+			stream.Write([]byte{proxy.ReplyCodeForError(err)})
+			return
+		}
+		defer conn.Close()
+		stream.Write([]byte{proxy.ReplySuccess})
+		go func() {
+			io.Copy(conn, stream)
+			conn.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(stream, conn)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serveStream(stream)
+				}
+			}()
+		}
+	}()
+}
+
+// echoThrough dials addr through c and fails unless data comes back
+func echoThrough(t *testing.T, c *Client, addr string, data []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := c.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != addr {
+		t.Errorf("remote address %s, want %s", conn.RemoteAddr(), addr)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d of %d bytes: %v", len(got), len(data), err)
+	}
+}
+
+// newTunnelServer returns a DNS handler for testDomain with a tunnel behind
+// it (see serveTunnel) and the certificates clients pin
+func newTunnelServer(t *testing.T, hellos chan<- protocol.Hello) (*server.DNSHandler, *crypto.CertSet) {
+	t.Helper()
+	logger := zerolog.Nop()
+	sessions := server.NewSessionManager()
+	sessions.Logger = &logger
+	injector := server.NewVirtualConn(sessions)
+	injector.Logger = &logger
+	h := &server.DNSHandler{
+		Sessions:            sessions,
+		Injector:            injector,
+		AllowedDomains:      map[string]bool{testDomain: true},
+		MaxFragsPerResponse: 6,
+		Logger:              &logger,
+	}
+	_, privKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := crypto.NewCertSet(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.IdentityKey = func(string) ed25519.PrivateKey { return privKey }
+	serveTunnel(t, h, certs, hellos)
+	return h, certs
+}
+
+func TestDialContext(t *testing.T) {
+	logger := zerolog.Nop()
+	hellos := make(chan protocol.Hello, 4)
+	h, certs := newTunnelServer(t, hellos)
+	sessions := h.Sessions
+
+	loopback := func() net.PacketConn {
+		return protocol.NewLoopbackConn(h.LoopbackResponder(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}))
+	}
+	newClient := func(encrypt bool) *Client {
+		c, err := NewClient(Config{
+			Resolvers:        []string{protocol.LoopbackResolverAddr.String()},
+			Domain:           testDomain,
+			Fingerprints:     []string{certs.Fingerprint()},
+			EncryptFragments: encrypt,
+			Logger:           &logger,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.dnsOptions.Transport = loopback()
+		return c
+	}
+	c := newClient(false)
+
+	echo := tcpEcho(t)
+	echoThrough(t, c, echo, bytes.Repeat([]byte("0123456789"), 500))
+
+	// Every tunnel opens with the capability hello, asking for what its transport relies on
+	select {
+	case hello := <-hellos:
+		if hello.Version != protocol.ProtocolVersion || hello.Caps.Missing(c.requiredCaps) != 0 {
+			t.Errorf("hello %+v, want version %d with %v", hello, protocol.ProtocolVersion, c.requiredCaps)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no capability hello")
+	}
+
+	// The server's reply code comes back to the caller
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	_, err = c.DialContext(context.Background(), "tcp", refused.Addr().String())
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != proxy.ReplyConnectionRefused {
+		t.Errorf("closed port: got %v, want connection refused", err)
+	}
+	if _, err := c.DialContext(context.Background(), "udp", echo); !errors.Is(err, ErrUnsupportedNetwork) {
+		t.Errorf("UDP: got %v, want ErrUnsupportedNetwork", err)
+	}
+
+	// A dropped tunnel is reconnected under a new session on the next dial.
+	// Closing a DNS transport closes its Transport, so the next gets a new one.
+	c.mu.Lock()
+	c.dnsOptions.Transport = loopback()
+	c.mu.Unlock()
+	first := c.conn.Load()
+	first.CloseWithError(0, "")
+	echoThrough(t, c, echo, []byte("again"))
+	if c.conn.Load() == first {
+		t.Error("dialed over the closed connection")
+	}
+	if got := sessions.Count(); got != 2 {
+		t.Errorf("%d sessions on the server, want 2", got)
+	}
+
+	// With fragment encryption the key is agreed before the handshake
+	sealed := newClient(true)
+	echoThrough(t, sealed, echo, []byte("sealed"))
+	if sealed.dnsConn.FragmentCipher() == nil {
+		t.Error("fragments not sealed")
+	}
+
+	c.Close()
+	if _, err := c.DialContext(context.Background(), "tcp", echo); !errors.Is(err, ErrClosed) {
+		t.Errorf("after Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestDialThroughResolver(t *testing.T) {
+	logger := zerolog.Nop()
+	h, certs := newTunnelServer(t, make(chan protocol.Hello, 4))
+
+	// The server answers on a UDP socket, counting the names it is asked
+	asked := make(map[string]int)
+	var mu sync.Mutex
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{PacketConn: serverConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		asked[strings.ToLower(r.Question[0].Name)]++
+		mu.Unlock()
+		h.HandleDNS(w, r)
+	})}
+	go dnsServer.ActivateAndServe()
+	t.Cleanup(func() { dnsServer.Shutdown() })
+
+	// Behind a recursive that caches answers and truncates everything over
+	// 512 bytes, like one that strips EDNS0
+	resolver := testutil.NewResolver(testutil.ResolverOptions{
+		Upstream:        serverConn.LocalAddr().String(),
+		CacheTTL:        time.Minute,
+		MaxResponseSize: protocol.MinResponseSize,
+		Logger:          &logger,
+	})
+	resolverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go resolver.Serve(resolverConn)
+	t.Cleanup(func() { resolverConn.Close() })
+
+	c, err := NewClient(Config{
+		Resolvers:    []string{resolverConn.LocalAddr().String()},
+		Domain:       testDomain,
+		Fingerprints: []string{certs.Fingerprint()},
+		Logger:       &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoThrough(t, c, tcpEcho(t), bytes.Repeat([]byte("0123456789"), 500))
+
+	// The client noticed the truncation and asked for responses that fit
+	stats := h.Sessions.Snapshot()
+	if len(stats) != 1 {
+		t.Fatalf("%d sessions, want 1", len(stats))
+	}
+	if limit := h.Sessions.Get(stats[0].ID).ResponseLimit(); limit != protocol.MinResponseSize {
+		t.Errorf("response limit %d, want %d", limit, protocol.MinResponseSize)
+	}
+	// Every query name is new, so the cache never answers for the server
+	mu.Lock()
+	defer mu.Unlock()
+	for name, n := range asked {
+		if n > 1 {
+			t.Errorf("%s asked %d times", name, n)
+		}
+	}
+}
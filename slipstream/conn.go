@@ -0,0 +1,44 @@
+package slipstream
+
+import (
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"slipstream-go/internal/protocol"
+)
+
+// tunnelAddr is the target address of a tunneled connection
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// streamConn is a tunneled TCP connection: one QUIC stream the server pipes to the target
+type streamConn struct {
+	stream *quic.Stream
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *streamConn) Read(p []byte) (int, error)  { return c.stream.Read(p) }
+func (c *streamConn) Write(p []byte) (int, error) { return c.stream.Write(p) }
+
+// CloseWrite half-closes the connection: the target sees EOF while its data keeps arriving
+func (c *streamConn) CloseWrite() error {
+	return c.stream.Close()
+}
+
+// Close ends both directions
+func (c *streamConn) Close() error {
+	c.stream.CancelRead(protocol.StreamCodeClosed)
+	return c.stream.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error      { return c.stream.SetDeadline(t) }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.stream.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.stream.SetWriteDeadline(t) }